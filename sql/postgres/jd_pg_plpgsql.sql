@@ -149,7 +149,7 @@ create domain jd_patch as jsonb check (value is null or _jd_validate_rfc6902(val
 create domain jd_merge as jsonb check (value is null or jsonb_typeof(value) = 'object');
 
 -- diff format enum (Milestone 6)
-create type jd_diff_format as enum ('jd','patch','merge');
+create type jd_diff_format as enum ('jd','patch','merge','jd2');
 
 create type jd_metadata as
 (
@@ -232,6 +232,23 @@ begin
 end
 $$;
 
+-- Sort keys with the collation named by the jd_sql.collation setting (e.g. "C" for a
+-- byte order that is the same on every server), or the database default when unset.
+create or replace function _jd_sorted_keys(keys text[]) returns setof text
+    language plpgsql
+    stable as
+$$
+declare
+    coll text := nullif(current_setting('jd_sql.collation', true), '');
+begin
+    if coll is null then
+        return query select k from unnest(keys) as t(k) order by k;
+    else
+        return query execute format('select k from unnest($1) as t(k) order by k collate %I', coll) using keys;
+    end if;
+end
+$$;
+
 create or replace function _jd_object_identity(v jsonb, setkeys text[]) returns jsonb
     language plpgsql
     immutable as
@@ -452,11 +469,67 @@ begin
 end
 $$;
 
+-- Whether a and b have no diff under options, without building the diff when it can be
+-- avoided: equal values never differ, and without options nothing but jsonb equality
+-- can make them equal. Only the remaining case (options such as SET or precision that
+-- may equate different values) walks the structural diff.
 create or replace function jd_equal(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns boolean
-    language sql
+    language plpgsql
     stable as
 $$
-select _jd_json_equal($1, $2, $3)
+begin
+    if a is null or b is null then return a is null and b is null; end if;
+    if a = b then return true; end if;
+    if options is null or options = '[]'::jsonb then return false; end if;
+    return not exists (select 1 from jd_diff_struct(a, b, options));
+end
+$$;
+
+-- Canonical text of a document for jd_canonical_hash: object keys sorted bytewise, no
+-- whitespace, and numbers without trailing fractional zeros, so documents that are
+-- equal as jsonb have the same text.
+create or replace function _jd_canonical_text(value jsonb) returns text
+    language plpgsql
+    immutable as
+$$
+declare
+    n text;
+begin
+    case jsonb_typeof(value)
+        when 'object' then
+            return '{' || coalesce((select string_agg(to_jsonb(e.key)::text || ':' || _jd_canonical_text(e.value), ','
+                                                      order by e.key collate "C")
+                                    from jsonb_each(value) e), '') || '}';
+        when 'array' then
+            return '[' || coalesce((select string_agg(_jd_canonical_text(e.value), ',' order by e.ord)
+                                    from jsonb_array_elements(value) with ordinality e(value, ord)), '') || ']';
+        when 'number' then
+            n := value::numeric::text;
+            if position('.' in n) > 0 then
+                n := rtrim(rtrim(n, '0'), '.');
+            end if;
+            return n;
+        else
+            return value::text;
+        end case;
+end
+$$;
+
+-- Canonical form of value as compact JSON text (see _jd_canonical_text).
+create or replace function jd_canonicalize(value jsonb) returns text
+    language sql
+    immutable as
+$$
+select _jd_canonical_text($1)
+$$;
+
+-- Hex SHA-256 of the canonical text of value. Documents that are equal as jsonb have
+-- the same hash; different hashes mean a non-empty diff when no options are given.
+create or replace function jd_canonical_hash(value jsonb) returns text
+    language sql
+    immutable as
+$$
+select encode(sha256(convert_to(_jd_canonical_text($1), 'UTF8')), 'hex')
 $$;
 
 -- Internal recursive helper with explicit path
@@ -685,13 +758,11 @@ begin
 
                 -- For setkeys and objects present in both, recurse into changed objects
                 if setkeys is not null then
-                    for hkey in select key
-                                from (select key
-                                      from jsonb_object_keys(amap) as key
-                                      intersect
-                                      select key
-                                      from jsonb_object_keys(bmap) as key) s
-                                order by 1
+                    for hkey in select _jd_sorted_keys(array(select key
+                                                             from jsonb_object_keys(amap) as key
+                                                             intersect
+                                                             select key
+                                                             from jsonb_object_keys(bmap) as key))
                         loop
                             ah := amap -> hkey; bh := bmap -> hkey;
                             -- when counts, value is count. fetch real objects from original arrays by searching first match
@@ -721,13 +792,11 @@ begin
                                     if debug then
                                         raise debug 'identity match at % key %, checking scalar fields', ipath, hkey;
                                     end if;
-                                    for kk in select key
-                                              from (select key
-                                                    from jsonb_object_keys(ah) as key
-                                                    union
-                                                    select key
-                                                    from jsonb_object_keys(bh) as key) u
-                                              order by 1
+                                    for kk in select _jd_sorted_keys(array(select key
+                                                                           from jsonb_object_keys(ah) as key
+                                                                           union
+                                                                           select key
+                                                                           from jsonb_object_keys(bh) as key))
                                         loop
                                             aval := ah -> kk; bval := bh -> kk;
                                             if aval is null or bval is null then
@@ -819,7 +888,7 @@ begin
                     elem.before := null; elem.after := null; elem.remove := null; elem.add := null;
 
                     -- removals
-                    for hkey in select key from jsonb_object_keys(amap) as key order by 1
+                    for hkey in select _jd_sorted_keys(array(select jsonb_object_keys(amap)))
                         loop
                             if counts then
                                 declare
@@ -867,7 +936,7 @@ begin
                         end loop;
 
                     -- additions
-                    for hkey in select key from jsonb_object_keys(bmap) as key order by 1
+                    for hkey in select _jd_sorted_keys(array(select jsonb_object_keys(bmap)))
                         loop
                             if counts then
                                 declare
@@ -1156,7 +1225,7 @@ $$
 declare
     t text;
 begin
-    if format = 'jd' then
+    if format in ('jd', 'jd2') then
         t := jd_diff_text(a, b, options);
         return to_jsonb(t);
     elsif format = 'patch' then
@@ -1171,9 +1240,147 @@ $$;
 
 -- Note: Only 4-arg jd_diff(a,b,options,format) is supported from Milestone 6 onward.
 
+-- jd_diff of the values at path in a and b. The values are extracted with #> and diffed
+-- starting from path, so every path of the diff is prefixed with it and the diff applies
+-- to the whole documents. A path missing from a document is diffed as a missing value.
+create or replace function jd_diff_at(a jsonb, b jsonb, path jd_path, options jd_option,
+                                      format jd_diff_format default 'jd') returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    keys  text[] := array(select e #>> '{}' from jsonb_array_elements(path) as z(e));
+    opt   jd_option := coalesce(options, '[]'::jsonb);
+    elems jd_diff_element[];
+begin
+    if path is null or path = '[]'::jsonb then return jd_diff(a, b, options, format); end if;
+    if exists (select 1 from jsonb_array_elements(path) as z(e) where jsonb_typeof(e) not in ('string', 'number')) then
+        raise exception 'jd_diff_at: path must hold only object keys and array indexes: %', path;
+    end if;
+    if format = 'merge' then opt := opt || '["MERGE"]'::jsonb; end if;
+    select array_agg(d) into elems
+    from _jd_diff_struct(a #> keys, b #> keys, path, opt) as d
+    where _jd_diff_allowed(d.path, opt);
+    if format in ('jd', 'jd2') then
+        if elems is null then return to_jsonb(''::text); end if;
+        return to_jsonb(jd_render_diff_text(elems, options));
+    elsif format = 'patch' then
+        if elems is null then return '[]'::jsonb; end if;
+        return jd_render_diff_patch(elems);
+    elsif format = 'merge' then
+        if elems is null then return '{}'::jsonb; end if;
+        return jd_render_diff_merge(elems);
+    else
+        raise exception 'jd_diff_at: unknown format %', format;
+    end if;
+end
+$$;
+
+-- Summary of the diff of a and b, like git diff --stat: the number of values added,
+-- removed and modified (removed and added in the same hunk), in total and per top-level
+-- path. A change of the whole document is counted under the path [].
+create or replace function jd_diff_stat(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns jsonb
+    language sql
+    stable as
+$$
+with e as (select case
+                      when coalesce(jsonb_array_length(d.path), 0) = 0 then '[]'::jsonb
+                      else jsonb_build_array(d.path -> 0)
+                      end                            as top,
+                  coalesce(array_length(d.remove, 1), 0) as r,
+                  coalesce(array_length(d.add, 1), 0)    as n
+           from jd_diff_struct($1, $2, $3) as d),
+     t as (select top,
+                  sum(n - least(r, n))::int as additions,
+                  sum(r - least(r, n))::int as removals,
+                  sum(least(r, n))::int     as modifications
+           from e
+           group by top)
+select jsonb_build_object(
+               'additions', coalesce(sum(additions), 0),
+               'removals', coalesce(sum(removals), 0),
+               'modifications', coalesce(sum(modifications), 0),
+               'paths', coalesce(jsonb_agg(jsonb_build_object('path', top, 'additions', additions, 'removals', removals,
+                                                              'modifications', modifications) order by top),
+                                 '[]'::jsonb))
+from t
+$$;
+
+-- The paths of the hunks of the diff of a and b, as a JSON array of jd paths without
+-- values, each listed once in the order of the diff. A change of the whole document is
+-- the path []. For invalidating caches by path without fetching the diff.
+create or replace function jd_diff_paths(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns jsonb
+    language sql
+    stable as
+$$
+select coalesce(jsonb_agg(p order by first), '[]'::jsonb)
+from (select coalesce(d.path, '[]'::jsonb) as p, min(d.n) as first
+      from jd_diff_struct($1, $2, $3) with ordinality as d(metadata, options, path, before, remove, add, after, n)
+      group by 1) as u
+$$;
+
+-- The hunks of the diff of a and b, one row each in the order of the diff: to_jsonb of
+-- each jd_diff_element, which jsonb_populate_record(null::jd_diff_element, h) turns back
+-- into one. For clients that consume a large diff row by row instead of as one value,
+-- which text and jsonb cap at 1 GB.
+create or replace function jd_diff_hunks(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns setof jsonb
+    language sql
+    stable as
+$$
+select to_jsonb(d) - 'ordinality'
+from jd_diff_struct($1, $2, $3) with ordinality as d
+order by d.ordinality
+$$;
+
+-- Whether a diff produced by jd_diff or jd_translate_diff_format in format is empty: an
+-- empty jd text, an empty RFC 6902 patch or an empty merge patch. Any other value,
+-- including a merge patch replacing the document with false or null, is a difference.
+create or replace function jd_diff_is_empty(diff jsonb, format jd_diff_format) returns boolean
+    language sql
+    immutable as
+$$
+select case
+           when diff is null then true
+           when format in ('jd', 'jd2') then jsonb_typeof(diff) = 'string' and btrim(diff #>> '{}') = ''
+           when format = 'patch' then diff = '[]'::jsonb
+           else diff = '{}'::jsonb
+           end
+$$;
+
+-- Downgrade jd v2 diff text to the v1 layout: drop the '^' options/metadata lines and
+-- the context lines, keeping only '@' headers and '-'/'+' changes.
+create or replace function _jd_diff_text_v1(diff_text text) returns text
+    language sql
+    immutable as
+$$
+select coalesce(string_agg(l, E'\n' order by n) || E'\n', '')
+from unnest(string_to_array(coalesce(diff_text, ''), E'\n')) with ordinality as u(l, n)
+where left(l, 2) in ('@ ', '- ', '+ ')
+$$;
+
+-- Read diff content in format as jd_diff_element[]. jd diffs are JSON strings holding the
+-- native text. With strict, RFC 6902 operations that cannot be represented raise an error.
+create or replace function _jd_read_diff(diff_content jsonb, format jd_diff_format, strict boolean) returns jd_diff_element[]
+    language plpgsql
+    stable as
+$$
+begin
+    if format in ('jd', 'jd2') then
+        return _jd_read_diff_text(_jd_jsonb_string_value(diff_content));
+    elsif format = 'patch' then
+        return _jd_read_diff_patch(diff_content, strict);
+    elsif format = 'merge' then
+        return jd_read_diff_merge(diff_content);
+    end if;
+    raise exception 'jd_translate_diff_format: unknown input format %', format;
+end
+$$;
+
 -- Milestone 6: translation helper stub (jd-involved flows only in this milestone)
+-- 'jd2' names the v2 native text explicitly; translating jd2 to jd yields the v1 layout.
 create or replace function jd_translate_diff_format(diff_content jsonb, input_format jd_diff_format,
-                                                    output_format jd_diff_format) returns jsonb
+                                                    output_format jd_diff_format,
+                                                    strict boolean default false) returns jsonb
     language plpgsql
     stable as
 $$
@@ -1185,20 +1392,11 @@ begin
     if input_format = output_format then return diff_content; end if;
 
     -- Normalize input to struct elements
-    if input_format = 'jd' then
-        t := _jd_jsonb_string_value(diff_content);
-        elems := _jd_read_diff_text(t);
-    elsif input_format = 'patch' then
-        elems := jd_read_diff_patch(diff_content);
-    elsif input_format = 'merge' then
-        elems := jd_read_diff_merge(diff_content);
-    else
-        raise exception 'jd_translate_diff_format: unknown input format %', input_format;
-    end if;
+    elems := _jd_read_diff(diff_content, input_format, strict);
 
     if elems is null or array_length(elems, 1) is null then
         -- empty diff translates to empty in any format
-        if output_format = 'jd' then
+        if output_format in ('jd', 'jd2') then
             return to_jsonb(''::text);
         elsif output_format = 'patch' then
             return '[]'::jsonb;
@@ -1208,7 +1406,9 @@ begin
     end if;
 
     -- Render to desired output
-    if output_format = 'jd' then
+    if output_format = 'jd' and input_format = 'jd2' then
+        return to_jsonb(_jd_diff_text_v1(_jd_jsonb_string_value(diff_content)));
+    elsif output_format in ('jd', 'jd2') then
         -- include MERGE header when elements originated from merge
         if input_format = 'merge' then
             t := jd_render_diff_text(elems, '[
@@ -1228,6 +1428,99 @@ begin
 end
 $$;
 
+-- The hunks of diff elements as JSON, for comparing diffs read from different formats:
+-- paths, context, values and options, but not the MERGE metadata.
+create or replace function _jd_diff_hunks(elems jd_diff_element[]) returns jsonb
+    language sql
+    immutable as
+$$
+select coalesce(jsonb_agg(jsonb_build_object('path', coalesce(e.path, '[]'::jsonb),
+                                             'options', coalesce(e.options, '[]'::jsonb),
+                                             'before', to_jsonb(e.before),
+                                             'remove', to_jsonb(e.remove),
+                                             'add', to_jsonb(e.add),
+                                             'after', to_jsonb(e.after)) order by e.n), '[]'::jsonb)
+from unnest(elems) with ordinality as e(metadata, options, path, before, remove, add, after, n)
+$$;
+
+-- Translate like jd_translate_diff_format, then translate the result back and raise an
+-- error, showing what came back, unless it has the hunks of the original: the
+-- translation is then lossy, as a merge patch is for array changes and removed values.
+create or replace function jd_translate_roundtrip(diff_content jsonb, input_format jd_diff_format,
+                                                  output_format jd_diff_format,
+                                                  strict boolean default false) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    translated jsonb := jd_translate_diff_format(diff_content, input_format, output_format, strict);
+    back       jsonb := jd_translate_diff_format(translated, output_format, input_format, strict);
+begin
+    if _jd_diff_hunks(_jd_read_diff(diff_content, input_format, strict)) is distinct from
+       _jd_diff_hunks(_jd_read_diff(back, input_format, strict)) then
+        raise exception 'jd_translate_roundtrip: %2% is lossy: translating back gives %', input_format, output_format,
+            case when input_format in ('jd', 'jd2') then _jd_jsonb_string_value(back) else back::text end;
+    end if;
+    return translated;
+end
+$$;
+
+-- Invert diff, in format: return the diff, in the same format, that undoes it, so that
+-- patching the result of applying diff with it gives back the original document. The
+-- hunks are reversed in order and their removed and added values swapped; context lines
+-- and the options header are kept. Merge patches do not record the values they replace,
+-- and neither do RFC 6902 remove and replace operations without a value or a test of
+-- their path before them, so these raise an error instead.
+create or replace function jd_invert_diff(diff jsonb, format jd_diff_format) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    elems    jd_diff_element[];
+    inverted jd_diff_element[] := array []::jd_diff_element[];
+    e        jd_diff_element;
+    op       jsonb;
+begin
+    if diff is null then return null; end if;
+    if format = 'merge' then
+        raise exception 'jd_invert_diff: a merge patch cannot be inverted: it does not record the values it replaces';
+    end if;
+    if format = 'patch' and jsonb_typeof(diff) = 'array' then
+        select o.e
+        into op
+        from jsonb_array_elements(diff) with ordinality as o(e, n)
+        where o.e ->> 'op' in ('remove', 'replace')
+          and not o.e ? 'value'
+          and not exists (select 1
+                          from jsonb_array_elements(diff) with ordinality as t(e, m)
+                          where t.m < o.n
+                            and t.e ->> 'op' = 'test'
+                            and t.e ->> 'path' = o.e ->> 'path')
+        order by o.n
+        limit 1;
+        if op is not null then
+            raise exception 'jd_invert_diff: % at % does not record the value it replaces (test the path first)',
+                op ->> 'op', op ->> 'path';
+        end if;
+    end if;
+
+    elems := _jd_read_diff(diff, format, true);
+    foreach e in array coalesce(elems, array []::jd_diff_element[])
+        loop
+            if (e.metadata).merge or e.options @> '["MERGE"]'::jsonb or e.options @> '[{"Merge": true}]'::jsonb then
+                raise exception 'jd_invert_diff: a diff with merge semantics cannot be inverted: it does not record the values it replaces';
+            end if;
+            inverted := array [row (e.metadata, e.options, e.path, e.before, e.add, e.remove, e.after)::jd_diff_element] ||
+                        inverted;
+        end loop;
+
+    if format in ('jd', 'jd2') then
+        return to_jsonb(jd_render_diff_text(inverted, coalesce((elems[1]).options, '[]'::jsonb)));
+    end if;
+    return jd_render_diff_patch(inverted);
+end
+$$;
+
 -- Minimal RFC 6902 applier: supports /key at root for add/remove/replace
 create or replace function jd_apply_patch(value jsonb, patch jd_patch) returns jsonb
     language plpgsql
@@ -1399,6 +1692,11 @@ $$;
 
 -- Render RFC 7386 Merge Patch from diff struct (objects only at leaf keys)
 -- For array element diffs, RFC 7386 semantics require replacing the entire array.
+-- A merge patch reads null as the removal of a key, so it cannot set a value to null. The
+-- jd_sql.merge_null_policy setting chooses what happens to such hunks: keep (the default)
+-- writes the null anyway, turning the assignment into a removal; error raises an error;
+-- drop leaves the hunk out; sentinel writes the jd_sql.merge_null_sentinel string
+-- (default "__jd_null__") for the consumer of the patch to replace.
 create or replace function jd_render_diff_merge(diff_elements jd_diff_element[]) returns jd_merge
     language plpgsql
     stable as
@@ -1412,7 +1710,12 @@ declare
     parent_arr text[];
     last_key   text;
     parent_obj jsonb;
+    add_val    jsonb;
+    null_policy text := coalesce(nullif(current_setting('jd_sql.merge_null_policy', true), ''), 'keep');
 begin
+    if null_policy not in ('keep', 'error', 'drop', 'sentinel') then
+        raise exception 'jd_render_diff_merge: unsupported jd_sql.merge_null_policy % (supported: keep, error, drop, sentinel)', null_policy;
+    end if;
     while i <= n
         loop
             e := diff_elements[i];
@@ -1439,13 +1742,26 @@ begin
                     end if;
                 end if;
 
+                add_val := null;
                 if e.add is not null and array_length(e.add, 1) = 1 then
+                    add_val := e.add[1];
+                    if add_val = 'null'::jsonb and null_policy <> 'keep' then
+                        if null_policy = 'error' then
+                            raise exception 'jd_render_diff_merge: % is set to null, which a merge patch cannot express (jd_sql.merge_null_policy = error)', e.path;
+                        elsif null_policy = 'drop' then
+                            add_val := null;
+                        else
+                            add_val := to_jsonb(coalesce(nullif(current_setting('jd_sql.merge_null_sentinel', true), ''), '__jd_null__'));
+                        end if;
+                    end if;
+                end if;
+                if add_val is not null then
                     if parent_arr is null then
                         -- set at top-level
-                        out := coalesce(out, '{}'::jsonb) || jsonb_build_object(last_key, e.add[1]);
+                        out := coalesce(out, '{}'::jsonb) || jsonb_build_object(last_key, add_val);
                     else
                         parent_obj := coalesce(out #> parent_arr, '{}'::jsonb);
-                        parent_obj := parent_obj || jsonb_build_object(last_key, e.add[1]);
+                        parent_obj := parent_obj || jsonb_build_object(last_key, add_val);
                         out := jsonb_set(out, parent_arr, parent_obj, true);
                     end if;
                 elsif e.remove is not null and array_length(e.remove, 1) = 1 and e.add is null then
@@ -1483,6 +1799,50 @@ begin
 end
 $$;
 
+-- Render diff elements given as a JSON array, such as the to_jsonb of jd_diff_struct rows,
+-- in format like jd_diff. A client can so assemble one diff from parts computed apart,
+-- e.g. the chunks of a large array diffed on several connections.
+create or replace function jd_render_diff(diff_elements jsonb, options jd_option,
+                                          format jd_diff_format default 'jd') returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    elems jd_diff_element[] := array(select jsonb_populate_record(null::jd_diff_element, e)
+                                     from jsonb_array_elements(coalesce(diff_elements, '[]'::jsonb))
+                                         with ordinality as t(e, n)
+                                     order by n);
+begin
+    if format in ('jd', 'jd2') then
+        return to_jsonb(jd_render_diff_text(elems, options));
+    elsif array_length(elems, 1) is null then
+        return case when format = 'patch' then '[]'::jsonb else '{}'::jsonb end;
+    elsif format = 'patch' then
+        return jd_render_diff_patch(elems);
+    elsif format = 'merge' then
+        return jd_render_diff_merge(elems);
+    else
+        raise exception 'jd_render_diff: unknown format %', format;
+    end if;
+end
+$$;
+
+-- Raise the conflict of a patch hunk that does not match the document, with SQLSTATE
+-- JDP01 and, as DETAIL, a JSON object of the 1-based hunk, its path, and the expected
+-- and actual values, each left out when there is no value (SQL NULL).
+create or replace function _jd_patch_conflict(hunk int, path jd_path, expected jsonb, actual jsonb, message text)
+    returns void
+    language plpgsql
+    immutable as
+$$
+begin
+    raise exception using errcode = 'JDP01', message = message,
+        detail = (jsonb_build_object('hunk', hunk, 'path', coalesce(path, '[]'::jsonb))
+            || case when expected is null then '{}'::jsonb else jsonb_build_object('expected', expected) end
+            || case when actual is null then '{}'::jsonb else jsonb_build_object('actual', actual) end)::text;
+end
+$$;
+
 -- Apply struct elements (objects at leaf keys)
 create or replace function jd_patch_struct(value jsonb, diff_elements jd_diff_element[]) returns jsonb
     language plpgsql
@@ -1540,7 +1900,8 @@ begin
                     arr := cur #> parent_path;
                 end if;
                 if jsonb_typeof(arr) <> 'array' then
-                    raise exception 'jd_patch_struct: expected array at %, got %', parent_path, jsonb_typeof(arr);
+                    perform _jd_patch_conflict(i, e.path - (jsonb_array_length(e.path) - 1), null, arr,
+                        format('jd_patch_struct: expected array at %s, got %s', parent_path, coalesce(jsonb_typeof(arr), 'no value')));
                 end if;
                 -- Optional context: last non-marker from before serves as previous element expectation
                 prev_expected := null;
@@ -1567,15 +1928,20 @@ begin
                     next_actual := null;
                 end if;
                 if prev_expected is not null and prev_actual is not null and prev_actual <> prev_expected then
-                    raise exception 'jd_patch_struct: context mismatch before index %: expected %, got %', idx, prev_expected, prev_actual;
+                    perform _jd_patch_conflict(i, (e.path - (jsonb_array_length(e.path) - 1)) || to_jsonb(idx - 1),
+                        prev_expected, prev_actual,
+                        format('jd_patch_struct: context mismatch before index %s: expected %s, got %s', idx, prev_expected, prev_actual));
                 end if;
                 if next_expected is not null and next_actual is not null and next_actual <> next_expected then
-                    raise exception 'jd_patch_struct: context mismatch after index %: expected %, got %', idx, next_expected, next_actual;
+                    perform _jd_patch_conflict(i, (e.path - (jsonb_array_length(e.path) - 1)) || to_jsonb(idx + 1),
+                        next_expected, next_actual,
+                        format('jd_patch_struct: context mismatch after index %s: expected %s, got %s', idx, next_expected, next_actual));
                 end if;
                 -- Replacement: require remove match when provided
                 if e.remove is not null and array_length(e.remove, 1) is not null then
                     if (cur #> full_path) <> e.remove[1] then
-                        raise exception 'jd_patch_struct: value mismatch at index %', idx;
+                        perform _jd_patch_conflict(i, e.path, e.remove[1], cur #> full_path,
+                            format('jd_patch_struct: value mismatch at index %s', idx));
                     end if;
                 end if;
                 if e.add is not null and array_length(e.add, 1) is not null then
@@ -1828,49 +2194,99 @@ end
 $$;
 
 -- Parse RFC 6902 JSON Patch into jd_diff_element[]
-create or replace function jd_read_diff_patch(patch jd_patch) returns jd_diff_element[]
+-- Read RFC 6902 operations as jd_diff_element[]. RFC 6902 carries no old values, so they
+-- come from test operations: a test at a path gives the value of a following remove or
+-- replace there (a modification), or of the source of a move or copy. A remove and an
+-- add at the same path in a row are one modification, as in jd's own patches. With
+-- strict, operations that cannot be represented (a test not paired with a later
+-- operation, a move or copy whose source value is unknown) raise an error; otherwise
+-- they are dropped.
+create or replace function _jd_read_diff_patch(patch jd_patch, strict boolean) returns jd_diff_element[]
     language plpgsql
     stable as
 $$
 declare
-    ops jsonb;
-    op  jsonb;
-    out jd_diff_element[] := array []::jd_diff_element[];
-    cur jd_diff_element;
-    p   text;
+    op     jsonb;
+    out    jd_diff_element[] := array []::jd_diff_element[];
+    cur    jd_diff_element;
+    prev   jd_diff_element;
+    n      int;
+    p      text;
+    src    text;
+    tested jsonb             := '{}'::jsonb;
+    v      jsonb;
 begin
     if patch is null or jsonb_typeof(patch) <> 'array' then return null; end if;
-    ops := patch;
-    for op in select e from jsonb_array_elements(ops) as z(e)
+    for op in select e from jsonb_array_elements(patch) as z(e)
         loop
             p := op ->> 'path';
+            src := op ->> 'from';
             cur.metadata := row (false)::jd_metadata;
             cur.options := '[]'::jsonb;
             cur.path := _jd_pointer_to_path(p);
             cur.before := null; cur.after := null; cur.remove := null; cur.add := null;
-            if op ->> 'op' = 'add' then
+            n := coalesce(array_length(out, 1), 0);
+            if op ->> 'op' = 'test' then
+                tested := tested || jsonb_build_object(p, op -> 'value');
+                continue;
+            elsif op ->> 'op' = 'add' then
+                if n > 0 then
+                    prev := out[n];
+                    if prev.path = cur.path and prev.add is null and array_length(prev.remove, 1) = 1 then
+                        -- remove + add: a modification
+                        prev.add := array [op -> 'value'];
+                        out[n] := prev;
+                        continue;
+                    end if;
+                end if;
                 cur.add := array [op -> 'value'];
-                out := out || array [cur];
             elsif op ->> 'op' = 'remove' then
                 if op ? 'value' then
                     cur.remove := array [op -> 'value'];
+                elsif tested ? p then
+                    cur.remove := array [tested -> p];
                 else
                     cur.remove := array ['null'::jsonb];
                 end if;
-                out := out || array [cur];
+                tested := tested - p;
             elsif op ->> 'op' = 'replace' then
-                if op ? 'value' then cur.add := array [op -> 'value']; end if;
+                if tested ? p then cur.remove := array [tested -> p]; end if;
                 -- replacement without prior value: represent as add only
-                out := out || array [cur];
-            else
-                -- ignore test/copy/move for translation into jd text
-                continue;
+                cur.add := array [op -> 'value'];
+                tested := tested - p;
+            elsif op ->> 'op' in ('move', 'copy') then
+                v := tested -> src;
+                if v is null then
+                    if strict then
+                        raise exception 'jd_translate_diff_format: % from % to % needs a test of its source value',
+                            op ->> 'op', src, p;
+                    end if;
+                    continue;
+                end if;
+                tested := tested - src;
+                if op ->> 'op' = 'move' then
+                    out := out || array [row (cur.metadata, cur.options, _jd_pointer_to_path(src), null, array [v], null,
+                        null)::jd_diff_element];
+                end if;
+                cur.add := array [v];
             end if;
+            out := out || array [cur];
         end loop;
+    if strict and tested <> '{}'::jsonb then
+        raise exception 'jd_translate_diff_format: test at % is not followed by an operation on its path',
+            (select min(k) from jsonb_object_keys(tested) as k);
+    end if;
     return out;
 end
 $$;
 
+create or replace function jd_read_diff_patch(patch jd_patch) returns jd_diff_element[]
+    language sql
+    stable as
+$$
+select _jd_read_diff_patch(patch, false)
+$$;
+
 -- Parse RFC 7386 Merge Patch into jd_diff_element[]
 create or replace function jd_read_diff_merge(merge jd_merge) returns jd_diff_element[]
     language plpgsql
@@ -1938,3 +2354,337 @@ begin
     return jd_patch_struct(value, elems);
 end
 $$;
+
+-- Check whether diff, in format, applies cleanly to value without returning the patched
+-- document. Hunks (jd hunks or JSON Patch operations) are applied one at a time; the
+-- first one that fails is returned with its 1-based position, its path and the error,
+-- and no row means the diff applies. Unlike jd_patch_text, a jd object hunk whose '-'
+-- value does not match the document, or that adds an existing key, fails (merge hunks
+-- excepted). A merge patch always applies (RFC 7386).
+create or replace function jd_patch_check(value jsonb, diff jsonb, format jd_diff_format)
+    returns table
+            (
+                hunk  int,
+                path  jd_path,
+                error text
+            )
+    language plpgsql
+    stable as
+$$
+declare
+    cur    jsonb := value;
+    el     jd_diff_element;
+    op     jsonb;
+    i      int   := 0;
+    keys   text[];
+    actual jsonb;
+begin
+    if diff is null or format = 'merge' then return; end if;
+    if format = 'patch' then
+        if jsonb_typeof(diff) <> 'array' then raise exception 'jd_patch_check: expected a JSON Patch array'; end if;
+        for op in select z.o from jsonb_array_elements(diff) as z(o)
+            loop
+                i := i + 1;
+                begin
+                    cur := jd_apply_patch(cur, jsonb_build_array(op));
+                exception
+                    when others then
+                        hunk := i;
+                        path := case when op ? 'path' then _jd_pointer_to_path(op ->> 'path') end;
+                        error := sqlerrm;
+                        return next;
+                        return;
+                end;
+            end loop;
+        return;
+    end if;
+
+    if jsonb_typeof(diff) <> 'string' then raise exception 'jd_patch_check: expected jd diff text as a JSON string'; end if;
+    foreach el in array coalesce(_jd_read_diff_text(diff #>> '{}'), array []::jd_diff_element[])
+        loop
+            i := i + 1;
+            begin
+                if jsonb_array_length(el.path) > 0 and jsonb_typeof(el.path -> -1) = 'string'
+                    and not coalesce((el.metadata).merge, false) then
+                    select array_agg(t.v) into keys from jsonb_array_elements_text(el.path) t(v);
+                    actual := cur #> keys;
+                    if el.remove is not null and array_length(el.remove, 1) = 1 then
+                        if actual is distinct from el.remove[1] then
+                            raise exception 'expected % at %, found %', el.remove[1], el.path, coalesce(actual::text, 'no value');
+                        end if;
+                    elsif actual is not null then
+                        raise exception 'expected no value at %, found %', el.path, actual;
+                    end if;
+                end if;
+                cur := jd_patch_struct(cur, array [el]);
+            exception
+                when others then
+                    hunk := i;
+                    path := el.path;
+                    error := sqlerrm;
+                    return next;
+                    return;
+            end;
+        end loop;
+end
+$$;
+
+-- Three-way merge helper with explicit path. SQL NULL stands for an absent value, so a
+-- key deleted on one side and unchanged on the other is deleted. Objects are merged key
+-- by key; any other value (including arrays) is replaced as a whole. A value changed
+-- differently on both sides is a conflict: ours is kept and the conflict is recorded.
+create or replace function _jd_merge3(base jsonb, ours jsonb, theirs jsonb, options jd_option, cur_path jd_path,
+                                      out merged jsonb, out conflicts jsonb)
+    language plpgsql
+    stable as
+$$
+declare
+    k   text;
+    sub record;
+begin
+    conflicts := '[]'::jsonb;
+    if _jd_json_equal(ours, theirs, options) or _jd_json_equal(base, theirs, options) then
+        merged := ours;
+        return;
+    end if;
+    if _jd_json_equal(base, ours, options) then
+        merged := theirs;
+        return;
+    end if;
+    if jsonb_typeof(ours) = 'object' and jsonb_typeof(theirs) = 'object'
+        and (base is null or jsonb_typeof(base) = 'object') then
+        merged := '{}'::jsonb;
+        for k in select key from jsonb_object_keys(ours) as t(key)
+                 union
+                 select key from jsonb_object_keys(theirs) as t(key)
+                 union
+                 select key from jsonb_object_keys(coalesce(base, '{}'::jsonb)) as t(key)
+                 order by 1
+            loop
+                sub := _jd_merge3(base -> k, ours -> k, theirs -> k, options, cur_path || to_jsonb(k));
+                if sub.merged is not null then
+                    merged := merged || jsonb_build_object(k, sub.merged);
+                end if;
+                conflicts := conflicts || sub.conflicts;
+            end loop;
+        return;
+    end if;
+    merged := ours;
+    conflicts := jsonb_build_array(jsonb_build_object('path', cur_path) ||
+                                   case when base is null then '{}'::jsonb else jsonb_build_object('base', base) end ||
+                                   case when ours is null then '{}'::jsonb else jsonb_build_object('ours', ours) end ||
+                                   case when theirs is null then '{}'::jsonb else jsonb_build_object('theirs', theirs) end);
+end
+$$;
+
+-- Three-way merge of ours and theirs, both derived from base. Returns the merged
+-- document and the conflicts, a JSON array of {"path", "base", "ours", "theirs"} objects
+-- (members absent on a side are omitted). Where the sides conflict, merged holds ours.
+-- Values are compared with the precision of options.
+create or replace function jd_merge3(base jsonb, ours jsonb, theirs jsonb, options jd_option default '[]'::jsonb)
+    returns table
+            (
+                merged    jsonb,
+                conflicts jsonb
+            )
+    language sql
+    stable as
+$$
+select m.merged, m.conflicts
+from _jd_merge3($1, $2, $3, coalesce($4, '[]'::jsonb), '[]'::jsonb) as m
+$$;
+
+-- Resolves the local $ref of the JSON Schema node, a JSON Pointer fragment into root
+-- ("#/$defs/name", or "#" for root itself). Chains of references are followed; other
+-- references are left as is.
+create or replace function _jd_schema_resolve(node jsonb, root jsonb) returns jsonb
+    language plpgsql
+    immutable as
+$$
+declare
+    ref   text;
+    depth int := 0;
+begin
+    while jsonb_typeof(node) = 'object' and jsonb_typeof(node -> '$ref') = 'string' and depth < 32
+        loop
+            ref := node ->> '$ref';
+            if ref = '#' then
+                node := root;
+            elsif left(ref, 2) = '#/' then
+                node := root #> array(select jsonb_array_elements_text(_jd_pointer_to_path(substr(ref, 2))));
+            else
+                return node;
+            end if;
+            depth := depth + 1;
+        end loop;
+    return node;
+end
+$$;
+
+-- Converts value to the single JSON Schema type, when it is a string holding a number
+-- or boolean of that type, or a number or boolean for a string. Other values are kept.
+create or replace function _jd_schema_coerce(value jsonb, type jsonb) returns jsonb
+    language plpgsql
+    immutable as
+$$
+declare
+    t   text := type #>> '{}';
+    s   text;
+    num numeric;
+begin
+    if jsonb_typeof(type) is distinct from 'string' then
+        return value;
+    end if;
+    if jsonb_typeof(value) = 'string' then
+        s := btrim(value #>> '{}');
+        if t in ('number', 'integer') and s ~ '^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$' then
+            num := s::numeric;
+            if t = 'number' or num = trunc(num) then
+                return to_jsonb(num);
+            end if;
+        elsif t = 'boolean' and lower(s) in ('true', 'false') then
+            return to_jsonb(lower(s)::boolean);
+        end if;
+    elsif t = 'string' and jsonb_typeof(value) in ('number', 'boolean') then
+        return to_jsonb(value #>> '{}');
+    end if;
+    return value;
+end
+$$;
+
+-- Internal recursive helper of jd_schema_defaults, applying the schema node to value.
+create or replace function _jd_schema_apply(value jsonb, node jsonb, root jsonb, coerce boolean) returns jsonb
+    language plpgsql
+    immutable as
+$$
+declare
+    k      text;
+    sub    jsonb;
+    prefix jsonb;
+    rest   jsonb;
+begin
+    node := _jd_schema_resolve(node, root);
+    if value is null or jsonb_typeof(node) is distinct from 'object' then
+        return value;
+    end if;
+    for sub in select s from jsonb_array_elements(coalesce(node -> 'allOf', '[]'::jsonb)) as e(s)
+        loop
+            value := _jd_schema_apply(value, sub, root, coerce);
+        end loop;
+    if coerce then
+        value := _jd_schema_coerce(value, node -> 'type');
+    end if;
+
+    if jsonb_typeof(value) = 'object' then
+        for k, sub in select key, s from jsonb_each(coalesce(node -> 'properties', '{}'::jsonb)) as p(key, s)
+            loop
+                sub := _jd_schema_resolve(sub, root);
+                if value ? k then
+                    value := jsonb_set(value, array [k], _jd_schema_apply(value -> k, sub, root, coerce));
+                elsif jsonb_typeof(sub) = 'object' and sub ? 'default' then
+                    value := jsonb_set(value, array [k], _jd_schema_apply(sub -> 'default', sub, root, coerce));
+                end if;
+            end loop;
+        for k in select key from jsonb_object_keys(value) as t(key)
+            loop
+                continue when node -> 'properties' ? k;
+                rest := null;
+                for sub in select s
+                           from jsonb_each(coalesce(node -> 'patternProperties', '{}'::jsonb)) as p(pattern, s)
+                           where k ~ p.pattern
+                    loop
+                        value := jsonb_set(value, array [k], _jd_schema_apply(value -> k, sub, root, coerce));
+                        rest := 'false'::jsonb;
+                    end loop;
+                if rest is null and jsonb_typeof(node -> 'additionalProperties') = 'object' then
+                    value := jsonb_set(value, array [k],
+                                       _jd_schema_apply(value -> k, node -> 'additionalProperties', root, coerce));
+                end if;
+            end loop;
+    elsif jsonb_typeof(value) = 'array' then
+        -- prefixItems (2020-12) or an items array (draft 7) apply by position, and the
+        -- items or additionalItems schema to the elements after them
+        prefix := case
+                      when jsonb_typeof(node -> 'prefixItems') = 'array' then node -> 'prefixItems'
+                      when jsonb_typeof(node -> 'items') = 'array' then node -> 'items'
+                      else '[]'::jsonb end;
+        rest := case
+                    when jsonb_typeof(node -> 'items') = 'object' then node -> 'items'
+                    else node -> 'additionalItems' end;
+        select coalesce(jsonb_agg(_jd_schema_apply(a.e, coalesce(prefix -> (a.n::int - 1), rest), root, coerce)
+                                  order by a.n), '[]'::jsonb)
+        into value
+        from jsonb_array_elements(value) with ordinality as a(e, n);
+    end if;
+    return value;
+end
+$$;
+
+-- The document value with the defaults of the JSON Schema schema materialized: a
+-- property absent from an object is set to the default of its schema, so that a field
+-- left out and a field set to its default diff as equal. The properties,
+-- patternProperties, additionalProperties, items, prefixItems, additionalItems, allOf
+-- and local $ref keywords are followed; conditional keywords (anyOf, oneOf, if) are
+-- not, as the branch that applies is ambiguous. With coerce, strings holding a number or
+-- boolean are converted to the type of their schema, and numbers and booleans to
+-- strings, where the type is a single one.
+create or replace function jd_schema_defaults(value jsonb, schema jsonb, coerce boolean default false) returns jsonb
+    language sql
+    immutable as
+$$
+select _jd_schema_apply($1, $2, $2, coalesce($3, false))
+$$;
+
+-- Normalize s to the Unicode normalization form (NFC, NFD, NFKC or NFKD). plpgsql defers
+-- the check of normalize(), which needs PostgreSQL 13, to the first call.
+create or replace function _jd_normalize_text(s text, form text) returns text
+    language plpgsql
+    immutable as
+$$
+begin
+    return case form
+               when 'NFC' then normalize(s, nfc)
+               when 'NFD' then normalize(s, nfd)
+               when 'NFKC' then normalize(s, nfkc)
+               else normalize(s, nfkd)
+        end;
+end
+$$;
+
+-- Internal recursive helper of jd_normalize_unicode.
+create or replace function _jd_normalize_unicode(value jsonb, form text) returns jsonb
+    language plpgsql
+    immutable as
+$$
+begin
+    case jsonb_typeof(value)
+        when 'string' then
+            return to_jsonb(_jd_normalize_text(value #>> '{}', form));
+        when 'object' then
+            return (select coalesce(jsonb_object_agg(_jd_normalize_text(e.key, form), _jd_normalize_unicode(e.value, form)),
+                                    '{}'::jsonb)
+                    from jsonb_each(value) as e);
+        when 'array' then
+            return (select coalesce(jsonb_agg(_jd_normalize_unicode(e.v, form) order by e.n), '[]'::jsonb)
+                    from jsonb_array_elements(value) with ordinality as e(v, n));
+        else
+            return value;
+        end case;
+end
+$$;
+
+-- value with its strings and object keys normalized to the Unicode normalization form
+-- (NFC, NFD, NFKC or NFKD), so that differently composed spellings of the same text
+-- compare equal. Keys that normalize alike are merged, the last one winning.
+create or replace function jd_normalize_unicode(value jsonb, form text default 'NFC') returns jsonb
+    language plpgsql
+    immutable as
+$$
+begin
+    form := upper(coalesce(form, 'NFC'));
+    if form not in ('NFC', 'NFD', 'NFKC', 'NFKD') then
+        raise exception 'unsupported normalization form: % (supported: NFC, NFD, NFKC, NFKD)', form;
+    end if;
+    return _jd_normalize_unicode(value, form);
+end
+$$;
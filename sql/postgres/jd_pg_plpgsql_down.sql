@@ -0,0 +1,100 @@
+-- Down migration of the PostgreSQL PL/pgSQL implementation surface for jd-sql: drops
+-- the jd-sql functions, domains and types of the current schema.
+--
+-- License: MIT
+-- This file is licensed under the MIT License. See the LICENSE file at
+-- github.com/deinspanjer/jd-sql/LICENSE for full license text.
+--
+-- Copyright (c) 2025 Daniel Einspanjer
+
+-- --------------------------------------------------------------------------------
+-- Objects that use jd-sql (views, columns, triggers, ...) are only dropped along with
+-- it when the jd_sql.uninstall_cascade setting is on, as with uninstall --cascade;
+-- otherwise they are reported and nothing is dropped.
+-- --------------------------------------------------------------------------------
+do
+$$
+    declare
+        do_cascade boolean := coalesce(nullif(current_setting('jd_sql.uninstall_cascade', true), ''), 'off')::boolean;
+        ns         oid     := (select oid from pg_namespace where nspname = current_schema());
+        dependents text;
+        functions  text[];
+        types      text[];
+        domains    text[];
+        obj        text;
+    begin
+        create temp table _jd_uninstall_objects
+        (
+            classid oid not null,
+            objid   oid not null
+        ) on commit drop;
+
+        -- The jd-sql functions, types and domains, the array types and relations of the
+        -- types and the check constraints of the domains
+        insert into _jd_uninstall_objects
+        select 'pg_proc'::regclass, p.oid
+        from pg_proc p
+        where p.pronamespace = ns
+          and p.proname ~ '^_?jd_';
+        insert into _jd_uninstall_objects
+        select 'pg_type'::regclass, t.oid
+        from pg_type t
+        where t.typnamespace = ns
+          and t.typname in ('jd_option', 'jd_path', 'jd_patch', 'jd_merge', 'jd_diff_format', 'jd_metadata',
+                            'jd_diff_element');
+        insert into _jd_uninstall_objects
+        select 'pg_type'::regclass, t.typarray
+        from pg_type t
+                 join _jd_uninstall_objects o on o.classid = 'pg_type'::regclass and o.objid = t.oid
+        where t.typarray <> 0
+        union all
+        select 'pg_class'::regclass, t.typrelid
+        from pg_type t
+                 join _jd_uninstall_objects o on o.classid = 'pg_type'::regclass and o.objid = t.oid
+        where t.typrelid <> 0
+        union all
+        select 'pg_constraint'::regclass, c.oid
+        from pg_constraint c
+                 join _jd_uninstall_objects o on o.classid = 'pg_type'::regclass and o.objid = c.contypid;
+
+        select string_agg(distinct pg_describe_object(d.classid, d.objid, d.objsubid), ', ')
+        into dependents
+        from pg_depend d
+                 join _jd_uninstall_objects o on o.classid = d.refclassid and o.objid = d.refobjid
+        where d.deptype in ('n', 'a')
+          and not exists (select 1
+                          from _jd_uninstall_objects i
+                          where i.classid = d.classid
+                            and i.objid = d.objid);
+        if dependents is not null and not do_cascade then
+            raise exception 'jd-sql is still used by: %', dependents
+                using errcode = 'dependent_objects_still_exist',
+                    hint = 'Drop these objects first, or set jd_sql.uninstall_cascade to on to drop them along with jd-sql.';
+        end if;
+
+        -- Names are collected before dropping anything. Functions go first, while the
+        -- types of their signatures still exist
+        select array_agg(p.oid::regprocedure::text)
+        into functions
+        from pg_proc p
+                 join _jd_uninstall_objects o on o.classid = 'pg_proc'::regclass and o.objid = p.oid;
+        select array_agg(format('%I.%I', current_schema(), t.typname)) filter (where t.typtype = 'd'),
+               array_agg(format('%I.%I', current_schema(), t.typname)) filter (where t.typtype <> 'd' and t.typcategory <> 'A')
+        into domains, types
+        from pg_type t
+                 join _jd_uninstall_objects o on o.classid = 'pg_type'::regclass and o.objid = t.oid;
+
+        foreach obj in array coalesce(functions, '{}')
+            loop
+                execute format('drop function if exists %s cascade', obj);
+            end loop;
+        foreach obj in array coalesce(types, '{}')
+            loop
+                execute format('drop type if exists %s cascade', obj);
+            end loop;
+        foreach obj in array coalesce(domains, '{}')
+            loop
+                execute format('drop domain if exists %s cascade', obj);
+            end loop;
+    end
+$$;
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func registerBenchFlags(fs *flag.FlagSet) {
+	fs.Int("iterations", 100, "timed executions per input")
+	fs.String("duration", "", "run each input for this long instead of --iterations, e.g. 10s")
+	fs.Int("warmup", 5, "untimed executions before measuring")
+	fs.String("sweep", "", "comma separated sizes of generated documents (leaf values), e.g. 10,100,1000")
+	fs.Int("explain", 5, "EXPLAIN ANALYZE samples for the server planning and execution time and buffers (0 disables)")
+	fs.Bool("json", false, "print one JSON object per input instead of a table")
+}
+
+// benchOptions are the parsed bench flags.
+type benchOptions struct {
+	Iterations int
+	Duration   time.Duration
+	Warmup     int
+	Sweep      []int
+	Explain    int
+	JSON       bool
+}
+
+func getBenchOptions(flags cliFlags) (benchOptions, error) {
+	opts := benchOptions{Iterations: 100, Warmup: 5, Explain: 5, JSON: flags.enabled("json")}
+	for _, f := range []struct {
+		name string
+		dst  *int
+	}{{"iterations", &opts.Iterations}, {"warmup", &opts.Warmup}, {"explain", &opts.Explain}} {
+		if v := flags.value(f.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || (f.name == "iterations" && n == 0) {
+				return opts, fmt.Errorf("invalid --%s value '%s'", f.name, v)
+			}
+			*f.dst = n
+		}
+	}
+	if v := flags.value("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid --duration value '%s' (expected a duration such as 10s)", v)
+		}
+		opts.Duration = d
+	}
+	if v := flags.value("sweep"); v != "" {
+		for _, part := range strings.Split(v, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || n < 1 {
+				return opts, fmt.Errorf("invalid --sweep size '%s' (expected positive integers)", part)
+			}
+			opts.Sweep = append(opts.Sweep, n)
+		}
+	}
+	return opts, nil
+}
+
+// benchResult is the measurement of one input pair. Latencies are client side round
+// trips; ServerMS, PlanningMS and the buffer counts are medians of the EXPLAIN ANALYZE
+// samples.
+type benchResult struct {
+	Input      string  `json:"input"`
+	Bytes      int     `json:"bytes"`
+	Iterations int     `json:"iterations"`
+	P50MS      float64 `json:"p50_ms"`
+	P95MS      float64 `json:"p95_ms"`
+	P99MS      float64 `json:"p99_ms"`
+	MaxMS      float64 `json:"max_ms"`
+	ServerMS   float64 `json:"server_ms,omitempty"`
+	PlanningMS float64 `json:"planning_ms,omitempty"`
+	SharedHit  int64   `json:"shared_hit_blocks,omitempty"`
+	SharedRead int64   `json:"shared_read_blocks,omitempty"`
+	TempBlocks int64   `json:"temp_blocks,omitempty"`
+	OpsPerSec  float64 `json:"ops_per_sec"`
+}
+
+// runBench measures the diff (patch, translate) of the input files, or of generated
+// document pairs of the --sweep sizes, and prints latency percentiles, server execution
+// time and throughput per input.
+func runBench(cfg Config, args cliArgs) (int, error) {
+	opts, err := getBenchOptions(args.Flags)
+	if err != nil {
+		return 2, err
+	}
+	type input struct {
+		name string
+		inv  invocation
+	}
+	var inputs []input
+	if args.FileA != "" {
+		aText, bText, err := readInputs(args.FileA, args.FileB)
+		if err != nil {
+			return 2, err
+		}
+		inputs = append(inputs, input{args.FileA + " " + args.FileB, flagInvocation(args.Flags, aText, bText)})
+	}
+	for _, n := range opts.Sweep {
+		a, b := generateBenchPair(n)
+		inputs = append(inputs, input{fmt.Sprintf("generated/%d", n), flagInvocation(args.Flags, a, b)})
+	}
+	if len(inputs) == 0 {
+		return 2, fmt.Errorf("bench expects two input files or --sweep")
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	configurePool(db, cfg, 1)
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	var results []benchResult
+	for _, in := range inputs {
+		r, err := benchInvocation(stmts, in.inv, opts)
+		if err != nil {
+			return 2, fmt.Errorf("%s: %w", in.name, err)
+		}
+		r.Input = in.name
+		if opts.JSON {
+			enc, _ := json.Marshal(r)
+			fmt.Fprintln(os.Stdout, string(enc))
+		}
+		results = append(results, r)
+	}
+	if !opts.JSON {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "input\tbytes\titerations\tp50 ms\tp95 ms\tp99 ms\tmax ms\tserver ms\tplan ms\tbuffers hit/read\tops/s\t")
+		for _, r := range results {
+			server, planning, buffers := "-", "-", "-"
+			if opts.Explain > 0 {
+				server, planning = fmt.Sprintf("%.3f", r.ServerMS), fmt.Sprintf("%.3f", r.PlanningMS)
+				buffers = fmt.Sprintf("%d/%d", r.SharedHit, r.SharedRead)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.3f\t%.3f\t%.3f\t%.3f\t%s\t%s\t%s\t%.1f\t\n",
+				r.Input, r.Bytes, r.Iterations, r.P50MS, r.P95MS, r.P99MS, r.MaxMS, server, planning, buffers, r.OpsPerSec)
+		}
+		w.Flush()
+	}
+	return 0, nil
+}
+
+func benchInvocation(db querier, inv invocation, opts benchOptions) (benchResult, error) {
+	r := benchResult{Bytes: len(inv.A) + len(inv.B)}
+	for i := 0; i < opts.Warmup; i++ {
+		if _, _, err := execInvocation(db, inv); err != nil {
+			return r, err
+		}
+	}
+
+	var samples []time.Duration
+	start := time.Now()
+	for i := 0; ; i++ {
+		if opts.Duration > 0 {
+			if time.Since(start) >= opts.Duration {
+				break
+			}
+		} else if i >= opts.Iterations {
+			break
+		}
+		t := time.Now()
+		if _, _, err := execInvocation(db, inv); err != nil {
+			return r, err
+		}
+		samples = append(samples, time.Since(t))
+	}
+	elapsed := time.Since(start)
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	r.Iterations = len(samples)
+	r.P50MS = milliseconds(percentile(samples, 50))
+	r.P95MS = milliseconds(percentile(samples, 95))
+	r.P99MS = milliseconds(percentile(samples, 99))
+	r.MaxMS = milliseconds(samples[len(samples)-1])
+	r.OpsPerSec = float64(len(samples)) / elapsed.Seconds()
+
+	if opts.Explain > 0 {
+		stats, err := explainSamples(db, inv, opts.Explain)
+		if err != nil {
+			return r, err
+		}
+		r.ServerMS, r.PlanningMS = stats.ExecutionMS, stats.PlanningMS
+		r.SharedHit, r.SharedRead, r.TempBlocks = stats.SharedHit, stats.SharedRead, stats.TempRead+stats.TempWritten
+	}
+	return r, nil
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// explainSamples returns the median of each statistic of n EXPLAIN ANALYZE runs of
+// inv's statement.
+func explainSamples(db querier, inv invocation, n int) (planStats, error) {
+	samples := make([]planStats, 0, n)
+	for i := 0; i < n; i++ {
+		_, stats, err := explainPlan(db, inv)
+		if err != nil {
+			return planStats{}, err
+		}
+		samples = append(samples, stats)
+	}
+	return planStats{
+		PlanningMS:  median(samples, func(s planStats) float64 { return s.PlanningMS }),
+		ExecutionMS: median(samples, func(s planStats) float64 { return s.ExecutionMS }),
+		SharedHit:   int64(median(samples, func(s planStats) float64 { return float64(s.SharedHit) })),
+		SharedRead:  int64(median(samples, func(s planStats) float64 { return float64(s.SharedRead) })),
+		TempRead:    int64(median(samples, func(s planStats) float64 { return float64(s.TempRead) })),
+		TempWritten: int64(median(samples, func(s planStats) float64 { return float64(s.TempWritten) })),
+	}, nil
+}
+
+// median returns the median of the values of field in samples.
+func median[T any](samples []T, field func(T) float64) float64 {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = field(s)
+	}
+	sort.Float64s(values)
+	return values[len(values)/2]
+}
+
+// generateBenchPair returns a document with about n leaf values and a copy in which
+// roughly one in ten values changed, one key was removed and one added. The documents
+// are deterministic for a given n so runs stay comparable.
+func generateBenchPair(n int) ([]byte, []byte) {
+	rng := rand.New(rand.NewPCG(uint64(n), 0x6a64))
+	a := map[string]any{}
+	for i := 0; i < n; {
+		key := fmt.Sprintf("k%06d", i)
+		switch rng.IntN(4) {
+		case 0:
+			a[key] = rng.IntN(1_000_000)
+			i++
+		case 1:
+			a[key] = fmt.Sprintf("value-%d", rng.IntN(1_000_000))
+			i++
+		case 2:
+			// Nested object of up to 4 leaves
+			obj := map[string]any{}
+			for j := 0; j < 4 && i < n; j++ {
+				obj[fmt.Sprintf("f%d", j)] = rng.IntN(1000)
+				i++
+			}
+			a[key] = obj
+		default:
+			// Array of up to 4 leaves
+			var arr []any
+			for j := 0; j < 4 && i < n; j++ {
+				arr = append(arr, rng.IntN(1000))
+				i++
+			}
+			a[key] = arr
+		}
+	}
+
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := make(map[string]any, len(a))
+	for i, k := range keys {
+		switch {
+		case i == 0 && len(keys) > 1:
+			// removed
+		case i%10 == 5:
+			b[k] = "changed"
+		default:
+			b[k] = a[k]
+		}
+	}
+	b["added"] = true
+
+	aText, _ := json.Marshal(a)
+	bText, _ := json.Marshal(b)
+	return aText, bText
+}
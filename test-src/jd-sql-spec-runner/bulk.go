@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// bulkDiffQuery diffs every pair copied into jd_sql_pairs in one set-based statement,
+// returning the diff and whether it is empty by pair id.
+const bulkDiffQuery = "SELECT id, d, jd_diff_is_empty(d, format::jd_diff_format) " +
+	"FROM (SELECT id, format, jd_diff(a::jsonb, b::jsonb, options::jsonb, format::jd_diff_format) AS d FROM jd_sql_pairs) AS s " +
+	"ORDER BY id"
+
+// bulkOutcome is the result of a case computed by runBulk.
+type bulkOutcome struct {
+	output string
+	exit   int
+	trace  *execTrace
+}
+
+// runBulk computes the plain diffs among cases (--bulk) in a single round trip: their
+// inputs are copied with COPY into a temporary table, diffed by bulkDiffQuery, and the
+// results attached to the cases, which runCase then evaluates without a query of their
+// own. Other cases (patch, translate, invalid inputs) keep running one by one. On error
+// no case is changed, so the caller can run them all one by one.
+func runBulk(db *sql.DB, cases []testCase) error {
+	type pair struct {
+		index int
+		inv   invocation
+	}
+	var pairs []pair
+	for i, c := range cases {
+		if c.Skip != "" || !c.Hooks.empty() {
+			continue
+		}
+		inv, err := c.prepare()
+		if err != nil || !bulkEligible(inv) {
+			// Errors are reported when the case runs
+			continue
+		}
+		pairs = append(pairs, pair{i, inv})
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	start := time.Now()
+	// The temporary table belongs to the session, so everything runs on one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	var tx *sql.Tx
+	if t := queryTimeouts.statement(); t > 0 {
+		tx, err = beginWithStatementTimeout(ctx, conn, t)
+	} else {
+		tx, err = conn.BeginTx(ctx, nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Temporary tables are never WAL-logged; the table is dropped with the transaction
+	if _, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE jd_sql_pairs (id int, a text, b text, options text, format text) ON COMMIT DROP"); err != nil {
+		return fmt.Errorf("failed to create pair table: %w", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("jd_sql_pairs", "id", "a", "b", "options", "format"))
+	if err != nil {
+		return fmt.Errorf("failed to start copy: %w", err)
+	}
+	for id, p := range pairs {
+		_, err := stmt.ExecContext(ctx, id, jdsql.NullableText(p.inv.A), jdsql.NullableText(p.inv.B),
+			jdsql.NullableText(p.inv.Options), p.inv.Format)
+		if err != nil {
+			stmt.Close()
+			return fmt.Errorf("failed to copy pairs: %w", err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return fmt.Errorf("failed to copy pairs: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return fmt.Errorf("failed to copy pairs: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, renderSQL(bulkDiffQuery))
+	if err != nil {
+		return fmt.Errorf("bulk diff failed: %w", queryTimeouts.describe(err))
+	}
+	defer rows.Close()
+	outcomes := make([]*bulkOutcome, len(pairs))
+	for rows.Next() {
+		var id int
+		var out sql.NullString
+		var empty sql.NullBool
+		if err := rows.Scan(&id, &out, &empty); err != nil {
+			return fmt.Errorf("bulk diff failed: %w", err)
+		}
+		o := &bulkOutcome{}
+		if out.Valid {
+			o.output, _ = jdsql.DecodeResult(out.String)
+			if empty.Valid && !empty.Bool {
+				o.exit = 1
+			}
+		}
+		outcomes[id] = o
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("bulk diff failed: %w", queryTimeouts.describe(err))
+	}
+	roundTrip := time.Since(start)
+	for id, p := range pairs {
+		o := outcomes[id]
+		if o == nil {
+			return fmt.Errorf("bulk diff failed: no result for %s", cases[p.index].Name)
+		}
+		// The round trip is that of the whole statement
+		o.trace = &execTrace{SQL: renderSQL(bulkDiffQuery), Rows: 1, RoundTrip: roundTrip, Attempts: 1}
+	}
+	for id, p := range pairs {
+		inv := p.inv
+		c := &cases[p.index]
+		c.prepare = func() (invocation, error) { return inv, nil }
+		c.bulk = outcomes[id]
+	}
+	return nil
+}
+
+// bulkEligible reports whether inv is a plain diff that runBulk can compute: one whose
+// inputs and options parse, so that no pair can fail the whole statement.
+func bulkEligible(inv invocation) bool {
+	if inv.mode() != "diff" || inv.At != nil || inv.QueryA != "" || inv.QueryB != "" || diffTemplate != "" ||
+		!jdsql.KnownFormat(inv.Format) {
+		return false
+	}
+	for _, doc := range [][]byte{inv.A, inv.B} {
+		if len(bytes.TrimSpace(doc)) > 0 && !json.Valid(doc) {
+			return false
+		}
+	}
+	if len(inv.Options) > 0 {
+		var opts []any
+		if json.Unmarshal(inv.Options, &opts) != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// resultCache stores the results of batch and spec cases by the content of their inputs
+// (--cache), so that a run over fixture pairs that did not change since the last run
+// reuses their results instead of diffing them again. It is nil without --cache.
+var resultCache *caseCache
+
+// caseCache is a directory of results, one file per key. Keys hash the scope, which
+// identifies the engine and the installed functions, with the statement of the case
+// and the SHA-256 of each of its parameters: the documents, the options and the format.
+type caseCache struct {
+	dir    string
+	scope  string
+	hits   atomic.Int64
+	stored atomic.Int64
+}
+
+// cachedResult is the content of a cache file.
+type cachedResult struct {
+	Output string `json:"output"`
+	Exit   int    `json:"exit"`
+}
+
+// installedFunctionsSQL digests the definitions of the installed jd-sql functions, so
+// that reinstalling or changing them invalidates the cached results.
+const installedFunctionsSQL = `select coalesce(md5(string_agg(p.oid::regprocedure::text || E'\n' || p.prosrc, E'\n'
+    order by p.oid::regprocedure::text)), '')
+from pg_proc p
+where p.proname like $1`
+
+// openCaseCache opens the cache directory dir for the cases run on db with cfg. The
+// scope of the keys is the engine, the naming and implementation of the functions, the
+// collation and merge null policy, the --json-type and the digest of the installed functions.
+func openCaseCache(ctx context.Context, db rowQuerier, cfg Config, dir string) (*caseCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %s: %w", dir, err)
+	}
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(cfg.FunctionPrefix+"jd_") + "%"
+	var functions string
+	if err := db.QueryRowContext(ctx, installedFunctionsSQL, pattern).Scan(&functions); err != nil {
+		return nil, fmt.Errorf("failed to read the installed functions for --cache: %w", err)
+	}
+	if functions == "" {
+		return nil, errors.New("--cache: no jd-sql functions are installed")
+	}
+	scope, _ := json.Marshal([]string{
+		cfg.Engine, cfg.implementation(), cfg.implementationSchema(), cfg.FunctionPrefix, cfg.Collation, strings.ToLower(cfg.MergeNullPolicy), jsonDocType, functions,
+	})
+	return &caseCache{dir: dir, scope: string(scope)}, nil
+}
+
+// key returns the cache key of inv, or "" when its result depends on more than its
+// inputs: query mode reads the documents from the database.
+func (c *caseCache) key(inv invocation) string {
+	if inv.QueryA != "" || inv.QueryB != "" {
+		return ""
+	}
+	sqlText, params := inv.query()
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", c.scope, sqlText)
+	for _, p := range params {
+		b, _ := json.Marshal(p)
+		sum := sha256.Sum256(b)
+		h.Write(sum[:])
+	}
+	// The output is stored as redacted and checked by --merge-strict
+	redact, _ := json.Marshal(inv.Redact)
+	fmt.Fprintf(h, "%s\x00%t", redact, inv.MergeStrict)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *caseCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// lookup returns the cached result of inv.
+func (c *caseCache) lookup(inv invocation) (string, int, bool) {
+	if c == nil {
+		return "", 0, false
+	}
+	key := c.key(inv)
+	if key == "" {
+		return "", 0, false
+	}
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return "", 0, false
+	}
+	var r cachedResult
+	if json.Unmarshal(b, &r) != nil {
+		return "", 0, false
+	}
+	c.hits.Add(1)
+	return r.Output, r.Exit, true
+}
+
+// store caches the result of inv. Errors are not cached, so they are retried by the
+// next run; a failure to write the cache is only logged.
+func (c *caseCache) store(inv invocation, output string, exit int, err error) {
+	if c == nil || err != nil {
+		return
+	}
+	key := c.key(inv)
+	if key == "" {
+		return
+	}
+	c.stored.Add(1)
+	b, _ := json.Marshal(cachedResult{Output: output, Exit: exit})
+	if err := c.write(c.path(key), b); err != nil {
+		logger.Warn("failed to cache result", "error", err)
+	}
+}
+
+// write writes a cache file through a temporary file, so that concurrent cases and
+// runs never read a partial result.
+func (c *caseCache) write(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
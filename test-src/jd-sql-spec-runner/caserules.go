@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// caseRule selects cases by a glob on the case name and/or its tags. In globs, * matches
+// any run of characters (including /) and ? a single character.
+type caseRule struct {
+	Name   string `yaml:"name"`
+	Tag    string `yaml:"tag"`
+	Reason string `yaml:"reason"`
+}
+
+func (r caseRule) matches(c testCase) bool {
+	if r.Name == "" && r.Tag == "" {
+		return false
+	}
+	if r.Name != "" && !globMatch(r.Name, c.Name) {
+		return false
+	}
+	if r.Tag != "" {
+		for _, t := range c.Tags {
+			if globMatch(r.Tag, t) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (r caseRule) describe() string {
+	if r.Reason != "" {
+		return r.Reason
+	}
+	var sel []string
+	if r.Name != "" {
+		sel = append(sel, "name "+r.Name)
+	}
+	if r.Tag != "" {
+		sel = append(sel, "tag "+r.Tag)
+	}
+	return "matched " + strings.Join(sel, ", ")
+}
+
+func globMatch(pattern, s string) bool {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String()).MatchString(s)
+}
+
+// applyCaseRules marks cases matched by the config's skips and xfail sections. A case
+// that is skipped is never run, so skips take precedence over xfail.
+func applyCaseRules(cfg Config, cases []testCase) {
+	for i := range cases {
+		c := &cases[i]
+		for _, r := range cfg.XFail {
+			if r.matches(*c) {
+				c.XFail = r.describe()
+				break
+			}
+		}
+		if c.Skip != "" {
+			continue
+		}
+		for _, r := range cfg.Skips {
+			if r.matches(*c) {
+				c.Skip = r.describe()
+				break
+			}
+		}
+	}
+}
+
+// caseFilter selects the cases of a batch or spec run with --case (globs on the case
+// name), --include-tags and --exclude-tags (comma separated globs on the case tags).
+// Cases it leaves out are not run nor reported, unlike skipped cases.
+type caseFilter struct {
+	Names   []string
+	Include []string
+	Exclude []string
+}
+
+// flagCaseFilter returns the filter set by the --case, --include-tags and --exclude-tags
+// flags, which may be repeated.
+func flagCaseFilter(flags cliFlags) caseFilter {
+	split := func(name string) []string {
+		var globs []string
+		for _, v := range flags.values(name) {
+			for _, g := range strings.Split(v, ",") {
+				if g = strings.TrimSpace(g); g != "" {
+					globs = append(globs, g)
+				}
+			}
+		}
+		return globs
+	}
+	return caseFilter{Names: flags.values("case"), Include: split("include-tags"), Exclude: split("exclude-tags")}
+}
+
+func (f caseFilter) empty() bool {
+	return len(f.Names) == 0 && len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// anyTag reports whether a tag of c matches one of globs.
+func anyTag(globs []string, c testCase) bool {
+	for _, g := range globs {
+		for _, t := range c.Tags {
+			if globMatch(g, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f caseFilter) matches(c testCase) bool {
+	if len(f.Names) > 0 && !slices.ContainsFunc(f.Names, func(g string) bool { return globMatch(g, c.Name) }) {
+		return false
+	}
+	if len(f.Include) > 0 && !anyTag(f.Include, c) {
+		return false
+	}
+	return !anyTag(f.Exclude, c)
+}
+
+// filterCases returns the cases selected by the --case and tag flags. A filter that
+// leaves no case is an error, so that a mistyped name does not pass as an empty run.
+func filterCases(flags cliFlags, cases []testCase) ([]testCase, error) {
+	f := flagCaseFilter(flags)
+	if f.empty() {
+		return cases, nil
+	}
+	var selected []testCase
+	for _, c := range cases {
+		if f.matches(c) {
+			selected = append(selected, c)
+		}
+	}
+	if len(selected) == 0 && len(cases) > 0 {
+		return nil, errors.New("no case matches --case, --include-tags and --exclude-tags")
+	}
+	logger.Debug("selected cases", "selected", len(selected), "total", len(cases))
+	return selected, nil
+}
+
+// validateCaseFilter rejects the case selection flags outside batch and spec runs.
+func validateCaseFilter(args cliArgs) error {
+	if !flagCaseFilter(args.Flags).empty() && args.Manifest == "" && args.Spec == "" {
+		return errors.New("--case, --include-tags and --exclude-tags are only supported in batch and spec modes")
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+func registerCDCFlags(fs *flag.FlagSet) {
+	fs.String("slot", "", "logical replication slot to consume (wal2json output plugin)")
+	fs.Bool("create-slot", false, "create the slot with wal2json if it does not exist")
+	fs.Var(new(repeatedFlag), "column", "JSON column to diff, as [schema.]table.column (repeatable)")
+	fs.String("webhook", "", "POST each change to this URL instead of printing it")
+	fs.String("poll", "1s", "interval between reads of the slot when it has no changes")
+	fs.String("batch", "1000", "most changes read from the slot at a time")
+	fs.String("f", "", "format of the diffs: jd|jd2|patch|merge")
+	fs.String("format", "", "format of the diffs (same as -f)")
+	registerOptionFlags(fs)
+	registerSinkFlags(fs)
+}
+
+// cdcColumn is a --column of cdc mode.
+type cdcColumn struct {
+	Schema, Table, Column string
+}
+
+// parseCDCColumn parses [schema.]table.column; the schema defaults to public.
+func parseCDCColumn(v string) (cdcColumn, error) {
+	parts := strings.Split(v, ".")
+	switch len(parts) {
+	case 2:
+		return cdcColumn{"public", parts[0], parts[1]}, nil
+	case 3:
+		return cdcColumn{parts[0], parts[1], parts[2]}, nil
+	}
+	return cdcColumn{}, fmt.Errorf("invalid --column value '%s' (expected [schema.]table.column)", v)
+}
+
+// wal2jsonChange is a change in the format-version 2 output of wal2json. Values are
+// JSON, with those of json and jsonb columns as strings of their text.
+type wal2jsonChange struct {
+	Action   string          `json:"action"`
+	Schema   string          `json:"schema"`
+	Table    string          `json:"table"`
+	Columns  []wal2jsonValue `json:"columns"`
+	Identity []wal2jsonValue `json:"identity"`
+	PK       []struct {
+		Name string `json:"name"`
+	} `json:"pk"`
+}
+
+type wal2jsonValue struct {
+	Name  string          `json:"name"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// document returns the value as the text of a JSON document: json and jsonb values are
+// strings of the document text.
+func (v wal2jsonValue) document() []byte {
+	var s string
+	if (v.Type == "json" || v.Type == "jsonb") && json.Unmarshal(v.Value, &s) == nil {
+		return []byte(s)
+	}
+	return v.Value
+}
+
+func findWal2jsonValue(values []wal2jsonValue, name string) (wal2jsonValue, bool) {
+	for _, v := range values {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return wal2jsonValue{}, false
+}
+
+// cdcEvent is a change emitted by cdc mode: the diff of the old and new value of a
+// column of an updated row.
+type cdcEvent struct {
+	LSN    string          `json:"lsn"`
+	Schema string          `json:"schema"`
+	Table  string          `json:"table"`
+	Column string          `json:"column"`
+	Key    json.RawMessage `json:"key"`
+	Diff   json.RawMessage `json:"diff"`
+}
+
+// cdcPeekSQL reads the pending changes of the slot in wal2json format-version 2,
+// restricted to the tables of the columns. Peeking leaves them in the slot until
+// cdcAdvanceSQL confirms them, so changes read by a runner that stops before emitting
+// them are read again.
+const cdcPeekSQL = `select lsn::text, data from pg_logical_slot_peek_changes($1, NULL, $2,
+    'format-version', '2', 'include-pk', 'true', 'include-transaction', 'false', 'add-tables', $3)`
+
+const cdcAdvanceSQL = `select pg_replication_slot_advance($1, $2::pg_lsn)`
+
+// runCDC consumes the logical replication slot of --slot, and for every UPDATE of a
+// row of the tables of the --column flags writes the diff of the old and new value of
+// each column that changed, as an NDJSON line on stdout or a POST to --webhook. It runs
+// until interrupted.
+//
+// The slot is read with the SQL functions of logical decoding, which lib/pq supports,
+// rather than the streaming replication protocol; the wal2json plugin produces the
+// text output they need. The old values come from the replica identity, so the tables
+// need REPLICA IDENTITY FULL.
+func runCDC(flags cliFlags, cfg Config) (int, error) {
+	slot := flags.value("slot")
+	if slot == "" {
+		return 2, errors.New("cdc requires --slot (a logical replication slot using wal2json)")
+	}
+	var columns []cdcColumn
+	for _, v := range flags.values("column") {
+		c, err := parseCDCColumn(v)
+		if err != nil {
+			return 2, err
+		}
+		columns = append(columns, c)
+	}
+	if len(columns) == 0 {
+		return 2, errors.New("cdc requires --column ([schema.]table.column of a JSON column to diff)")
+	}
+	poll, err := time.ParseDuration(coalesceNonEmpty(flags.value("poll"), "1s"))
+	if err != nil || poll <= 0 {
+		return 2, fmt.Errorf("invalid --poll value '%s' (expected a positive duration, e.g. 1s)", flags.value("poll"))
+	}
+	batch, err := strconv.Atoi(coalesceNonEmpty(flags.value("batch"), "1000"))
+	if err != nil || batch <= 0 {
+		return 2, fmt.Errorf("invalid --batch value '%s' (expected a positive integer)", flags.value("batch"))
+	}
+	if flagPathsFormat(flags) != "" {
+		return 2, errors.New("cdc emits diffs: -f paths is not supported")
+	}
+	webhook := flags.value("webhook")
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	if flags.enabled("create-slot") {
+		if err := createCDCSlot(db, slot); err != nil {
+			return 2, err
+		}
+	}
+
+	var tables []string
+	for _, c := range columns {
+		if t := quoteWal2jsonTable(c); !contains(tables, t) {
+			tables = append(tables, t)
+		}
+	}
+	inv := flagInvocation(flags, nil, nil)
+	warned := map[string]bool{}
+	for {
+		n, err := readCDCChanges(db, slot, batch, strings.Join(tables, ","), func(lsn string, ch wal2jsonChange) error {
+			for _, c := range columns {
+				if ch.Schema != c.Schema || ch.Table != c.Table {
+					continue
+				}
+				newValue, ok := findWal2jsonValue(ch.Columns, c.Column)
+				if !ok {
+					// An unchanged TOASTed value is not in the change
+					continue
+				}
+				oldValue, ok := findWal2jsonValue(ch.Identity, c.Column)
+				if !ok {
+					if !warned[c.Table] {
+						warned[c.Table] = true
+						logger.Warn("old value not in the change; set REPLICA IDENTITY FULL on the table",
+							"table", c.Schema+"."+c.Table)
+					}
+					continue
+				}
+				inv.A, inv.B = oldValue.document(), newValue.document()
+				inv.Options = flagOptions(flags, inv.A, inv.B)
+				out, code, err := execInvocation(db, inv)
+				if err != nil {
+					return fmt.Errorf("%s %s.%s.%s: %w", lsn, c.Schema, c.Table, c.Column, err)
+				}
+				if code == 0 {
+					continue
+				}
+				ev := cdcEvent{LSN: lsn, Schema: c.Schema, Table: c.Table, Column: c.Column, Key: cdcKey(ch), Diff: json.RawMessage(out)}
+				if jdsql.IsJdText(inv.Format) {
+					ev.Diff, _ = json.Marshal(out)
+				}
+				if err := emitCDCEvent(webhook, ev); err != nil {
+					return err
+				}
+				if err := eventSinks.publish("cdc", ev); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if stopped() != nil {
+				return 0, nil
+			}
+			return 2, err
+		}
+		if n >= batch {
+			// More changes may be pending
+			continue
+		}
+		select {
+		case <-baseContext.Done():
+			return 0, nil
+		case <-time.After(poll):
+		}
+	}
+}
+
+// createCDCSlot creates slot with the wal2json plugin unless it exists.
+func createCDCSlot(db *sql.DB, slot string) error {
+	var exists bool
+	if err := db.QueryRowContext(baseContext, "select exists (select from pg_replication_slots where slot_name = $1)", slot).
+		Scan(&exists); err != nil {
+		return fmt.Errorf("failed to read the replication slots: %w", err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := db.ExecContext(baseContext, "select pg_create_logical_replication_slot($1, 'wal2json')", slot); err != nil {
+		return fmt.Errorf("failed to create replication slot %s: %w", slot, err)
+	}
+	logger.Info("created replication slot", "slot", slot)
+	return nil
+}
+
+// readCDCChanges peeks at most limit changes of slot for tables, calls fn with each
+// UPDATE, and then advances the slot past the changes read. It returns the number of
+// changes read.
+func readCDCChanges(db *sql.DB, slot string, limit int, tables string, fn func(lsn string, ch wal2jsonChange) error) (int, error) {
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, cdcPeekSQL, slot, limit, tables)
+	if err != nil {
+		return 0, queryTimeouts.describe(fmt.Errorf("failed to read replication slot %s: %w", slot, err))
+	}
+	type change struct {
+		lsn, data string
+	}
+	var changes []change
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.lsn, &c.data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, queryTimeouts.describe(fmt.Errorf("failed to read replication slot %s: %w", slot, err))
+	}
+
+	for _, c := range changes {
+		var ch wal2jsonChange
+		if err := json.Unmarshal([]byte(c.data), &ch); err != nil {
+			return 0, fmt.Errorf("invalid change at %s (is slot %s using wal2json?): %w", c.lsn, slot, err)
+		}
+		if ch.Action != "U" {
+			continue
+		}
+		if err := fn(c.lsn, ch); err != nil {
+			return 0, err
+		}
+	}
+	if len(changes) > 0 {
+		last := changes[len(changes)-1].lsn
+		if _, err := db.ExecContext(context.WithoutCancel(ctx), cdcAdvanceSQL, slot, last); err != nil {
+			return 0, fmt.Errorf("failed to advance replication slot %s to %s: %w", slot, last, err)
+		}
+	}
+	return len(changes), nil
+}
+
+// quoteWal2jsonTable returns the table of c as the add-tables option of wal2json
+// takes it, with its separators and special characters escaped.
+func quoteWal2jsonTable(c cdcColumn) string {
+	esc := strings.NewReplacer(`\`, `\\`, ",", `\,`, ".", `\.`, " ", `\ `, "*", `\*`)
+	return esc.Replace(c.Schema) + "." + esc.Replace(c.Table)
+}
+
+// cdcKey returns the primary key of the row of ch as a JSON object, or null for a table
+// without one.
+func cdcKey(ch wal2jsonChange) json.RawMessage {
+	if len(ch.PK) == 0 {
+		return json.RawMessage("null")
+	}
+	key := map[string]json.RawMessage{}
+	for _, pk := range ch.PK {
+		if v, ok := findWal2jsonValue(ch.Columns, pk.Name); ok {
+			key[pk.Name] = v.Value
+		}
+	}
+	b, _ := json.Marshal(key)
+	return b
+}
+
+// emitCDCEvent writes ev as an NDJSON line to stdout, or POSTs it to webhook. A webhook
+// that does not answer with a 2xx status stops the run, leaving the change in the slot.
+func emitCDCEvent(webhook string, ev cdcEvent) error {
+	b, _ := json.Marshal(ev)
+	if webhook == "" {
+		_, err := fmt.Fprintf(os.Stdout, "%s\n", b)
+		return err
+	}
+	ctx, cancel := context.WithTimeout(baseContext, defaultFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("invalid --webhook: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post change %s to webhook: %w", ev.LSN, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to post change %s to webhook: %s", ev.LSN, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// patchChainFlags are the flags of a single patch that a patch chain does not support.
+var patchChainFlags = []string{
+	"report", "watch", "stream", "ndjson", "chunk", "oracle", "validate-local", "dry-run", "engines", "merge-strict", "invert",
+}
+
+// validatePatchChain rejects the flags a patch chain does not support.
+func validatePatchChain(flags cliFlags, impls []string) error {
+	for _, name := range patchChainFlags {
+		if flags.enabled(name) {
+			return fmt.Errorf("--%s is not supported with a patch chain", name)
+		}
+	}
+	if len(impls) > 1 {
+		return errors.New("--impl with several implementations is not supported with a patch chain")
+	}
+	return nil
+}
+
+// runPatchChain applies the patch files in order to the document in docFile and prints
+// the final document. The chain is one statement (see jdsql.PatchChainQuery), so it
+// applies as a whole or not at all. When it fails, the prefixes of the chain are applied
+// one by one to find the first patch that does not apply, which the error names.
+func runPatchChain(flags cliFlags, cfg Config, docFile string, patchFiles []string) (int, error) {
+	doc, err := readInput(docFile)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read input file: %s: %w", docFile, err)
+	}
+	inv := flagInvocation(flags, nil, doc)
+	for _, f := range patchFiles {
+		patch, err := readInput(f)
+		if err != nil {
+			return 2, fmt.Errorf("failed to read patch file: %s: %w", f, err)
+		}
+		// --from auto detects the format of each patch
+		inv.Chain = append(inv.Chain, patch)
+		inv.ChainFormats = append(inv.ChainFormats, flagInvocation(flags, patch, nil).Format)
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	out, code, err := execInvocation(db, inv)
+	if err == nil {
+		if err := writeOutput(inv, out); err != nil {
+			return 2, err
+		}
+		return code, nil
+	}
+	if exitCode(err) != exitError {
+		// Not a patch that failed to apply
+		return code, err
+	}
+	for n := 1; n < len(inv.Chain); n++ {
+		prefix := inv
+		prefix.Chain, prefix.ChainFormats = inv.Chain[:n], inv.ChainFormats[:n]
+		if _, _, perr := execInvocation(db, prefix); perr != nil {
+			return code, fmt.Errorf("patch %d of %d (%s) failed: %w", n, len(patchFiles), patchFiles[n-1], perr)
+		}
+	}
+	return code, fmt.Errorf("patch %d of %d (%s) failed: %w", len(patchFiles), len(patchFiles), patchFiles[len(patchFiles)-1], err)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// checkpointHeader is the first line of a checkpoint file. Digest identifies the case
+// list, so a checkpoint is not resumed against a manifest or spec that changed.
+type checkpointHeader struct {
+	Kind   string `json:"kind"`
+	Cases  int    `json:"cases"`
+	Digest string `json:"digest"`
+}
+
+// checkpointEntry is the recorded result of a case, one line per case in case order.
+type checkpointEntry struct {
+	Case       string `json:"case"`
+	Status     string `json:"status"`
+	Exit       int    `json:"exit"`
+	Output     string `json:"output,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Message    string `json:"message,omitempty"`
+	DurationNS int64  `json:"duration_ns"`
+}
+
+// checkpoint appends the results of a batch or spec run to the --checkpoint file as they
+// are emitted, so that --resume can continue an interrupted run after the last case
+// recorded. Results are emitted in case order, so the file always holds a prefix of the
+// run.
+type checkpoint struct {
+	f    *os.File
+	path string
+	err  error
+	// stop is set once a result is not recorded; recording the later ones would leave
+	// a gap in the prefix.
+	stop bool
+}
+
+// caseListDigest returns the SHA-256 of the names and sources of cases.
+func caseListDigest(cases []testCase) string {
+	h := sha256.New()
+	for _, c := range cases {
+		fmt.Fprintf(h, "%s\x00%s\x00", c.Name, c.Source)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// openCheckpoint opens the checkpoint file at path for a run of cases. With resume, the
+// results recorded by an earlier run of the same cases are returned and new results are
+// appended after them; a missing file starts the run from the first case. Without
+// resume the file is started over.
+func openCheckpoint(path, kind string, cases []testCase, resume bool) (*checkpoint, []caseResult, error) {
+	header := checkpointHeader{Kind: kind, Cases: len(cases), Digest: caseListDigest(cases)}
+	if resume {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			restored, size, err := readCheckpoint(f, header, cases)
+			if err == nil {
+				// A line cut short by the interruption is dropped
+				err = f.Truncate(size)
+			}
+			if err == nil {
+				_, err = f.Seek(size, io.SeekStart)
+			}
+			if err != nil {
+				f.Close()
+				return nil, nil, fmt.Errorf("failed to resume from checkpoint: %s: %w", path, err)
+			}
+			return &checkpoint{f: f, path: path}, restored, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, fmt.Errorf("failed to resume from checkpoint: %s: %w", path, err)
+		}
+		logger.Info("no checkpoint to resume from, starting with the first case", "checkpoint", path)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create checkpoint file: %s: %w", path, err)
+	}
+	cp := &checkpoint{f: f, path: path}
+	cp.writeLine(header)
+	if cp.err != nil {
+		f.Close()
+		return nil, nil, cp.err
+	}
+	return cp, nil, nil
+}
+
+// readCheckpoint returns the results recorded in f for cases and the size of the
+// complete lines holding them.
+func readCheckpoint(f *os.File, header checkpointHeader, cases []testCase) ([]caseResult, int64, error) {
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	var got checkpointHeader
+	if err != nil || json.Unmarshal(line, &got) != nil {
+		return nil, 0, errors.New("not a checkpoint file")
+	}
+	if got != header {
+		return nil, 0, fmt.Errorf("recorded for a different list of %s cases; remove it or run without --resume", got.Kind)
+	}
+	size := int64(len(line))
+	var restored []caseResult
+	for len(restored) < len(cases) {
+		line, err := r.ReadBytes('\n')
+		var e checkpointEntry
+		if err != nil || json.Unmarshal(bytes.TrimSpace(line), &e) != nil || e.Case != cases[len(restored)].Name {
+			break
+		}
+		res := caseResult{
+			Case:     cases[len(restored)],
+			Status:   caseStatus(e.Status),
+			Output:   e.Output,
+			Exit:     e.Exit,
+			Message:  e.Message,
+			Duration: time.Duration(e.DurationNS),
+		}
+		if e.Error != "" {
+			res.Err = errors.New(e.Error)
+		}
+		restored = append(restored, res)
+		size += int64(len(line))
+	}
+	return restored, size, nil
+}
+
+// record appends res to the checkpoint. Once the run is stopped, a case loses the
+// database or a case is halted by --max-failures, nothing more is recorded: the cases
+// that were interrupted, failed to connect or did not start run again on --resume.
+func (cp *checkpoint) record(res caseResult) {
+	if cp == nil || cp.stop || cp.err != nil {
+		return
+	}
+	if stopped() != nil || res.Halted || res.Err != nil && exitCode(res.Err) == exitConnection {
+		cp.stop = true
+		return
+	}
+	e := checkpointEntry{
+		Case:       res.Case.Name,
+		Status:     string(res.Status),
+		Exit:       res.Exit,
+		Output:     res.Output,
+		Message:    res.Message,
+		DurationNS: int64(res.Duration),
+	}
+	if res.Err != nil {
+		e.Error = res.Err.Error()
+	}
+	cp.writeLine(e)
+}
+
+func (cp *checkpoint) writeLine(v any) {
+	b, err := json.Marshal(v)
+	if err == nil {
+		_, err = cp.f.Write(append(b, '\n'))
+	}
+	if err != nil {
+		cp.err = fmt.Errorf("failed to write checkpoint file: %s: %w", cp.path, err)
+	}
+}
+
+// close closes the checkpoint file and returns the first error writing it.
+func (cp *checkpoint) close() error {
+	if cp == nil {
+		return nil
+	}
+	if err := cp.f.Close(); err != nil && cp.err == nil {
+		cp.err = fmt.Errorf("failed to write checkpoint file: %s: %w", cp.path, err)
+	}
+	return cp.err
+}
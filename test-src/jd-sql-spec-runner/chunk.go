@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// Array context markers of jd_diff_struct: the start and the end of the array.
+var (
+	openMarker  = json.RawMessage(`"__OPEN__"`)
+	closeMarker = json.RawMessage(`"__CLOSE__"`)
+)
+
+// diffElement is a jd_diff_element as JSON (see jdsql.DiffElementsQuery).
+type diffElement struct {
+	Metadata json.RawMessage   `json:"metadata"`
+	Options  json.RawMessage   `json:"options"`
+	Path     []json.RawMessage `json:"path"`
+	Before   []json.RawMessage `json:"before"`
+	Remove   []json.RawMessage `json:"remove"`
+	Add      []json.RawMessage `json:"add"`
+	After    []json.RawMessage `json:"after"`
+}
+
+// flagChunk returns the --chunk size, or 0 without --chunk.
+func flagChunk(flags cliFlags) (int, error) {
+	v := flags.value("chunk")
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid --chunk value '%s' (expected a number of array elements > 0)", v)
+	}
+	return n, nil
+}
+
+// validateChunk checks that --chunk is used for a single jd or patch diff, with no
+// option comparing the top-level arrays as sets: chunks are diffed by position.
+func validateChunk(args cliArgs, inv invocation) error {
+	switch {
+	case inv.mode() != "diff" || inv.At != nil:
+		return errors.New("--chunk requires a plain diff (without -p, -t, --check, --equal, --canonicalize, --stat or --at)")
+	case args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil ||
+		args.Manifest != "" || args.Spec != "" || isDir(args.FileA) || args.FileB == "":
+		return errors.New("--chunk expects two input files")
+	case inv.Format == jdsql.FormatMerge:
+		return errors.New("--chunk is not supported with -f merge, which replaces arrays as a whole")
+	case oracle != nil:
+		return errors.New("--chunk cannot be combined with --oracle")
+	case args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.enabled("watch"):
+		return errors.New("--chunk cannot be combined with --stream, --ndjson or --watch")
+	case args.Flags.value("report") != "":
+		return errors.New("--report is not supported with --chunk")
+	}
+	var opts []any
+	if json.Unmarshal(inv.Options, &opts) == nil {
+		for _, o := range opts {
+			switch o := o.(type) {
+			case string:
+				if o == "SET" || o == "MULTISET" {
+					return errors.New("--chunk cannot be combined with -set or -mset")
+				}
+			case map[string]any:
+				if _, ok := o["setkeys"]; ok {
+					return errors.New("--chunk cannot be combined with -setkeys")
+				}
+				if _, ok := o["@"]; ok && !isDiffGate(o["^"]) {
+					return errors.New("--chunk cannot be combined with --path-opt or path_options, whose paths shift with the chunks")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// runChunked diffs fileA and fileB with --chunk: when both are arrays they are split
+// into chunks of size elements, the chunks at the same position are diffed concurrently
+// on up to jobs connections, and the hunks are stitched into one diff. Other documents
+// are diffed as usual.
+//
+// The hunks of a chunk are shifted to the position of the chunk in the document as
+// patched so far: the chunks before it already hold the elements of B. Context at the
+// chunk edges is replaced with the neighbouring elements, so the stitched diff applies
+// to the whole documents. A change that moves elements across a chunk boundary makes
+// the diff larger than that of a single jd_diff, but still correct.
+func runChunked(flags cliFlags, cfg Config, fileA, fileB string, size, jobs int) (int, error) {
+	aText, bText, err := readInputs(fileA, fileB)
+	if err != nil {
+		return 2, err
+	}
+	inv := flagInvocation(flags, aText, bText)
+	if flags.enabled("validate-local") {
+		if err := validateLocal(inv, fileA, fileB); err != nil {
+			return 2, err
+		}
+	}
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	var a, b []json.RawMessage
+	if !isJSONArray(aText) || !isJSONArray(bText) || json.Unmarshal(aText, &a) != nil || json.Unmarshal(bText, &b) != nil {
+		return printInvocation(db, inv)
+	}
+	configurePool(db, cfg, jobs)
+
+	n := (max(len(a), len(b)) + size - 1) / size
+	hunks := make([][]diffElement, n)
+	errs := make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(jobs, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range next {
+				hunks[k], errs[k] = diffChunk(db, a, b, k, size, inv.Options)
+			}
+		}()
+	}
+	for k := 0; k < n; k++ {
+		next <- k
+	}
+	close(next)
+	wg.Wait()
+	var elems []diffElement
+	for k := range hunks {
+		if errs[k] != nil {
+			return 2, fmt.Errorf("chunk %d (elements %d to %d): %w", k+1, k*size, (k+1)*size-1, errs[k])
+		}
+		elems = append(elems, hunks[k]...)
+	}
+
+	enc, err := json.Marshal(elems)
+	if err != nil {
+		return 2, err
+	}
+	if elems == nil {
+		enc = []byte("[]")
+	}
+	q, args := jdsql.RenderDiffQuery(enc, inv.Options, inv.Format)
+	var out sql.NullString
+	var empty sql.NullBool
+	if err := queryChunk(db, q, args, &out, &empty); err != nil {
+		return 2, fmt.Errorf("failed to render the chunked diff: %w", err)
+	}
+	code := 0
+	text, _ := jdsql.DecodeResult(out.String)
+	if empty.Valid && !empty.Bool {
+		code = 1
+	}
+	if err := writeOutput(inv, redactOutput(inv, text)); err != nil {
+		return 2, err
+	}
+	return code, nil
+}
+
+// diffChunk diffs chunk k of a and b and returns its hunks with paths and context
+// relative to the whole documents.
+func diffChunk(db *sql.DB, a, b []json.RawMessage, k, size int, options []byte) ([]diffElement, error) {
+	ca, cb := chunkOf(a, k, size), chunkOf(b, k, size)
+	docA, _ := json.Marshal(ca)
+	docB, _ := json.Marshal(cb)
+	q, args := jdsql.DiffElementsQuery(docA, docB, options)
+	var raw []byte
+	if err := queryChunk(db, q, args, &raw); err != nil {
+		return nil, err
+	}
+	var elems []diffElement
+	if err := json.Unmarshal(raw, &elems); err != nil {
+		return nil, fmt.Errorf("invalid diff elements: %w", err)
+	}
+	// The chunks before k have been patched into the elements of b
+	offset := min(k*size, len(b))
+	for i := range elems {
+		e := &elems[i]
+		if len(e.Path) == 0 {
+			continue
+		}
+		idx, err := strconv.Atoi(string(e.Path[0]))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected diff path %s", e.Path[0])
+		}
+		e.Path = append([]json.RawMessage{json.RawMessage(strconv.Itoa(offset + idx))}, e.Path[1:]...)
+		if len(e.Path) > 1 {
+			continue
+		}
+		if len(e.Before) == 1 && bytes.Equal(e.Before[0], openMarker) && offset > 0 {
+			e.Before = []json.RawMessage{b[offset-1]}
+		}
+		if end := min((k+1)*size, len(a)); len(e.After) == 1 && bytes.Equal(e.After[0], closeMarker) && end < len(a) {
+			e.After = []json.RawMessage{a[end]}
+		}
+	}
+	return elems, nil
+}
+
+// isJSONArray reports whether doc is a JSON array, judging by its first character.
+func isJSONArray(doc []byte) bool {
+	doc = bytes.TrimSpace(doc)
+	return len(doc) > 0 && doc[0] == '['
+}
+
+// chunkOf returns chunk k of elements, empty past their end.
+func chunkOf(elements []json.RawMessage, k, size int) []json.RawMessage {
+	start := min(k*size, len(elements))
+	return elements[start:min(start+size, len(elements))]
+}
+
+// queryChunk runs q, scanning its single row into dest, within the query timeouts.
+func queryChunk(db *sql.DB, q string, args []any, dest ...any) error {
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	var rq rowQuerier = db
+	if t := queryTimeouts.statement(); t > 0 {
+		tx, err := beginWithStatementTimeout(ctx, db, t)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		rq = tx
+	}
+	return queryTimeouts.describe(rq.QueryRowContext(ctx, renderSQL(q), args...).Scan(dest...))
+}
+
+// isDiffGate reports whether the directives of a jd PathOption only turn diffing on or
+// off (DIFF_ON, DIFF_OFF), as those of --ignore.
+func isDiffGate(directives any) bool {
+	ds, _ := directives.([]any)
+	for _, d := range ds {
+		if d != "DIFF_ON" && d != "DIFF_OFF" {
+			return false
+		}
+	}
+	return true
+}
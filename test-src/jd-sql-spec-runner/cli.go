@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// command is a subcommand, given as the first argument. Without one, diff runs.
+type command struct {
+	name string
+	// args describes the positional arguments in the usage line.
+	args    string
+	summary string
+	// flags registers the command's flags besides the common ones.
+	flags func(fs *flag.FlagSet)
+}
+
+var commands = []command{
+	{"diff", "[flags] <a.json> <b.json>", "diff two documents (the default command)", registerDiffFlags},
+	{"patch", "[flags] <diff> <doc.json> | <doc.json> <diff>...", "apply a diff, or a chain of diffs in order, to a document (diff -p)", registerDiffFlags},
+	{"translate", "--from <in> --to <out> [flags] [<diff>|-]", "translate a diff between formats (diff -t)", registerTranslateFlags},
+	{"install", "[flags]", "install the packaged jd-sql SQL into the configured database", func(fs *flag.FlagSet) {
+		fs.String("version", "", "packaged jd-sql version to install (default: latest)")
+	}},
+	{"uninstall", "[--cascade] [flags]", "drop the jd-sql functions, types and jd_sql_meta from the configured database", func(fs *flag.FlagSet) {
+		fs.Bool("cascade", false, "also drop the objects that use jd-sql, such as views, columns and triggers")
+	}},
+	{"doctor", "[flags]", "check the server settings and the installed jd-sql surface", func(*flag.FlagSet) {}},
+	{"dump", "[--dir <dir>] [--diff] [flags]", "write the source of the installed jd-sql functions and types to files, or diff it with the packaged SQL", func(fs *flag.FlagSet) {
+		fs.String("dir", "", "directory to write the dump to (default "+dumpDir+"; with --diff, none)")
+		fs.Bool("diff", false, "compare the installed functions and types with the packaged SQL; exit 1 if they differ")
+		fs.String("version", "", "packaged jd-sql version to compare with (default: latest)")
+	}},
+	{"selftest", "[flags]", "run an embedded corpus of canonical cases against the configured database", func(*flag.FlagSet) {}},
+	{"bench", "[flags] [<a.json> <b.json>]", "measure the latency of a diff", func(fs *flag.FlagSet) {
+		registerSharedFlags(fs)
+		registerBenchFlags(fs)
+	}},
+	{"fuzz", "[flags] [<a.json> <b.json>]", "check diff/patch round trips on generated documents", func(fs *flag.FlagSet) {
+		registerSharedFlags(fs)
+		registerFuzzFlags(fs)
+	}},
+	{"serve", "[flags]", "serve diff, patch and translate as a REST API", func(fs *flag.FlagSet) {
+		fs.String("listen", ":8080", "address to serve the REST API on")
+	}},
+	{"daemon", "[--socket <path>] [flags]", "keep a warm connection pool for the diff, patch and translate runs of other invocations (--daemon)", func(fs *flag.FlagSet) {
+		fs.String("socket", "", "unix socket to accept runs on (default: jdsql.sock in $XDG_RUNTIME_DIR or a private temporary directory)")
+	}},
+	{"merge3", "[flags] <base.json> <ours.json> <theirs.json>", "merge two documents changed from a common base", registerOptionFlags},
+	{"hash", "[flags] <doc.json>", "print the canonical hash of a document, or compare two tables by hash", registerTableFlags},
+	{"gen-trigger", "--table <t> --column <c> --key <k> [flags]", "generate (or --install) a trigger recording the jd diff of a JSON column on every update", registerGenTriggerFlags},
+	{"cdc", "--slot <slot> --column <table.column>... [flags]", "emit the diff of every update of JSON columns read from a logical replication slot", registerCDCFlags},
+	{"snapshot", "--table <t> --column <c> --key <k> [flags]", "write the keyed JSON values of a table to a snapshot file", registerSnapshotFlags},
+	{"drift", "[flags] <snapshot>", "diff the live rows of a table with a snapshot, by key", registerDriftFlags},
+	{"sync-spec", "[flags]", "convert the upstream jd spec cases at a pinned version into spec case files", registerSyncSpecFlags},
+	{"completion", "bash|zsh|fish|powershell", "write a shell completion script", func(*flag.FlagSet) {}},
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// newFlagSet returns the flag set of cmd. Parse errors are returned, not printed; see
+// parseFlags.
+func newFlagSet(cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+	registerCommonFlags(fs)
+	cmd.flags(fs)
+	return fs
+}
+
+// registerCommonFlags registers the flags that every command accepts.
+func registerCommonFlags(fs *flag.FlagSet) {
+	fs.String("c", "", "config file (default: jd-sql-spec.yaml in the working directory or next to the binary)")
+	fs.String("config", "", "config file (same as -c)")
+	fs.String("profile", "", "use the named profile of the config file")
+	fs.String("engines", "", "run against the named config engines (comma list or all) and compare")
+	fs.String("impl", "", "jd-sql implementation: plpgsql|plv8, or a comma list (or all) to compare (overrides implementation)")
+	fs.String("collation", "", "collation the elements of sets are ordered with, e.g. C (overrides collation)")
+	fs.String("merge-null-policy", "", "what merge patches do with values set to null: keep|error|drop|sentinel (overrides merge_null_policy)")
+	fs.String("json-type", "", "SQL type the documents are parsed as: json|jsonb (default jsonb)")
+	fs.Bool("ephemeral", false, "run against a disposable Postgres container")
+	fs.String("connect-timeout", "", "timeout establishing each connection, e.g. 5s (overrides timeouts.connect, default 10s)")
+	fs.String("query-timeout", "", "per-query timeout, e.g. 30s (overrides timeouts.query)")
+	fs.String("timeout", "", "per-query timeout (same as --query-timeout)")
+	fs.String("total-timeout", "", "timeout of the whole run, e.g. 10m (overrides timeouts.total)")
+	fs.Bool("v", false, "log the SQL, parameters, round trip and result type of each query (--log-level debug)")
+	fs.Bool("verbose", false, "log the SQL, parameters, round trip and result type of each query (same as -v)")
+	fs.String("log-level", "", "lowest level of the logs on stderr: debug|info|warn|error (default info)")
+	fs.String("log-format", "", "format of the logs on stderr: text|json (default text)")
+	fs.String("o", "", "write the result to this file (atomically) instead of stdout")
+	fs.String("output", "", "write the result to this file (same as -o)")
+	fs.String("compress", "", "compress the result written to stdout or -o: gzip|zstd")
+	fs.String("newline", "", "line ends of the result written to stdout or -o: lf|crlf|native (default lf)")
+	fs.String("record", "", "write the SQL traffic of the run (statements, parameters and results) to this JSON trace")
+	fs.String("replay", "", "answer the statements of the run from a --record trace instead of a database")
+	fs.Bool("q", false, "print nothing on stdout; report only through the exit code")
+	fs.Bool("quiet", false, "print nothing on stdout (same as -q)")
+}
+
+// parseFlags parses args with fs, allowing flags after positional arguments as the
+// runner always has (jd-sql-spec-runner a.json b.json -f patch). Everything after "--"
+// is positional. Unknown flags and missing values are errors.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return pos, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(pos, rest...), nil
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+}
+
+// checkOptionalValues rejects a value given apart from a flag that only takes it as
+// --name=value, as in --progress plain: fs takes plain for an input file, silently.
+func checkOptionalValues(fs *flag.FlagSet, args []string) error {
+	for i := 0; i < len(args)-1; i++ {
+		a := args[i]
+		if a == "--" {
+			return nil
+		}
+		if len(a) < 2 || a[0] != '-' || strings.Contains(a, "=") {
+			continue
+		}
+		name := strings.TrimPrefix(a[1:], "-")
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+		if ov, ok := f.Value.(*optionalValueFlag); ok && contains(ov.values, args[i+1]) {
+			return fmt.Errorf("ambiguous argument '%s' after --%s: write --%s=%s, or put it before the flag if it is an input file",
+				args[i+1], name, name, args[i+1])
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+			// Skip the value, which parseFlags has checked is there
+			i++
+		}
+	}
+	return nil
+}
+
+// cliFlags are the flags of a command as parsed. The zero value has no flags given.
+type cliFlags struct {
+	fs *flag.FlagSet
+}
+
+// given reports whether the flag name was given on the command line.
+func (f cliFlags) given(name string) bool {
+	found := false
+	if f.fs != nil {
+		f.fs.Visit(func(fl *flag.Flag) { found = found || fl.Name == name })
+	}
+	return found
+}
+
+// value returns the value of the flag name, or "" when it was not given. A bool flag
+// given alone is "true".
+func (f cliFlags) value(name string) string {
+	if !f.given(name) {
+		return ""
+	}
+	return f.fs.Lookup(name).Value.String()
+}
+
+// values returns every value of the repeatable flag name, in order.
+func (f cliFlags) values(name string) []string {
+	if !f.given(name) {
+		return nil
+	}
+	if r, ok := f.fs.Lookup(name).Value.(*repeatedFlag); ok {
+		return *r
+	}
+	return []string{f.value(name)}
+}
+
+// enabled reports whether the flag name is on: given with a value other than false.
+func (f cliFlags) enabled(name string) bool {
+	v := f.value(name)
+	return v != "" && v != "false"
+}
+
+// printUsage writes the usage of cmd, or of the runner when cmd is empty, to w.
+func printUsage(w io.Writer, cmd *command) {
+	if cmd == nil {
+		fmt.Fprintln(w, "Usage: jd-sql-spec-runner [command] [flags] <args>")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Commands:")
+		for _, c := range commands {
+			fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Without a command, diff runs. Run 'jd-sql-spec-runner <command> --help' for its flags.")
+		return
+	}
+	fmt.Fprintf(w, "Usage: jd-sql-spec-runner %s %s\n\n%s\n\nFlags:\n", cmd.name, cmd.args, capitalize(cmd.summary))
+	fs := newFlagSet(*cmd)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// usageError wraps a command line error with a pointer to the usage of cmd.
+func usageError(cmd string, err error) error {
+	return fmt.Errorf("%w (see jd-sql-spec-runner %s --help)", err, cmd)
+}
+
+// isHelpArg reports whether a is a request for the runner's usage.
+func isHelpArg(a string) bool {
+	return a == "-h" || a == "-help" || a == "--help" || a == "help"
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsRegion returns region, or the region of the environment (default us-east-1).
+func awsRegion(region string) string {
+	return coalesceNonEmpty(region, coalesceNonEmpty(coalesceNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")), "us-east-1"))
+}
+
+// rdsAuthToken generates the RDS IAM authentication token of the host, port and user of
+// dsn, a libpq key/value connection string: a connect request to the rds-db service,
+// presigned with AWS Signature Version 4 and valid for 15 minutes, used as the password.
+func rdsAuthToken(dsn, region string, now time.Time) (string, error) {
+	params, err := parseDSNParams(dsn)
+	if err != nil {
+		return "", err
+	}
+	host, user := params["host"], params["user"]
+	switch {
+	case host == "" || strings.HasPrefix(host, "/"):
+		return "", errors.New("the dsn needs the host name of the RDS instance")
+	case user == "":
+		return "", errors.New("the dsn needs the database user to authenticate as")
+	}
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return "", err
+	}
+	if creds.AccessKeyID == "" {
+		return "", errors.New("no AWS credentials found")
+	}
+	endpoint := net.JoinHostPort(host, coalesceNonEmpty(params["port"], "5432"))
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + region + "/rds-db/aws4_request"
+	query := map[string]string{
+		"Action":              "connect",
+		"DBUser":              user,
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    creds.AccessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       "900",
+		"X-Amz-SignedHeaders": "host",
+	}
+	if creds.SessionToken != "" {
+		query["X-Amz-Security-Token"] = creds.SessionToken
+	}
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, k := range names {
+		pairs[i] = awsEscape(k) + "=" + awsEscape(query[k])
+	}
+	canonicalQuery := strings.Join(pairs, "&")
+
+	request := strings.Join([]string{"GET", "/", canonicalQuery, "host:" + endpoint + "\n", "host", emptyPayloadHash}, "\n")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(request)}, "\n")
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "rds-db", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return endpoint + "/?" + canonicalQuery + "&X-Amz-Signature=" + hex.EncodeToString(hmacSHA256(key, toSign)), nil
+}
+
+// awsEscape percent-encodes s as AWS Signature Version 4 requires (RFC 3986).
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// gcpAccessToken returns an OAuth access token for the Google Cloud APIs: the value of
+// the variable named by fetch.gcs_token_env (default GOOGLE_OAUTH_ACCESS_TOKEN), or else
+// the token of the service account of the instance from the metadata server, which is
+// how workloads running on Google Cloud authenticate.
+func gcpAccessToken(ctx context.Context) (string, error) {
+	if tok := os.Getenv(coalesceNonEmpty(fetchSettings.GCSTokenEnv, "GOOGLE_OAUTH_ACCESS_TOKEN")); tok != "" {
+		return tok, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("no OAuth access token (set GOOGLE_OAUTH_ACCESS_TOKEN, e.g. from gcloud auth print-access-token): %w", err)
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.AccessToken == "" {
+		return "", errors.New("unexpected response of the metadata server")
+	}
+	return resp.AccessToken, nil
+}
+
+// CloudSQLConfig connects through the Cloud SQL connector protocol instead of the host
+// of the DSN: connections are dialed to the server proxy of the instance, port 3307,
+// over TLS with an ephemeral client certificate issued by the Cloud SQL Admin API.
+type CloudSQLConfig struct {
+	// Instance is the connection name of the instance, project:region:instance.
+	Instance string `yaml:"instance"`
+	// IPType is public (the default) or private.
+	IPType string `yaml:"ip_type"`
+	// IAMAuth logs in with IAM database authentication: the ephemeral certificate carries
+	// the OAuth token of the caller, and no password is needed.
+	IAMAuth bool `yaml:"iam_auth"`
+}
+
+var cloudSQLIPTypes = []string{"public", "private"}
+
+func validateCloudSQLConfig(c CloudSQLConfig, t TLSConfig) error {
+	if c == (CloudSQLConfig{}) {
+		return nil
+	}
+	switch {
+	case len(strings.Split(c.Instance, ":")) != 3:
+		return fmt.Errorf("cloud_sql.instance: expected the connection name project:region:instance, got '%s'", c.Instance)
+	case c.IPType != "" && !contains(cloudSQLIPTypes, c.IPType):
+		return fmt.Errorf("cloud_sql.ip_type: unsupported type '%s' (supported: %s)", c.IPType, strings.Join(cloudSQLIPTypes, ", "))
+	case t != (TLSConfig{}):
+		return errors.New("cloud_sql connections use their own TLS: tls cannot be set")
+	}
+	return nil
+}
+
+// cloudSQLDialer dials the server proxy of a Cloud SQL instance, whichever address lib/pq
+// asks for. The TLS settings of the instance (its address, server CA and a client
+// certificate) are fetched on first use and again shortly before the certificate expires.
+type cloudSQLDialer struct {
+	cfg CloudSQLConfig
+	tcp keepaliveDialer
+
+	mu      sync.Mutex
+	addr    string
+	tls     *tls.Config
+	expires time.Time
+}
+
+func newCloudSQLDialer(cfg CloudSQLConfig, tcp keepaliveDialer) *cloudSQLDialer {
+	return &cloudSQLDialer{cfg: cfg, tcp: tcp}
+}
+
+func (d *cloudSQLDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *cloudSQLDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *cloudSQLDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	addr, config, err := d.settings(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cloud sql instance %s: %w", d.cfg.Instance, err)
+	}
+	conn, err := d.tcp.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cloud sql instance %s: %w", d.cfg.Instance, err)
+	}
+	return tlsConn, nil
+}
+
+// settings returns the address of the server proxy and the TLS config of connections to
+// it, refreshing them when the client certificate expires within 5 minutes.
+func (d *cloudSQLDialer) settings(ctx context.Context) (string, *tls.Config, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tls != nil && time.Until(d.expires) > 5*time.Minute {
+		return d.addr, d.tls, nil
+	}
+	parts := strings.Split(d.cfg.Instance, ":")
+	project, instance := parts[0], parts[2]
+	base := "https://sqladmin.googleapis.com/sql/v1beta4/projects/" + url.PathEscape(project) + "/instances/" + url.PathEscape(instance)
+	token, err := gcpAccessToken(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var settings struct {
+		ServerCACert struct {
+			Cert string `json:"cert"`
+		} `json:"serverCaCert"`
+		IPAddresses []struct {
+			Type      string `json:"type"`
+			IPAddress string `json:"ipAddress"`
+		} `json:"ipAddresses"`
+		DNSName string `json:"dnsName"`
+	}
+	if err := callSQLAdmin(ctx, http.MethodGet, base+"/connectSettings", token, nil, &settings); err != nil {
+		return "", nil, err
+	}
+	ipType := map[string]string{"": "PRIMARY", "public": "PRIMARY", "private": "PRIVATE"}[d.cfg.IPType]
+	addr := ""
+	for _, ip := range settings.IPAddresses {
+		if ip.Type == ipType {
+			addr = net.JoinHostPort(ip.IPAddress, "3307")
+		}
+	}
+	if addr == "" {
+		return "", nil, fmt.Errorf("the instance has no %s IP address", coalesceNonEmpty(d.cfg.IPType, "public"))
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(settings.ServerCACert.Cert)) {
+		return "", nil, errors.New("invalid server CA certificate")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", nil, err
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	certReq := map[string]string{"public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))}
+	if d.cfg.IAMAuth {
+		certReq["access_token"] = token
+	}
+	var certResp struct {
+		EphemeralCert struct {
+			Cert string `json:"cert"`
+		} `json:"ephemeralCert"`
+	}
+	if err := callSQLAdmin(ctx, http.MethodPost, base+":generateEphemeralCert", token, certReq, &certResp); err != nil {
+		return "", nil, err
+	}
+	block, _ := pem.Decode([]byte(certResp.EphemeralCert.Cert))
+	if block == nil {
+		return "", nil, errors.New("invalid ephemeral certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid ephemeral certificate: %w", err)
+	}
+
+	serverName := project + ":" + instance
+	d.addr, d.expires = addr, cert.NotAfter
+	d.tls = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{block.Bytes}, PrivateKey: key, Leaf: cert}},
+		MinVersion:   tls.VersionTLS13,
+		// The server certificate names the instance (project:instance) or, for instances
+		// with a CA service issued certificate, its DNS name, rather than the address
+		// dialed, so the chain and name are verified here
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return errors.New("no server certificate")
+			}
+			certs := make([]*x509.Certificate, len(raw))
+			for i, r := range raw {
+				c, err := x509.ParseCertificate(r)
+				if err != nil {
+					return err
+				}
+				certs[i] = c
+			}
+			inter := x509.NewCertPool()
+			for _, c := range certs[1:] {
+				inter.AddCert(c)
+			}
+			if _, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: inter}); err != nil {
+				return err
+			}
+			if certs[0].Subject.CommonName == serverName {
+				return nil
+			}
+			if settings.DNSName != "" && certs[0].VerifyHostname(strings.TrimSuffix(settings.DNSName, ".")) == nil {
+				return nil
+			}
+			return fmt.Errorf("server certificate is not that of instance %s", d.cfg.Instance)
+		},
+	}
+	logger.Debug("fetched cloud sql connection settings", "instance", d.cfg.Instance, "address", addr, "cert_expires", d.expires)
+	return d.addr, d.tls, nil
+}
+
+// callSQLAdmin calls the Cloud SQL Admin API, decoding the JSON response into out.
+func callSQLAdmin(ctx context.Context, method, target, token string, in, out any) error {
+	var body *bytes.Reader
+	if in != nil {
+		b, _ := json.Marshal(in)
+		body = bytes.NewReader(b)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	b, err := doSecretRequest(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// completionShells are the shells that the completion command writes scripts for.
+var completionShells = []string{"bash", "zsh", "fish", "powershell"}
+
+// formatValues are the diff formats, which -f takes along with pathsFormats, sidebyside
+// and hunks-ndjson.
+var formatValues = []string{jdsql.FormatJd, jdsql.FormatJd2, jdsql.FormatPatch, jdsql.FormatMerge}
+
+// formatFlagValues returns the values of -f.
+func formatFlagValues() []string {
+	return append(append(append([]string{}, formatValues...), pathsFormats...), formatSideBySide, formatHunksNDJSON)
+}
+
+// completionFlag is a flag of a command as the completion scripts see it.
+type completionFlag struct {
+	name  string
+	usage string
+	// value is set for flags that take a value in the next argument.
+	value bool
+}
+
+// option returns the flag as typed on the command line: -c, --config.
+func (f completionFlag) option() string {
+	if len(f.name) == 1 {
+		return "-" + f.name
+	}
+	return "--" + f.name
+}
+
+// completionFlags returns the flags of cmd, sorted by name.
+func completionFlags(cmd command) []completionFlag {
+	var flags []completionFlag
+	newFlagSet(cmd).VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage, value: !ok || !b.IsBoolFlag()})
+	})
+	return flags
+}
+
+// translateSpecs returns the values of -t: every <in>2<out> pair of formats.
+func translateSpecs() []string {
+	var specs []string
+	for _, in := range formatValues {
+		for _, out := range formatValues {
+			if in != out {
+				specs = append(specs, in+"2"+out)
+			}
+		}
+	}
+	return specs
+}
+
+func commandNames() []string {
+	names := make([]string, len(commands))
+	for i, c := range commands {
+		names[i] = c.name
+	}
+	return names
+}
+
+// runCompletion writes the completion script for shell to w. The scripts complete the
+// commands and their flags, format and translate values and config file paths; engine
+// names are read from the config when completing, through "completion engines".
+func runCompletion(w io.Writer, shell, configPath string) error {
+	switch shell {
+	case "engines":
+		return writeEngineNames(w, configPath)
+	case "bash":
+		return writeBashCompletion(w)
+	case "zsh":
+		return writeZshCompletion(w)
+	case "fish":
+		return writeFishCompletion(w)
+	case "powershell":
+		return writePowerShellCompletion(w)
+	}
+	return fmt.Errorf("unsupported shell '%s' (supported: %s)", shell, strings.Join(completionShells, ", "))
+}
+
+// writeEngineNames writes the top level engine names of the config, one per line. A
+// config with problems still completes the names it holds, and an unreadable one none,
+// rather than printing errors into the shell.
+func writeEngineNames(w io.Writer, configPath string) error {
+	cfg, _ := loadConfig(configPath, "", false)
+	names := make([]string, 0, len(cfg.Engines))
+	for _, e := range cfg.Engines {
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintln(w, n)
+	}
+	return nil
+}
+
+// flagPattern returns the command line forms of names (e.g. "c", "config"), with one and
+// two dashes, as alternatives for a shell case pattern.
+func flagPattern(names ...string) string {
+	var alts []string
+	for _, n := range names {
+		alts = append(alts, "-"+n, "--"+n)
+	}
+	return strings.Join(alts, "|")
+}
+
+var (
+	configFlags  = flagPattern("c", "config")
+	formatFlags  = flagPattern("f", "format")
+	transFlags   = flagPattern("t", "translate")
+	enginesFlags = flagPattern("engines")
+)
+
+func writeBashCompletion(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `# bash completion for jd-sql-spec-runner
+# Load with: source <(jd-sql-spec-runner completion bash)
+
+_jd_sql_spec_runner() {
+    local cur prev cmd config i
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    # --flag=value is split at the '='
+    if [[ $cur == = ]]; then
+        cur=""
+    elif [[ $prev == = ]]; then
+        prev="${COMP_WORDS[COMP_CWORD-2]}"
+    fi
+    cmd=diff
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        case "${COMP_WORDS[i]}" in
+        %[1]s)
+            config="${COMP_WORDS[i+1]}"
+            [[ $config == = ]] && config="${COMP_WORDS[i+2]}"
+            ;;
+        esac
+    done
+    case " %[2]s " in
+    *" ${COMP_WORDS[1]} "*) [[ COMP_CWORD -gt 1 ]] && cmd="${COMP_WORDS[1]}" ;;
+    esac
+
+    case "$prev" in
+    %[1]s)
+        compopt -o filenames
+        COMPREPLY=($(compgen -d -- "$cur") $(compgen -f -X '!*.yaml' -- "$cur") $(compgen -f -X '!*.yml' -- "$cur"))
+        return
+        ;;
+    %[3]s)
+        COMPREPLY=($(compgen -W "%[4]s" -- "$cur"))
+        return
+        ;;
+    %[5]s)
+        COMPREPLY=($(compgen -W "%[6]s" -- "$cur"))
+        return
+        ;;
+    %[7]s)
+        local prefix="" engines
+        [[ $cur == *,* ]] && prefix="${cur%%,*},"
+        engines="all $(jd-sql-spec-runner completion engines ${config:+-c "$config"} 2>/dev/null)"
+        compopt -o nospace
+        COMPREPLY=($(compgen -P "$prefix" -W "$engines" -- "${cur##*,}"))
+        return
+        ;;
+    esac
+
+    if [[ $cmd == completion && $cur != -* ]]; then
+        COMPREPLY=($(compgen -W "%[8]s" -- "$cur"))
+        return
+    fi
+    if [[ $cur == -* ]]; then
+        local flags
+        case "$cmd" in
+`, configFlags, strings.Join(commandNames(), " "), formatFlags, strings.Join(formatFlagValues(), " "),
+		transFlags, strings.Join(translateSpecs(), " "), enginesFlags, strings.Join(completionShells, " "))
+	for _, c := range commands {
+		var opts []string
+		for _, f := range completionFlags(c) {
+			opts = append(opts, f.option())
+		}
+		fmt.Fprintf(&b, "        %s) flags=\"%s\" ;;\n", c.name, strings.Join(opts, " "))
+	}
+	fmt.Fprintf(&b, `        esac
+        COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+        return
+    fi
+    if [[ COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    fi
+}
+
+complete -o default -F _jd_sql_spec_runner jd-sql-spec-runner
+`, strings.Join(commandNames(), " "))
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func writeZshCompletion(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `#compdef jd-sql-spec-runner
+# zsh completion for jd-sql-spec-runner
+# Load with: source <(jd-sql-spec-runner completion zsh), after compinit
+
+_jd_sql_spec_runner() {
+    local cmd=diff config prev=${words[CURRENT-1]} i
+    local -a commands flags engines
+    commands=(%[1]s)
+    for ((i = 2; i < CURRENT; i++)); do
+        case ${words[i]} in
+        %[2]s) config=${words[i+1]} ;;
+        -c=*|--c=*|-config=*|--config=*) config=${words[i]#*=} ;;
+        esac
+    done
+    (( CURRENT > 2 && ${commands[(Ie)${words[2]}]} )) && cmd=${words[2]}
+    # --flag=value
+    if [[ $PREFIX == -*=* ]]; then
+        prev=${PREFIX%%%%=*}
+        compset -P '*='
+    fi
+
+    case $prev in
+    %[2]s) _files -g '*.(yaml|yml)'; return ;;
+    %[3]s) compadd -- %[4]s; return ;;
+    %[5]s) compadd -- %[6]s; return ;;
+    %[7]s)
+        engines=(all ${(f)"$(jd-sql-spec-runner completion engines ${config:+-c $config} 2>/dev/null)"})
+        compset -P '*,'
+        compadd -S '' -- $engines
+        return
+        ;;
+    esac
+
+    if [[ $cmd == completion && $PREFIX != -* ]]; then
+        compadd -- %[8]s
+        return
+    fi
+    if [[ $PREFIX == -* ]]; then
+        case $cmd in
+`, strings.Join(commandNames(), " "), configFlags, formatFlags, strings.Join(formatFlagValues(), " "),
+		transFlags, strings.Join(translateSpecs(), " "), enginesFlags, strings.Join(completionShells, " "))
+	for _, c := range commands {
+		var opts []string
+		for _, f := range completionFlags(c) {
+			opts = append(opts, f.option())
+		}
+		fmt.Fprintf(&b, "        %s) flags=(%s) ;;\n", c.name, strings.Join(opts, " "))
+	}
+	b.WriteString(`        esac
+        compadd -- $flags
+        return
+    fi
+    (( CURRENT == 2 )) && compadd -- $commands
+    _files
+}
+
+compdef _jd_sql_spec_runner jd-sql-spec-runner
+`)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func writeFishCompletion(w io.Writer) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `# fish completion for jd-sql-spec-runner
+# Load with: jd-sql-spec-runner completion fish | source
+
+function __jd_sql_spec_runner_engines
+    set -l tokens (commandline -opc)
+    set -l config
+    for i in (seq (count $tokens))
+        if contains -- $tokens[$i] %[1]s; and test $i -lt (count $tokens)
+            set config -c $tokens[(math $i + 1)]
+        end
+    end
+    set -l prefix (commandline -ct | string replace -r '^-[^=]*=' '' | string match -r '.*,')
+    for e in all (jd-sql-spec-runner completion engines $config 2>/dev/null)
+        echo $prefix$e
+    end
+end
+
+complete -c jd-sql-spec-runner -f
+`, strings.ReplaceAll(configFlags, "|", " "))
+	names := strings.Join(commandNames(), " ")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "complete -c jd-sql-spec-runner -n '__fish_use_subcommand' -a %s -d %s\n", c.name, fishQuote(c.summary))
+	}
+	fmt.Fprintf(&b, "complete -c jd-sql-spec-runner -n '__fish_seen_subcommand_from completion' -a '%s'\n",
+		strings.Join(completionShells, " "))
+	for _, c := range commands {
+		cond := fmt.Sprintf("__fish_seen_subcommand_from %s", c.name)
+		if c.name == "diff" {
+			// diff is also the command without a command
+			cond = fmt.Sprintf("not __fish_seen_subcommand_from %s; or __fish_seen_subcommand_from diff",
+				strings.TrimSpace(strings.Replace(" "+names+" ", " diff ", " ", 1)))
+		}
+		for _, f := range completionFlags(c) {
+			line := fmt.Sprintf("complete -c jd-sql-spec-runner -n '%s' ", cond)
+			if len(f.name) == 1 {
+				line += "-s " + f.name
+			} else {
+				line += "-l " + f.name
+			}
+			switch f.name {
+			case "c", "config":
+				line += " -r -k -a '(__fish_complete_suffix .yaml; __fish_complete_suffix .yml)'"
+			case "f", "format":
+				line += " -x -a '" + strings.Join(formatFlagValues(), " ") + "'"
+			case "t", "translate":
+				line += " -x -a '" + strings.Join(translateSpecs(), " ") + "'"
+			case "engines":
+				line += " -x -a '(__jd_sql_spec_runner_engines)'"
+			default:
+				if f.value {
+					line += " -r"
+				}
+			}
+			fmt.Fprintf(&b, "%s -d %s\n", line, fishQuote(f.usage))
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// fishQuote quotes s as a fish single-quoted string.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func writePowerShellCompletion(w io.Writer) error {
+	var b bytes.Buffer
+	b.WriteString(`# PowerShell completion for jd-sql-spec-runner
+# Load with: jd-sql-spec-runner completion powershell | Out-String | Invoke-Expression
+
+Register-ArgumentCompleter -Native -CommandName 'jd-sql-spec-runner' -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+
+    $flags = @{
+`)
+	for _, c := range commands {
+		var opts []string
+		for _, f := range completionFlags(c) {
+			opts = append(opts, "'"+f.option()+"'")
+		}
+		fmt.Fprintf(&b, "        '%s' = @(%s)\n", c.name, strings.Join(opts, ", "))
+	}
+	fmt.Fprintf(&b, `    }
+    $words = @($commandAst.CommandElements | Where-Object { $_.Extent.EndOffset -lt $cursorPosition } | ForEach-Object { $_.ToString() })
+    $prev = $words[-1]
+    $cmd = 'diff'
+    if ($words.Count -gt 1 -and $flags.ContainsKey($words[1])) { $cmd = $words[1] }
+    $config = @()
+    for ($i = 1; $i -lt $words.Count - 1; $i++) {
+        if ($words[$i] -in %[1]s) { $config = @('-c', $words[$i + 1]) }
+    }
+
+    $prefix = ''
+    $values = switch ($prev) {
+        { $_ -in %[1]s } {
+            Get-ChildItem -Path "$wordToComplete*" -ErrorAction SilentlyContinue |
+                Where-Object { $_.PSIsContainer -or $_.Extension -in '.yaml', '.yml' } |
+                ForEach-Object { Resolve-Path -Relative $_.FullName }
+            break
+        }
+        { $_ -in %[2]s } { %[3]s; break }
+        { $_ -in %[4]s } { %[5]s; break }
+        { $_ -in %[6]s } {
+            if ($wordToComplete -match '^(.*,)') { $prefix = $Matches[1] }
+            @('all') + @(& jd-sql-spec-runner completion engines @config 2>$null)
+            break
+        }
+        default {
+            if ($wordToComplete -like '-*') { $flags[$cmd] }
+            elseif ($cmd -eq 'completion') { %[7]s }
+            elseif ($words.Count -eq 1) { $flags.Keys | Sort-Object }
+        }
+    }
+    $values | ForEach-Object { "$prefix$_" } | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`, psList(strings.Split(configFlags, "|")), psList(strings.Split(formatFlags, "|")), psList(formatFlagValues()),
+		psList(strings.Split(transFlags, "|")), psList(translateSpecs()), psList(strings.Split(enginesFlags, "|")),
+		psList(completionShells))
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// psList formats values as a PowerShell array literal.
+func psList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = "'" + v + "'"
+	}
+	return "@(" + strings.Join(quoted, ", ") + ")"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Compressed inputs are recognized by their magic bytes, whatever their name: no JSON
+// document or diff starts with them. zstd has no decoder in the standard library, so
+// it goes through the zstd command.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressions are the accepted values of --compress.
+var compressions = []string{"gzip", "zstd"}
+
+// compressionOf returns the compression of data starting with head, or "".
+func compressionOf(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(head, zstdMagic):
+		return "zstd"
+	}
+	return ""
+}
+
+// decompress returns rc decompressed as it is read when it is gzip or zstd data, or
+// rc itself. Closing the result closes rc.
+func decompress(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	head, _ := br.Peek(len(zstdMagic))
+	switch compressionOf(head) {
+	case "gzip":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("invalid gzip input: %w", err)
+		}
+		return readCloser{zr, closers{zr, rc}}, nil
+	case "zstd":
+		cmd := exec.Command("zstd", "-d", "-c", "-q")
+		cmd.Stdin = br
+		z := &zstdReader{cmd: cmd, src: rc}
+		cmd.Stderr = &z.stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("zstd input needs the zstd command: %w", err)
+		}
+		z.out = out
+		return z, nil
+	}
+	return readCloser{br, rc}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closers closes each of its closers, returning the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// zstdReader reads the output of zstd -d. A failure of zstd, such as corrupt input, is
+// returned by the read that reaches the end of its output.
+type zstdReader struct {
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	src    io.Closer
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.out.Read(p)
+	if err == io.EOF {
+		if werr := z.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (z *zstdReader) wait() error {
+	if !z.waited {
+		z.waited = true
+		if err := z.cmd.Wait(); err != nil {
+			z.err = fmt.Errorf("zstd: %s: %w", strings.TrimSpace(z.stderr.String()), err)
+		}
+	}
+	return z.err
+}
+
+func (z *zstdReader) Close() error {
+	z.out.Close()
+	z.wait()
+	return z.src.Close()
+}
+
+// compressOutput returns a file whose writes are compressed with method into dst, and
+// the function that flushes the compressed stream once everything is written. The file
+// is a pipe, so it can stand in for os.Stdout.
+func compressOutput(dst *os.File, method string) (*os.File, func() error, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	switch method {
+	case "gzip":
+		go func() {
+			zw := gzip.NewWriter(dst)
+			_, err := io.Copy(zw, pr)
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+			pr.Close()
+			done <- err
+		}()
+	case "zstd":
+		cmd := exec.Command("zstd", "-c", "-q")
+		cmd.Stdin, cmd.Stdout = pr, dst
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			pr.Close()
+			pw.Close()
+			return nil, nil, fmt.Errorf("--compress zstd needs the zstd command: %w", err)
+		}
+		go func() {
+			err := cmd.Wait()
+			pr.Close()
+			if err != nil {
+				err = fmt.Errorf("zstd: %s: %w", strings.TrimSpace(stderr.String()), err)
+			}
+			done <- err
+		}()
+	default:
+		pr.Close()
+		pw.Close()
+		return nil, nil, fmt.Errorf("invalid --compress value '%s' (expected %s)", method, strings.Join(compressions, " or "))
+	}
+	finish := func() error {
+		err := pw.Close()
+		if werr := <-done; werr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to compress output: %w", werr))
+		}
+		return err
+	}
+	return pw, finish, nil
+}
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Engine string `yaml:"engine"`
+	DSN    string `yaml:"dsn"`
+	// DSNEnv names an environment variable holding the DSN, in place of dsn.
+	DSNEnv string `yaml:"dsn_env"`
+	// SQL replaces the built-in statement of plain diffs and query mode; see diffTemplate.
+	SQL string `yaml:"sql"`
+	// Implementation selects the flavor of the jd-sql functions, plpgsql (the default) or
+	// plv8, and Schema overrides the schema it is installed in; see implementationSchemas.
+	Implementation string `yaml:"implementation"`
+	Schema         string `yaml:"schema"`
+	// FunctionPrefix is prepended to the names of the jd-sql functions, for installs that
+	// prefix them.
+	FunctionPrefix string `yaml:"function_prefix"`
+	// Collation is the collation the functions order the elements of sets with, sent as
+	// the jd_sql.collation setting; "C" makes the order the same on every server. The
+	// default is the collation of the database. --collation overrides it.
+	Collation string `yaml:"collation"`
+	// MergeNullPolicy is what the functions do with a null assignment rendered as a merge
+	// patch, which RFC 7386 reads as a removal: keep (the default), error, drop or
+	// sentinel, sent as the jd_sql.merge_null_policy setting. --merge-null-policy
+	// overrides it.
+	MergeNullPolicy string `yaml:"merge_null_policy"`
+	// TLS configures TLS; see TLSConfig for the defaults.
+	TLS TLSConfig `yaml:"tls"`
+	// Credentials reads the password from a secrets manager; see CredentialsConfig.
+	Credentials CredentialsConfig `yaml:"credentials"`
+	// CloudSQL dials a Cloud SQL instance through the connector protocol; see
+	// CloudSQLConfig.
+	CloudSQL CloudSQLConfig `yaml:"cloud_sql"`
+	// Pool tunes the connection pool of batch, spec and directory runs.
+	Pool PoolConfig `yaml:"pool"`
+	// Retry is the retry policy for transient database errors.
+	Retry RetryConfig `yaml:"retry"`
+	// Timeouts bound the execution of each query.
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+	// Fetch configures the download of inputs given as URLs.
+	Fetch FetchConfig `yaml:"fetch"`
+	// Limits bound the size and shape of the inputs; see LimitsConfig.
+	Limits LimitsConfig `yaml:"limits"`
+	// Serve bounds the load of serve on the database; see ServeConfig.
+	Serve ServeConfig `yaml:"serve"`
+	// PathOptions are jd options of the subtrees at their paths, added to those of every
+	// run, such as matching the elements of one array by key.
+	PathOptions []PathOption `yaml:"path_options"`
+	// Image is the Docker image of the ephemeral engine (default postgres:17).
+	Image string `yaml:"image"`
+	// Engines are named backends for --engines runs; each inherits the settings above
+	// that it does not set itself.
+	Engines []NamedEngine `yaml:"engines"`
+	// Profiles are named environments (dev, staging, ci) selected with --profile; each
+	// inherits the settings above that it does not set itself.
+	Profiles map[string]Config `yaml:"profiles"`
+	// Skips and XFail select manifest/spec cases that are skipped or expected to fail.
+	Skips []caseRule `yaml:"skips"`
+	XFail []caseRule `yaml:"xfail"`
+}
+
+// supportedEngines are the accepted values of engine.
+var supportedEngines = []string{"postgres", "pg", "postgres-ephemeral"}
+
+// loadConfig reads and validates the config file and returns the settings of profile,
+// or the top level settings when profile is empty. Unknown keys and invalid values are
+// all reported, one "invalid config: <file>:<line>: ..." line each. With ephemeral
+// (--ephemeral), no dsn is needed.
+func loadConfig(path, profile string, ephemeral bool) (Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %s: %w", path, err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return cfg, fmt.Errorf("failed to parse YAML config: %s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return cfg, fmt.Errorf("invalid config: %s: the file is empty", path)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return cfg, fmt.Errorf("invalid config: %s:%d: expected a mapping of config keys", path, root.Line)
+	}
+
+	v := &configValidator{path: path, root: root, ephemeral: ephemeral}
+	v.knownFields(root, reflect.TypeOf(cfg), "")
+	if err := v.selectProfile(profile); err != nil {
+		return cfg, err
+	}
+	v.interpolateEnv(root)
+	if err := doc.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse YAML config: %s: %w", path, err)
+	}
+	v.validate(&cfg, profile)
+	if err := v.err(); err != nil {
+		return cfg, err
+	}
+	if profile != "" {
+		cfg = cfg.profileConfig(profile)
+	}
+	return cfg, nil
+}
+
+// configValidator collects config problems with the line they were found at.
+type configValidator struct {
+	path string
+	root *yaml.Node
+	errs []configProblem
+	// profiles are the names of all profiles in the file; see selectProfile.
+	profiles []string
+	// ephemeral is set by --ephemeral, which runs every engine in a disposable container.
+	ephemeral bool
+}
+
+// isEphemeral reports whether c runs in a disposable container, which needs no dsn.
+func (v *configValidator) isEphemeral(c Config) bool {
+	return v.ephemeral || isEphemeral(c)
+}
+
+type configProblem struct {
+	line int
+	msg  string
+}
+
+func (v *configValidator) errorf(line int, format string, a ...any) {
+	v.errs = append(v.errs, configProblem{line, fmt.Sprintf(format, a...)})
+}
+
+// err returns the problems in line order, or nil.
+func (v *configValidator) err() error {
+	sort.SliceStable(v.errs, func(i, j int) bool { return v.errs[i].line < v.errs[j].line })
+	errs := make([]error, 0, len(v.errs))
+	for _, p := range v.errs {
+		errs = append(errs, fmt.Errorf("invalid config: %s:%d: %s", v.path, p.line, p.msg))
+	}
+	return errors.Join(errs...)
+}
+
+// line returns the line of the value at keys (mapping keys and sequence indexes) below
+// the root, or of the closest existing ancestor.
+func (v *configValidator) line(keys ...any) int {
+	n := v.root
+	for _, k := range keys {
+		next := childNode(n, k)
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return n.Line
+}
+
+func childNode(n *yaml.Node, key any) *yaml.Node {
+	switch k := key.(type) {
+	case string:
+		if n.Kind != yaml.MappingNode {
+			return nil
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == k {
+				return n.Content[i+1]
+			}
+		}
+	case int:
+		if n.Kind == yaml.SequenceNode && k < len(n.Content) {
+			return n.Content[k]
+		}
+	}
+	return nil
+}
+
+// knownFields reports mapping keys that have no matching yaml field in t.
+func (v *configValidator) knownFields(n *yaml.Node, t reflect.Type, where string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, c := range n.Content {
+			v.knownFields(c, t.Elem(), fmt.Sprintf("%s[%d]", where, i))
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v.knownFields(n.Content[i+1], t.Elem(), strings.TrimPrefix(where+"."+n.Content[i].Value, "."))
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			ft, ok := fields[key.Value]
+			if !ok {
+				section := "config"
+				if where != "" {
+					section = where
+				}
+				msg := fmt.Sprintf("unknown key '%s' in %s", key.Value, section)
+				if s := suggestKey(key.Value, fields); s != "" {
+					msg += fmt.Sprintf(" (did you mean '%s'?)", s)
+				}
+				v.errorf(key.Line, "%s", msg)
+				continue
+			}
+			v.knownFields(n.Content[i+1], ft, strings.TrimPrefix(where+"."+key.Value, "."))
+		}
+	}
+}
+
+// yamlFields maps the yaml keys of struct t, including inlined structs, to field types.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if opts == "inline" {
+			for k, ft := range yamlFields(f.Type) {
+				fields[k] = ft
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// suggestKey returns the known key closest to key, if it is a likely typo.
+func suggestKey(key string, fields map[string]reflect.Type) string {
+	names := make([]string, 0, len(fields))
+	for k := range fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	best, bestDist := "", 3
+	for _, k := range names {
+		if d := editDistance(key, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// validate checks the decoded values and resolves dsn_env references. The top level
+// needs an engine and dsn only when it is used itself: without engines and profile.
+func (v *configValidator) validate(cfg *Config, profile string) {
+	topLevel := len(cfg.Engines) == 0 && profile == ""
+	v.engineSettings(cfg, topLevel && len(v.profiles) == 0)
+	if topLevel && len(v.profiles) > 0 && (cfg.Engine == "" || cfg.DSN == "" && !v.isEphemeral(*cfg)) {
+		v.errorf(v.root.Line, "missing engine or dsn at the top level (set them, or select a profile with --profile: %s)",
+			strings.Join(v.profiles, ", "))
+	}
+	v.runSettings(cfg)
+	v.engines(cfg)
+	if profile == "" {
+		return
+	}
+
+	p := cfg.Profiles[profile]
+	sub := &configValidator{path: v.path, root: childNode(childNode(v.root, "profiles"), profile), ephemeral: v.ephemeral}
+	if len(p.Profiles) > 0 {
+		sub.errorf(sub.line("profiles"), "profiles.%s: profiles cannot be nested", profile)
+	}
+	sub.engineSettings(&p, false)
+	sub.runSettings(&p)
+	cfg.Profiles[profile] = p
+	merged := cfg.profileConfig(profile)
+	if len(p.Engines) > 0 {
+		sub.engines(&merged)
+	} else if len(merged.Engines) == 0 {
+		// An unset dsn_env has been reported
+		if merged.DSN == "" && p.DSNEnv == "" && !v.isEphemeral(merged) {
+			sub.errorf(sub.root.Line, "profiles.%s: missing dsn (set dsn or dsn_env here or at the top level)", profile)
+		}
+		if merged.Engine == "" {
+			sub.errorf(sub.root.Line, "profiles.%s: missing engine (set engine here or at the top level)", profile)
+		}
+	}
+	v.errs = append(v.errs, sub.errs...)
+}
+
+// selectProfile drops the profiles other than profile from the document, so that only
+// the selected one is interpolated and validated: the environment variables of the
+// others need not be set. Their keys have been checked by then.
+func (v *configValidator) selectProfile(profile string) error {
+	n := childNode(v.root, "profiles")
+	if n == nil || n.Kind != yaml.MappingNode {
+		if profile != "" {
+			return fmt.Errorf("unknown profile '%s': %s has no profiles", profile, v.path)
+		}
+		return nil
+	}
+	var kept []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		v.profiles = append(v.profiles, n.Content[i].Value)
+		if n.Content[i].Value == profile {
+			kept = n.Content[i : i+2]
+		}
+	}
+	sort.Strings(v.profiles)
+	if profile != "" && kept == nil {
+		return fmt.Errorf("unknown profile '%s' in %s (profiles: %s)", profile, v.path, strings.Join(v.profiles, ", "))
+	}
+	n.Content = kept
+	return nil
+}
+
+// runSettings checks the retry, timeout, fetch, serve, limits and path option settings.
+func (v *configValidator) runSettings(cfg *Config) {
+	if err := validateRetryConfig(cfg.Retry); err != nil {
+		v.errorf(v.line("retry"), "%v", err)
+	}
+	if t := cfg.Timeouts; t.Connect < 0 || t.Query < 0 || t.Statement < 0 || t.Total < 0 {
+		v.errorf(v.line("timeouts"), "timeouts must not be negative")
+	}
+	if cfg.Fetch.Timeout < 0 {
+		v.errorf(v.line("fetch", "timeout"), "fetch.timeout must not be negative")
+	}
+	if err := validateServeConfig(cfg.Serve); err != nil {
+		v.errorf(v.line("serve"), "%v", err)
+	}
+	if err := validateLimitsConfig(cfg.Limits); err != nil {
+		v.errorf(v.line("limits"), "%v", err)
+	}
+	for i, po := range cfg.PathOptions {
+		if _, err := po.directive(); err != nil {
+			v.errorf(v.line("path_options", i), "path_options[%d]: %v", i, err)
+		}
+	}
+}
+
+// engines checks the engines entries of cfg, which they inherit their settings from.
+func (v *configValidator) engines(cfg *Config) {
+	seen := map[string]bool{}
+	for i := range cfg.Engines {
+		e := &cfg.Engines[i]
+		line := v.line("engines", i)
+		switch {
+		case e.Name == "":
+			v.errorf(line, "engines[%d]: missing name", i)
+		case e.Name == "all" || strings.Contains(e.Name, ","):
+			v.errorf(v.line("engines", i, "name"), "engines[%d]: invalid name '%s'", i, e.Name)
+		case seen[e.Name]:
+			v.errorf(v.line("engines", i, "name"), "engines[%d]: duplicate name '%s'", i, e.Name)
+		}
+		seen[e.Name] = true
+		if len(e.Engines) > 0 {
+			v.errorf(v.line("engines", i, "engines"), "engines[%d]: engines cannot be nested", i)
+		}
+		sub := &configValidator{path: v.path, root: childNode(v.root, "engines").Content[i], ephemeral: v.ephemeral}
+		sub.engineSettings(&e.Config, false)
+		merged := cfg.engineConfig(*e)
+		if merged.DSN == "" && !v.isEphemeral(merged) {
+			sub.errorf(line, "engines[%d]: missing dsn (set dsn or dsn_env here or at the top level)", i)
+		}
+		if merged.Engine == "" {
+			sub.errorf(line, "engines[%d]: missing engine (set engine here or at the top level)", i)
+		}
+		v.errs = append(v.errs, sub.errs...)
+	}
+}
+
+// interpolateEnv replaces ${NAME} and ${NAME:-default} references in the scalar values
+// of the config document with environment variables, so credentials can stay out of the
+// YAML file. $${ is a literal ${. Only the braced form is recognized, leaving the $1
+// placeholders of sql templates alone. A reference to an unset variable without a
+// default is reported with its line number.
+func (v *configValidator) interpolateEnv(n *yaml.Node) {
+	if n.Kind == yaml.ScalarNode && strings.Contains(n.Value, "${") {
+		s, err := expandEnv(n.Value)
+		if err != nil {
+			v.errorf(n.Line, "%v", err)
+			return
+		}
+		n.Value = s
+		return
+	}
+	for _, c := range n.Content {
+		v.interpolateEnv(c)
+	}
+}
+
+func expandEnv(s string) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			// $${ escapes a literal ${
+			sb.WriteString(s[:i])
+			sb.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		sb.WriteString(s[:i])
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s[i:])
+		}
+		ref := s[i+2 : i+end]
+		name, def, hasDef := strings.Cut(ref, ":-")
+		if name == "" {
+			return "", fmt.Errorf("empty variable reference ${%s}", ref)
+		}
+		v, ok := os.LookupEnv(name)
+		switch {
+		case ok && (v != "" || !hasDef):
+			sb.WriteString(v)
+		case hasDef:
+			sb.WriteString(def)
+		default:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		s = s[i+end+1:]
+	}
+}
+
+// engineSettings checks the settings that the top level and engines entries share.
+// With required, engine and dsn must be set.
+func (v *configValidator) engineSettings(c *Config, required bool) {
+	switch {
+	case c.Engine != "" && !contains(supportedEngines, strings.ToLower(c.Engine)):
+		v.errorf(v.line("engine"), "unsupported engine '%s' (supported: %s)", c.Engine, strings.Join(supportedEngines, ", "))
+	case c.Engine == "" && required:
+		v.errorf(v.root.Line, "missing engine (supported: %s)", strings.Join(supportedEngines, ", "))
+	}
+	if err := resolveDSNEnv(c); err != nil {
+		v.errorf(v.line("dsn_env"), "%v", err)
+	} else if c.DSN == "" && required && !v.isEphemeral(*c) {
+		v.errorf(v.root.Line, "missing dsn (set dsn or dsn_env)")
+	}
+	if c.SQL != "" {
+		sqlText, err := expandSQLTemplate(c.SQL)
+		if err == nil {
+			c.SQL = sqlText
+			err = validateSQLTemplate(c.SQL)
+		}
+		if err != nil {
+			v.errorf(v.line("sql"), "sql: %v", err)
+		}
+	}
+	if c.Implementation != "" {
+		if err := validateImplementation(c.Implementation); err != nil {
+			v.errorf(v.line("implementation"), "%v", err)
+		}
+	}
+	if c.MergeNullPolicy != "" {
+		if err := validateMergeNullPolicy(c.MergeNullPolicy); err != nil {
+			v.errorf(v.line("merge_null_policy"), "merge_null_policy: %v", err)
+		}
+	}
+	if err := validateTLSConfig(c.TLS); err != nil {
+		v.errorf(v.line("tls"), "%v", err)
+	}
+	if err := validateCredentialsConfig(c.Credentials); err != nil {
+		v.errorf(v.line("credentials"), "%v", err)
+	}
+	if err := validateCloudSQLConfig(c.CloudSQL, c.TLS); err != nil {
+		v.errorf(v.line("cloud_sql"), "%v", err)
+	}
+	for _, section := range []struct {
+		name  string
+		rules []caseRule
+	}{{"skips", c.Skips}, {"xfail", c.XFail}} {
+		for i, r := range section.rules {
+			if r.Name == "" && r.Tag == "" {
+				v.errorf(v.line(section.name, i), "%s[%d]: expected a name or tag pattern", section.name, i)
+			}
+		}
+	}
+}
+
+// sqlPlaceholder matches the bind parameters of the sql statement.
+var sqlPlaceholder = regexp.MustCompile(`\$([0-9]+)`)
+
+// validateSQLTemplate checks the sql statement: it must bind the two documents as $1
+// and $2 (optionally options $3 and format $4), with balanced quotes and parentheses.
+func validateSQLTemplate(sqlText string) error {
+	if strings.TrimSpace(sqlText) == "" {
+		return fmt.Errorf("statement is blank")
+	}
+	depth := 0
+	var quote rune
+	comment := false
+	var outside strings.Builder
+	for _, r := range []rune(sqlText + "\n") {
+		switch {
+		case comment:
+			comment = r != '\n'
+			continue
+		case quote == 0 && r == '-' && strings.HasSuffix(outside.String(), "-"):
+			comment = true
+			continue
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+			continue
+		case r == '\'' || r == '"':
+			quote = r
+			continue
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced ')'")
+			}
+		}
+		outside.WriteRune(r)
+	}
+	if quote != 0 {
+		return fmt.Errorf("unterminated %c quoted text", quote)
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced '(': %d not closed", depth)
+	}
+	used := map[int]bool{}
+	for _, m := range sqlPlaceholder.FindAllStringSubmatch(outside.String(), -1) {
+		n, _ := strconv.Atoi(m[1])
+		if n < 1 || n > 4 {
+			return fmt.Errorf("unknown placeholder $%d (expected $1 A, $2 B, $3 options, $4 format)", n)
+		}
+		used[n] = true
+	}
+	if !used[1] || !used[2] {
+		return fmt.Errorf("expected placeholders $1 and $2 for the two documents")
+	}
+	return nil
+}
+
+// resolveDSNEnv fills cfg.DSN from the environment variable named by dsn_env.
+func resolveDSNEnv(cfg *Config) error {
+	if cfg.DSNEnv == "" {
+		return nil
+	}
+	if cfg.DSN != "" {
+		return fmt.Errorf("dsn and dsn_env are mutually exclusive")
+	}
+	cfg.DSN = os.Getenv(cfg.DSNEnv)
+	if cfg.DSN == "" {
+		return fmt.Errorf("dsn_env: environment variable %s is not set", cfg.DSNEnv)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lib/pq"
+)
+
+// patchConflictCode is the SQLSTATE raised by _jd_patch_conflict when a hunk of a patch
+// does not match the document; the DETAIL of the error is the conflict as JSON.
+const patchConflictCode = "JDP01"
+
+// conflictFormats are the values of --conflict-format.
+var conflictFormats = []string{"text", "json"}
+
+// patchConflict is the hunk of a patch that does not match the document it is applied
+// to. Expected and Actual are nil when there is no value.
+type patchConflict struct {
+	// Hunk is the 1-based position of the hunk in the diff.
+	Hunk     int             `json:"hunk"`
+	Path     json.RawMessage `json:"path"`
+	Expected json.RawMessage `json:"expected,omitempty"`
+	Actual   json.RawMessage `json:"actual,omitempty"`
+	Message  string          `json:"message"`
+}
+
+// asPatchConflict returns the conflict of err, if it is an error of _jd_patch_conflict.
+func asPatchConflict(err error) (*patchConflict, bool) {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || string(pqErr.Code) != patchConflictCode {
+		return nil, false
+	}
+	c := &patchConflict{Message: pqErr.Message}
+	if json.Unmarshal([]byte(pqErr.Detail), c) != nil {
+		return nil, false
+	}
+	return c, true
+}
+
+// writeConflict writes c to w in format (see conflictFormats).
+func writeConflict(w io.Writer, c *patchConflict, format string) {
+	if format == "json" {
+		b, _ := json.Marshal(c)
+		fmt.Fprintf(w, "%s\n", b)
+		return
+	}
+	value := func(v json.RawMessage) string {
+		if v == nil {
+			return "no value"
+		}
+		var buf bytes.Buffer
+		if json.Compact(&buf, v) != nil {
+			return string(v)
+		}
+		return buf.String()
+	}
+	fmt.Fprintf(w, "patch conflict at hunk %d\n  path:     %s\n  expected: %s\n  actual:   %s\n  %s\n",
+		c.Hunk, value(c.Path), value(c.Expected), value(c.Actual), c.Message)
+}
+
+// flagConflictFormat returns the --conflict-format of the run, text by default.
+func flagConflictFormat(flags cliFlags) (string, error) {
+	format := coalesceNonEmpty(flags.value("conflict-format"), "text")
+	if !contains(conflictFormats, format) {
+		return "", fmt.Errorf("invalid --conflict-format value '%s' (expected text or json)", format)
+	}
+	return format, nil
+}
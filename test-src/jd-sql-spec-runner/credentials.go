@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CredentialsConfig fetches the password of the DSN (and optionally the user) from a
+// secrets manager before connecting, so it appears neither in the config nor in the
+// environment, or generates a short-lived IAM token in its place.
+type CredentialsConfig struct {
+	// Provider is vault, aws-secrets-manager, gcp-secret-manager or aws-rds-iam.
+	Provider string `yaml:"provider"`
+	// Secret is the Vault path (e.g. secret/data/jd-sql), the AWS secret name or ARN, or
+	// the GCP secret resource (projects/p/secrets/s, at its latest version unless one is
+	// given).
+	Secret string `yaml:"secret"`
+	// Field is the field of the secret holding the password (default password). A secret
+	// that is not a JSON object is the password itself.
+	Field string `yaml:"field"`
+	// UserField is the field holding the user name, which then replaces that of the DSN.
+	UserField string `yaml:"user_field"`
+	// Address is the Vault server (default VAULT_ADDR); the token is read from
+	// VAULT_TOKEN.
+	Address string `yaml:"address"`
+	// Region is the AWS region of the AWS providers (default AWS_REGION).
+	Region string `yaml:"region"`
+	// Refresh is how long a fetched secret is reused for new connections (default 5m, and
+	// 10m for aws-rds-iam tokens, which expire after 15m), so rotated passwords are picked
+	// up by long runs.
+	Refresh time.Duration `yaml:"refresh"`
+}
+
+var credentialProviders = []string{"vault", "aws-secrets-manager", "gcp-secret-manager", "aws-rds-iam"}
+
+const (
+	defaultCredentialsRefresh = 5 * time.Minute
+	rdsTokenRefresh           = 10 * time.Minute
+)
+
+func validateCredentialsConfig(c CredentialsConfig) error {
+	if c == (CredentialsConfig{}) {
+		return nil
+	}
+	switch {
+	case !contains(credentialProviders, c.Provider):
+		return fmt.Errorf("credentials.provider: unsupported provider '%s' (supported: %s)", c.Provider, strings.Join(credentialProviders, ", "))
+	case c.Secret == "" && c.Provider != "aws-rds-iam":
+		return fmt.Errorf("credentials.secret: missing the secret to read")
+	case c.Secret != "" && c.Provider == "aws-rds-iam":
+		return fmt.Errorf("credentials.secret is not used by aws-rds-iam, which generates the password")
+	case c.Field != "" && c.Provider == "aws-rds-iam" || c.UserField != "" && c.Provider == "aws-rds-iam":
+		return fmt.Errorf("credentials.field and user_field are not used by aws-rds-iam")
+	case c.Region != "" && !strings.HasPrefix(c.Provider, "aws-"):
+		return fmt.Errorf("credentials.region is only used by the AWS providers")
+	case c.Refresh < 0:
+		return fmt.Errorf("credentials.refresh must not be negative")
+	case c.Address != "" && c.Provider != "vault":
+		return fmt.Errorf("credentials.address is only used by the vault provider")
+	}
+	return nil
+}
+
+// secretConnector opens connections with the credentials read from the secrets manager
+// of cfg, or the token it generates, reading them again once they are older than the
+// refresh period.
+type secretConnector struct {
+	cfg    CredentialsConfig
+	dsn    string
+	dialer pq.Dialer
+
+	mu        sync.Mutex
+	user      string
+	password  string
+	fetchedAt time.Time
+}
+
+func newSecretConnector(cfg CredentialsConfig, dsn string, dialer pq.Dialer) *secretConnector {
+	return &secretConnector{cfg: cfg, dsn: dsn, dialer: dialer}
+}
+
+func (c *secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	user, password, err := c.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dsn := c.dsn + " password='" + escapeDSNValue(password) + "'"
+	if user != "" {
+		dsn += " user='" + escapeDSNValue(user) + "'"
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(c.dialer)
+	return connector.Connect(ctx)
+}
+
+func (c *secretConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// credentials returns the user (empty without user_field) and password, fetching them
+// when the cached ones are too old.
+func (c *secretConnector) credentials(ctx context.Context) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	refresh := c.cfg.Refresh
+	if refresh <= 0 {
+		refresh = defaultCredentialsRefresh
+		if c.cfg.Provider == "aws-rds-iam" {
+			refresh = rdsTokenRefresh
+		}
+	}
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < refresh {
+		return c.user, c.password, nil
+	}
+	if c.cfg.Provider == "aws-rds-iam" {
+		token, err := rdsAuthToken(c.dsn, awsRegion(c.cfg.Region), time.Now())
+		if err != nil {
+			return "", "", fmt.Errorf("failed to generate an RDS IAM token: %w", err)
+		}
+		c.password, c.fetchedAt = token, time.Now()
+		return "", token, nil
+	}
+	secret, err := fetchSecret(ctx, c.cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read credentials from %s: %w", c.cfg.Provider, err)
+	}
+	user, password, err := secretFields(secret, c.cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read credentials from %s: %s: %w", c.cfg.Provider, c.cfg.Secret, err)
+	}
+	c.user, c.password, c.fetchedAt = user, password, time.Now()
+	logger.Debug("fetched database credentials", "provider", c.cfg.Provider, "secret", c.cfg.Secret)
+	return user, password, nil
+}
+
+// escapeDSNValue escapes a value for a single quoted libpq key/value setting.
+func escapeDSNValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+}
+
+// secretFields extracts the password, and the user with user_field, from the secret.
+func secretFields(secret []byte, cfg CredentialsConfig) (string, string, error) {
+	var fields map[string]any
+	if json.Unmarshal(secret, &fields) != nil {
+		if cfg.Field != "" || cfg.UserField != "" {
+			return "", "", fmt.Errorf("the secret is not a JSON object")
+		}
+		return "", strings.TrimRight(string(secret), "\r\n"), nil
+	}
+	field := func(name string) (string, error) {
+		s, ok := fields[name].(string)
+		if !ok {
+			return "", fmt.Errorf("the secret has no string field '%s'", name)
+		}
+		return s, nil
+	}
+	password, err := field(coalesceNonEmpty(cfg.Field, "password"))
+	if err != nil {
+		return "", "", err
+	}
+	user := ""
+	if cfg.UserField != "" {
+		if user, err = field(cfg.UserField); err != nil {
+			return "", "", err
+		}
+	}
+	return user, password, nil
+}
+
+// fetchSecret reads the secret of cfg: for Vault the data of the path (of a KV version 2
+// engine or not), for the cloud providers the secret string.
+func fetchSecret(ctx context.Context, cfg CredentialsConfig) ([]byte, error) {
+	timeout := fetchSettings.Timeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	switch cfg.Provider {
+	case "vault":
+		return fetchVaultSecret(ctx, cfg)
+	case "aws-secrets-manager":
+		return fetchAWSSecret(ctx, cfg)
+	default:
+		return fetchGCPSecret(ctx, cfg)
+	}
+}
+
+func fetchVaultSecret(ctx context.Context, cfg CredentialsConfig) ([]byte, error) {
+	addr := coalesceNonEmpty(cfg.Address, os.Getenv("VAULT_ADDR"))
+	if addr == "" {
+		return nil, fmt.Errorf("no Vault address (set credentials.address or VAULT_ADDR)")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(addr, "/")+"/v1/"+escapePath(strings.TrimPrefix(cfg.Secret, "/")), nil)
+	if err != nil {
+		return nil, err
+	}
+	if tok := os.Getenv("VAULT_TOKEN"); tok != "" {
+		req.Header.Set("X-Vault-Token", tok)
+	}
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Data == nil {
+		return nil, fmt.Errorf("unexpected Vault response for %s", cfg.Secret)
+	}
+	// A KV version 2 engine nests the secret in data.data, next to data.metadata
+	if inner, ok := resp.Data["data"]; ok && len(resp.Data["metadata"]) > 0 {
+		return inner, nil
+	}
+	return json.Marshal(resp.Data)
+}
+
+// fetchAWSSecret calls GetSecretValue of AWS Secrets Manager, signed with the
+// credentials and region that s3 downloads use. AWS_ENDPOINT_URL_SECRETS_MANAGER (or
+// AWS_ENDPOINT_URL) replaces the regional endpoint.
+func fetchAWSSecret(ctx context.Context, cfg CredentialsConfig) ([]byte, error) {
+	region := awsRegion(cfg.Region)
+	if strings.HasPrefix(cfg.Secret, "arn:") {
+		// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+		if parts := strings.Split(cfg.Secret, ":"); len(parts) > 3 && parts[3] != "" {
+			region = parts[3]
+		}
+	}
+	endpoint := fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", region)
+	if ep := coalesceNonEmpty(os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER"), os.Getenv("AWS_ENDPOINT_URL")); ep != "" {
+		endpoint = strings.TrimSuffix(ep, "/") + "/"
+	}
+	payload, _ := json.Marshal(map[string]string{"SecretId": cfg.Secret})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" {
+		return nil, fmt.Errorf("no AWS credentials found")
+	}
+	signV4(req, creds, region, "secretsmanager", payload, time.Now())
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.SecretString == nil {
+		return nil, fmt.Errorf("secret %s has no secret string", cfg.Secret)
+	}
+	return []byte(*resp.SecretString), nil
+}
+
+// fetchGCPSecret accesses a version of a GCP Secret Manager secret, with the OAuth
+// access token of gcpAccessToken.
+func fetchGCPSecret(ctx context.Context, cfg CredentialsConfig) ([]byte, error) {
+	name := strings.TrimPrefix(cfg.Secret, "/")
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := gcpAccessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok)
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("unexpected Secret Manager response for %s", cfg.Secret)
+	}
+	return base64.StdEncoding.DecodeString(resp.Payload.Data)
+}
+
+// doSecretRequest sends req and returns the body of a 2xx response. The body of other
+// responses is not included in the error, since it may echo the secret.
+func doSecretRequest(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Redacted(), resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
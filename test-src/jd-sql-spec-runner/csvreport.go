@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvReportHeader names the columns of --report csv and tsv. Like the fields of the JSON
+// report they are part of the format: add columns at the end rather than renaming or
+// reordering them, so loaded history stays comparable.
+var csvReportHeader = []string{
+	"started_at", "kind", "engine", "case", "class", "status", "classification", "exit", "duration_ms", "output_sha256",
+}
+
+func writeCSVReport(w io.Writer, run suiteRun) error {
+	return writeDelimitedReport(w, run, ',')
+}
+
+func writeTSVReport(w io.Writer, run suiteRun) error {
+	return writeDelimitedReport(w, run, '\t')
+}
+
+// writeDelimitedReport writes a header and one row per case, for loading the results of
+// runs into a spreadsheet or warehouse. Every row repeats the start of the run, so the
+// rows of many runs can be appended to one table.
+func writeDelimitedReport(w io.Writer, run suiteRun, comma rune) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	if err := cw.Write(csvReportHeader); err != nil {
+		return err
+	}
+	started := run.Start.UTC().Format(time.RFC3339Nano)
+	for _, r := range run.Results {
+		row := []string{
+			started, run.Kind, run.Engine, r.Case.Name, r.Case.Class, string(r.Status), exitClassification(r),
+			strconv.Itoa(r.Exit), fmt.Sprintf("%.3f", milliseconds(r.Duration)), outputHash(r),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// outputHash returns the SHA-256 of the normalized output of r, so that outputs can be
+// compared across runs, releases and engines without storing them, or "" for a case
+// that was not executed.
+func outputHash(r caseResult) string {
+	if r.Status == statusSkip {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalizeOutput(r.Output)))
+	return hex.EncodeToString(sum[:])
+}
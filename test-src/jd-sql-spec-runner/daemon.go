@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/lib/pq"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// daemonEnv names the socket of a daemon that diff, patch and translate runs use when it
+// listens, without --daemon.
+const daemonEnv = "JD_SQL_DAEMON"
+
+// defaultDaemonSocket is the name of the socket of daemon without --socket, in
+// daemonSocketDir.
+const defaultDaemonSocket = "jdsql.sock"
+
+// daemonIdentity is what decides the result of a run besides its flags and inputs: the
+// database and the settings of its connections, and the jd-sql functions and statement
+// called. A client only sends its runs to a daemon of the same identity, so that they
+// give what a direct run would.
+type daemonIdentity struct {
+	// DSN is the SHA-256 of the connection string with the settings the runner adds,
+	// such as the collation and the search path, and of the Cloud SQL instance.
+	DSN            string       `json:"dsn"`
+	Implementation string       `json:"implementation"`
+	Naming         jdsql.Naming `json:"naming"`
+	// SQL is the SHA-256 of the config's sql, or "".
+	SQL string `json:"sql,omitempty"`
+}
+
+// configIdentity returns the identity of the daemon of cfg.
+func configIdentity(cfg Config) (daemonIdentity, error) {
+	dsn, _, err := postgresDSN(cfg)
+	if err != nil {
+		return daemonIdentity{}, err
+	}
+	sum := sha256.Sum256([]byte(dsn + "\x00" + cfg.CloudSQL.Instance))
+	id := daemonIdentity{DSN: hex.EncodeToString(sum[:]), Implementation: cfg.implementation(), Naming: cfg.naming()}
+	if cfg.SQL != "" {
+		sum := sha256.Sum256([]byte(cfg.SQL))
+		id.SQL = hex.EncodeToString(sum[:])
+	}
+	return id, nil
+}
+
+// daemonRequest is the body of POST /v1/run: a single attempt at the invocation the
+// client built from its flags and inputs, and the identity the client expects of the
+// daemon. Retries, traces, --redact and --record-to are left to the client, as they are
+// in a direct run (see runInvocation).
+type daemonRequest struct {
+	Identity   daemonIdentity `json:"identity"`
+	Invocation invocation     `json:"invocation"`
+}
+
+// daemonResponse is the result of a run by the daemon. A run that failed sets Error and
+// Exit, the exit code of the error, and the fields of the Postgres error if there is one,
+// so that the client reports it as a direct run would. Trace is what the daemon saw of
+// the query, for -v and reports of the client.
+type daemonResponse struct {
+	Output   string      `json:"output"`
+	Exit     int         `json:"exit"`
+	Error    string      `json:"error,omitempty"`
+	SQLState string      `json:"sqlstate,omitempty"`
+	Message  string      `json:"message,omitempty"`
+	Detail   string      `json:"detail,omitempty"`
+	Hint     string      `json:"hint,omitempty"`
+	Trace    daemonTrace `json:"trace"`
+}
+
+// daemonTrace is the part of an execTrace filled by the daemon.
+type daemonTrace struct {
+	SQL        string `json:"sql"`
+	Rows       int    `json:"rows"`
+	ColumnType string `json:"column_type,omitempty"`
+}
+
+// daemonError is an error of a run by the daemon. It wraps the Postgres error of the run,
+// if any, so asPatchConflict and exitCode see it.
+type daemonError struct {
+	msg  string
+	exit int
+	pq   *pq.Error
+}
+
+func (e *daemonError) Error() string { return e.msg }
+
+func (e *daemonError) Unwrap() error {
+	if e.pq == nil {
+		return nil
+	}
+	return e.pq
+}
+
+// runDaemon keeps a connection pool to the configured database open and runs the
+// invocations that short-lived runner processes send on the unix socket --socket, until
+// interrupted. The clients skip connecting, authenticating and preparing statements,
+// which is most of the latency of a small diff. The socket is only accessible to the
+// user running the daemon.
+func runDaemon(flags cliFlags, cfg Config) (int, error) {
+	socket := flags.value("socket")
+	if socket == "" {
+		dir, err := daemonSocketDir()
+		if err != nil {
+			return 2, err
+		}
+		socket = filepath.Join(dir, defaultDaemonSocket)
+	}
+
+	identity, err := configIdentity(cfg)
+	if err != nil {
+		return 2, fmt.Errorf("failed to connect to postgres: %s: %w", cfg.DSN, err)
+	}
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	configurePool(db, cfg, runtime.GOMAXPROCS(0))
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+	// Open and authenticate the first connection now rather than on the first request
+	if err := pingDaemonPool(db.PingContext); err != nil {
+		return 2, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	ln, err := listenDaemon(socket)
+	if err != nil {
+		return 2, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/identity", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(identity)
+	})
+	mux.HandleFunc("POST /v1/run", func(w http.ResponseWriter, r *http.Request) {
+		var req daemonRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeDaemonResponse(w, http.StatusBadRequest, daemonResponse{Exit: 2, Error: "invalid request: " + err.Error()})
+			return
+		}
+		if req.Identity != identity {
+			writeDaemonResponse(w, http.StatusConflict, daemonResponse{Exit: 2, Error: "the daemon serves another config"})
+			return
+		}
+		inv := req.Invocation
+		trace := &execTrace{log: logger}
+		start := time.Now()
+		out, code, err := "", exitInputLimit, inputLimits.checkInvocation(inv)
+		if err == nil {
+			out, code, err = queryInvocation(r.Context(), stmts, inv, trace)
+		}
+		if err != nil && inv.TranslateIn != "" {
+			err = describeTranslateError(stmts, inv, err)
+		}
+		if verbose {
+			trace.RoundTrip, trace.Attempts, trace.Err = time.Since(start), 1, err
+			logTrace(trace)
+		}
+		resp := daemonResponse{Output: out, Exit: code, Trace: daemonTrace{SQL: trace.SQL, Rows: trace.Rows, ColumnType: trace.ColumnType}}
+		if err != nil {
+			resp.Exit, resp.Error = exitCode(err), err.Error()
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) {
+				resp.SQLState, resp.Message, resp.Detail, resp.Hint = string(pqErr.Code), pqErr.Message, pqErr.Detail, pqErr.Hint
+			}
+		}
+		writeDaemonResponse(w, http.StatusOK, resp)
+	})
+
+	ctx := baseContext
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context { return ctx }}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+	logger.Info("daemon listening", "socket", socket)
+
+	// Idle connections are pinged so that they stay open and authenticated between
+	// requests, however long the editor waits
+	keepalive := time.NewTicker(defaultKeepalive)
+	defer keepalive.Stop()
+serve:
+	for {
+		select {
+		case err := <-errc:
+			return 2, fmt.Errorf("failed to serve: %s: %w", socket, err)
+		case <-keepalive.C:
+			if err := pingDaemonPool(db.PingContext); err != nil {
+				logger.Warn("keepalive ping failed", "error", err)
+			}
+		case <-ctx.Done():
+			break serve
+		}
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		return 2, fmt.Errorf("failed to shut down: %w", err)
+	}
+	return 0, nil
+}
+
+func pingDaemonPool(ping func(context.Context) error) error {
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	return ping(ctx)
+}
+
+// listenDaemon listens on the unix socket path, readable and writable by the user only
+// from its creation on (see listenPrivate). A socket left behind by a daemon that is
+// gone is replaced; one that a daemon still listens on is an error.
+func listenDaemon(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon already listens on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %s: %w", path, err)
+		}
+	}
+	ln, err := listenPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %s: %w", path, err)
+	}
+	return ln, nil
+}
+
+func writeDaemonResponse(w http.ResponseWriter, status int, resp daemonResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// flagDaemonSocket returns the socket of the daemon that runs the diff, and whether it
+// was given with --daemon rather than taken from JD_SQL_DAEMON. The environment is
+// ignored for the runs the daemon does not support.
+func flagDaemonSocket(args cliArgs) (string, bool) {
+	if v := args.Flags.value("daemon"); v != "" {
+		return v, true
+	}
+	if v := os.Getenv(daemonEnv); v != "" && daemonUnsupported(args) == "" {
+		return v, false
+	}
+	return "", false
+}
+
+// daemonUnsupported names the flag or mode of args that the daemon cannot run, or "".
+// The daemon runs single diffs, patches and translations of input files.
+func daemonUnsupported(args cliArgs) string {
+	switch {
+	case args.Command != "":
+		return args.Command
+	case args.Table != nil:
+		return "table mode"
+	case args.queryMode():
+		return "query mode"
+	case args.Update != nil:
+		return "update mode"
+	case args.Git != nil:
+		return "--git"
+	case args.Manifest != "" || args.Spec != "":
+		return "batch and spec modes"
+	case isDir(args.FileA) || isDir(args.FileB):
+		return "directory mode"
+	case args.Chain != nil:
+		return "patch chains"
+	case flagHunks(args.Flags):
+		return "-f hunks-ndjson"
+	}
+	for _, name := range []string{"report", "explain", "verify-determinism", "engines", "impl",
+		"dry-run", "chunk", "tui", "watch", "split", "ndjson", "interactive"} {
+		if args.Flags.enabled(name) {
+			return "--" + name
+		}
+	}
+	return ""
+}
+
+// validateDaemon rejects --daemon for the runs the daemon does not support.
+func validateDaemon(args cliArgs) error {
+	if args.Flags.value("daemon") == "" {
+		return nil
+	}
+	if what := daemonUnsupported(args); what != "" {
+		return fmt.Errorf("--daemon is not supported with %s", what)
+	}
+	return nil
+}
+
+// runDaemonClient runs the diff, patch or translate of fileA and fileB through the daemon
+// listening on socket and prints the result as runPostgres does, retrying and tracing
+// the attempts the daemon makes as a direct run would. ok is false when the run should
+// connect itself instead: when no daemon listens on a socket taken from JD_SQL_DAEMON,
+// the socket is owned by another user, or the daemon serves another config than cfg
+// (see daemonIdentity). With --daemon these are errors.
+func runDaemonClient(flags cliFlags, cfg Config, socket, fileA, fileB string, explicit bool) (code int, ok bool, err error) {
+	aText, bText, err := readInputs(fileA, fileB)
+	if err != nil {
+		return 2, true, err
+	}
+	inv := flagInvocation(flags, aText, bText)
+	if flags.enabled("validate-local") {
+		if err := validateLocal(inv, fileA, fileB); err != nil {
+			return 2, true, err
+		}
+	}
+
+	identity, err := configIdentity(cfg)
+	if err != nil {
+		return 2, true, fmt.Errorf("failed to connect to postgres: %s: %w", cfg.DSN, err)
+	}
+	if err := checkSocketOwner(socket); err != nil && !os.IsNotExist(err) {
+		if !explicit {
+			logger.Warn("not using the daemon, connecting directly", "socket", socket, "error", err)
+			return 0, false, nil
+		}
+		return 2, true, fmt.Errorf("failed to reach the daemon: %w", err)
+	}
+	served, err := daemonIdentityOf(socket)
+	var netErr *net.OpError
+	if errors.As(err, &netErr) && netErr.Op == "dial" && !explicit {
+		logger.Debug("no daemon listens, connecting directly", "socket", socket, "error", err)
+		return 0, false, nil
+	}
+	if err != nil {
+		return exitConnection, true, fmt.Errorf("failed to reach the daemon: %s: %w", socket, err)
+	}
+	if served != identity {
+		if !explicit {
+			logger.Debug("the daemon serves another config, connecting directly", "socket", socket)
+			return 0, false, nil
+		}
+		return 2, true, fmt.Errorf("the daemon listening on %s serves another config (database, implementation or sql)", socket)
+	}
+
+	req := daemonRequest{Identity: identity, Invocation: inv}
+	req.Invocation.Redact = nil
+	out, code, err := runInvocation(inv, nil, func(trace *execTrace) (string, int, error) {
+		return queryDaemon(socket, req, trace)
+	})
+	if c, ok := asPatchConflict(err); ok && inv.Patch {
+		format, _ := flagConflictFormat(flags)
+		writeConflict(os.Stderr, c, format)
+		return 1, true, nil
+	}
+	code, err = printResult(inv, out, code, err)
+	return code, true, err
+}
+
+// queryDaemon makes one attempt at the invocation of req on the daemon listening on
+// socket, filling trace with what the daemon saw of the query.
+func queryDaemon(socket string, req daemonRequest, trace *execTrace) (string, int, error) {
+	resp, err := callDaemon(socket, req)
+	if err != nil {
+		return "", exitConnection, fmt.Errorf("failed to reach the daemon: %s: %w", socket, err)
+	}
+	if trace != nil {
+		trace.SQL, trace.Rows, trace.ColumnType = resp.Trace.SQL, resp.Trace.Rows, resp.Trace.ColumnType
+		_, trace.Params = req.Invocation.query()
+	}
+	if resp.Error != "" {
+		derr := &daemonError{msg: resp.Error, exit: resp.Exit}
+		if resp.SQLState != "" {
+			derr.pq = &pq.Error{Code: pq.ErrorCode(resp.SQLState), Message: resp.Message, Detail: resp.Detail, Hint: resp.Hint}
+		}
+		return "", resp.Exit, derr
+	}
+	return resp.Output, resp.Exit, nil
+}
+
+// daemonIdentityOf returns the identity of the daemon listening on socket.
+func daemonIdentityOf(socket string) (daemonIdentity, error) {
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://jd-sql-daemon/v1/identity", nil)
+	if err != nil {
+		return daemonIdentity{}, err
+	}
+	hresp, err := daemonClient(socket).Do(hreq)
+	if err != nil {
+		return daemonIdentity{}, err
+	}
+	defer hresp.Body.Close()
+	var id daemonIdentity
+	if err := json.NewDecoder(hresp.Body).Decode(&id); err != nil {
+		return daemonIdentity{}, fmt.Errorf("invalid daemon response: %w", err)
+	}
+	return id, nil
+}
+
+// daemonClient returns an HTTP client that connects to the daemon listening on socket.
+func daemonClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+// callDaemon sends req to the daemon listening on socket and returns its response.
+func callDaemon(socket string, req daemonRequest) (daemonResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return daemonResponse{}, err
+	}
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://jd-sql-daemon/v1/run", bytes.NewReader(body))
+	if err != nil {
+		return daemonResponse{}, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hresp, err := daemonClient(socket).Do(hreq)
+	if err != nil {
+		return daemonResponse{}, err
+	}
+	defer hresp.Body.Close()
+	var resp daemonResponse
+	if err := json.NewDecoder(hresp.Body).Decode(&resp); err != nil {
+		return daemonResponse{}, fmt.Errorf("invalid daemon response: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// flagDeterminism returns the number of runs of --verify-determinism and the number of
+// connections of --determinism-connections (default 1), or zero runs when the check is
+// off.
+func flagDeterminism(flags cliFlags) (runs, conns int, err error) {
+	v := flags.value("verify-determinism")
+	c := flags.value("determinism-connections")
+	if v == "" {
+		if c != "" {
+			return 0, 0, errors.New("--determinism-connections requires --verify-determinism")
+		}
+		return 0, 0, nil
+	}
+	runs, err = strconv.Atoi(v)
+	if err != nil || runs < 2 {
+		return 0, 0, fmt.Errorf("invalid --verify-determinism value '%s' (expected a number of runs >= 2)", v)
+	}
+	conns = 1
+	if c != "" {
+		conns, err = strconv.Atoi(c)
+		if err != nil || conns < 1 || conns > runs {
+			return 0, 0, fmt.Errorf("invalid --determinism-connections value '%s' (expected 1 to the number of runs, %d)", c, runs)
+		}
+	}
+	return runs, conns, nil
+}
+
+// validateDeterminism rejects --verify-determinism outside a single run.
+func validateDeterminism(args cliArgs, inv invocation) error {
+	runs, _, err := flagDeterminism(args.Flags)
+	if err != nil || runs == 0 {
+		return err
+	}
+	if args.Command != "" || args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil ||
+		args.Chain != nil || args.Manifest != "" || args.Spec != "" || isDir(args.FileA) ||
+		args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.enabled("watch") ||
+		args.Flags.enabled("tui") || args.Flags.enabled("interactive") || args.Flags.value("chunk") != "" {
+		return errors.New("--verify-determinism is only supported for a single run")
+	}
+	if args.Flags.value("report") != "" || args.Flags.enabled("explain") || oracle != nil {
+		return errors.New("--verify-determinism cannot be combined with --report, --explain or --oracle")
+	}
+	return nil
+}
+
+// determinismRun is the outcome of one run of a determinism check.
+type determinismRun struct {
+	pid    int
+	output string
+	code   int
+	err    string
+}
+
+// verifyDeterminism runs inv runs times, spread in turn over conns connections, each
+// its own backend, and fails unless every run has the same exit code, error and output,
+// compared after normalizeOutput so that only differences in content count, such as the
+// order of the elements of an array. When the runs agree, the output of the first is
+// written as for a plain run, with its exit code.
+func verifyDeterminism(db *sql.DB, inv invocation, runs, conns int) (int, error) {
+	sessions := make([]*sql.Conn, conns)
+	pids := make([]int, conns)
+	for i := range sessions {
+		conn, err := db.Conn(baseContext)
+		if err != nil {
+			return 2, fmt.Errorf("failed to connect to postgres: %w", err)
+		}
+		defer conn.Close()
+		if err := conn.QueryRowContext(baseContext, "select pg_backend_pid()").Scan(&pids[i]); err != nil {
+			return 2, fmt.Errorf("failed to connect to postgres: %w", err)
+		}
+		sessions[i] = conn
+	}
+
+	var first determinismRun
+	var firstOut string
+	var firstErr error
+	for i := 0; i < runs; i++ {
+		if err := stopped(); err != nil {
+			return 2, err
+		}
+		out, code, err := execInvocation(sessions[i%conns], inv)
+		run := determinismRun{pid: pids[i%conns], output: normalizeOutput(out), code: code}
+		if err != nil {
+			run.err = err.Error()
+		}
+		if i == 0 {
+			first, firstOut, firstErr = run, out, err
+			continue
+		}
+		if run.output != first.output || run.code != first.code || run.err != first.err {
+			return 2, fmt.Errorf("nondeterministic result: run %d of %d (backend %d) differs from run 1 (backend %d)\n%s",
+				i+1, runs, run.pid, first.pid, describeDeterminism(first, run, i+1))
+		}
+	}
+	if firstErr != nil {
+		return first.code, firstErr
+	}
+	if err := writeOutput(inv, firstOut); err != nil {
+		return 2, err
+	}
+	return first.code, nil
+}
+
+// describeDeterminism renders how run b, the nth, differs from the first run a.
+func describeDeterminism(a, b determinismRun, n int) string {
+	var parts []string
+	if a.code != b.code {
+		parts = append(parts, fmt.Sprintf("exit code %d, then %d", a.code, b.code))
+	}
+	if a.err != b.err {
+		parts = append(parts, fmt.Sprintf("error %q, then %q", a.err, b.err))
+	}
+	if a.output != b.output {
+		parts = append(parts, strings.TrimRight(unifiedDiff("run 1", "run "+strconv.Itoa(n), a.output, b.output), "\n"))
+	}
+	return strings.Join(parts, "\n")
+}
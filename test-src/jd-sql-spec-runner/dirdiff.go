@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// devNull is printed in file headers for the side of a pair that does not exist.
+const devNull = "/dev/null"
+
+func isDir(p string) bool {
+	st, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	return st.IsDir()
+}
+
+// listJSONFiles returns the slash separated paths of all *.json files below root,
+// relative to root.
+func listJSONFiles(root string) (map[string]bool, error) {
+	files := map[string]bool{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.EqualFold(filepath.Ext(p), ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %s: %w", root, err)
+	}
+	return files, nil
+}
+
+// runDirectoryDiff diffs matching *.json files of two directory trees, like diff -r.
+// A file present on only one side is diffed against NULL, so it shows up as a full
+// addition or removal. Each non-empty diff is preceded by a "diff <A> <B>" header.
+// The exit code is 2 if any pair failed, otherwise 1 if any pair differed. The pairs
+// are diffed with the format and options of a single diff.
+func runDirectoryDiff(flags cliFlags, cfg Config, dirA, dirB string) (int, error) {
+	if m := flagInvocation(flags, nil, nil).mode(); m != "diff" {
+		return 2, fmt.Errorf("%s mode is not supported with directories", m)
+	}
+	filesA, err := listJSONFiles(dirA)
+	if err != nil {
+		return 2, err
+	}
+	filesB, err := listJSONFiles(dirB)
+	if err != nil {
+		return 2, err
+	}
+	all := make([]string, 0, len(filesA)+len(filesB))
+	for rel := range filesA {
+		all = append(all, rel)
+	}
+	for rel := range filesB {
+		if !filesA[rel] {
+			all = append(all, rel)
+		}
+	}
+	sort.Strings(all)
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	configurePool(db, cfg, 1)
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	progress := newProgress(flags, len(all))
+	exit := 0
+	for _, rel := range all {
+		if err := stopped(); err != nil {
+			progress.close()
+			return exitCode(err), err
+		}
+		progress.running(rel)
+		code := diffDirectoryPair(flags, stmts, dirA, dirB, rel, filesA[rel], filesB[rel])
+		progress.finished(code == 2)
+		exit = max(exit, code)
+	}
+	progress.close()
+	return exit, nil
+}
+
+// diffDirectoryPair diffs the file rel of dirA and dirB, either of which may be missing,
+// and prints a non-empty diff. Failures are logged; the result is the exit
+// code of the pair.
+func diffDirectoryPair(flags cliFlags, stmts querier, dirA, dirB, rel string, inA, inB bool) int {
+	pathA, pathB := devNull, devNull
+	var aText, bText []byte
+	var err error
+	if inA {
+		pathA = filepath.Join(dirA, filepath.FromSlash(rel))
+		if aText, err = readInput(pathA); err != nil {
+			logger.Error("failed to read input file A", "path", pathA, "error", err)
+			return 2
+		}
+	}
+	if inB {
+		pathB = filepath.Join(dirB, filepath.FromSlash(rel))
+		if bText, err = readInput(pathB); err != nil {
+			logger.Error("failed to read input file B", "path", pathB, "error", err)
+			return 2
+		}
+	}
+
+	inv := flagInvocation(flags, aText, bText)
+	out, code, err := execInvocation(stmts, inv)
+	if err != nil {
+		logger.Error("diff failed", "a", pathA, "b", pathB, "error", err)
+		return 2
+	}
+	if code == 0 {
+		return 0
+	}
+	fmt.Fprintf(os.Stdout, "diff %s %s\n", pathA, pathB)
+	if err := writeOutput(inv, out); err != nil {
+		logger.Error("failed to write diff", "a", pathA, "b", pathB, "error", err)
+		return 2
+	}
+	if !strings.HasSuffix(out, "\n") {
+		fmt.Fprintln(os.Stdout)
+	}
+	return code
+}
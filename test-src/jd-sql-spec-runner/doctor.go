@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// expectedTypes are the jd-sql types the runner and the spec cases depend on.
+var expectedTypes = []string{
+	"jd_option", "jd_path", "jd_patch", "jd_merge",
+	"jd_diff_format", "jd_metadata", "jd_diff_element",
+}
+
+// expectedFunctions are the public jd-sql functions, by regprocedure signature.
+var expectedFunctions = []string{
+	"jd_diff(jsonb,jsonb,jd_option,jd_diff_format)",
+	"jd_diff_at(jsonb,jsonb,jd_path,jd_option,jd_diff_format)",
+	"jd_diff_stat(jsonb,jsonb,jd_option)",
+	"jd_diff_hunks(jsonb,jsonb,jd_option)",
+	"jd_diff_paths(jsonb,jsonb,jd_option)",
+	"jd_translate_diff_format(jsonb,jd_diff_format,jd_diff_format,boolean)",
+	"jd_translate_roundtrip(jsonb,jd_diff_format,jd_diff_format,boolean)",
+	"jd_invert_diff(jsonb,jd_diff_format)",
+	"jd_diff_is_empty(jsonb,jd_diff_format)",
+	"jd_patch_text(jsonb,text)",
+	"jd_patch_check(jsonb,jsonb,jd_diff_format)",
+	"jd_merge3(jsonb,jsonb,jsonb,jd_option)",
+	"jd_canonical_hash(jsonb)",
+	"jd_canonicalize(jsonb)",
+	"jd_schema_defaults(jsonb,jsonb,boolean)",
+	"jd_normalize_unicode(jsonb,text)",
+	"jd_apply_patch(jsonb,jd_patch)",
+	"jd_apply_merge(jsonb,jd_merge)",
+	"jd_equal(jsonb,jsonb,jd_option)",
+	"jd_diff_struct(jsonb,jsonb,jd_option)",
+	"jd_diff_text(jsonb,jsonb,jd_option)",
+	"jd_diff_patch(jsonb,jsonb,jd_option)",
+	"jd_diff_merge(jsonb,jsonb,jd_option)",
+	"jd_render_diff_text(jd_diff_element[],jd_option)",
+	"jd_render_diff_patch(jd_diff_element[])",
+	"jd_render_diff_merge(jd_diff_element[])",
+	"jd_render_diff(jsonb,jd_option,jd_diff_format)",
+	"jd_read_diff_text(text)",
+	"jd_read_diff_patch(jd_patch)",
+	"jd_read_diff_merge(jd_merge)",
+	"jd_patch_struct(jsonb,jd_diff_element[])",
+}
+
+// expectedSettings are server settings that change how jd-sql results come out.
+var expectedSettings = []struct {
+	Name, Value, Why string
+}{
+	{"standard_conforming_strings", "on", "backslashes in string literals would be treated as escapes"},
+	{"server_encoding", "UTF8", "jsonb cannot store non-ASCII \\u escapes in other encodings"},
+}
+
+// doctorReport prints check results and remembers whether any check failed.
+type doctorReport struct {
+	w      io.Writer
+	failed bool
+}
+
+func (r *doctorReport) ok(format string, a ...any) {
+	fmt.Fprintf(r.w, "ok   %s\n", fmt.Sprintf(format, a...))
+}
+
+func (r *doctorReport) warn(format string, a ...any) {
+	fmt.Fprintf(r.w, "warn %s\n", fmt.Sprintf(format, a...))
+}
+
+func (r *doctorReport) fail(format string, a ...any) {
+	r.failed = true
+	fmt.Fprintf(r.w, "FAIL %s\n", fmt.Sprintf(format, a...))
+}
+
+// runDoctor checks that the configured database has the jd-sql surface the runner expects.
+// It exits 1 if a type, function or setting is missing or wrong; a version that differs
+// from the packaged one is only a warning.
+func runDoctor(cfg Config) (int, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx := baseContext
+	r := &doctorReport{w: os.Stdout}
+
+	var server string
+	if err := db.QueryRowContext(ctx, "select version()").Scan(&server); err != nil {
+		return 2, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	r.ok("connected: %s", server)
+	var path string
+	if err := db.QueryRowContext(ctx, "select current_setting('search_path')").Scan(&path); err != nil {
+		return 2, fmt.Errorf("failed to read setting search_path: %w", err)
+	}
+	r.ok("implementation %s (search_path = %s)", cfg.implementation(), path)
+
+	for _, s := range expectedSettings {
+		var v string
+		if err := db.QueryRowContext(ctx, "select current_setting($1)", s.Name).Scan(&v); err != nil {
+			return 2, fmt.Errorf("failed to read setting %s: %w", s.Name, err)
+		}
+		if strings.EqualFold(v, s.Value) {
+			r.ok("%s = %s", s.Name, v)
+		} else {
+			r.fail("%s = %s, expected %s (%s)", s.Name, v, s.Value, s.Why)
+		}
+	}
+
+	for _, t := range expectedTypes {
+		var found bool
+		if err := db.QueryRowContext(ctx, "select to_regtype($1) is not null", t).Scan(&found); err != nil {
+			return 2, fmt.Errorf("failed to look up type %s: %w", t, err)
+		}
+		if found {
+			r.ok("type %s", t)
+		} else {
+			r.fail("type %s is missing", t)
+		}
+	}
+	var labels string
+	err = db.QueryRowContext(ctx, `select string_agg(enumlabel, ',' order by enumsortorder)
+from pg_enum
+where enumtypid = to_regtype('jd_diff_format')`).Scan(&labels)
+	if err == nil && labels != "" && labels != "jd,patch,merge,jd2" {
+		r.fail("type jd_diff_format has labels %s, expected jd,patch,merge,jd2", labels)
+	}
+
+	for _, f := range expectedFunctions {
+		var found bool
+		// to_regprocedure raises for unknown argument types, so check those first
+		err := db.QueryRowContext(ctx, `select case
+           when exists (select 1
+                        from unnest(string_to_array(substring($1 from '\((.*)\)'), ',')) t
+                        where to_regtype(t) is null) then false
+           else to_regprocedure($1) is not null end`, sqlNaming.Qualify(f)).Scan(&found)
+		if err != nil {
+			return 2, fmt.Errorf("failed to look up function %s: %w", f, err)
+		}
+		if found {
+			r.ok("function %s", f)
+		} else {
+			r.fail("function %s is missing", f)
+		}
+	}
+
+	if err := checkInstalledVersion(ctx, db, r); err != nil {
+		return 2, err
+	}
+
+	if r.failed {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// checkInstalledVersion compares the install recorded in jd_sql_meta with the latest
+// packaged release.
+func checkInstalledVersion(ctx context.Context, db *sql.DB, r *doctorReport) error {
+	latest := sqlReleases[len(sqlReleases)-1]
+	script, err := packagedSQL.ReadFile(latest.Script)
+	if err != nil {
+		return fmt.Errorf("failed to read packaged SQL: %s: %w", latest.Script, err)
+	}
+	checksum := sqlChecksum(script)
+
+	var hasMeta bool
+	if err := db.QueryRowContext(ctx, "select to_regclass('jd_sql_meta') is not null").Scan(&hasMeta); err != nil {
+		return fmt.Errorf("failed to look up jd_sql_meta: %w", err)
+	}
+	if !hasMeta {
+		r.warn("installed version unknown (no jd_sql_meta; the runner expects %s, see `install`)", latest.Version)
+		return nil
+	}
+	var version, installed string
+	err = db.QueryRowContext(ctx, "select version, checksum from jd_sql_meta order by installed_at desc limit 1").
+		Scan(&version, &installed)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		r.warn("installed version unknown (jd_sql_meta is empty; the runner expects %s)", latest.Version)
+	case err != nil:
+		return fmt.Errorf("failed to read jd_sql_meta: %w", err)
+	case version != latest.Version:
+		r.warn("installed jd-sql %s, the runner expects %s", version, latest.Version)
+	case installed != checksum:
+		r.warn("installed jd-sql %s differs from the packaged script (checksum %.12s, expected %.12s)", version, installed, checksum)
+	default:
+		r.ok("installed jd-sql %s", version)
+	}
+	return nil
+}
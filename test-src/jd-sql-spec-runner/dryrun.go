@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// dryRunMode returns the --dry-run style: "literal" (parameters inlined as SQL literals),
+// "psql" (parameters as psql variables) or "" when --dry-run is not given.
+func dryRunMode(flags cliFlags) (string, error) {
+	switch v := flags.value("dry-run"); v {
+	case "true":
+		// --dry-run alone
+		return "literal", nil
+	case "", "false":
+		return "", nil
+	case "literal", "psql":
+		return v, nil
+	default:
+		return "", fmt.Errorf("unsupported --dry-run style '%s' (supported: literal, psql)", v)
+	}
+}
+
+// runDryRun prints the statements a run would execute, without connecting. Batch and
+// spec runs print one statement per case, headed by a comment naming the case.
+func runDryRun(cfg Config, args cliArgs, style string) (int, error) {
+	if args.Command != "" {
+		return 2, fmt.Errorf("--dry-run is not supported with %s", args.Command)
+	}
+	if td := args.Table; td != nil && td.sourced() {
+		// The diffs of the pairs depend on the rows read, so only the reads are printed
+		fmt.Fprintln(os.Stdout, "-- --source-a")
+		writeDryRunSQL(os.Stdout, td.sourceQuery(td.TableA, td.QueryA, td.ColumnA), nil, style, "")
+		fmt.Fprintln(os.Stdout, "\n-- --source-b")
+		writeDryRunSQL(os.Stdout, td.sourceQuery(td.TableB, td.QueryB, td.ColumnB), nil, style, "")
+		return 0, nil
+	}
+	if args.Table != nil {
+		sqlText, params := args.Table.query(flagInvocation(args.Flags, nil, nil))
+		writeDryRunSQL(os.Stdout, sqlText, params, style, "")
+		return 0, nil
+	}
+	if args.queryMode() {
+		inv, err := flagQueryInvocation(cfg, args)
+		if err != nil {
+			return 2, err
+		}
+		writeDryRun(os.Stdout, inv, style, "")
+		return 0, nil
+	}
+	if args.Manifest == "" && args.Spec == "" {
+		if isDir(args.FileA) || isDir(args.FileB) {
+			return 2, fmt.Errorf("--dry-run is not supported in directory mode")
+		}
+		aText, bText, err := readInputs(args.FileA, args.FileB)
+		if err != nil {
+			return 2, err
+		}
+		writeDryRun(os.Stdout, flagInvocation(args.Flags, aText, bText), style, "")
+		return 0, nil
+	}
+
+	_, cases, err := loadSuiteCases(args)
+	if err != nil {
+		return 2, err
+	}
+	if cases, err = filterCases(args.Flags, cases); err != nil {
+		return 2, err
+	}
+	for i, c := range cases {
+		if i > 0 {
+			fmt.Fprintln(os.Stdout)
+		}
+		fmt.Fprintf(os.Stdout, "-- %s (%s)\n", c.Name, c.Source)
+		if c.Skip != "" {
+			fmt.Fprintf(os.Stdout, "-- skipped: %s\n", c.Skip)
+			continue
+		}
+		inv, err := c.prepare()
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "-- error: %v\n", err)
+			continue
+		}
+		writeDryRunHooks(os.Stdout, c.Hooks.Setup, style)
+		writeDryRun(os.Stdout, inv, style, fmt.Sprintf("c%d_", i+1))
+		writeDryRunHooks(os.Stdout, c.Hooks.Teardown, style)
+	}
+	return 0, nil
+}
+
+// writeDryRun writes the statement of inv terminated by a semicolon. In psql style the
+// parameters are first assigned to psql variables named <prefix>p1, <prefix>p2, ...
+// and referenced as :'name', so the statement can be pasted into psql as is.
+func writeDryRun(w io.Writer, inv invocation, style, prefix string) {
+	sqlText, params := inv.query()
+	writeDryRunSQL(w, sqlText, params, style, prefix)
+}
+
+func writeDryRunSQL(w io.Writer, sqlText string, params []any, style, prefix string) {
+	values := make([]string, len(params))
+	for i, p := range params {
+		switch {
+		case p == nil:
+			values[i] = "NULL"
+		case style == "psql":
+			name := fmt.Sprintf("%sp%d", prefix, i+1)
+			fmt.Fprintf(w, "\\set %s %s\n", name, psqlQuote(fmt.Sprint(p)))
+			values[i] = ":'" + name + "'"
+		default:
+			values[i] = sqlLiteral(fmt.Sprint(p))
+		}
+	}
+	fmt.Fprintf(w, "%s;\n", inlineParams(sqlText, values))
+}
+
+// inlineParams replaces the $N placeholders of sqlText with values[N-1].
+func inlineParams(sqlText string, values []string) string {
+	var sb strings.Builder
+	for i := 0; i < len(sqlText); i++ {
+		if sqlText[i] == '$' {
+			j := i + 1
+			for j < len(sqlText) && sqlText[j] >= '0' && sqlText[j] <= '9' {
+				j++
+			}
+			var n int
+			if j > i+1 {
+				fmt.Sscanf(sqlText[i+1:j], "%d", &n)
+			}
+			if n >= 1 && n <= len(values) {
+				sb.WriteString(values[n-1])
+				i = j - 1
+				continue
+			}
+		}
+		sb.WriteByte(sqlText[i])
+	}
+	return sb.String()
+}
+
+// sqlLiteral quotes s as a standard conforming SQL string literal.
+func sqlLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// psqlQuote quotes s for a psql \set argument, where backslash sequences are
+// interpreted and a quote is written as two.
+func psqlQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `'`, `''`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+	return "'" + s + "'"
+}
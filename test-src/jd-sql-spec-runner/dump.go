@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// dumpDir is the directory dump writes to without --dir.
+const dumpDir = "jd-sql-dump"
+
+// installedObject is a jd-sql function or type as installed in the database.
+type installedObject struct {
+	// Name is the name of the object in the database, with any function prefix.
+	Name string
+	// Signature identifies a function as regprocedure does, without the function
+	// prefix: name(type,...). It is the name for types.
+	Signature string
+	// DDL recreates the object: pg_get_functiondef for functions, and a statement built
+	// from the catalogs for types.
+	DDL string
+	// Source is the body of a function (pg_proc.prosrc).
+	Source string
+}
+
+// dumpFunctionsSQL lists the jd-sql functions visible in the session, or those of the
+// implementation schema ($1), whose names are the function prefix ($2) followed by jd_ or
+// _jd_.
+const dumpFunctionsSQL = `select p.proname,
+       substr(p.proname, length($2) + 1) || '(' || replace(oidvectortypes(p.proargtypes), ', ', ',') || ')',
+       pg_get_functiondef(p.oid),
+       p.prosrc
+from pg_proc p
+         join pg_namespace n on n.oid = p.pronamespace
+where p.prokind in ('f', 'p')
+  and left(p.proname, length($2)) = $2
+  and substr(p.proname, length($2) + 1) ~ '^_?jd_'
+  and case when $1 = '' then pg_function_is_visible(p.oid) else n.nspname = $1 end
+order by 2`
+
+// dumpTypesSQL lists the jd-sql enums, domains and composite types visible in the
+// session, or those of the implementation schema ($1), with a statement recreating each.
+const dumpTypesSQL = `select t.typname,
+       t.typname,
+       case t.typtype
+           when 'e' then format(E'create type %s as enum (%s);\n', format_type(t.oid, null),
+                                (select string_agg(quote_literal(e.enumlabel), ', ' order by e.enumsortorder)
+                                 from pg_enum e
+                                 where e.enumtypid = t.oid))
+           when 'd' then format(E'create domain %s as %s%s%s%s;\n', format_type(t.oid, null),
+                                format_type(t.typbasetype, t.typtypmod),
+                                coalesce(' default ' || t.typdefault, ''),
+                                case when t.typnotnull then ' not null' else '' end,
+                                coalesce((select string_agg(format(E'\n    constraint %I %s', c.conname,
+                                                                   pg_get_constraintdef(c.oid)), '' order by c.conname)
+                                          from pg_constraint c
+                                          where c.contypid = t.oid), ''))
+           else format(E'create type %s as\n(\n%s\n);\n', format_type(t.oid, null),
+                       (select string_agg(format('    %I %s', a.attname, format_type(a.atttypid, a.atttypmod)),
+                                          E',\n' order by a.attnum)
+                        from pg_attribute a
+                        where a.attrelid = t.typrelid
+                          and a.attnum > 0
+                          and not a.attisdropped))
+           end,
+       ''
+from pg_type t
+         join pg_namespace n on n.oid = t.typnamespace
+where t.typname ~ '^jd_'
+  and (t.typtype in ('d', 'e') or
+       t.typtype = 'c' and exists (select 1 from pg_class c where c.oid = t.typrelid and c.relkind = 'c'))
+  and case when $1 = '' then pg_type_is_visible(t.oid) else n.nspname = $1 end
+order by 1`
+
+// runDump reads the source of the installed jd-sql functions and types from the
+// catalogs. It writes one file per object to --dir, or with --diff compares the
+// functions with those of a packaged release and prints the differences.
+func runDump(flags cliFlags, cfg Config) (int, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx := baseContext
+	functions, err := dumpObjects(ctx, db, dumpFunctionsSQL, cfg.implementationSchema(), cfg.FunctionPrefix)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read the installed functions: %w", err)
+	}
+	types, err := dumpObjects(ctx, db, dumpTypesSQL, cfg.implementationSchema())
+	if err != nil {
+		return 2, fmt.Errorf("failed to read the installed types: %w", err)
+	}
+
+	dir := flags.value("dir")
+	diff := flags.enabled("diff")
+	if !diff || dir != "" {
+		dir = coalesceNonEmpty(dir, dumpDir)
+		if err := writeDump(dir, functions, types); err != nil {
+			return 2, err
+		}
+		fmt.Fprintf(os.Stdout, "wrote %d functions and %d types to %s\n", len(functions), len(types), dir)
+	}
+	if !diff {
+		return 0, nil
+	}
+	rel, err := findSQLRelease(flags.value("version"))
+	if err != nil {
+		return 2, err
+	}
+	return diffDump(ctx, db, rel, functions, types)
+}
+
+// dumpObjects runs one of the dump statements and returns the objects it lists.
+func dumpObjects(ctx context.Context, db *sql.DB, q string, args ...any) ([]installedObject, error) {
+	rows, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var objects []installedObject
+	for rows.Next() {
+		var o installedObject
+		if err := rows.Scan(&o.Name, &o.Signature, &o.DDL, &o.Source); err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+	}
+	return objects, rows.Err()
+}
+
+// writeDump writes the functions to dir/functions and the types to dir/types, one file
+// per name; the overloads of a function share its file.
+func writeDump(dir string, functions, types []installedObject) error {
+	for sub, objects := range map[string][]installedObject{"functions": functions, "types": types} {
+		files := map[string]*strings.Builder{}
+		var names []string
+		for _, o := range objects {
+			b, ok := files[o.Name]
+			if !ok {
+				b = &strings.Builder{}
+				files[o.Name] = b
+				names = append(names, o.Name)
+			} else {
+				b.WriteString("\n")
+			}
+			b.WriteString(strings.TrimRight(o.DDL, "\n"))
+			if sub == "functions" {
+				// pg_get_functiondef leaves out the terminating semicolon
+				b.WriteString(";")
+			}
+			b.WriteString("\n")
+		}
+		path := filepath.Join(dir, sub)
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return fmt.Errorf("failed to create dump directory: %s: %w", path, err)
+		}
+		for _, name := range names {
+			file := filepath.Join(path, name+".sql")
+			if err := os.WriteFile(file, []byte(files[name].String()), 0o644); err != nil {
+				return fmt.Errorf("failed to write dump file: %s: %w", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	// packagedFunction matches the head of a function in a release script, up to the
+	// dollar quote opening its body.
+	packagedFunction = regexp.MustCompile(`(?is)create\s+or\s+replace\s+function\s+([a-z0-9_]+)\s*\((.*?)\)\s*(?:returns|language)\b.*?\bas\s*(\$[a-z0-9_]*\$)`)
+	// packagedType matches the name of a type or domain created by a release script.
+	packagedType = regexp.MustCompile(`(?i)create\s+(?:type|domain)\s+([a-z0-9_]+)`)
+	// argDefault matches the default of a function argument.
+	argDefault = regexp.MustCompile(`(?is)\s+default\s.*$|\s*=.*$`)
+)
+
+// packagedObjects reads the functions and types a release script creates, keyed like
+// the installed ones. The argument types of the functions are normalized by the server
+// with format_type, so that int and integer, say, compare equal.
+func packagedObjects(ctx context.Context, db *sql.DB, script string) (map[string]string, map[string]bool, error) {
+	type function struct {
+		name   string
+		types  []string
+		source string
+	}
+	var functions []function
+	var allTypes []string
+	for _, m := range packagedFunction.FindAllStringSubmatchIndex(script, -1) {
+		tag := script[m[6]:m[7]]
+		end := strings.Index(script[m[1]:], tag)
+		if end < 0 {
+			return nil, nil, fmt.Errorf("unterminated body of function %s", script[m[2]:m[3]])
+		}
+		f := function{name: strings.ToLower(script[m[2]:m[3]]), source: script[m[1] : m[1]+end]}
+		for _, arg := range splitArgs(script[m[4]:m[5]]) {
+			fields := strings.Fields(argDefault.ReplaceAllString(arg, ""))
+			if len(fields) > 0 {
+				switch strings.ToLower(fields[0]) {
+				case "out":
+					// Output arguments are not part of the signature
+					continue
+				case "in", "inout", "variadic":
+					fields = fields[1:]
+				}
+			}
+			if len(fields) > 1 {
+				fields = fields[1:]
+			}
+			f.types = append(f.types, strings.Join(fields, " "))
+		}
+		allTypes = append(allTypes, f.types...)
+		functions = append(functions, f)
+	}
+
+	rows, err := db.QueryContext(ctx, `select coalesce(format_type(to_regtype(t), null), t)
+from unnest($1::text[]) with ordinality as u(t, n)
+order by n`, pq.Array(allTypes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to normalize argument types: %w", err)
+	}
+	defer rows.Close()
+	var normalized []string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, nil, fmt.Errorf("failed to normalize argument types: %w", err)
+		}
+		normalized = append(normalized, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to normalize argument types: %w", err)
+	}
+
+	sources := map[string]string{}
+	for _, f := range functions {
+		n := len(f.types)
+		sources[f.name+"("+strings.Join(normalized[:n], ",")+")"] = f.source
+		normalized = normalized[n:]
+	}
+	types := map[string]bool{}
+	for _, m := range packagedType.FindAllStringSubmatch(script, -1) {
+		types[strings.ToLower(m[1])] = true
+	}
+	return sources, types, nil
+}
+
+// splitArgs splits a function argument list at the commas outside parentheses and
+// quotes.
+func splitArgs(s string) []string {
+	var args []string
+	depth, quoted, start := 0, false, 0
+	for i, r := range s {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case quoted:
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			args = append(args, s[start:i])
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(s[start:]) != "" {
+		args = append(args, s[start:])
+	}
+	return args
+}
+
+// diffDump compares the installed functions and types with those of rel and prints
+// the missing, extra and changed ones; changed functions are followed by a unified
+// diff of their bodies. Types are compared by name only. It exits 1 when anything
+// differs.
+func diffDump(ctx context.Context, db *sql.DB, rel sqlRelease, functions, types []installedObject) (int, error) {
+	script, err := packagedSQL.ReadFile(rel.Script)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read packaged SQL: %s: %w", rel.Script, err)
+	}
+	packaged, packagedTypes, err := packagedObjects(ctx, db, string(script))
+	if err != nil {
+		return 2, fmt.Errorf("failed to read packaged SQL: %s: %w", rel.Script, err)
+	}
+
+	installed := map[string]string{}
+	for _, f := range functions {
+		installed[f.Signature] = f.Source
+	}
+	installedTypes := map[string]bool{}
+	for _, t := range types {
+		installedTypes[t.Signature] = true
+	}
+
+	differences := 0
+	report := func(kind string, packaged, installed map[string]bool) {
+		for _, name := range sortedUnion(packaged, installed) {
+			switch {
+			case !installed[name]:
+				fmt.Fprintf(os.Stdout, "missing %s %s\n", kind, name)
+			case !packaged[name]:
+				fmt.Fprintf(os.Stdout, "extra %s %s\n", kind, name)
+			default:
+				continue
+			}
+			differences++
+		}
+	}
+	report("type", packagedTypes, installedTypes)
+	report("function", keySet(packaged), keySet(installed))
+	for _, sig := range sortedUnion(keySet(packaged), keySet(installed)) {
+		p, inP := packaged[sig]
+		i, inI := installed[sig]
+		if !inP || !inI || p == i {
+			continue
+		}
+		differences++
+		fmt.Fprintf(os.Stdout, "changed function %s\n", sig)
+		fmt.Fprint(os.Stdout, unifiedDiff(rel.Version+"/"+sig, "installed/"+sig, p, i))
+	}
+
+	if differences > 0 {
+		fmt.Fprintf(os.Stdout, "dump: %d differences from jd-sql %s\n", differences, rel.Version)
+		return 1, nil
+	}
+	fmt.Fprintf(os.Stdout, "dump: %d functions and %d types match jd-sql %s\n", len(functions), len(types), rel.Version)
+	return 0, nil
+}
+
+// keySet returns the keys of m as a set.
+func keySet(m map[string]string) map[string]bool {
+	set := make(map[string]bool, len(m))
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+// sortedUnion returns the keys of a and b, sorted.
+func sortedUnion(a, b map[string]bool) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if !a[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
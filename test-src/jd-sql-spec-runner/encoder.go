@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+	"jd-sql/test-runner/render"
+)
+
+// Encoder renders the output of an invocation, as returned by the database, to w.
+type Encoder interface {
+	Encode(w io.Writer, inv invocation, out string) error
+}
+
+// EncoderFunc adapts a function to the Encoder interface.
+type EncoderFunc func(w io.Writer, inv invocation, out string) error
+
+func (f EncoderFunc) Encode(w io.Writer, inv invocation, out string) error {
+	return f(w, inv, out)
+}
+
+// encoders are the encoders selectable with --output-format, by name.
+var encoders = map[string]Encoder{}
+
+// registerEncoder makes e selectable with --output-format name.
+func registerEncoder(name string, e Encoder) {
+	if _, ok := encoders[name]; ok {
+		panic("encoder registered twice: " + name)
+	}
+	encoders[name] = e
+}
+
+func init() {
+	registerEncoder("raw", EncoderFunc(encodeRaw))
+	registerEncoder("compact-json", EncoderFunc(encodeCompactJSON))
+	registerEncoder("pretty-json", EncoderFunc(encodePrettyJSON))
+	registerEncoder("color", EncoderFunc(encodeColor))
+	registerEncoder("stat", EncoderFunc(encodeStat))
+	registerEncoder("paths", EncoderFunc(encodePaths))
+	registerEncoder("sidebyside", EncoderFunc(encodeSideBySide))
+}
+
+// outputEncoder is the encoder selected with --output-format, or nil to select one by
+// the kind of output (see defaultEncoder).
+var outputEncoder Encoder
+
+// encoderNames lists the registered encoders in name order.
+func encoderNames() []string {
+	names := make([]string, 0, len(encoders))
+	for name := range encoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flagEncoder returns the encoder selected with --output-format, or nil.
+func flagEncoder(flags cliFlags) (Encoder, error) {
+	v := strings.ToLower(strings.TrimSpace(flags.value("output-format")))
+	if v == "" {
+		return nil, nil
+	}
+	e, ok := encoders[v]
+	if !ok {
+		return nil, fmt.Errorf("invalid --output-format value '%s' (expected %s)", v, strings.Join(encoderNames(), ", "))
+	}
+	return e, nil
+}
+
+// validateOutputFormat rejects the encoders that render output inv does not produce:
+// stat needs --stat, paths needs -f paths or paths-json and sidebyside -f sidebyside.
+func validateOutputFormat(args cliArgs, inv invocation) error {
+	v := strings.ToLower(strings.TrimSpace(args.Flags.value("output-format")))
+	switch {
+	case v == "":
+		return nil
+	case v == "stat" && !inv.Stat:
+		return errors.New("--output-format stat requires --stat")
+	case v == "paths" && inv.Paths == "":
+		return errors.New("--output-format paths requires -f paths or -f paths-json")
+	case v == "sidebyside" && !inv.SideBySide:
+		return errors.New("--output-format sidebyside requires -f sidebyside")
+	case args.Table != nil || inv.Hunks || args.Update != nil:
+		return errors.New("--output-format is not supported in table and update modes and with -f hunks-ndjson")
+	}
+	return nil
+}
+
+// defaultEncoder selects the encoder of the output of inv when --output-format is not
+// given: the summary of --stat, the paths of -f paths, the columns of -f sidebyside,
+// indented canonical forms, and colorized jd diffs when colorOutput is set. Anything
+// else, such as patch results and JSON diffs, is printed as is.
+func defaultEncoder(inv invocation) Encoder {
+	switch {
+	case inv.Stat:
+		return encoders["stat"]
+	case inv.Paths == formatPaths:
+		return encoders["paths"]
+	case inv.SideBySide:
+		return encoders["sidebyside"]
+	case inv.Canonicalize:
+		return encoders["pretty-json"]
+	case colorOutput && jdsql.IsJdText(inv.outputFormat()):
+		return encoders["color"]
+	}
+	return encoders["raw"]
+}
+
+func encodeRaw(w io.Writer, _ invocation, out string) error {
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+// encodeCompactJSON writes JSON output on one line; output that is not a JSON value,
+// such as a jd diff, is written as is.
+func encodeCompactJSON(w io.Writer, inv invocation, out string) error {
+	var buf bytes.Buffer
+	if strings.TrimSpace(out) == "" || json.Compact(&buf, []byte(out)) != nil {
+		return encodeRaw(w, inv, out)
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// encodePrettyJSON writes JSON output indented by two spaces, which keeps its key order
+// and number literals; output that is not a JSON value is written as is.
+func encodePrettyJSON(w io.Writer, inv invocation, out string) error {
+	var buf bytes.Buffer
+	if strings.TrimSpace(out) == "" || json.Indent(&buf, []byte(strings.TrimSpace(out)), "", "  ") != nil {
+		return encodeRaw(w, inv, out)
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// encodeColor writes jd diff text colorized whatever --color says.
+func encodeColor(w io.Writer, _ invocation, out string) error {
+	return render.Diff(w, out, true)
+}
+
+func encodeStat(w io.Writer, inv invocation, out string) error {
+	return encodeRaw(w, inv, renderStat(out))
+}
+
+func encodePaths(w io.Writer, inv invocation, out string) error {
+	return encodeRaw(w, inv, renderPaths(out))
+}
+
+func encodeSideBySide(w io.Writer, inv invocation, out string) error {
+	return encodeRaw(w, inv, renderSideBySide(out, inv.Width, colorOutput))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncoders(t *testing.T) {
+	const diff = "@ [\"a\"]\n- 1\n+ 2\n"
+	tests := []struct {
+		name    string
+		encoder string
+		out     string
+		want    string
+	}{
+		{name: "raw json", encoder: "raw", out: "{\"a\": [1, 2]}\n", want: "{\"a\": [1, 2]}\n"},
+		{name: "raw text", encoder: "raw", out: diff, want: diff},
+		{name: "raw empty", encoder: "raw", out: "", want: ""},
+		{name: "compact json", encoder: "compact-json", out: "{\n  \"a\": [1, 2]\n}", want: "{\"a\":[1,2]}\n"},
+		{name: "compact text", encoder: "compact-json", out: diff, want: diff},
+		{name: "compact empty", encoder: "compact-json", out: "", want: ""},
+		{name: "pretty json", encoder: "pretty-json", out: "{\"b\":1.50,\"a\":[1]}", want: "{\n  \"b\": 1.50,\n  \"a\": [\n    1\n  ]\n}\n"},
+		{name: "pretty text", encoder: "pretty-json", out: diff, want: diff},
+		{name: "pretty empty", encoder: "pretty-json", out: " \n", want: " \n"},
+		{name: "color", encoder: "color", out: diff, want: "\x1b[2m@ [\"a\"]\x1b[0m\n\x1b[31m- 1\x1b[0m\n\x1b[32m+ 2\x1b[0m\n"},
+		{name: "color empty", encoder: "color", out: "", want: ""},
+		{
+			name:    "stat",
+			encoder: "stat",
+			out:     `{"additions":1,"removals":0,"modifications":1,"paths":[{"path":["a"],"additions":0,"removals":0,"modifications":1},{"path":["bb"],"additions":1,"removals":0,"modifications":0}]}`,
+			want:    " [\"a\"]  | 1 modified\n [\"bb\"] | 1 added\n 2 paths changed, 1 addition, 0 removals, 1 modification\n",
+		},
+		{name: "stat equal", encoder: "stat", out: `{"additions":0,"removals":0,"modifications":0,"paths":[]}`, want: ""},
+		{name: "stat not a summary", encoder: "stat", out: diff, want: diff},
+		{name: "paths", encoder: "paths", out: `[["a"], ["b", 0]]`, want: "[\"a\"]\n[\"b\",0]\n"},
+		{name: "paths equal", encoder: "paths", out: `[]`, want: ""},
+		{name: "paths not an array", encoder: "paths", out: diff, want: diff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := encoders[tt.encoder].Encode(&buf, invocation{}, tt.out); err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("%s encoded %q as %q, want %q", tt.encoder, tt.out, got, tt.want)
+			}
+		})
+	}
+}
+
+// encoderName returns the name e is registered under, or "" if it is not registered.
+func encoderName(e Encoder) string {
+	for name, r := range encoders {
+		if reflect.ValueOf(r).Pointer() == reflect.ValueOf(e).Pointer() {
+			return name
+		}
+	}
+	return ""
+}
+
+func TestDefaultEncoder(t *testing.T) {
+	tests := []struct {
+		name  string
+		inv   invocation
+		color bool
+		want  string
+	}{
+		{name: "jd diff", inv: invocation{Format: "jd"}, want: "raw"},
+		{name: "jd diff in color", inv: invocation{Format: "jd"}, color: true, want: "color"},
+		{name: "jd2 diff in color", inv: invocation{Format: "jd2"}, color: true, want: "color"},
+		{name: "patch diff in color", inv: invocation{Format: "patch"}, color: true, want: "raw"},
+		{name: "translation to jd in color", inv: invocation{TranslateIn: "patch", TranslateOut: "jd"}, color: true, want: "color"},
+		{name: "patched document in color", inv: invocation{Format: "jd", Patch: true}, color: true, want: "raw"},
+		{name: "stat", inv: invocation{Format: "jd", Stat: true}, want: "stat"},
+		{name: "paths", inv: invocation{Paths: formatPaths}, want: "paths"},
+		{name: "paths-json", inv: invocation{Paths: formatPathsJSON}, want: "raw"},
+		{name: "sidebyside", inv: invocation{SideBySide: true}, want: "sidebyside"},
+		{name: "canonicalize", inv: invocation{Canonicalize: true}, color: true, want: "pretty-json"},
+	}
+	defer func(c bool) { colorOutput = c }(colorOutput)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			colorOutput = tt.color
+			if got := encoderName(defaultEncoder(tt.inv)); got != tt.want {
+				t.Errorf("defaultEncoder = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// diffFlags parses args as the flags of the diff command.
+func diffFlags(t *testing.T, args ...string) cliFlags {
+	t.Helper()
+	cmd, _ := lookupCommand("diff")
+	fs := newFlagSet(cmd)
+	if _, err := parseFlags(fs, args); err != nil {
+		t.Fatalf("failed to parse %v: %v", args, err)
+	}
+	return cliFlags{fs}
+}
+
+func TestValidateOutputFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags []string
+		args  cliArgs
+		inv   invocation
+		err   string
+	}{
+		{name: "not given"},
+		{name: "raw", flags: []string{"--output-format", "raw"}},
+		{name: "case and spaces", flags: []string{"--output-format", " Pretty-JSON "}},
+		{name: "stat", flags: []string{"--output-format", "stat"}, inv: invocation{Stat: true}},
+		{name: "stat without --stat", flags: []string{"--output-format", "stat"}, err: "--output-format stat requires --stat"},
+		{name: "paths", flags: []string{"--output-format", "paths"}, inv: invocation{Paths: formatPathsJSON}},
+		{name: "paths without -f paths", flags: []string{"--output-format", "paths"}, err: "--output-format paths requires -f paths or -f paths-json"},
+		{name: "sidebyside", flags: []string{"--output-format=sidebyside"}, inv: invocation{SideBySide: true}},
+		{name: "sidebyside without -f sidebyside", flags: []string{"--output-format=sidebyside"}, err: "--output-format sidebyside requires -f sidebyside"},
+		{name: "table mode", flags: []string{"--output-format", "raw"}, args: cliArgs{Table: &tableDiff{}}, err: "--output-format is not supported in table and update modes"},
+		{name: "update mode", flags: []string{"--output-format", "raw"}, args: cliArgs{Update: &updateTarget{}}, err: "--output-format is not supported in table and update modes"},
+		{name: "hunks", flags: []string{"--output-format", "raw"}, inv: invocation{Hunks: true}, err: "and with -f hunks-ndjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			args.Flags = diffFlags(t, tt.flags...)
+			err := validateOutputFormat(args, tt.inv)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("validateOutputFormat: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("validateOutputFormat = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
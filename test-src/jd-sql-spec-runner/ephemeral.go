@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// defaultEphemeralImage matches the POSTGRES_MAJOR default of the Taskfile.
+const defaultEphemeralImage = "postgres:17"
+
+// ephemeralStartTimeout bounds the wait for a fresh container to accept connections.
+const ephemeralStartTimeout = 90 * time.Second
+
+// isEphemeral reports whether cfg selects a disposable Postgres container with engine:
+// postgres-ephemeral. --ephemeral selects one for every engine.
+func isEphemeral(cfg Config) bool {
+	return strings.EqualFold(cfg.Engine, "postgres-ephemeral")
+}
+
+// startEphemeralPostgres starts a throwaway Postgres container with the docker CLI (the
+// same tool the pg:* tasks drive), waits for it to accept connections and installs the
+// packaged jd-sql SQL. It returns cfg pointed at the container and a function that
+// removes the container.
+func startEphemeralPostgres(cfg Config) (Config, func(), error) {
+	image := coalesceNonEmpty(cfg.Image, defaultEphemeralImage)
+	logger.Info("starting ephemeral postgres", "image", image)
+	out, err := dockerCmd("run", "-d", "--rm",
+		"-e", "POSTGRES_PASSWORD=postgres",
+		"-p", "127.0.0.1::5432",
+		"--label", "jd-sql.ephemeral=true",
+		image)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("failed to start ephemeral postgres: %w", err)
+	}
+	id := strings.TrimSpace(out)
+	stop := func() {
+		if _, err := dockerCmd("rm", "-f", "-v", id); err != nil {
+			logger.Warn("failed to remove ephemeral postgres container", "container", fmt.Sprintf("%.12s", id), "error", err)
+		}
+	}
+
+	out, err = dockerCmd("port", id, "5432/tcp")
+	if err != nil {
+		stop()
+		return cfg, nil, fmt.Errorf("failed to find ephemeral postgres port: %w", err)
+	}
+	// docker port prints one line per binding, e.g. 127.0.0.1:49153
+	addr := strings.TrimSpace(strings.SplitN(out, "\n", 2)[0])
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		stop()
+		return cfg, nil, fmt.Errorf("unexpected docker port output %q: %w", addr, err)
+	}
+	cfg.Engine = "postgres"
+	cfg.DSN = fmt.Sprintf("postgres://postgres:postgres@%s/postgres?sslmode=disable", net.JoinHostPort(host, port))
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		stop()
+		return cfg, nil, err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(baseContext, ephemeralStartTimeout)
+	defer cancel()
+	// The image only listens on TCP once initdb has finished, so the first successful
+	// ping is the final server
+	for {
+		if err = db.PingContext(ctx); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			stop()
+			return cfg, nil, fmt.Errorf("ephemeral postgres did not accept connections within %s: %w", ephemeralStartTimeout, err)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+
+	if _, _, err := installSQL(ctx, db, sqlReleases[len(sqlReleases)-1]); err != nil {
+		stop()
+		return cfg, nil, err
+	}
+	return cfg, stop, nil
+}
+
+func dockerCmd(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("docker %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("docker %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/lib/pq"
+)
+
+// Exit codes of a run that fails with an error. 0 (no diff) and 1 (diff) report the
+// result; the others classify the error that ended the run, by its SQLSTATE class where
+// there is one. The mapping is documented and stable, so scripts can rely on it.
+const (
+	// exitError is an SQL or semantic error, invalid input or invalid usage.
+	exitError = 2
+	// exitConnection is a failure to reach or stay connected to the database: SQLSTATE
+	// class 08, an administrator shutdown (57P01-57P03) or a network error.
+	exitConnection = 3
+	// exitAuth is a rejected login: SQLSTATE class 28.
+	exitAuth = 4
+	// exitNotInstalled is a missing jd-sql function or type (42883, 42704).
+	exitNotInstalled = 5
+	// exitTimeout is a query cancelled by statement_timeout (57014) or by the client
+	// deadline of --query-timeout, or a run stopped by --total-timeout.
+	exitTimeout = 6
+	// exitInputLimit is an input exceeding the limits of the config (errInputLimit).
+	exitInputLimit = 7
+	// exitInterrupted is a run stopped by SIGINT or SIGTERM, as shells report a
+	// command killed by SIGINT.
+	exitInterrupted = 130
+)
+
+// exitCode returns the exit code of a run that failed with err.
+func exitCode(err error) int {
+	if errors.Is(err, errInterrupted) || interrupted() {
+		return exitInterrupted
+	}
+	if errors.Is(err, errInputLimit) {
+		return exitInputLimit
+	}
+	var daemonErr *daemonError
+	if errors.As(err, &daemonErr) {
+		// Classified by the daemon, which saw the error itself
+		return daemonErr.exit
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errTotalTimeout) {
+		return exitTimeout
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		code := string(pqErr.Code)
+		switch {
+		case code == "57014":
+			return exitTimeout
+		case strings.HasPrefix(code, "08"), code == "57P01", code == "57P02", code == "57P03":
+			return exitConnection
+		case strings.HasPrefix(code, "28"):
+			return exitAuth
+		case code == "42883", code == "42704":
+			return exitNotInstalled
+		}
+		return exitError
+	}
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.As(err, &netErr) {
+		return exitConnection
+	}
+	return exitError
+}
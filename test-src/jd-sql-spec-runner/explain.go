@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// planStats are the statistics of an EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) plan. The
+// buffer counts are those of the top plan node, which include its children and the
+// functions it calls.
+type planStats struct {
+	PlanningMS  float64
+	ExecutionMS float64
+	SharedHit   int64
+	SharedRead  int64
+	TempRead    int64
+	TempWritten int64
+}
+
+// explainPlan runs the statement of inv under EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON)
+// and returns the plan, as Postgres returns it, and its statistics. The statement is
+// executed, but its result is discarded.
+func explainPlan(db querier, inv invocation) (json.RawMessage, planStats, error) {
+	sqlText, params := inv.query()
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	var out []byte
+	if err := db.QueryRowContext(ctx, "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) "+sqlText, params...).Scan(&out); err != nil {
+		return nil, planStats{}, queryTimeouts.describe(fmt.Errorf("EXPLAIN ANALYZE failed: %w", err))
+	}
+	var plans []struct {
+		PlanningTime  float64 `json:"Planning Time"`
+		ExecutionTime float64 `json:"Execution Time"`
+		Plan          struct {
+			SharedHit   int64 `json:"Shared Hit Blocks"`
+			SharedRead  int64 `json:"Shared Read Blocks"`
+			TempRead    int64 `json:"Temp Read Blocks"`
+			TempWritten int64 `json:"Temp Written Blocks"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(out, &plans); err != nil || len(plans) == 0 {
+		return nil, planStats{}, fmt.Errorf("unexpected EXPLAIN output: %s", out)
+	}
+	p := plans[0]
+	return out, planStats{
+		PlanningMS:  p.PlanningTime,
+		ExecutionMS: p.ExecutionTime,
+		SharedHit:   p.Plan.SharedHit,
+		SharedRead:  p.Plan.SharedRead,
+		TempRead:    p.Plan.TempRead,
+		TempWritten: p.Plan.TempWritten,
+	}, nil
+}
+
+// validateExplain rejects --explain outside a single run on input files.
+func validateExplain(args cliArgs, impls []string) error {
+	if args.Command != "" || !args.Flags.enabled("explain") {
+		// bench takes --explain as its number of samples
+		return nil
+	}
+	if args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil || args.Manifest != "" ||
+		args.Spec != "" || isDir(args.FileA) || args.Chain != nil || oracle != nil ||
+		args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.enabled("watch") ||
+		args.Flags.value("chunk") != "" || args.Flags.value("report") != "" ||
+		args.Flags.value("engines") != "" || len(impls) > 1 {
+		return errors.New("--explain is only supported for a single run on input files")
+	}
+	return nil
+}
+
+// printExplain prints the plan of inv in place of its output, and logs its timing.
+func printExplain(db querier, inv invocation) (int, error) {
+	start := time.Now()
+	plan, stats, err := explainPlan(db, inv)
+	if err != nil {
+		return 2, err
+	}
+	fmt.Fprintln(os.Stdout, string(plan))
+	logger.Info("explain", "planning_ms", stats.PlanningMS, "execution_ms", stats.ExecutionMS,
+		"round_trip_ms", milliseconds(time.Since(start)), "shared_hit_blocks", stats.SharedHit,
+		"shared_read_blocks", stats.SharedRead, "temp_read_blocks", stats.TempRead, "temp_written_blocks", stats.TempWritten)
+	return 0, nil
+}
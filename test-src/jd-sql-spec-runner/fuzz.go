@@ -0,0 +1,485 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func registerFuzzFlags(fs *flag.FlagSet) {
+	fs.Int("iterations", 1000, "number of generated pairs")
+	fs.String("duration", "", "generate pairs for this long instead of --iterations, e.g. 5m")
+	fs.String("seed", "", "random seed (default: time based, printed with the summary)")
+	fs.Int("depth", 4, "maximum nesting depth of generated documents")
+	fs.Int("width", 5, "maximum number of members of generated objects and arrays")
+	fs.String("types", "", "comma separated value types to generate (default: null,bool,number,string,object,array)")
+	fs.String("corpus", "fuzz-corpus", "directory receiving minimized failures")
+	fs.Int("max-failures", 1, "stop after this many failures (0 for no limit)")
+}
+
+// fuzzTypes are the JSON value types the generator can produce.
+var fuzzTypes = []string{"null", "bool", "number", "string", "object", "array"}
+
+// fuzzOptions are the parsed fuzz flags.
+type fuzzOptions struct {
+	Iterations  int
+	Duration    time.Duration
+	Seed        uint64
+	Depth       int
+	Width       int
+	Types       []string
+	Corpus      string
+	MaxFailures int
+}
+
+func getFuzzOptions(flags cliFlags) (fuzzOptions, error) {
+	opts := fuzzOptions{
+		Iterations:  1000,
+		Seed:        uint64(time.Now().UnixNano()),
+		Depth:       4,
+		Width:       5,
+		Types:       fuzzTypes,
+		Corpus:      coalesceNonEmpty(flags.value("corpus"), "fuzz-corpus"),
+		MaxFailures: 1,
+	}
+	for _, f := range []struct {
+		name string
+		dst  *int
+		min  int
+	}{{"iterations", &opts.Iterations, 1}, {"depth", &opts.Depth, 0}, {"width", &opts.Width, 1}, {"max-failures", &opts.MaxFailures, 0}} {
+		if v := flags.value(f.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < f.min {
+				return opts, fmt.Errorf("invalid --%s value '%s' (expected an integer >= %d)", f.name, v, f.min)
+			}
+			*f.dst = n
+		}
+	}
+	if v := flags.value("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return opts, fmt.Errorf("invalid --duration value '%s' (expected a duration such as 5m)", v)
+		}
+		opts.Duration = d
+	}
+	if v := flags.value("seed"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --seed value '%s' (expected an unsigned integer)", v)
+		}
+		opts.Seed = n
+	}
+	if v := flags.value("types"); v != "" {
+		opts.Types = nil
+		for _, t := range strings.Split(v, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if !contains(fuzzTypes, t) {
+				return opts, fmt.Errorf("invalid --types value '%s' (supported: %s)", t, strings.Join(fuzzTypes, ", "))
+			}
+			opts.Types = append(opts.Types, t)
+		}
+		if !contains(opts.Types, "object") && !contains(opts.Types, "array") {
+			return opts, fmt.Errorf("--types must include object or array")
+		}
+	}
+	return opts, nil
+}
+
+// fuzzFailure describes a failed round trip. Kind is one of "diff", "patch" and
+// "mismatch"; the minimizer only accepts reductions that fail the same way.
+type fuzzFailure struct {
+	Kind   string
+	Detail string
+}
+
+func (f fuzzFailure) String() string {
+	switch f.Kind {
+	case "diff":
+		return "jd_diff failed: " + f.Detail
+	case "patch":
+		return "patch failed: " + f.Detail
+	default:
+		return "patch(A, diff(A,B)) != B\n" + f.Detail
+	}
+}
+
+// runFuzz generates document pairs, diffs them and applies the diff to A, and reports
+// pairs for which the patched document differs from B. Failing pairs are minimized and
+// written to the corpus directory. With two input files, the pair is checked once so
+// that a corpus entry can be replayed.
+func runFuzz(cfg Config, args cliArgs) (int, error) {
+	opts, err := getFuzzOptions(args.Flags)
+	if err != nil {
+		return 2, err
+	}
+	format := getFormatFlag(args.Flags)
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	// Connection problems must not be reported as fuzz failures
+	if err := db.Ping(); err != nil {
+		return 2, fmt.Errorf("failed to connect: %w", err)
+	}
+	configurePool(db, cfg, 1)
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	check := func(a, b any) (*fuzzFailure, error) {
+		aText, _ := json.Marshal(a)
+		bText, _ := json.Marshal(b)
+		return checkRoundTrip(stmts, format, aText, bText)
+	}
+
+	if args.FileA != "" {
+		aText, bText, err := readInputs(args.FileA, args.FileB)
+		if err != nil {
+			return 2, err
+		}
+		f, err := checkRoundTrip(stmts, format, aText, bText)
+		if err != nil {
+			return 2, err
+		}
+		if f != nil {
+			printFuzzFailure(os.Stdout, fmt.Sprintf("%s %s", args.FileA, args.FileB), *f, "")
+			return 1, nil
+		}
+		fmt.Fprintf(os.Stdout, "PASS %s %s\n", args.FileA, args.FileB)
+		return 0, nil
+	}
+
+	gen := &fuzzGen{rng: rand.New(rand.NewPCG(opts.Seed, 0x6a64)), depth: opts.Depth, width: opts.Width, types: opts.Types}
+	start := time.Now()
+	pairs, failures := 0, 0
+	for ; ; pairs++ {
+		if opts.Duration > 0 {
+			if time.Since(start) >= opts.Duration {
+				break
+			}
+		} else if pairs >= opts.Iterations {
+			break
+		}
+		if opts.MaxFailures > 0 && failures >= opts.MaxFailures {
+			break
+		}
+
+		a, b := gen.pair()
+		f, err := check(a, b)
+		if err != nil {
+			return 2, err
+		}
+		if f == nil {
+			continue
+		}
+		failures++
+		a, b, f, err = minimizeFuzzPair(check, a, b, f)
+		if err != nil {
+			return 2, err
+		}
+		base, err := writeFuzzCorpus(opts.Corpus, a, b, *f, format, opts.Seed)
+		if err != nil {
+			return 2, err
+		}
+		printFuzzFailure(os.Stdout, fmt.Sprintf("pair %d", pairs+1), *f, base)
+	}
+
+	fmt.Fprintf(os.Stdout, "fuzz: %d pairs, %d failures (format %s, seed %d)\n", pairs, failures, format, opts.Seed)
+	if failures > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func printFuzzFailure(w *os.File, name string, f fuzzFailure, base string) {
+	lines := strings.Split(strings.TrimRight(f.String(), "\n"), "\n")
+	fmt.Fprintf(w, "FAIL %s: %s\n", name, lines[0])
+	for _, l := range lines[1:] {
+		fmt.Fprintf(w, "    %s\n", l)
+	}
+	if base != "" {
+		fmt.Fprintf(w, "    minimized pair written to %s.a.json and %s.b.json\n", base, base)
+	}
+}
+
+// checkRoundTrip diffs a and b in format, applies the diff to a and returns the failure,
+// or nil when the result equals b. SQL errors are failures; other errors, such as a lost
+// connection, are returned.
+func checkRoundTrip(db querier, format string, a, b []byte) (*fuzzFailure, error) {
+	diff, _, err := execInvocation(db, invocation{A: a, B: b, Format: format})
+	if err != nil {
+		if isServerError(err) {
+			return &fuzzFailure{Kind: "diff", Detail: err.Error()}, nil
+		}
+		return nil, err
+	}
+	patched, _, err := execInvocation(db, invocation{A: []byte(diff), B: a, Format: format, Patch: true})
+	if err != nil {
+		if isServerError(err) {
+			return &fuzzFailure{Kind: "patch", Detail: fmt.Sprintf("%v\ndiff:\n%s", err, diff)}, nil
+		}
+		return nil, err
+	}
+	var want, got any
+	if json.Unmarshal(b, &want) != nil || json.Unmarshal([]byte(patched), &got) != nil || !reflect.DeepEqual(want, got) {
+		return &fuzzFailure{Kind: "mismatch", Detail: fmt.Sprintf("diff:\n%s\npatched: %s\nB:       %s", diff, patched, b)}, nil
+	}
+	return nil, nil
+}
+
+// fuzzMinimizeBudget bounds the number of round trips spent minimizing one failure.
+const fuzzMinimizeBudget = 1000
+
+// minimizeFuzzPair shrinks a failing pair one reduction at a time (dropping an object
+// member or array element, emptying a string, zeroing a number), first in A and then in
+// B, keeping a reduction when the pair still fails the same way.
+func minimizeFuzzPair(check func(a, b any) (*fuzzFailure, error), a, b any, f *fuzzFailure) (any, any, *fuzzFailure, error) {
+	pair := [2]any{a, b}
+	budget := fuzzMinimizeBudget
+	for progress := true; progress && budget > 0; {
+		progress = false
+		for side := 0; side < 2 && !progress && budget > 0; side++ {
+			for _, c := range fuzzShrinks(pair[side]) {
+				if budget == 0 {
+					break
+				}
+				budget--
+				next := pair
+				next[side] = c
+				got, err := check(next[0], next[1])
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				if got != nil && got.Kind == f.Kind {
+					pair, f, progress = next, got, true
+					break
+				}
+			}
+		}
+	}
+	return pair[0], pair[1], f, nil
+}
+
+// fuzzShrinks returns the variants of v that are one reduction smaller.
+func fuzzShrinks(v any) []any {
+	var out []any
+	switch t := v.(type) {
+	case map[string]any:
+		keys := sortedKeys(t)
+		for _, k := range keys {
+			c := maps.Clone(t)
+			delete(c, k)
+			out = append(out, c)
+		}
+		for _, k := range keys {
+			for _, s := range fuzzShrinks(t[k]) {
+				c := maps.Clone(t)
+				c[k] = s
+				out = append(out, c)
+			}
+		}
+	case []any:
+		for i := range t {
+			out = append(out, slices.Delete(slices.Clone(t), i, i+1))
+		}
+		for i := range t {
+			for _, s := range fuzzShrinks(t[i]) {
+				c := slices.Clone(t)
+				c[i] = s
+				out = append(out, c)
+			}
+		}
+	case string:
+		if t != "" {
+			out = append(out, "")
+		}
+	case float64:
+		if t != 0 {
+			out = append(out, float64(0))
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeFuzzCorpus writes a failing pair as <hash>.a.json and <hash>.b.json, with the
+// failure in <hash>.txt, and returns the path without the suffixes.
+func writeFuzzCorpus(dir string, a, b any, f fuzzFailure, format string, seed uint64) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create corpus directory: %s: %w", dir, err)
+	}
+	aText, _ := json.MarshalIndent(a, "", "  ")
+	bText, _ := json.MarshalIndent(b, "", "  ")
+	sum := sha256.Sum256(append(append(aText, 0), bText...))
+	base := filepath.Join(dir, hex.EncodeToString(sum[:6]))
+	info := fmt.Sprintf("format: %s\nseed: %d\n\n%s\n", format, seed, f)
+	for _, file := range []struct {
+		suffix string
+		data   []byte
+	}{{".a.json", append(aText, '\n')}, {".b.json", append(bText, '\n')}, {".txt", []byte(info)}} {
+		if err := os.WriteFile(base+file.suffix, file.data, 0o644); err != nil {
+			return "", fmt.Errorf("failed to write corpus file: %s: %w", base+file.suffix, err)
+		}
+	}
+	return base, nil
+}
+
+// fuzzGen generates random JSON documents. Roots are always objects or arrays, so that
+// results are never bare strings, which the runner prints unquoted.
+type fuzzGen struct {
+	rng   *rand.Rand
+	depth int
+	width int
+	types []string
+}
+
+// fuzzKeys and fuzzStrings favor collisions between A and B and values that need
+// escaping in JSON or in JSON Pointer paths.
+var (
+	fuzzKeys    = []string{"a", "b", "c", "id", "name", "", " ", "a/b", "~1", "ü", `q"`}
+	fuzzStrings = []string{"", "a", "b", "hello world", "ü", "日本", "line\nbreak", `"quoted"`, `back\slash`, "/~0"}
+)
+
+// pair returns a document and, usually, a mutation of it; otherwise an unrelated one.
+func (g *fuzzGen) pair() (any, any) {
+	a := g.root()
+	if g.rng.IntN(4) == 0 {
+		return a, g.root()
+	}
+	return a, g.mutate(a, 0)
+}
+
+func (g *fuzzGen) root() any {
+	var containers []string
+	for _, t := range g.types {
+		if t == "object" || t == "array" {
+			containers = append(containers, t)
+		}
+	}
+	return g.ofType(containers[g.rng.IntN(len(containers))], 0)
+}
+
+// value returns a random value; below the maximum depth only scalars are generated.
+func (g *fuzzGen) value(depth int) any {
+	types := g.types
+	if depth >= g.depth {
+		types = slices.DeleteFunc(slices.Clone(types), func(t string) bool { return t == "object" || t == "array" })
+		if len(types) == 0 {
+			return map[string]any{}
+		}
+	}
+	return g.ofType(types[g.rng.IntN(len(types))], depth)
+}
+
+func (g *fuzzGen) ofType(t string, depth int) any {
+	switch t {
+	case "null":
+		return nil
+	case "bool":
+		return g.rng.IntN(2) == 0
+	case "number":
+		switch g.rng.IntN(4) {
+		case 0:
+			return float64(g.rng.IntN(3))
+		case 1:
+			return float64(g.rng.IntN(20001)-10000) / 100
+		case 2:
+			return float64(g.rng.Int64N(1 << 53))
+		default:
+			return float64(g.rng.IntN(2001) - 1000)
+		}
+	case "string":
+		if g.rng.IntN(2) == 0 {
+			return fuzzStrings[g.rng.IntN(len(fuzzStrings))]
+		}
+		return fmt.Sprintf("s%d", g.rng.IntN(100))
+	case "object":
+		n := g.rng.IntN(g.width + 1)
+		obj := make(map[string]any, n)
+		for i := 0; i < n; i++ {
+			obj[g.key()] = g.value(depth + 1)
+		}
+		return obj
+	default:
+		n := g.rng.IntN(g.width + 1)
+		arr := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			arr = append(arr, g.value(depth+1))
+		}
+		return arr
+	}
+}
+
+func (g *fuzzGen) key() string {
+	if g.rng.IntN(2) == 0 {
+		return fuzzKeys[g.rng.IntN(len(fuzzKeys))]
+	}
+	return fmt.Sprintf("k%d", g.rng.IntN(20))
+}
+
+// mutate returns a copy of v with random members removed, replaced, inserted or
+// mutated in turn.
+func (g *fuzzGen) mutate(v any, depth int) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t)+1)
+		for _, k := range sortedKeys(t) {
+			switch g.rng.IntN(8) {
+			case 0:
+				// removed
+			case 1:
+				out[k] = g.value(depth + 1)
+			default:
+				out[k] = g.mutate(t[k], depth+1)
+			}
+		}
+		if g.rng.IntN(3) == 0 {
+			out[g.key()] = g.value(depth + 1)
+		}
+		return out
+	case []any:
+		out := make([]any, 0, len(t)+1)
+		for _, e := range t {
+			switch g.rng.IntN(8) {
+			case 0:
+				// removed
+			case 1:
+				out = append(out, g.value(depth+1))
+			case 2:
+				out = append(out, g.value(depth+1), g.mutate(e, depth+1))
+			default:
+				out = append(out, g.mutate(e, depth+1))
+			}
+		}
+		if g.rng.IntN(3) == 0 {
+			out = append(out, g.value(depth+1))
+		}
+		return out
+	default:
+		if g.rng.IntN(4) == 0 {
+			return g.value(depth)
+		}
+		return v
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+func registerGenTriggerFlags(fs *flag.FlagSet) {
+	fs.String("table", "", "table to audit (optionally schema qualified)")
+	fs.String("column", "", "JSON column whose changes are recorded")
+	fs.String("key", "", "comma separated key columns identifying the audited rows")
+	fs.String("audit-table", "", "table the diffs are recorded in (default: <table>_audit, in the schema of the table)")
+	fs.Bool("install", false, "create the audit table and trigger in the configured database instead of printing them")
+	fs.String("f", "", "format of the recorded diffs: jd|jd2|patch|merge")
+	fs.String("format", "", "format of the recorded diffs (same as -f)")
+	registerOptionFlags(fs)
+}
+
+// auditTrigger is the audit of the changes to a JSON column: a table recording the diff
+// of the old and new value of the column on every update of a row, and the trigger
+// that records them.
+type auditTrigger struct {
+	Table      string
+	Column     string
+	Key        []string
+	AuditTable string
+	Format     string
+	Options    []byte
+}
+
+// getAuditTrigger reads the gen-trigger flags.
+func getAuditTrigger(flags cliFlags) (auditTrigger, error) {
+	at := auditTrigger{
+		Table:      flags.value("table"),
+		Column:     flags.value("column"),
+		AuditTable: flags.value("audit-table"),
+		Format:     getFormatFlag(flags),
+		Options:    flagOptions(flags),
+	}
+	for _, k := range strings.Split(flags.value("key"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			at.Key = append(at.Key, k)
+		}
+	}
+	switch {
+	case at.Table == "":
+		return at, errors.New("gen-trigger requires --table (the table to audit)")
+	case at.Column == "":
+		return at, errors.New("gen-trigger requires --column (the JSON column to audit)")
+	case len(at.Key) == 0:
+		return at, errors.New("gen-trigger requires --key (comma separated key columns)")
+	case flagPathsFormat(flags) != "":
+		return at, errors.New("gen-trigger records diffs: -f paths is not supported")
+	case len(flagRedacts(flags)) > 0:
+		return at, errors.New("--redact is not supported by gen-trigger")
+	case ignoreGlobs(flags):
+		// Wildcards are expanded against documents, which are only known in the trigger
+		return at, errors.New("gen-trigger does not support --ignore wildcards")
+	}
+	if at.AuditTable == "" {
+		at.AuditTable = at.Table + "_audit"
+	}
+	return at, nil
+}
+
+// names returns the quoted names of the objects of the audit: the table, the audit
+// table and the trigger function, both in the schema of the table unless the audit
+// table is qualified, and the trigger.
+func (at auditTrigger) names() map[string]string {
+	schema, table := "", at.Table
+	if i := strings.LastIndex(at.Table, "."); i >= 0 {
+		schema, table = at.Table[:i+1], at.Table[i+1:]
+	}
+	auditTable := at.AuditTable
+	if !strings.Contains(auditTable, ".") {
+		auditTable = schema + auditTable
+	}
+	base := table + "_" + at.Column
+	return map[string]string{
+		"Table":      quoteQualifiedIdent(at.Table),
+		"AuditTable": quoteQualifiedIdent(auditTable),
+		"Function":   quoteQualifiedIdent(schema + base + "_audit"),
+		"Trigger":    quoteIdent(base + "_audit"),
+		"KeyIndex":   quoteIdent(strings.TrimPrefix(auditTable, schema) + "_key_idx"),
+		"Column":     quoteIdent(at.Column),
+	}
+}
+
+var auditTriggerTemplate = template.Must(template.New("audit").Parse(`-- Audit of the changes to {{.Table}}.{{.Column}}: every update of a row that changes the
+-- column records the jd diff of its old and new value in {{.AuditTable}}.
+-- Generated by jd-sql-spec-runner gen-trigger.
+create table if not exists {{.AuditTable}}
+(
+    audit_id   bigint generated always as identity primary key,
+    key        jsonb       not null,
+    diff       jsonb       not null,
+    changed_at timestamptz not null default now(),
+    changed_by text        not null default current_user,
+    txid       bigint      not null default txid_current()
+);
+
+create index if not exists {{.KeyIndex}} on {{.AuditTable}} (key, changed_at);
+
+create or replace function {{.Function}}() returns trigger
+    language plpgsql as
+$$
+declare
+    d jsonb;
+begin
+    d := jd_diff(OLD.{{.Column}}::jsonb, NEW.{{.Column}}::jsonb, {{.Options}}::jsonb, {{.Format}}::jd_diff_format);
+    if not jd_diff_is_empty(d, {{.Format}}::jd_diff_format) then
+        insert into {{.AuditTable}} (key, diff) values (jsonb_build_object({{.KeyObject}}), d);
+    end if;
+    return NEW;
+end
+$$;
+
+drop trigger if exists {{.Trigger}} on {{.Table}};
+create trigger {{.Trigger}}
+    after update of {{.Column}} on {{.Table}}
+    for each row
+    when (OLD.{{.Column}}::jsonb is distinct from NEW.{{.Column}}::jsonb)
+execute function {{.Function}}();
+`))
+
+// script returns the SQL creating the audit table, the trigger function and the
+// trigger. The jd-sql names are qualified as configured, and the options and format
+// are fixed in the function when it is generated.
+func (at auditTrigger) script() string {
+	data := at.names()
+	pairs := make([]string, len(at.Key))
+	for i, k := range at.Key {
+		pairs[i] = fmt.Sprintf("%s, NEW.%s", sqlLiteral(k), quoteIdent(k))
+	}
+	data["KeyObject"] = strings.Join(pairs, ", ")
+	data["Format"] = sqlLiteral(at.Format)
+	data["Options"] = "'[]'"
+	if opts := jdsql.NullableText(at.Options); opts != nil {
+		data["Options"] = sqlLiteral(opts.(string))
+	}
+	var b strings.Builder
+	// The template only substitutes quoted names and literals
+	_ = auditTriggerTemplate.Execute(&b, data)
+	return sqlNaming.Qualify(b.String())
+}
+
+// runGenTrigger prints the audit table and trigger of the gen-trigger flags, or with
+// --install creates them in the configured database, in one transaction.
+func runGenTrigger(flags cliFlags, cfg Config) (int, error) {
+	at, err := getAuditTrigger(flags)
+	if err != nil {
+		return 2, err
+	}
+	script := at.script()
+	if !flags.enabled("install") {
+		fmt.Fprint(os.Stdout, script)
+		return 0, nil
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	tx, err := db.BeginTx(baseContext, nil)
+	if err != nil {
+		return 2, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer tx.Rollback()
+	// Without bind parameters lib/pq sends the script as one simple query
+	if _, err := tx.ExecContext(baseContext, script); err != nil {
+		return 2, fmt.Errorf("failed to install the audit trigger: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 2, fmt.Errorf("failed to commit the audit trigger: %w", err)
+	}
+	names := at.names()
+	fmt.Fprintf(os.Stdout, "installed trigger %s on %s, recording into %s\n", names["Trigger"], names["Table"], names["AuditTable"])
+	return 0, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// gitDiff holds the arguments git passes to an external diff program (see
+// GIT_EXTERNAL_DIFF in git(1)): the path, then the file, hex and mode of the old and of
+// the new version. For a rename git appends the new path and a similarity message.
+type gitDiff struct {
+	Path    string
+	OldFile string
+	NewFile string
+	// NewPath is the path after a rename, or Path.
+	NewPath string
+}
+
+// getGitDiff reads git's external diff arguments from the positional args of --git.
+func getGitDiff(pos []string) (gitDiff, error) {
+	if len(pos) != 7 && len(pos) != 9 {
+		return gitDiff{}, fmt.Errorf("--git expects git's 7 external diff arguments (path old-file old-hex old-mode new-file new-hex new-mode), got %d", len(pos))
+	}
+	gd := gitDiff{Path: pos[0], OldFile: pos[1], NewFile: pos[4], NewPath: pos[0]}
+	if len(pos) == 9 {
+		gd.NewPath = pos[7]
+	}
+	if err := ensureFilesExist(gd.OldFile, gd.NewFile); err != nil {
+		return gitDiff{}, err
+	}
+	return gd, nil
+}
+
+// runGitDiff prints the diff of one file for git diff. A side that does not exist (an
+// added or deleted file, passed as /dev/null) is bound as NULL. Files that are not JSON
+// are reported and skipped, so one README does not abort a whole git diff. Git treats
+// any non-zero exit as a failure of the program, so differences exit 0; errors exit 2.
+func runGitDiff(flags cliFlags, cfg Config, gd gitDiff) (int, error) {
+	aText, bText, err := readInputs(gd.OldFile, gd.NewFile)
+	if err != nil {
+		return 2, err
+	}
+	for _, text := range [][]byte{aText, bText} {
+		if strings.TrimSpace(string(text)) != "" && !json.Valid(text) {
+			fmt.Fprintf(os.Stdout, "jd-sql: %s is not JSON, skipped\n", gd.Path)
+			return 0, nil
+		}
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	inv := flagInvocation(flags, aText, bText)
+	if inv.mode() != "diff" {
+		return 2, fmt.Errorf("%s mode is not supported with --git", inv.mode())
+	}
+	out, code, err := execInvocation(db, inv)
+	if oracle != nil {
+		if msg := checkOracle(inv, out, code, err); msg != "" {
+			return 2, errors.New(msg)
+		}
+	}
+	if err != nil {
+		return 2, err
+	}
+	if code == 0 {
+		return 0, nil
+	}
+	fmt.Fprintf(os.Stdout, "diff --git a/%s b/%s\n--- a/%s\n+++ b/%s\n", gd.Path, gd.NewPath, gd.Path, gd.NewPath)
+	if err := writeOutput(inv, out); err != nil {
+		return 2, err
+	}
+	if !strings.HasSuffix(out, "\n") {
+		fmt.Fprintln(os.Stdout)
+	}
+	return 0, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// runHash prints the jd_canonical_hash of the document in file. A blank file is a
+// missing document, which has no hash and prints nothing.
+func runHash(cfg Config, file string) (int, error) {
+	doc, err := readInput(file)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read input file: %s: %w", file, err)
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	q, args := jdsql.HashQuery(doc)
+	var hash sql.NullString
+	if err := db.QueryRowContext(ctx, renderSQL(q), args...).Scan(&hash); err != nil {
+		return 2, queryTimeouts.describe(fmt.Errorf("query failed: %w", err))
+	}
+	if hash.Valid {
+		fmt.Fprintln(os.Stdout, hash.String)
+	}
+	return 0, nil
+}
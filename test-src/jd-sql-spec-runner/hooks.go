@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// caseHook is a setup or teardown step of a case: SQL run in the session of the case, or
+// a shell command. In case files a string is SQL, and {"shell": "..."} a command.
+type caseHook struct {
+	SQL   string `json:"sql,omitempty"`
+	Shell string `json:"shell,omitempty"`
+}
+
+func (h *caseHook) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &h.SQL); err == nil {
+		if strings.TrimSpace(h.SQL) == "" {
+			return errors.New("empty hook")
+		}
+		return nil
+	}
+	type plain caseHook
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return errors.New(`a hook is SQL text, {"sql": "..."} or {"shell": "..."}`)
+	}
+	if (strings.TrimSpace(p.SQL) == "") == (strings.TrimSpace(p.Shell) == "") {
+		return errors.New(`a hook holds either "sql" or "shell"`)
+	}
+	*h = caseHook(p)
+	return nil
+}
+
+// caseHooks are the setup and teardown hooks of a case, or of all the cases of a
+// manifest or spec file (its "suite" entry), such as SET jit = off or the creation of
+// helper data, so that the preconditions of the cases on an engine live next to them.
+type caseHooks struct {
+	Setup    []caseHook `json:"setup"`
+	Teardown []caseHook `json:"teardown"`
+}
+
+func (h caseHooks) empty() bool {
+	return len(h.Setup) == 0 && len(h.Teardown) == 0
+}
+
+// around returns the hooks of case c of the suite with hooks h: the setup of the suite
+// runs first and its teardown last.
+func (h caseHooks) around(c caseHooks) caseHooks {
+	return caseHooks{
+		Setup:    append(append([]caseHook(nil), h.Setup...), c.Setup...),
+		Teardown: append(append([]caseHook(nil), c.Teardown...), h.Teardown...),
+	}
+}
+
+// runHooked runs inv, the invocation of c, between the setup and teardown hooks of c,
+// all on one session. The teardown runs even when the setup or the case failed. A hook
+// that fails is returned as hookErr, which fails the case whatever it expects. The
+// session is discarded afterwards rather than returned to the pool, so that what the
+// hooks changed in it does not leak into other cases.
+func runHooked(db querier, c testCase, inv invocation, trace *execTrace) (out string, code int, err, hookErr error) {
+	conn, release, err := hookSession(db)
+	if err != nil {
+		return "", 2, nil, fmt.Errorf("setup: %w", err)
+	}
+	defer release()
+	code = 2
+	if hookErr = runHooks(conn, c, "setup", c.Hooks.Setup, trace); hookErr == nil {
+		out, code, err = execInvocationTrace(conn, inv, trace)
+	}
+	if terr := runHooks(conn, c, "teardown", c.Hooks.Teardown, trace); terr != nil && hookErr == nil {
+		hookErr = terr
+	}
+	return out, code, err, hookErr
+}
+
+// hookSession returns a session of db for a case with hooks, and the function that
+// discards it.
+func hookSession(db querier) (*sql.Conn, func(), error) {
+	switch q := db.(type) {
+	case *sql.Conn:
+		// The session of the caller, which owns it
+		return q, func() {}, nil
+	case *sessionStmts:
+		// The session of the worker, which replaces it
+		ctx, cancel := queryTimeouts.context(baseContext)
+		defer cancel()
+		conn, err := q.session(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, q.discard, nil
+	case interface {
+		Conn(context.Context) (*sql.Conn, error)
+	}:
+		ctx, cancel := queryTimeouts.context(baseContext)
+		defer cancel()
+		conn, err := q.Conn(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func() {
+			// database/sql closes a connection reported bad instead of reusing it
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+			conn.Close()
+		}, nil
+	}
+	return nil, nil, errors.New("no session for the hooks")
+}
+
+// runHooks runs the hooks of the given stage of c in order, stopping at the first that
+// fails. SQL hooks run on conn, and are logged like the query of the case with -v.
+func runHooks(conn *sql.Conn, c testCase, stage string, hooks []caseHook, trace *execTrace) error {
+	for i, h := range hooks {
+		if err := stopped(); err != nil {
+			return err
+		}
+		var err error
+		if h.Shell != "" {
+			err = runShellHook(c, h.Shell)
+		} else {
+			ht := &execTrace{SQL: h.SQL, Attempts: 1}
+			if trace != nil {
+				ht.log = trace.log
+			}
+			ctx, cancel := queryTimeouts.context(baseContext)
+			start := time.Now()
+			_, err = conn.ExecContext(ctx, h.SQL)
+			cancel()
+			ht.RoundTrip, ht.Err = time.Since(start), queryTimeouts.describe(err)
+			if verbose {
+				logTrace(ht)
+			}
+			err = ht.Err
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %d failed: %w", stage, i+1, err)
+		}
+	}
+	return nil
+}
+
+// runShellHook runs command with sh (cmd on Windows), with JD_SQL_CASE set to the name
+// of c. Its output is shown only when it fails.
+func runShellHook(c testCase, command string) error {
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	cmd.Env = append(os.Environ(), "JD_SQL_CASE="+c.Name)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, truncateRunes(msg, 500))
+		}
+		return err
+	}
+	return nil
+}
+
+// writeDryRunHooks writes the hooks of a stage of a dry run: SQL as statements, and
+// shell commands as \! meta-commands in psql style, else as comments.
+func writeDryRunHooks(w io.Writer, hooks []caseHook, style string) {
+	for _, h := range hooks {
+		switch {
+		case h.Shell == "":
+			fmt.Fprintf(w, "%s;\n", strings.TrimRight(strings.TrimSpace(h.SQL), ";"))
+		case style == "psql":
+			fmt.Fprintf(w, "\\! %s\n", h.Shell)
+		default:
+			fmt.Fprintf(w, "-- shell: %s\n", h.Shell)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// htmlReport is the data of the --report html template.
+type htmlReport struct {
+	Kind     string
+	Engine   string
+	Started  string
+	Elapsed  string
+	Summary  suiteSummary
+	Diffs    int
+	NoDiffs  int
+	Errors   int
+	Cases    []htmlCase
+	Rendered string
+}
+
+type htmlCase struct {
+	Name     string
+	Class    string
+	Source   string
+	Status   string
+	Result   string
+	Duration string
+	// Open expands the section of cases that need attention.
+	Open    bool
+	Message string
+	Error   string
+	// Left and Right are the documents shown side by side, with their changed paths
+	// marked: A and B of a diff, or the document before and after a patch.
+	LeftTitle, RightTitle string
+	Left, Right           template.HTML
+	OutputTitle           string
+	Output                template.HTML
+	SQL                   string
+}
+
+// writeHTMLReport writes a self-contained HTML page: summary counts, then a collapsible
+// section per case with its documents side by side, the paths changed by the diff
+// highlighted, and the highlighted output. Failed cases are expanded.
+func writeHTMLReport(w io.Writer, run suiteRun) error {
+	rep := htmlReport{
+		Kind:     run.Kind,
+		Engine:   run.Engine,
+		Started:  run.Start.UTC().Format(time.RFC3339),
+		Elapsed:  run.Elapsed.Round(time.Millisecond).String(),
+		Summary:  summarize(run.Results),
+		Rendered: time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, r := range run.Results {
+		class := exitClassification(r)
+		switch class {
+		case "diff":
+			rep.Diffs++
+		case "no_diff":
+			rep.NoDiffs++
+		case "error":
+			rep.Errors++
+		}
+		c := htmlCase{
+			Name:     r.Case.Name,
+			Class:    r.Case.Class,
+			Source:   r.Case.Source,
+			Status:   string(r.Status),
+			Result:   strings.ReplaceAll(class, "_", " "),
+			Duration: r.Duration.Round(time.Microsecond).String(),
+			Open:     r.Status.failed(),
+		}
+		if r.Status != statusPass {
+			c.Message = r.Message
+		}
+		if r.Err != nil {
+			c.Error = r.Err.Error()
+		}
+		if r.Trace != nil {
+			c.SQL = r.Trace.SQL
+		}
+		if r.Invocation != nil {
+			htmlCaseDocuments(&c, *r.Invocation, r)
+		}
+		rep.Cases = append(rep.Cases, c)
+	}
+	return htmlReportTemplate.Execute(w, rep)
+}
+
+// htmlCaseDocuments fills the side-by-side documents and the output of c.
+func htmlCaseDocuments(c *htmlCase, inv invocation, r caseResult) {
+	switch inv.mode() {
+	case "patch":
+		changed := changedPaths(inv.A, inv.Format)
+		c.LeftTitle, c.Left = "Document", jsonHTML(redactDocument(inv.B, inv.Redact), changed)
+		c.OutputTitle, c.Output = "Diff ("+inv.Format+")", diffHTML(redactInputDiff(inv.A, inv.Format, inv.Redact), inv.Format)
+		if r.Err == nil {
+			c.RightTitle, c.Right = "Patched", jsonHTML([]byte(r.Output), changed)
+		}
+	case "translate":
+		c.LeftTitle, c.Left = "Diff ("+inv.TranslateIn+")", diffHTML(redactInputDiff(inv.A, inv.TranslateIn, inv.Redact), inv.TranslateIn)
+		if r.Err == nil {
+			c.RightTitle, c.Right = "Translated ("+inv.TranslateOut+")", diffHTML([]byte(r.Output), inv.TranslateOut)
+		}
+	default:
+		if inv.QueryA != "" || inv.QueryB != "" {
+			// Query mode computes the documents in the database, but for a side read from
+			// a file
+			c.LeftTitle, c.Left = "Query A", template.HTML(html.EscapeString(inv.QueryA))
+			c.RightTitle, c.Right = "Query B", template.HTML(html.EscapeString(inv.QueryB))
+			if inv.QueryA == "" {
+				c.LeftTitle, c.Left = "A", jsonHTML(redactDocument(inv.A, inv.Redact), nil)
+			}
+			if inv.QueryB == "" {
+				c.RightTitle, c.Right = "B", jsonHTML(redactDocument(inv.B, inv.Redact), nil)
+			}
+		} else {
+			var changed map[string]bool
+			if r.Err == nil {
+				changed = changedPaths([]byte(r.Output), inv.Format)
+			}
+			c.LeftTitle, c.Left = "A", jsonHTML(redactDocument(inv.A, inv.Redact), changed)
+			c.RightTitle, c.Right = "B", jsonHTML(redactDocument(inv.B, inv.Redact), changed)
+		}
+		if r.Err == nil {
+			c.OutputTitle, c.Output = "Diff ("+inv.Format+")", diffHTML([]byte(r.Output), inv.Format)
+		}
+	}
+}
+
+// changedPaths returns the JSON Pointers of the values that diff changes: the @ paths of
+// a jd diff, the paths of a JSON Patch and the leaves of a merge patch. A jd path is cut
+// at its first set or multiset element, whose value has no pointer.
+func changedPaths(diff []byte, format string) map[string]bool {
+	paths := map[string]bool{}
+	switch {
+	case jdsql.IsJdText(format):
+		text := string(diff)
+		var s string
+		if json.Unmarshal(diff, &s) == nil {
+			text = s
+		}
+		for _, line := range strings.Split(text, "\n") {
+			header, ok := strings.CutPrefix(line, "@ ")
+			if !ok {
+				continue
+			}
+			var elems []any
+			dec := json.NewDecoder(strings.NewReader(header))
+			dec.UseNumber()
+			if dec.Decode(&elems) != nil {
+				continue
+			}
+			var ptr strings.Builder
+		elems:
+			for _, e := range elems {
+				switch e := e.(type) {
+				case string:
+					ptr.WriteString("/" + escapePointer(e))
+				case json.Number:
+					ptr.WriteString("/" + e.String())
+				default:
+					break elems
+				}
+			}
+			paths[ptr.String()] = true
+		}
+	case format == jdsql.FormatPatch:
+		var ops []struct {
+			Path string  `json:"path"`
+			From *string `json:"from"`
+		}
+		if json.Unmarshal(diff, &ops) != nil {
+			return paths
+		}
+		for _, op := range ops {
+			paths[strings.TrimSuffix(op.Path, "/-")] = true
+			if op.From != nil {
+				paths[*op.From] = true
+			}
+		}
+	case format == jdsql.FormatMerge:
+		var patch any
+		if json.Unmarshal(diff, &patch) != nil {
+			return paths
+		}
+		var walk func(ptr string, v any)
+		walk = func(ptr string, v any) {
+			obj, ok := v.(map[string]any)
+			if !ok {
+				paths[ptr] = true
+				return
+			}
+			for k, child := range obj {
+				walk(ptr+"/"+escapePointer(k), child)
+			}
+		}
+		walk("", patch)
+	}
+	return paths
+}
+
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// jsonHTML pretty-prints doc as syntax-highlighted HTML in its original key order,
+// marking the values at the changed paths. Input that is not JSON is shown as is.
+func jsonHTML(doc []byte, changed map[string]bool) template.HTML {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var b strings.Builder
+	if err := writeJSONHTML(&b, dec, "", "", changed); err != nil {
+		return template.HTML(html.EscapeString(string(doc)))
+	}
+	return template.HTML(b.String())
+}
+
+func writeJSONHTML(b *strings.Builder, dec *json.Decoder, path, indent string, changed map[string]bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if changed[path] {
+		b.WriteString(`<span class="chg">`)
+		defer b.WriteString(`</span>`)
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		open, end := string(t), "}"
+		if t == '[' {
+			end = "]"
+		}
+		b.WriteString(open)
+		n := 0
+		for dec.More() {
+			if n > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n" + indent + "  ")
+			child := path + "/" + strconv.Itoa(n)
+			if t == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				k, _ := key.(string)
+				q, _ := json.Marshal(k)
+				fmt.Fprintf(b, `<span class="key">%s</span>: `, html.EscapeString(string(q)))
+				child = path + "/" + escapePointer(k)
+			}
+			if err := writeJSONHTML(b, dec, child, indent+"  ", changed); err != nil {
+				return err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		if n > 0 {
+			b.WriteString("\n" + indent)
+		}
+		b.WriteString(end)
+	case string:
+		q, _ := json.Marshal(t)
+		fmt.Fprintf(b, `<span class="str">%s</span>`, html.EscapeString(string(q)))
+	case json.Number:
+		fmt.Fprintf(b, `<span class="num">%s</span>`, t)
+	case bool:
+		fmt.Fprintf(b, `<span class="lit">%t</span>`, t)
+	case nil:
+		b.WriteString(`<span class="lit">null</span>`)
+	}
+	return nil
+}
+
+// diffHTML highlights a diff in format: jd text by line kind, as on the terminal (see
+// render.Colorize), and the JSON formats as JSON.
+func diffHTML(diff []byte, format string) template.HTML {
+	if !jdsql.IsJdText(format) {
+		return jsonHTML(diff, nil)
+	}
+	text := string(diff)
+	var s string
+	if json.Unmarshal(diff, &s) == nil {
+		text = s
+	}
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		class := ""
+		switch {
+		case strings.HasPrefix(line, "-"):
+			class = "del"
+		case strings.HasPrefix(line, "+"):
+			class = "add"
+		case strings.HasPrefix(line, "@"), strings.HasPrefix(line, "^"):
+			class = "meta"
+		}
+		if class == "" {
+			b.WriteString(html.EscapeString(line))
+			continue
+		}
+		fmt.Fprintf(&b, `<span class="%s">%s</span>`, class, html.EscapeString(line))
+	}
+	return template.HTML(b.String())
+}
+
+var htmlReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>jd-sql-spec-runner {{.Kind}} report</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+table.summary td { padding: 0.2em 1.2em 0.2em 0; }
+details { border: 1px solid #ddd; border-radius: 4px; margin: 0.4em 0; }
+summary { cursor: pointer; padding: 0.5em; }
+details > div { padding: 0 1em 1em; }
+.status { display: inline-block; min-width: 4em; font-weight: bold; }
+.PASS, .XFAIL { color: #1a7f37; }
+.FAIL, .XPASS { color: #cf222e; }
+.SKIP { color: #9a6700; }
+.muted { color: #777; }
+.sides { display: grid; grid-template-columns: 1fr 1fr; gap: 1em; }
+pre { background: #f6f8fa; padding: 0.6em; overflow: auto; margin: 0.3em 0; }
+.key { color: #0550ae; }
+.str { color: #0a3069; }
+.num { color: #953800; }
+.lit { color: #8250df; }
+.chg { background: #fff8c5; outline: 1px solid #d4a72c; }
+.del { color: #cf222e; }
+.add { color: #1a7f37; }
+.meta { color: #777; }
+</style>
+</head>
+<body>
+<h1>jd-sql-spec-runner {{.Kind}} report</h1>
+<table class="summary">
+<tr><td>Engine</td><td>{{.Engine}}</td></tr>
+<tr><td>Started</td><td>{{.Started}}</td></tr>
+<tr><td>Wall time</td><td>{{.Elapsed}}</td></tr>
+<tr><td>Cases</td><td>{{.Summary.Total}}: <span class="PASS">{{.Summary.Passed}} passed</span>, <span class="FAIL">{{.Summary.Failed}} failed</span>, <span class="SKIP">{{.Summary.Skipped}} skipped</span>, {{.Summary.XFailed}} xfailed</td></tr>
+<tr><td>Results</td><td>{{.Diffs}} with differences, {{.NoDiffs}} without, {{.Errors}} errors</td></tr>
+</table>
+{{range .Cases}}
+<details{{if .Open}} open{{end}}>
+<summary><span class="status {{.Status}}">{{.Status}}</span> {{.Name}} <span class="muted">{{if .Class}}{{.Class}} · {{end}}{{.Result}} · {{.Duration}}</span></summary>
+<div>
+{{if .Source}}<p class="muted">{{.Source}}</p>{{end}}
+{{if .Message}}<pre>{{.Message}}</pre>{{end}}
+{{if and .Error (ne .Error .Message)}}<pre class="del">{{.Error}}</pre>{{end}}
+{{if .LeftTitle}}<div class="sides">
+<div><strong>{{.LeftTitle}}</strong><pre>{{.Left}}</pre></div>
+<div>{{if .RightTitle}}<strong>{{.RightTitle}}</strong><pre>{{.Right}}</pre>{{end}}</div>
+</div>{{end}}
+{{if .OutputTitle}}<strong>{{.OutputTitle}}</strong><pre>{{.Output}}</pre>{{end}}
+{{if .SQL}}<details><summary class="muted">SQL</summary><pre>{{.SQL}}</pre></details>{{end}}
+</div>
+</details>
+{{end}}
+<p class="muted">Generated by jd-sql-spec-runner at {{.Rendered}}.</p>
+</body>
+</html>
+`))
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// formatHunksNDJSON is the -f value writing the hunks of a diff as JSON Lines, each as
+// soon as it is read from jd_diff_hunks, instead of the diff as one value.
+const formatHunksNDJSON = "hunks-ndjson"
+
+// flagHunks reports whether -f selects hunks output.
+func flagHunks(flags cliFlags) bool {
+	f := coalesceNonEmpty(flags.value("f"), flags.value("format"))
+	return strings.ToLower(strings.TrimSpace(f)) == formatHunksNDJSON
+}
+
+// validateHunks rejects -f hunks-ndjson outside a plain diff of two input files.
+func validateHunks(args cliArgs, inv invocation) error {
+	if !inv.Hunks {
+		return nil
+	}
+	if flags := inv.modeFlags(); len(flags) > 0 || inv.At != nil {
+		if inv.At != nil {
+			flags = append(flags, "--at")
+		}
+		return errors.New("-f hunks-ndjson cannot be combined with " + strings.Join(flags, " and "))
+	}
+	if len(inv.Redact) > 0 {
+		return errors.New("-f hunks-ndjson cannot be combined with --redact")
+	}
+	if args.Command != "" || args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil ||
+		args.Manifest != "" || args.Spec != "" || isDir(args.FileA) || args.FileB == "" ||
+		args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.enabled("watch") ||
+		args.Flags.enabled("tui") || args.Flags.value("chunk") != "" {
+		return errors.New("-f hunks-ndjson is only supported for a single diff of two input files")
+	}
+	if args.Flags.value("report") != "" || args.Flags.enabled("explain") || args.Flags.value("verify-determinism") != "" {
+		return errors.New("-f hunks-ndjson cannot be combined with --report, --explain or --verify-determinism")
+	}
+	return nil
+}
+
+// runHunks diffs fileA and fileB with jd_diff_hunks and writes each hunk to stdout as a
+// JSON line as soon as its row arrives, so that consumers can start on a large diff
+// before it is complete and the runner never holds more than one hunk. The exit code is
+// 1 if there is any hunk.
+func runHunks(flags cliFlags, cfg Config, fileA, fileB string) (int, error) {
+	aText, bText, err := readInputs(fileA, fileB)
+	if err != nil {
+		return 2, err
+	}
+	inv := flagInvocation(flags, aText, bText)
+	sqlText, params := inv.query()
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	var q rowsQuerier = db
+	if t := queryTimeouts.statement(); t > 0 {
+		tx, err := beginWithStatementTimeout(ctx, db, t)
+		if err != nil {
+			return 2, err
+		}
+		defer tx.Rollback()
+		q = tx
+	}
+
+	trace := &execTrace{SQL: sqlText, Params: params, Attempts: 1}
+	start := time.Now()
+	finish := func(err error) error {
+		trace.RoundTrip = time.Since(start)
+		trace.Err = queryTimeouts.describe(err)
+		if verbose {
+			logTrace(trace)
+		}
+		return trace.Err
+	}
+	rows, err := q.QueryContext(ctx, sqlText, params...)
+	if err != nil {
+		return 2, fmt.Errorf("query failed: %w", finish(err))
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	for rows.Next() {
+		var hunk []byte
+		if err := rows.Scan(&hunk); err != nil {
+			return 2, fmt.Errorf("failed to read hunk %d: %w", trace.Rows+1, err)
+		}
+		trace.Rows++
+		w.Write(hunk)
+		w.WriteByte('\n')
+		// Each hunk goes out as it arrives rather than when the buffer fills
+		if err := w.Flush(); err != nil {
+			return 2, fmt.Errorf("failed to write hunk %d: %w", trace.Rows, err)
+		}
+	}
+	if err := finish(rows.Err()); err != nil {
+		// The hunks written so far are a prefix of the diff
+		return 2, fmt.Errorf("query failed after %d hunks: %w", trace.Rows, err)
+	}
+	if trace.Rows > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
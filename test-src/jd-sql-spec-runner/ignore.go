@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// flagIgnores returns the --ignore paths given.
+func flagIgnores(flags cliFlags) []pathPattern {
+	var ips []pathPattern
+	for _, v := range flags.values("ignore") {
+		// Validated by run
+		if ip, err := parsePathPattern("ignore", v); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// validateIgnores checks the --ignore values, and that wildcards are only used where the
+// runner reads the documents it matches them against.
+func validateIgnores(args cliArgs) error {
+	for _, v := range args.Flags.values("ignore") {
+		if _, err := parsePathPattern("ignore", v); err != nil {
+			return err
+		}
+	}
+	if ignoreGlobs(args.Flags) && (args.Table != nil || args.queryMode() || args.Update != nil || args.Flags.enabled("stream")) {
+		return errors.New("--ignore wildcards are matched against the input files and are not supported in table, query, update and stream modes")
+	}
+	return nil
+}
+
+// ignoreGlobs reports whether an --ignore path given has wildcards.
+func ignoreGlobs(flags cliFlags) bool {
+	for _, ip := range flagIgnores(flags) {
+		if ip.Glob != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns the jd paths ip ignores: its path or, with a glob, the children of its
+// path in any of docs whose key or index matches.
+func (ip pathPattern) expand(docs ...[]byte) [][]any {
+	if ip.Glob == "" {
+		return [][]any{ip.Path}
+	}
+	var paths [][]any
+	seen := map[string]bool{}
+	add := func(seg any) {
+		p := append(append([]any{}, ip.Path...), seg)
+		enc, _ := json.Marshal(p)
+		if !seen[string(enc)] {
+			seen[string(enc)] = true
+			paths = append(paths, p)
+		}
+	}
+	for _, doc := range docs {
+		v, err := jdsql.DecodeJSON(doc)
+		if err != nil {
+			continue
+		}
+		for _, seg := range ip.Path {
+			v = jsonChild(v, seg)
+		}
+		switch t := v.(type) {
+		case map[string]any:
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if ok, _ := path.Match(ip.Glob, k); ok {
+					add(k)
+				}
+			}
+		case []any:
+			for i := range t {
+				if ok, _ := path.Match(ip.Glob, strconv.Itoa(i)); ok {
+					add(i)
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// jsonChild returns the member or element of v at the jd path segment seg, or nil.
+func jsonChild(v any, seg any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		if k, ok := seg.(string); ok {
+			return t[k]
+		}
+		return t[fmt.Sprint(seg)]
+	case []any:
+		var i int
+		switch s := seg.(type) {
+		case int:
+			i = s
+		case float64:
+			i = int(s)
+		default:
+			return nil
+		}
+		if i >= 0 && i < len(t) {
+			return t[i]
+		}
+	}
+	return nil
+}
+
+// withIgnores appends to the jd options array options (nil for none) a DIFF_OFF
+// directive for each path of ignores, expanding wildcards against docs.
+func withIgnores(options []byte, ignores []pathPattern, docs ...[]byte) []byte {
+	var opts []json.RawMessage
+	if options != nil && json.Unmarshal(options, &opts) != nil {
+		return options
+	}
+	n := len(opts)
+	for _, ip := range ignores {
+		for _, p := range ip.expand(docs...) {
+			enc, _ := json.Marshal(map[string]any{"@": p, "^": []string{"DIFF_OFF"}})
+			opts = append(opts, enc)
+		}
+	}
+	if len(opts) == n {
+		return options
+	}
+	enc, _ := json.Marshal(opts)
+	return enc
+}
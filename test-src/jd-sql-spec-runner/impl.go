@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// implementationSchemas maps the flavors of the jd-sql functions to the schema each is
+// installed in. Both flavors can live side by side in one database: the plpgsql one,
+// which install applies, in the default schema of the connection ("") and the plv8
+// one in jd_plv8.
+var implementationSchemas = map[string]string{
+	"plpgsql": "",
+	"plv8":    "jd_plv8",
+}
+
+// implementationNames are the accepted implementation values, in --impl all order.
+var implementationNames = []string{"plpgsql", "plv8"}
+
+// implementation returns the flavor of the jd-sql functions selected by cfg.
+func (cfg Config) implementation() string {
+	return coalesceNonEmpty(strings.ToLower(cfg.Implementation), "plpgsql")
+}
+
+// implementationSchema returns the schema holding the functions of cfg, or "" for the
+// default schema of the connection.
+func (cfg Config) implementationSchema() string {
+	if cfg.Schema != "" {
+		return cfg.Schema
+	}
+	return implementationSchemas[cfg.implementation()]
+}
+
+// sqlNaming qualifies the jd-sql names of the statements the runner builds; withEngine
+// sets it from the config of the engine.
+var sqlNaming jdsql.Naming
+
+// naming returns the schema and prefix of the jd-sql functions of cfg.
+func (cfg Config) naming() jdsql.Naming {
+	return jdsql.Naming{Schema: cfg.implementationSchema(), FunctionPrefix: cfg.FunctionPrefix}
+}
+
+// searchPath returns the search_path that resolves the jd-sql names that are not
+// qualified, those of user sql templates and the calls inside the functions, to the
+// selected implementation, or "" to keep the server's. public stays on the path for the
+// tables that queries and table mode name.
+func (cfg Config) searchPath() string {
+	schema := cfg.implementationSchema()
+	if schema == "" {
+		return ""
+	}
+	return quoteIdent(schema) + ", public"
+}
+
+func validateImplementation(name string) error {
+	if _, ok := implementationSchemas[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("unsupported implementation '%s' (supported: %s)", name, strings.Join(implementationNames, ", "))
+	}
+	return nil
+}
+
+// flagImplementations returns the --impl values: one implementation, a comma separated
+// list or "all". It returns nil without --impl.
+func flagImplementations(flags cliFlags) ([]string, error) {
+	v := strings.TrimSpace(flags.value("impl"))
+	switch v {
+	case "":
+		return nil, nil
+	case "all":
+		return implementationNames, nil
+	}
+	var out []string
+	for _, name := range strings.Split(v, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if err := validateImplementation(name); err != nil {
+			return nil, fmt.Errorf("--impl: %w", err)
+		}
+		if !contains(out, name) {
+			out = append(out, name)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("--impl: no implementation selected")
+	}
+	return out, nil
+}
+
+// withImplementation returns cfg using the functions of impl. The configured schema
+// belongs to the configured implementation, so it is dropped.
+func (cfg Config) withImplementation(impl string) Config {
+	cfg.Implementation = impl
+	cfg.Schema = ""
+	return cfg
+}
+
+// implementationEngines returns one engine per implementation, named after it, for
+// comparing the implementations with runMatrix.
+func implementationEngines(cfg Config, impls []string) []NamedEngine {
+	out := make([]NamedEngine, 0, len(impls))
+	for _, impl := range impls {
+		out = append(out, NamedEngine{Name: impl, Config: cfg.withImplementation(impl)})
+	}
+	return out
+}
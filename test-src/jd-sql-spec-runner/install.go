@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// The packaged SQL is a copy of sql/postgres at the repository root, which is outside
+// this module and cannot be embedded directly. Refresh it with `go generate` (the
+// spec:build-runner task does this before building).
+//
+//go:generate cp ../../sql/postgres/jd_pg_plpgsql.sql sql/postgres/jd_pg_plpgsql.sql
+//go:generate cp ../../sql/postgres/jd_pg_plpgsql_down.sql sql/postgres/jd_pg_plpgsql_down.sql
+
+//go:embed sql/postgres/*.sql
+var packagedSQL embed.FS
+
+// sqlRelease is a packaged version of the jd-sql SQL surface. Each release script is a
+// full install: it drops and recreates the jd-sql types and functions, so upgrading from
+// any earlier version means applying the target release. Down is the down migration of
+// the release, which drops what its script created (see runUninstall).
+type sqlRelease struct {
+	Version string
+	Script  string
+	Down    string
+}
+
+// sqlReleases lists the packaged releases, oldest first. The last one is installed
+// unless --version selects another.
+var sqlReleases = []sqlRelease{
+	{Version: "v0.1", Script: "sql/postgres/jd_pg_plpgsql.sql", Down: "sql/postgres/jd_pg_plpgsql_down.sql"},
+}
+
+// installLockID keys the advisory lock that serializes concurrent installs.
+const installLockID = 0x6a642d73716c // "jd-sql"
+
+func findSQLRelease(version string) (sqlRelease, error) {
+	if version == "" {
+		return sqlReleases[len(sqlReleases)-1], nil
+	}
+	var known []string
+	for _, r := range sqlReleases {
+		if r.Version == version || r.Version == "v"+version {
+			return r, nil
+		}
+		known = append(known, r.Version)
+	}
+	return sqlRelease{}, fmt.Errorf("unknown jd-sql version '%s' (packaged: %s)", version, strings.Join(known, ", "))
+}
+
+// sqlChecksum identifies a release script in jd_sql_meta.
+func sqlChecksum(script []byte) string {
+	sum := sha256.Sum256(script)
+	return hex.EncodeToString(sum[:])
+}
+
+// runInstall applies a packaged release to the configured database and records it in
+// jd_sql_meta. Installing the version that is already recorded, with the same script
+// checksum, does nothing.
+func runInstall(flags cliFlags, cfg Config) (int, error) {
+	if impl := cfg.implementation(); impl != "plpgsql" {
+		return 2, fmt.Errorf("install packages the plpgsql implementation only; install the %s one with its own script", impl)
+	}
+	rel, err := findSQLRelease(flags.value("version"))
+	if err != nil {
+		return 2, err
+	}
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	if schema := cfg.implementationSchema(); schema != "" {
+		// The script creates its objects in the first schema of the search_path
+		if _, err := db.ExecContext(baseContext, "create schema if not exists "+quoteIdent(schema)); err != nil {
+			return 2, fmt.Errorf("failed to create schema %s: %w", schema, err)
+		}
+	}
+	prev, applied, err := installSQL(baseContext, db, rel)
+	if err != nil {
+		return 2, err
+	}
+	switch {
+	case !applied:
+		fmt.Fprintf(os.Stdout, "jd-sql %s is already installed\n", rel.Version)
+	case prev == "":
+		fmt.Fprintf(os.Stdout, "installed jd-sql %s\n", rel.Version)
+	case prev == rel.Version:
+		fmt.Fprintf(os.Stdout, "reinstalled jd-sql %s (script changed)\n", rel.Version)
+	default:
+		fmt.Fprintf(os.Stdout, "upgraded jd-sql %s -> %s\n", prev, rel.Version)
+	}
+	return 0, nil
+}
+
+// installSQL applies rel in a single transaction unless jd_sql_meta already records it.
+// It returns the previously recorded version ("" if none) and whether rel was applied.
+func installSQL(ctx context.Context, db *sql.DB, rel sqlRelease) (string, bool, error) {
+	script, err := packagedSQL.ReadFile(rel.Script)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read packaged SQL: %s: %w", rel.Script, err)
+	}
+	checksum := sqlChecksum(script)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock($1)", installLockID); err != nil {
+		return "", false, fmt.Errorf("failed to lock jd_sql_meta: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `create table if not exists jd_sql_meta
+(
+    version      text        not null,
+    checksum     text        not null,
+    installed_at timestamptz not null default now()
+)`); err != nil {
+		return "", false, fmt.Errorf("failed to create jd_sql_meta: %w", err)
+	}
+
+	var curVersion, curChecksum string
+	err = tx.QueryRowContext(ctx, "select version, checksum from jd_sql_meta order by installed_at desc limit 1").
+		Scan(&curVersion, &curChecksum)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", false, fmt.Errorf("failed to read jd_sql_meta: %w", err)
+	}
+	if curVersion == rel.Version && curChecksum == checksum {
+		return curVersion, false, nil
+	}
+
+	// Without bind parameters lib/pq sends the script as one simple query, so the
+	// multi-statement file (including its DO blocks) runs as is.
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return "", false, fmt.Errorf("failed to apply %s: %w", rel.Script, err)
+	}
+	if _, err := tx.ExecContext(ctx, "insert into jd_sql_meta (version, checksum) values ($1, $2)", rel.Version, checksum); err != nil {
+		return "", false, fmt.Errorf("failed to record install in jd_sql_meta: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", false, fmt.Errorf("failed to commit install: %w", err)
+	}
+	return curVersion, true, nil
+}
+
+// runUninstall drops the jd-sql functions and types and the jd_sql_meta table from the
+// configured database with the down migration of the installed version. Objects that
+// use jd-sql, such as views or gen-trigger triggers, make it fail unless --cascade drops
+// them too.
+func runUninstall(cfg Config, cascade bool) (int, error) {
+	if impl := cfg.implementation(); impl != "plpgsql" {
+		return 2, fmt.Errorf("uninstall packages the plpgsql implementation only; uninstall the %s one with its own script", impl)
+	}
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	version, err := uninstallSQL(baseContext, db, cascade)
+	if err != nil {
+		return 2, err
+	}
+	if version == "" {
+		fmt.Fprintln(os.Stdout, "uninstalled jd-sql (no version recorded in jd_sql_meta)")
+	} else {
+		fmt.Fprintf(os.Stdout, "uninstalled jd-sql %s\n", version)
+	}
+	return 0, nil
+}
+
+// uninstallSQL applies the down migration of the version recorded in jd_sql_meta, or of
+// the latest release when none is recorded (installs made with psql), and drops
+// jd_sql_meta, in a single transaction. It returns the recorded version.
+func uninstallSQL(ctx context.Context, db *sql.DB, cascade bool) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "select pg_advisory_xact_lock($1)", installLockID); err != nil {
+		return "", fmt.Errorf("failed to lock jd_sql_meta: %w", err)
+	}
+	var hasMeta bool
+	if err := tx.QueryRowContext(ctx, "select to_regclass('jd_sql_meta') is not null").Scan(&hasMeta); err != nil {
+		return "", fmt.Errorf("failed to look up jd_sql_meta: %w", err)
+	}
+	var version string
+	if hasMeta {
+		err = tx.QueryRowContext(ctx, "select version from jd_sql_meta order by installed_at desc limit 1").Scan(&version)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("failed to read jd_sql_meta: %w", err)
+		}
+	}
+	rel := sqlReleases[len(sqlReleases)-1]
+	if version != "" {
+		if rel, err = findSQLRelease(version); err != nil {
+			return "", fmt.Errorf("jd-sql %s is installed, which this runner cannot uninstall: %w", version, err)
+		}
+	}
+	script, err := packagedSQL.ReadFile(rel.Down)
+	if err != nil {
+		return "", fmt.Errorf("failed to read packaged SQL: %s: %w", rel.Down, err)
+	}
+
+	// The down migration reads the setting to decide whether dependent objects block it
+	if _, err := tx.ExecContext(ctx, "select set_config('jd_sql.uninstall_cascade', $1, true)", strconv.FormatBool(cascade)); err != nil {
+		return "", fmt.Errorf("failed to set jd_sql.uninstall_cascade: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return "", fmt.Errorf("failed to apply %s: %w", rel.Down, describeDependents(err))
+	}
+	drop := "drop table if exists jd_sql_meta"
+	if cascade {
+		drop += " cascade"
+	}
+	if _, err := tx.ExecContext(ctx, drop); err != nil {
+		return "", fmt.Errorf("failed to drop jd_sql_meta: %w", describeDependents(err))
+	}
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit uninstall: %w", err)
+	}
+	return version, nil
+}
+
+// describeDependents points a dependent_objects_still_exist error, raised when objects
+// outside jd-sql use it, to --cascade.
+func describeDependents(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "2BP01" {
+		return fmt.Errorf("%w; drop them first, or uninstall with --cascade to drop them too", err)
+	}
+	return err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// interactiveHelp explains the answers to the hunk prompt of patch --interactive.
+const interactiveHelp = `y - apply this hunk
+n - skip this hunk
+e - edit this hunk, then apply it
+a - apply this hunk and all later hunks
+d - skip this hunk and all later hunks
+q - quit; skip this hunk and all later hunks
+? - print help
+`
+
+// validateInteractive rejects --interactive and --residual outside a patch of one
+// document by one diff file.
+func validateInteractive(args cliArgs, inv invocation) error {
+	interactive := args.Flags.enabled("interactive")
+	if !interactive {
+		if args.Flags.value("residual") != "" {
+			return errors.New("--residual requires patch --interactive")
+		}
+		return nil
+	}
+	if !inv.Patch {
+		return errors.New("--interactive requires patch (or -p)")
+	}
+	if inv.Invert || inv.Check || inv.MergeStrict || len(inv.Redact) > 0 || oracle != nil {
+		return errors.New("--interactive cannot be combined with --invert, --check, --merge-strict, --redact or --oracle")
+	}
+	if args.Chain != nil || args.Command != "" || args.Table != nil || args.queryMode() || args.Update != nil ||
+		args.Git != nil || args.Manifest != "" || args.Spec != "" || isDir(args.FileA) || args.FileB == "" ||
+		args.Flags.enabled("ndjson") || args.Flags.enabled("watch") || args.Flags.enabled("tui") ||
+		args.Flags.value("report") != "" {
+		return errors.New("--interactive is only supported for a single diff applied to a single document")
+	}
+	if args.FileA == "-" || args.FileB == "-" {
+		return errors.New("--interactive reads its answers from stdin, so the diff and document must be files")
+	}
+	return nil
+}
+
+// interactivePatch walks through the hunks of a diff, asking which ones to apply.
+type interactivePatch struct {
+	db      rowQuerier
+	inv     invocation
+	in      *bufio.Reader
+	applied []json.RawMessage
+	skipped []json.RawMessage
+}
+
+// runInteractivePatch reads the diff in fileA into its elements and asks, hunk by hunk,
+// whether to apply it to the document in fileB, like git add -p. The answers are read
+// from stdin and the hunks and prompts written to stderr, so stdout (or -o) receives
+// only the patched document. The selected hunks are applied in the database with
+// jd_patch_struct; the skipped ones make up the residual diff, in the format of the
+// input, which is written to --residual or else to stderr.
+func runInteractivePatch(flags cliFlags, cfg Config, fileA, fileB string) (int, error) {
+	aText, bText, err := readInputs(fileA, fileB)
+	if err != nil {
+		return 2, err
+	}
+	inv := flagInvocation(flags, aText, bText)
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	p := &interactivePatch{db: db, inv: inv, in: bufio.NewReader(os.Stdin)}
+	hunks, err := p.read(inv.A)
+	if err != nil {
+		return 2, err
+	}
+	if err := p.ask(hunks); err != nil {
+		return 2, err
+	}
+	fmt.Fprintf(os.Stderr, "applied %d, skipped %d of %d hunks\n", len(p.applied), len(p.skipped), len(hunks))
+
+	applied, _ := json.Marshal(p.applied)
+	q, params := jdsql.PatchElementsQuery(applied, inv.B)
+	var out sql.NullString
+	if err := p.scan(q, params, &out); err != nil {
+		return 2, fmt.Errorf("failed to apply the selected hunks: %w", err)
+	}
+	residual, err := p.render(p.skipped)
+	if err != nil {
+		return 2, fmt.Errorf("failed to render the residual diff: %w", err)
+	}
+	if path := flags.value("residual"); path != "" {
+		if err := os.WriteFile(path, []byte(residual), 0o644); err != nil {
+			return 2, fmt.Errorf("failed to write the residual diff: %s: %w", path, err)
+		}
+	} else if len(p.skipped) > 0 {
+		fmt.Fprint(os.Stderr, "residual diff:\n", residual)
+	}
+	patched, _ := jdsql.DecodeResult(out.String)
+	if err := writeOutput(inv, patched); err != nil {
+		return 2, err
+	}
+	return 0, nil
+}
+
+// ask prompts for each of hunks in turn and sorts it into applied or skipped.
+func (p *interactivePatch) ask(hunks []json.RawMessage) error {
+	all := ""
+	for i := 0; i < len(hunks); i++ {
+		if all == "" && stopped() != nil {
+			all = "d"
+		}
+		switch all {
+		case "a":
+			p.applied = append(p.applied, hunks[i])
+			continue
+		case "d":
+			p.skipped = append(p.skipped, hunks[i])
+			continue
+		}
+		text, err := p.render(hunks[i : i+1])
+		if err != nil {
+			return fmt.Errorf("failed to render hunk %d: %w", i+1, err)
+		}
+		fmt.Fprintf(os.Stderr, "(%d/%d)\n%s", i+1, len(hunks), text)
+		fmt.Fprint(os.Stderr, "Apply this hunk [y,n,e,a,d,q,?]? ")
+		answer, err := p.in.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read the answer: %w", err)
+		}
+		if err != nil && strings.TrimSpace(answer) == "" {
+			// stdin ended: the remaining hunks are skipped
+			fmt.Fprintln(os.Stderr)
+			answer = "q"
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y":
+			p.applied = append(p.applied, hunks[i])
+		case "n":
+			p.skipped = append(p.skipped, hunks[i])
+		case "e":
+			edited, err := p.edit(text)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				i--
+				continue
+			}
+			if len(edited) == 0 {
+				fmt.Fprintln(os.Stderr, "the edited hunk is empty, skipping it")
+				p.skipped = append(p.skipped, hunks[i])
+				continue
+			}
+			p.applied = append(p.applied, edited...)
+		case "a":
+			all = "a"
+			p.applied = append(p.applied, hunks[i])
+		case "d", "q":
+			all = "d"
+			p.skipped = append(p.skipped, hunks[i])
+		default:
+			fmt.Fprint(os.Stderr, interactiveHelp)
+			i--
+		}
+	}
+	return nil
+}
+
+// edit opens text, a hunk in the format of the input, in $VISUAL or $EDITOR (vi by
+// default) and reads the edited file back into diff elements. An emptied file yields
+// no elements.
+func (p *interactivePatch) edit(text string) ([]json.RawMessage, error) {
+	ext := ".jd"
+	if !jdsql.IsJdText(p.inv.Format) {
+		ext = ".json"
+	}
+	f, err := os.CreateTemp("", "jd-sql-hunk-*"+ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the hunk file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write the hunk file: %w", err)
+	}
+
+	editor := strings.Fields(coalesceNonEmpty(os.Getenv("VISUAL"), os.Getenv("EDITOR")))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+	cmd := exec.Command(editor[0], append(editor[1:], f.Name())...)
+	// stdout may be the -o file, so the editor draws on stderr
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor %s failed: %w", editor[0], err)
+	}
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the hunk file: %w", err)
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+	edited, err := p.read(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid edited hunk: %w", err)
+	}
+	return edited, nil
+}
+
+// read reads diff, in the format of the input, into its diff elements.
+func (p *interactivePatch) read(diff []byte) ([]json.RawMessage, error) {
+	q, params := jdsql.ReadDiffQuery(diff, p.inv.Format)
+	var out []byte
+	if err := p.scan(q, params, &out); err != nil {
+		return nil, fmt.Errorf("failed to read the diff: %w", err)
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(out, &elems); err != nil {
+		return nil, fmt.Errorf("unexpected diff elements: %w", err)
+	}
+	return elems, nil
+}
+
+// render renders diff elements in the format of the input, JSON indented, ending with a
+// newline.
+func (p *interactivePatch) render(elems []json.RawMessage) (string, error) {
+	if elems == nil {
+		elems = []json.RawMessage{}
+	}
+	elements, _ := json.Marshal(elems)
+	q, params := jdsql.RenderDiffQuery(elements, p.inv.Options, p.inv.Format)
+	var d sql.NullString
+	var empty sql.NullBool
+	if err := p.scan(q, params, &d, &empty); err != nil {
+		return "", err
+	}
+	text, _ := jdsql.DecodeResult(d.String)
+	var buf bytes.Buffer
+	if !jdsql.IsJdText(p.inv.Format) && json.Indent(&buf, []byte(text), "", "  ") == nil {
+		text = buf.String()
+	}
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text, nil
+}
+
+// scan runs the statement q, rendered by renderSQL, under the query timeout and scans
+// its single row into dest.
+func (p *interactivePatch) scan(q string, params []any, dest ...any) error {
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	return queryTimeouts.describe(p.db.QueryRowContext(ctx, renderSQL(q), params...).Scan(dest...))
+}
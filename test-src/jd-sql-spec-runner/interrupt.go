@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// baseContext is the parent context of every query and download. run replaces it with
+// one cancelled on SIGINT or SIGTERM; lib/pq then sends the server a cancel request for
+// the statement in flight, so an interrupted diff does not keep running on the server.
+var baseContext = context.Background()
+
+// Errors ending a run stopped early: by SIGINT or SIGTERM, or by the total timeout.
+var (
+	errInterrupted  = errors.New("interrupted")
+	errTotalTimeout = errors.New("run exceeded the total timeout")
+)
+
+// handleInterrupts sets baseContext to a context cancelled by the first SIGINT or
+// SIGTERM. A second signal kills the runner as usual. The returned function releases
+// the signals; it does not cancel the context, so stopped stays nil for a run that
+// ends normally.
+func handleInterrupts() (stop func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		signal.Stop(sig)
+		cancel(errInterrupted)
+	}()
+	baseContext = ctx
+	return func() { signal.Stop(sig) }
+}
+
+// limitRun bounds baseContext by the total timeout d, if d is positive. The returned
+// function releases the timer.
+func limitRun(d time.Duration) (cancel func()) {
+	if d <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeoutCause(baseContext, d, errTotalTimeout)
+	baseContext = ctx
+	return cancel
+}
+
+// stopped returns why the run was stopped early, errInterrupted or errTotalTimeout, or
+// nil while it is not.
+func stopped() error {
+	switch cause := context.Cause(baseContext); cause {
+	case errInterrupted, errTotalTimeout:
+		return cause
+	}
+	return nil
+}
+
+// interrupted reports whether the run was stopped by SIGINT or SIGTERM.
+func interrupted() bool {
+	return stopped() == errInterrupted
+}
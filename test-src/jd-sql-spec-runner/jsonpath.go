@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// parseAtPath parses an --at value, a JSON Pointer (/spec/containers/0/env) or a jd path
+// (["spec","containers",0,"env"]), into a jd path as JSON. In a pointer, segments of
+// digits are array indexes; a jd path can name object keys made of digits.
+func parseAtPath(v string) ([]byte, error) {
+	invalid := fmt.Errorf("invalid --at value '%s' (expected a JSON Pointer such as /spec/env or a jd path such as [\"spec\",\"env\"])", v)
+	switch {
+	case strings.HasPrefix(v, "/"):
+		return json.Marshal(pointerPath(pointerSegments(v)))
+	case strings.HasPrefix(strings.TrimSpace(v), "["):
+		path, ok := parseJdPath(v)
+		if !ok {
+			return nil, invalid
+		}
+		return json.Marshal(path)
+	default:
+		return nil, invalid
+	}
+}
+
+// pointerSegments returns the unescaped segments of the JSON Pointer p.
+func pointerSegments(p string) []string {
+	if p == "" {
+		return nil
+	}
+	segs := strings.Split(p, "/")[1:]
+	for i, seg := range segs {
+		segs[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(seg)
+	}
+	return segs
+}
+
+// pointerPath turns pointer segments into a jd path, taking segments of digits as
+// array indexes.
+func pointerPath(segs []string) []any {
+	path := []any{}
+	for _, seg := range segs {
+		if i, err := strconv.Atoi(seg); err == nil && i >= 0 && strconv.Itoa(i) == seg {
+			path = append(path, i)
+		} else {
+			path = append(path, seg)
+		}
+	}
+	return path
+}
+
+// parseJdPath parses a jd path of object keys and array indexes, such as
+// ["spec","containers",0].
+func parseJdPath(v string) ([]any, bool) {
+	var path []any
+	if err := json.Unmarshal([]byte(v), &path); err != nil || path == nil {
+		return nil, false
+	}
+	for _, seg := range path {
+		switch t := seg.(type) {
+		case string:
+		case float64:
+			if t < 0 || t != float64(int(t)) {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return path, true
+}
+
+// pathPattern is a path given to --ignore or --redact: a jd path or, when the last
+// segment of a JSON Pointer has wildcards, the path of a parent whose keys (or array
+// indexes) must match Glob.
+type pathPattern struct {
+	Path []any
+	Glob string
+}
+
+// parsePathPattern parses the value of the path flag name: a JSON Pointer, whose last
+// segment may be a glob (/metadata/*Time) and which may end in /** for the whole subtree
+// (the same as without it, since a path covers everything below it), or a jd path.
+func parsePathPattern(name, v string) (pathPattern, error) {
+	invalid := fmt.Errorf("invalid --%s value '%s' (expected a JSON Pointer such as /status/** or /metadata/*Time, or a jd path such as [\"status\"])", name, v)
+	if !strings.HasPrefix(v, "/") {
+		p, ok := parseJdPath(v)
+		if !ok {
+			return pathPattern{}, invalid
+		}
+		return pathPattern{Path: p}, nil
+	}
+	segs := pointerSegments(strings.TrimSuffix(v, "/**"))
+	for i, seg := range segs {
+		if !strings.ContainsAny(seg, "*?[") {
+			continue
+		}
+		if i < len(segs)-1 {
+			return pathPattern{}, fmt.Errorf("invalid --%s value '%s' (wildcards are only supported in the last segment)", name, v)
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return pathPattern{}, invalid
+		}
+		return pathPattern{Path: pointerPath(segs[:i]), Glob: seg}, nil
+	}
+	return pathPattern{Path: pointerPath(segs)}, nil
+}
+
+// flagAtPath returns the jd path of the --at flag, or nil when it is not given.
+func flagAtPath(flags cliFlags) []byte {
+	v := flags.value("at")
+	if v == "" {
+		return nil
+	}
+	// Validated by run
+	path, _ := parseAtPath(v)
+	return path
+}
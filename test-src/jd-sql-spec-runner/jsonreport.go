@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// jsonReport is the --report json document. Field names are part of the report format;
+// add fields rather than renaming them so downstream aggregation keeps working.
+type jsonReport struct {
+	Runner     string           `json:"runner"`
+	Kind       string           `json:"kind"`
+	Engine     string           `json:"engine"`
+	StartedAt  string           `json:"started_at"`
+	WallTimeMS float64          `json:"wall_time_ms"`
+	Summary    jsonSummary      `json:"summary"`
+	Cases      []jsonCaseReport `json:"cases"`
+}
+
+type jsonSummary struct {
+	Passed  int `json:"passed"`
+	Failed  int `json:"failed"`
+	Skipped int `json:"skipped"`
+	XFailed int `json:"xfailed"`
+	Total   int `json:"total"`
+}
+
+type jsonCaseReport struct {
+	Name         string   `json:"name"`
+	Class        string   `json:"class,omitempty"`
+	Source       string   `json:"source,omitempty"`
+	Status       string   `json:"status"`
+	Tags         []string `json:"tags,omitempty"`
+	SQL          string   `json:"sql,omitempty"`
+	ParamsSHA256 string   `json:"params_sha256,omitempty"`
+	WallTimeMS   float64  `json:"wall_time_ms"`
+	RoundTripMS  float64  `json:"round_trip_ms"`
+	// ResultRows is the number of result rows read, 1 for a diff, patch or translate.
+	ResultRows int    `json:"result_rows"`
+	Attempts   int    `json:"attempts,omitempty"`
+	ColumnType string `json:"column_type,omitempty"`
+	Cached     bool   `json:"cached,omitempty"`
+	Output     string `json:"output"`
+	Exit       int    `json:"exit"`
+	// Classification is one of no_diff, diff, error or skipped.
+	Classification string `json:"classification"`
+	Error          string `json:"error,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func exitClassification(r caseResult) string {
+	switch {
+	case r.Status == statusSkip:
+		return "skipped"
+	case r.Err != nil || r.Exit == 2:
+		return "error"
+	case r.Exit == 1:
+		return "diff"
+	default:
+		return "no_diff"
+	}
+}
+
+// paramsHash returns the SHA-256 of the JSON encoded bound parameters, so identical
+// inputs can be grouped without storing them in the report.
+func paramsHash(params []any) string {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJSONReport(w io.Writer, run suiteRun) error {
+	s := summarize(run.Results)
+	rep := jsonReport{
+		Runner:     "jd-sql-spec-runner",
+		Kind:       run.Kind,
+		Engine:     run.Engine,
+		StartedAt:  run.Start.UTC().Format(time.RFC3339Nano),
+		WallTimeMS: milliseconds(run.Elapsed),
+		Summary:    jsonSummary{Passed: s.Passed, Failed: s.Failed, Skipped: s.Skipped, XFailed: s.XFailed, Total: s.Total},
+		Cases:      make([]jsonCaseReport, 0, len(run.Results)),
+	}
+	for _, r := range run.Results {
+		c := jsonCaseReport{
+			Name:           r.Case.Name,
+			Class:          r.Case.Class,
+			Source:         r.Case.Source,
+			Status:         string(r.Status),
+			Tags:           r.Case.Tags,
+			WallTimeMS:     milliseconds(r.Duration),
+			Output:         r.Output,
+			Exit:           r.Exit,
+			Classification: exitClassification(r),
+		}
+		if r.Trace != nil {
+			c.SQL = r.Trace.SQL
+			c.ParamsSHA256 = paramsHash(r.Trace.Params)
+			c.RoundTripMS = milliseconds(r.Trace.RoundTrip)
+			c.ResultRows = r.Trace.Rows
+			c.Attempts = r.Trace.Attempts
+			c.ColumnType = r.Trace.ColumnType
+			c.Cached = r.Trace.Cached
+		}
+		if r.Err != nil {
+			c.Error = r.Err.Error()
+		}
+		if r.Status != statusPass {
+			c.Message = r.Message
+		}
+		rep.Cases = append(rep.Cases, c)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
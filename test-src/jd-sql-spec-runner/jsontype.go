@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// jsonDocType is the --json-type of the documents: jsonb (the default) or json.
+var jsonDocType = "jsonb"
+
+// flagJSONType returns the --json-type value, jsonb without the flag.
+func flagJSONType(flags cliFlags) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(flags.value("json-type"))); v {
+	case "", "jsonb":
+		return "jsonb", nil
+	case "json":
+		return v, nil
+	default:
+		return "", fmt.Errorf("unsupported --json-type '%s' (supported: json, jsonb)", v)
+	}
+}
+
+// jsonbCast matches the jsonb casts of the generated statements.
+var jsonbCast = regexp.MustCompile(`::jsonb\b`)
+
+// renderSQL returns q, a statement built by the runner or jdsql, as it is sent: its
+// jd-sql names qualified by sqlNaming and, with --json-type json, its values parsed as
+// json before they are converted to the jsonb the functions take. Parsing as json
+// accepts what json columns and json-typed queries hold, and leaves the conversion,
+// which drops duplicate keys, to the last step.
+func renderSQL(q string) string {
+	q = sqlNaming.Qualify(q)
+	if jsonDocType == "json" {
+		q = jsonbCast.ReplaceAllString(q, "::json::jsonb")
+	}
+	return q
+}
+
+// outputsEqual compares an expected and an actual output of a case, both trimmed. With
+// --json-type json, JSON outputs are compared as values: the jd-sql functions build
+// their results as jsonb, whose key order is not that of json documents.
+func outputsEqual(expected, actual string) bool {
+	if expected == actual {
+		return true
+	}
+	return jsonDocType == "json" && json.Valid([]byte(expected)) && json.Valid([]byte(actual)) &&
+		jsonEquivalent(expected, actual)
+}
+
+// warnDuplicateKeys logs, with --json-type json, the duplicate object keys of the
+// documents of inv: json keeps them, but the jd-sql functions see the last value only.
+func warnDuplicateKeys(inv invocation, log *slog.Logger) {
+	if jsonDocType != "json" || inv.TranslateIn != "" || inv.mode() == "invert" || inv.QueryA != "" || inv.QueryB != "" {
+		return
+	}
+	docs := map[string][]byte{"a": inv.A, "b": inv.B}
+	if inv.Patch || inv.Check {
+		// A holds the diff
+		delete(docs, "a")
+	}
+	for _, side := range []string{"a", "b"} {
+		for _, path := range duplicateKeys(docs[side]) {
+			log.Warn("duplicate key; jsonb keeps the last value", "document", side, "path", path)
+		}
+	}
+}
+
+// duplicateKeys returns the JSON pointers of the keys of doc that repeat a key of the
+// same object, or nil when doc is not JSON.
+func duplicateKeys(doc []byte) []string {
+	if len(bytes.TrimSpace(doc)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	var dups []string
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			seen := map[string]bool{}
+			for dec.More() {
+				kt, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := kt.(string)
+				p := path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+				if seen[key] {
+					dups = append(dups, p)
+				}
+				seen[key] = true
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+	if err := walk(""); err != nil && err != io.EOF {
+		return nil
+	}
+	return dups
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// pgServiceEnv holds PGSERVICE and PGSERVICEFILE, read at start up and removed from the
+// environment: the runner resolves services itself, and lib/pq refuses to connect while
+// they are set.
+var pgServiceEnv = func() map[string]string {
+	env := map[string]string{}
+	for _, k := range []string{"PGSERVICE", "PGSERVICEFILE"} {
+		if v, ok := os.LookupEnv(k); ok {
+			env[k] = v
+			os.Unsetenv(k)
+		}
+	}
+	return env
+}()
+
+// applyService adds to params the settings of the connection service named by their
+// service parameter, or PGSERVICE, as libpq does: the settings of params take
+// precedence, and the service is looked up in PGSERVICEFILE (default
+// ~/.pg_service.conf), then in pg_service.conf of PGSYSCONFDIR.
+func applyService(params map[string]string) error {
+	name := params["service"]
+	delete(params, "service")
+	if name == "" {
+		name = pgServiceEnv["PGSERVICE"]
+	}
+	if name == "" {
+		return nil
+	}
+	var files []string
+	if f := pgServiceEnv["PGSERVICEFILE"]; f != "" {
+		files = append(files, f)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "pg_service.conf"))
+	}
+	for _, f := range files {
+		settings, ok, err := readServiceFile(f, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		for k, v := range settings {
+			if _, set := params[k]; !set {
+				params[k] = v
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("definition of service '%s' not found (searched: %s)", name, strings.Join(files, ", "))
+}
+
+// readServiceFile returns the settings of service name in the service file path, an INI
+// file with a [name] section of key=value lines per service. A missing file has no
+// services.
+func readServiceFile(path, name string) (map[string]string, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to read service file: %w", err)
+	}
+	defer f.Close()
+	var settings map[string]string
+	section := ""
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+			if settings != nil {
+				// The service ends at the next section
+				return settings, true, nil
+			}
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			if section == name {
+				settings = map[string]string{}
+			}
+		case section == name:
+			k, v, ok := strings.Cut(text, "=")
+			if !ok {
+				return nil, false, fmt.Errorf("syntax error in service file %s:%d: expected key=value", path, line)
+			}
+			if k = strings.TrimSpace(k); k == "service" {
+				return nil, false, fmt.Errorf("nested service specifications are not supported in service file %s:%d", path, line)
+			}
+			settings[k] = strings.TrimSpace(v)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to read service file: %w", err)
+	}
+	return settings, settings != nil, nil
+}
+
+// socketDirs are the directories searched for the Unix socket of the server when the
+// DSN names no host, like psql: the Debian and Red Hat default, and the upstream one.
+var socketDirs = []string{"/var/run/postgresql", "/run/postgresql", "/tmp"}
+
+// defaultSocketDir returns the directory of the socket of a local server listening on
+// port, or "" when there is none, in which case lib/pq connects to localhost over TCP.
+func defaultSocketDir(port string) string {
+	for _, dir := range socketDirs {
+		if fi, err := os.Stat(filepath.Join(dir, ".s.PGSQL."+port)); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return dir
+		}
+	}
+	return ""
+}
+
+// pgpassPassword returns the password of the first entry of the password file matching
+// the host, port, database and user of params, as libpq does: the file is the passfile
+// parameter, PGPASSFILE or ~/.pgpass, and is ignored, with a warning, when others can
+// read it. Socket connections match the host localhost.
+func pgpassPassword(params map[string]string) (string, error) {
+	path := coalesceNonEmpty(params["passfile"], os.Getenv("PGPASSFILE"))
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", nil
+		}
+		path = filepath.Join(home, ".pgpass")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", nil
+	}
+	if fi.Mode().Perm()&0o077 != 0 {
+		logger.Warn("password file has group or world access; permissions should be u=rw (0600) or less", "file", path)
+		return "", nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	defer f.Close()
+
+	env := func(key, envKey, def string) string {
+		return coalesceNonEmpty(coalesceNonEmpty(params[key], os.Getenv(envKey)), def)
+	}
+	osUser := ""
+	if u, err := user.Current(); err == nil {
+		osUser = u.Username
+	}
+	host := env("host", "PGHOST", "localhost")
+	if strings.HasPrefix(host, "/") {
+		host = "localhost"
+	}
+	usr := env("user", "PGUSER", osUser)
+	want := []string{host, env("port", "PGPORT", "5432"), env("dbname", "PGDATABASE", usr), usr}
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := pgpassFields(line)
+		if len(fields) != 5 {
+			continue
+		}
+		match := true
+		for i, w := range want {
+			if fields[i] != "*" && fields[i] != w {
+				match = false
+				break
+			}
+		}
+		if match {
+			return fields[4], nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	return "", nil
+}
+
+// pgpassFields splits a password file line at its unescaped colons, removing the
+// backslash escapes of \: and \\.
+func pgpassFields(line string) []string {
+	var fields []string
+	var f strings.Builder
+	escaped := false
+	for _, c := range line {
+		switch {
+		case escaped:
+			f.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == ':':
+			fields = append(fields, f.String())
+			f.Reset()
+		default:
+			f.WriteRune(c)
+		}
+	}
+	return append(fields, f.String())
+}
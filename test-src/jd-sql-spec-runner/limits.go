@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// LimitsConfig bounds the inputs of a run. The limits are checked by the runner before
+// anything is sent, so an accidental multi-GB input fails at once instead of consuming
+// the memory of the server. Zero values disable a limit.
+type LimitsConfig struct {
+	// MaxInputBytes caps the size of each input file, after decompression, and of each
+	// document sent.
+	MaxInputBytes int64 `yaml:"max_input_bytes"`
+	// MaxDepth caps the nesting of arrays and objects in a document; a scalar is at depth
+	// 0, and the members of a top-level object at depth 1.
+	MaxDepth int `yaml:"max_depth"`
+	// MaxArrayLength caps the number of elements of each array in a document.
+	MaxArrayLength int `yaml:"max_array_length"`
+}
+
+// inputLimits is set from the config by run before any input is read.
+var inputLimits LimitsConfig
+
+// errInputLimit is the error of an input that exceeds inputLimits (exit code
+// exitInputLimit).
+var errInputLimit = errors.New("input exceeds a configured limit")
+
+// validateLimitsConfig checks the limits settings of the config.
+func validateLimitsConfig(l LimitsConfig) error {
+	if l.MaxInputBytes < 0 || l.MaxDepth < 0 || l.MaxArrayLength < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// reader returns r, failing with errInputLimit once it has read more than
+// MaxInputBytes.
+func (l LimitsConfig) reader(r io.ReadCloser) io.ReadCloser {
+	if l.MaxInputBytes <= 0 {
+		return r
+	}
+	return &limitedInput{ReadCloser: r, max: l.MaxInputBytes}
+}
+
+type limitedInput struct {
+	io.ReadCloser
+	max, read int64
+}
+
+func (l *limitedInput) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return 0, fmt.Errorf("%w: larger than limits.max_input_bytes (%d bytes)", errInputLimit, l.max)
+	}
+	return n, err
+}
+
+// checkInvocation checks the documents inv sends.
+func (l LimitsConfig) checkInvocation(inv invocation) error {
+	docs := append([][]byte{inv.A, inv.B}, inv.Chain...)
+	for _, doc := range docs {
+		if err := l.check(doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check checks the size, depth and array lengths of the JSON document doc. Text that is
+// not valid JSON is checked up to the error, which the database reports.
+func (l LimitsConfig) check(doc []byte) error {
+	if l.MaxInputBytes > 0 && int64(len(doc)) > l.MaxInputBytes {
+		return fmt.Errorf("%w: a document of %d bytes is larger than limits.max_input_bytes (%d bytes)", errInputLimit, len(doc), l.MaxInputBytes)
+	}
+	if l.MaxDepth <= 0 && l.MaxArrayLength <= 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	// lengths holds the number of elements of each enclosing array, -1 for objects
+	var lengths []int
+	element := func() error {
+		if len(lengths) == 0 || lengths[len(lengths)-1] < 0 {
+			return nil
+		}
+		lengths[len(lengths)-1]++
+		if l.MaxArrayLength > 0 && lengths[len(lengths)-1] > l.MaxArrayLength {
+			return fmt.Errorf("%w: an array has more than limits.max_array_length (%d) elements", errInputLimit, l.MaxArrayLength)
+		}
+		return nil
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			if err := element(); err != nil {
+				return err
+			}
+			if tok == json.Delim('[') {
+				lengths = append(lengths, 0)
+			} else {
+				lengths = append(lengths, -1)
+			}
+			if l.MaxDepth > 0 && len(lengths) > l.MaxDepth {
+				return fmt.Errorf("%w: nested deeper than limits.max_depth (%d)", errInputLimit, l.MaxDepth)
+			}
+		case json.Delim(']'), json.Delim('}'):
+			lengths = lengths[:len(lengths)-1]
+		default:
+			// Object keys are tokens too, but not elements of an array
+			if err := element(); err != nil {
+				return err
+			}
+		}
+	}
+}
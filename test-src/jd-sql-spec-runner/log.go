@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logger receives the runner's diagnostics on stderr: what long-running modes are doing,
+// warnings, failed pairs and, at debug level, every query and case. run configures it
+// from --log-level and --log-format. Results and the final error of a run are not logs:
+// they go to stdout and stderr as they are.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// logLevels are the accepted values of --log-level.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogger configures logger from --log-level (default info, or debug with -v) and
+// --log-format (text or json), and sets verbose when debug logs are enabled.
+func setupLogger(flags cliFlags) error {
+	level := slog.LevelInfo
+	if flags.enabled("v") || flags.enabled("verbose") {
+		level = slog.LevelDebug
+	}
+	if v := flags.value("log-level"); v != "" {
+		l, ok := logLevels[strings.ToLower(v)]
+		if !ok {
+			return fmt.Errorf("invalid --log-level value '%s' (expected debug, info, warn or error)", v)
+		}
+		level = l
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch v := flags.value("log-format"); strings.ToLower(v) {
+	case "", "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("invalid --log-format value '%s' (expected text or json)", v)
+	}
+	verbose = logger.Enabled(context.Background(), slog.LevelDebug)
+	return nil
+}
+
+// logCase logs the result of a batch or spec case at debug level, with the fields that
+// correlate it with its queries.
+func logCase(engine string, res caseResult) {
+	attrs := []any{"case", res.Case.Name, "engine", engine, "status", string(res.Status),
+		"exit", res.Exit, "duration", res.Duration}
+	if res.Message != "" {
+		attrs = append(attrs, "message", res.Message)
+	}
+	logger.Debug("case finished", attrs...)
+}
@@ -1,190 +1,888 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
-	"gopkg.in/yaml.v3"
+	"github.com/lib/pq"
+
+	"jd-sql/test-runner/pkg/jdsql"
+	"jd-sql/test-runner/render"
 )
 
-type Config struct {
-    Engine string `yaml:"engine"`
-    DSN    string `yaml:"dsn"`
-    SQL    string `yaml:"sql"`
-}
+// stdoutFile is the process stdout, which -o and -q replace for the duration of a run.
+var stdoutFile = os.Stdout
+
+// colorOutput is set by --color (or a terminal stdout in auto mode): jd diffs printed
+// to stdout are colorized.
+var colorOutput bool
 
 func main() {
 	code, err := run()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(2)
+		os.Exit(exitCode(err))
 	}
 	os.Exit(code)
 }
 
-func run() (int, error) {
-    cfgPath, fileA, fileB, err := parseArgs()
-    if err != nil {
-        return 2, err
-    }
+func run() (code int, err error) {
+	args, err := parseArgs()
+	if errors.Is(err, flag.ErrHelp) {
+		// The usage was printed on request
+		return 0, nil
+	}
+	if err != nil {
+		return 2, err
+	}
+	if args.Command == "completion" {
+		// Completion needs no valid config, so it runs before loading one
+		return 0, runCompletion(os.Stdout, args.Shell, args.ConfigPath)
+	}
+	if args.Command == "sync-spec" {
+		// Neither does sync-spec, which only converts files
+		return runSyncSpec(args.Flags)
+	}
 
-    cfg, err := loadConfig(cfgPath)
+	flags := args.Flags
+	cfg, err := loadConfig(args.ConfigPath, flags.value("profile"), flags.enabled("ephemeral"))
 	if err != nil {
 		return 2, err
 	}
 
-	switch strings.ToLower(cfg.Engine) {
-	case "postgres", "pg":
-        return runPostgres(cfg, fileA, fileB)
-    default:
-        return 2, fmt.Errorf("unsupported engine '%s' (supported: postgres)", cfg.Engine)
-    }
-}
-
-// parseArgs now also parses -f/--format and -t/--translate but only returns cfg path and files here;
-// flags are accessed later via package flag.
-func parseArgs() (cfgPath string, fileA string, fileB string, err error) {
-    // Define flag holders to capture known flags but ignore usage here
-    var configFlag string
-    var _format string
-    var _translate string
-    fs := flag.NewFlagSet("jd-sql-spec-runner", flag.ContinueOnError)
-    fs.SetOutput(new(nopWriter))
-    fs.StringVar(&configFlag, "c", "", "config file")
-    fs.StringVar(&configFlag, "config", "", "config file")
-    fs.StringVar(&_format, "f", "", "diff/patch format: jd|patch|merge")
-    fs.StringVar(&_format, "format", "", "diff/patch format: jd|patch|merge")
-    fs.StringVar(&_translate, "t", "", "translate: <in>2<out> (e.g., jd2patch)")
-    fs.StringVar(&_translate, "translate", "", "translate: <in>2<out> (e.g., jd2merge)")
-    _ = fs.Parse(os.Args[1:])
-
-    raw := os.Args[1:]
-    raw = stripConfigArgs(raw)
-
-    // collect positional args (files)
-    pos := make([]string, 0, len(raw))
-    for _, s := range raw {
-        if strings.HasPrefix(s, "-") {
-            continue
-        }
-        pos = append(pos, s)
-    }
-
-    // Default: expect two files; if translate flag provided and only one file, allow single input
-    if len(pos) == 1 {
-        // In translate mode, the single input is the diff content; set B empty
-        return resolveConfigPath(configFlag), pos[0], "", nil
-    }
-    if len(pos) < 2 {
-        // fallback to env
-        configFlag2, a, b, perr := permissiveParseEnvArgs()
-        if perr != nil {
-            return "", "", "", errors.New("missing input files (expected two file paths)")
-        }
-        if configFlag == "" {
-            configFlag = configFlag2
-        }
-        if err := ensureFilesExist(a, b); err != nil {
-            return "", "", "", err
-        }
-        return resolveConfigPath(configFlag), a, b, nil
-    }
-    if len(pos) > 2 {
-        return "", "", "", errors.New("too many input files (expected two)")
-    }
-    a := pos[len(pos)-2]
-    b := pos[len(pos)-1]
-    if err := ensureFilesExist(a, b); err != nil {
-        return "", "", "", err
-    }
-    return resolveConfigPath(configFlag), a, b, nil
+	defer handleInterrupts()()
+	retryPolicy = cfg.Retry
+	if err := setupLogger(flags); err != nil {
+		return 2, err
+	}
+	if err := applyTimeoutFlags(flags, &cfg.Timeouts); err != nil {
+		return 2, err
+	}
+	queryTimeouts = cfg.Timeouts
+	defer limitRun(queryTimeouts.Total)()
+	fetchSettings = cfg.Fetch
+	inputLimits = cfg.Limits
+	impls, err := flagImplementations(flags)
+	if err != nil {
+		return 2, err
+	}
+	if err := validateTraffic(flags, impls); err != nil {
+		return 2, err
+	}
+	saveTraffic, err := startTraffic(flags)
+	if err != nil {
+		return 2, err
+	}
+	defer func() {
+		if ferr := saveTraffic(); ferr != nil && err == nil {
+			code, err = 2, ferr
+		}
+	}()
+	if len(impls) > 0 && flags.value("engines") != "" {
+		return 2, errors.New("--impl cannot be combined with --engines; set implementation on the engines instead")
+	}
+	if len(impls) == 1 {
+		cfg = cfg.withImplementation(impls[0])
+	}
+	if v := flags.value("collation"); v != "" {
+		cfg.Collation = v
+	}
+	if v := flags.value("merge-null-policy"); v != "" {
+		if err := validateMergeNullPolicy(v); err != nil {
+			return 2, fmt.Errorf("--merge-null-policy: %w", err)
+		}
+		cfg.MergeNullPolicy = v
+	}
+	sqlNaming, diffTemplate, configPathOptions = cfg.naming(), cfg.SQL, cfg.PathOptions
+	if jsonDocType, err = flagJSONType(flags); err != nil {
+		return 2, err
+	}
+	if v := flags.value("precision"); v != "" {
+		if _, err := parsePrecision(v); err != nil {
+			return 2, err
+		}
+	}
+	if v := flags.value("opts"); v != "" {
+		if _, err := readOpts(v); err != nil {
+			return 2, err
+		}
+	}
+	if err := validatePathOpts(flags); err != nil {
+		return 2, err
+	}
+	if err := validateIgnores(args); err != nil {
+		return 2, err
+	}
+	if err := validateRedacts(flags); err != nil {
+		return 2, err
+	}
+	if v := flags.value("at"); v != "" {
+		if _, err := parseAtPath(v); err != nil {
+			return 2, err
+		}
+	}
+	inv := flagInvocation(flags, nil, nil)
+	if flags := inv.modeFlags(); len(flags) > 1 {
+		return 2, fmt.Errorf("%s cannot be combined", strings.Join(flags, " and "))
+	}
+	if err := validateTranslateFlag(flags); err != nil {
+		return 2, err
+	}
+	if v := coalesceNonEmpty(flags.value("f"), flags.value("format")); v != "" &&
+		!jdsql.KnownFormat(strings.ToLower(strings.TrimSpace(v))) && flagPathsFormat(flags) == "" && !flagSideBySide(flags) && !flagHunks(flags) {
+		if existsFile(v) {
+			// -f a.json b.json takes the first input file for the format
+			return 2, fmt.Errorf("invalid -f value '%s', which is a file: -f takes a format (jd, jd2, patch, merge, paths, paths-json, sidebyside or hunks-ndjson) as its value", v)
+		}
+		return 2, fmt.Errorf("invalid -f value '%s' (expected jd, jd2, patch, merge, paths, paths-json, sidebyside or hunks-ndjson)", v)
+	}
+	if v := flags.value("from"); v != "" {
+		if f := strings.ToLower(strings.TrimSpace(v)); f != jdsql.FormatAuto && !jdsql.KnownFormat(f) {
+			return 2, fmt.Errorf("invalid --from value '%s' (expected jd, jd2, patch, merge or auto)", v)
+		}
+		if m := inv.mode(); m != "translate" && m != "patch" && m != "check" && m != "invert" {
+			return 2, errors.New("--from requires -t, -p, --check or --invert")
+		}
+	}
+	if inv.VerifyRoundTrip && inv.mode() != "translate" {
+		return 2, errors.New("--verify-roundtrip requires -t")
+	}
+	if flags.value("conflict-format") != "" {
+		if _, err := flagConflictFormat(flags); err != nil {
+			return 2, err
+		}
+		if inv.mode() != "patch" {
+			return 2, errors.New("--conflict-format requires -p")
+		}
+	}
+	if inv.At != nil && inv.mode() != "diff" {
+		return 2, fmt.Errorf("--at is not supported in %s mode", inv.mode())
+	}
+	if inv.Canonicalize && args.FileB != "" {
+		return 2, errors.New("--canonicalize expects one input file")
+	}
+	if inv.mode() == "invert" && args.FileB != "" {
+		return 2, errors.New("--invert expects one input file, the diff; add -p to revert a document with it")
+	}
+	color := flags.value("color")
+	if color == "true" {
+		// --color alone
+		color = string(render.ColorAlways)
+	}
+	mode, err := render.ParseColorMode(color)
+	if err != nil {
+		return 2, err
+	}
+	colorOutput = mode.Enabled(os.Stdout)
+	if outputEncoder, err = flagEncoder(flags); err != nil {
+		return 2, err
+	}
+	if err := validateOutputFormat(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateTemplateFlags(args, inv); err != nil {
+		return 2, err
+	}
+	if oracle, err = selectOracle(flags.value("oracle")); err != nil {
+		return 2, err
+	}
+	if oracle != nil && (args.Table != nil || args.queryMode() || args.Update != nil) {
+		return 2, errors.New("--oracle is not supported in table, query and update modes")
+	}
+	if oracle != nil && (inv.Equal || inv.Canonicalize || inv.Stat || inv.At != nil || inv.Invert || inv.Paths != "" || inv.SideBySide || inv.Hunks) {
+		// The oracle compares whole diffs, patched documents and translations only
+		return 2, errors.New("--oracle cannot be combined with --equal, --canonicalize, --stat, --at, --invert, -f paths, -f sidebyside or -f hunks-ndjson")
+	}
+	if inv.At != nil && (args.Table != nil || args.queryMode() || args.Update != nil ||
+		args.Manifest != "" || args.Spec != "" || isDir(args.FileA)) {
+		return 2, errors.New("--at is not supported in table, query, update, batch, spec and directory modes")
+	}
+	if inv.Stat && (args.Table != nil || args.queryMode() || args.Update != nil) {
+		return 2, errors.New("--stat is not supported in table, query and update modes")
+	}
+	if inv.Paths != "" {
+		if err := validatePaths(args, inv); err != nil {
+			return 2, err
+		}
+	}
+	if err := validateSideBySide(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateHunks(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateTUI(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateInteractive(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateDeterminism(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateSchema(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateNormalize(args, inv); err != nil {
+		return 2, err
+	}
+	if err := validateRecordTo(args, inv, impls); err != nil {
+		return 2, err
+	}
+	if err := validateSplit(args, inv, impls); err != nil {
+		return 2, err
+	}
+	if err := validateExplain(args, impls); err != nil {
+		return 2, err
+	}
+	if v := flags.value("schema"); v != "" {
+		if diffSchema, err = readSchema(v); err != nil {
+			return 2, err
+		}
+	}
+	if style, err := progressMode(flags); err != nil {
+		return 2, err
+	} else if batch := args.Manifest != "" || args.Spec != "" || args.Table != nil || isDir(args.FileA); style != "" &&
+		(!batch || args.Command != "" || flags.value("engines") != "" || len(impls) > 1) {
+		return 2, errors.New("--progress is only supported in batch, spec, table and directory modes")
+	}
+	if args.Chain != nil {
+		if err := validatePatchChain(flags, impls); err != nil {
+			return 2, err
+		}
+	}
+	if (flags.value("checkpoint") != "" || flags.enabled("resume")) &&
+		(args.Manifest == "" && args.Spec == "" || args.Command != "" || flags.value("engines") != "" || len(impls) > 1) {
+		return 2, errors.New("--checkpoint and --resume are only supported in batch and spec modes")
+	}
+	if flags.value("cache") != "" &&
+		(args.Manifest == "" && args.Spec == "" || args.Command != "" || flags.value("engines") != "" || len(impls) > 1) {
+		return 2, errors.New("--cache is only supported in batch and spec modes")
+	}
+	if (flags.enabled("fail-fast") || flags.value("max-failures") != "") &&
+		(args.Manifest == "" && args.Spec == "" || args.Command != "" || flags.value("engines") != "" || len(impls) > 1) {
+		return 2, errors.New("--fail-fast and --max-failures are only supported in batch and spec modes")
+	}
+	if err := validateDaemon(args); err != nil {
+		return 2, err
+	}
+	if err := validateCaseFilter(args); err != nil {
+		return 2, err
+	}
+	if err := validateSinks(args, impls); err != nil {
+		return 2, err
+	}
+	if eventSinks, err = flagSinks(flags); err != nil {
+		return 2, err
+	}
+	if flags.enabled("validate-local") && (args.Command != "" || args.Table != nil || args.queryMode() ||
+		args.Update != nil || args.Git != nil || args.Manifest != "" || args.Spec != "" || isDir(args.FileA) ||
+		flags.enabled("stream") || flags.enabled("ndjson") || flags.enabled("watch")) {
+		return 2, errors.New("--validate-local is only supported for a single run on input files")
+	}
+	if chunk, err := flagChunk(flags); err != nil {
+		return 2, err
+	} else if chunk > 0 {
+		if err := validateChunk(args, inv); err != nil {
+			return 2, err
+		}
+	}
+
+	outPath := coalesceNonEmpty(flags.value("o"), flags.value("output"))
+	quiet := flags.enabled("q") || flags.enabled("quiet")
+	if quiet && outPath != "" {
+		return 2, errors.New("-q/--quiet cannot be combined with -o/--output")
+	}
+	if outPath != "" {
+		appendMode := flags.enabled("append")
+		if appendMode && args.Manifest == "" && args.Spec == "" && !isDir(args.FileA) {
+			return 2, errors.New("--append is only supported in batch, spec and directory modes")
+		}
+		out, err := openOutput(outPath, appendMode)
+		if err != nil {
+			return 2, err
+		}
+		os.Stdout = out.File
+		defer func() {
+			os.Stdout = stdoutFile
+			if ferr := out.finish(code < 2); ferr != nil && err == nil {
+				code, err = 2, ferr
+			}
+		}()
+	} else if flags.enabled("append") {
+		return 2, errors.New("--append requires -o/--output")
+	}
+	if method := flags.value("compress"); method != "" && !quiet {
+		prev := os.Stdout
+		pw, finish, err := compressOutput(prev, method)
+		if err != nil {
+			return 2, err
+		}
+		os.Stdout = pw
+		defer func() {
+			os.Stdout = prev
+			if ferr := finish(); ferr != nil && err == nil {
+				code, err = 2, ferr
+			}
+		}()
+	}
+	// Line ends are converted before the output is compressed
+	crlf, err := flagCRLF(flags)
+	if err != nil {
+		return 2, err
+	}
+	if crlf && !quiet {
+		prev := os.Stdout
+		pw, finish, perr := crlfOutput(prev)
+		if perr != nil {
+			return 2, perr
+		}
+		os.Stdout = pw
+		defer func() {
+			os.Stdout = prev
+			if ferr := finish(); ferr != nil && err == nil {
+				code, err = 2, ferr
+			}
+		}()
+	}
+	if quiet {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return 2, fmt.Errorf("failed to open %s: %w", os.DevNull, err)
+		}
+		os.Stdout = devNull
+		defer func() {
+			os.Stdout = stdoutFile
+			devNull.Close()
+		}()
+	}
+
+	// A dry run only renders SQL, so it needs neither a database nor an engine
+	style, err := dryRunMode(flags)
+	if err != nil {
+		return 2, err
+	}
+	// Update mode previews its changes in a rolled back transaction instead
+	if style != "" && args.Update == nil {
+		return runDryRun(cfg, args, style)
+	}
+
+	if len(impls) > 1 {
+		return runMatrix(implementationEngines(cfg, impls), args)
+	}
+	if names := flags.value("engines"); names != "" {
+		engines, err := selectEngines(cfg, names)
+		if err != nil {
+			return 2, err
+		}
+		return runMatrix(engines, args)
+	}
+	return withEngine(cfg, flags.enabled("ephemeral"), func(cfg Config) (int, error) {
+		return runEngine(cfg, args)
+	})
 }
 
-func ensureFilesExist(a, b string) error {
-    if a != "" {
-        if _, err := os.Stat(a); err != nil {
-            return fmt.Errorf("input file does not exist: %s", a)
-        }
-    }
-    if b != "" {
-        if _, err := os.Stat(b); err != nil {
-            return fmt.Errorf("input file does not exist: %s", b)
-        }
-    }
-    return nil
-}
-
-func stripConfigArgs(args []string) []string {
-	out := make([]string, 0, len(args))
-	i := 0
-	for i < len(args) {
-		a := args[i]
-		if a == "-c" || a == "--config" {
-			if i+1 < len(args) {
-				i += 2
-				continue
+// withEngine calls fn with cfg, after starting a disposable database if cfg selects
+// the ephemeral engine or ephemeral is set (unless the run is replayed); the database
+// is removed when fn returns.
+func withEngine(cfg Config, ephemeral bool, fn func(Config) (int, error)) (int, error) {
+	if (ephemeral || isEphemeral(cfg)) && !replaying {
+		ecfg, stop, err := startEphemeralPostgres(cfg)
+		if err != nil {
+			return 2, err
+		}
+		defer stop()
+		cfg = ecfg
+	}
+	sqlNaming, diffTemplate = cfg.naming(), cfg.SQL
+	return fn(cfg)
+}
+
+// runEngine runs the mode selected by args against the single engine of cfg.
+func runEngine(cfg Config, args cliArgs) (int, error) {
+	switch strings.ToLower(cfg.Engine) {
+	case "postgres", "pg":
+		switch args.Command {
+		case "install":
+			return runInstall(args.Flags, cfg)
+		case "uninstall":
+			return runUninstall(cfg, args.Flags.enabled("cascade"))
+		case "doctor":
+			return runDoctor(cfg)
+		case "dump":
+			return runDump(args.Flags, cfg)
+		case "selftest":
+			return runSelftest(args.Flags, cfg)
+		case "bench":
+			return runBench(cfg, args)
+		case "fuzz":
+			return runFuzz(cfg, args)
+		case "serve":
+			return runServe(args.Flags, cfg)
+		case "daemon":
+			return runDaemon(args.Flags, cfg)
+		case "merge3":
+			return runMerge3(cfg, args)
+		case "gen-trigger":
+			return runGenTrigger(args.Flags, cfg)
+		case "cdc":
+			return runCDC(args.Flags, cfg)
+		case "snapshot":
+			return runSnapshot(args.Flags, cfg)
+		case "drift":
+			return runDrift(args.Flags, cfg, args.FileA)
+		case "hash":
+			if args.Table != nil {
+				return runTableDiff(args.Flags, cfg, *args.Table)
 			}
-			i++
-			continue
+			return runHash(cfg, args.FileA)
 		}
-		if strings.HasPrefix(a, "-c=") || strings.HasPrefix(a, "--config=") {
-			i++
-			continue
+		opts, err := getSuiteOptions(args.Flags)
+		if err != nil {
+			return 2, err
+		}
+		if table := args.Flags.value("record-to"); table != "" {
+			if diffRecorder, err = openRecorder(cfg, table); err != nil {
+				return 2, err
+			}
+			defer func() {
+				diffRecorder.close()
+				diffRecorder = nil
+			}()
+		}
+		if args.Table != nil {
+			return runTableDiff(args.Flags, cfg, *args.Table)
+		}
+		if args.queryMode() {
+			return runQueryDiff(cfg, args)
+		}
+		if args.Update != nil {
+			return runUpdate(args.Flags, cfg, *args.Update, args.FileA, args.Flags.enabled("commit"))
+		}
+		if args.Git != nil {
+			return runGitDiff(args.Flags, cfg, *args.Git)
+		}
+		if args.Manifest != "" || args.Spec != "" {
+			if args.Manifest != "" {
+				return runManifest(args.Flags, cfg, args.Manifest, opts)
+			}
+			return runSpec(args.Flags, cfg, args.Spec, opts)
+		}
+		if isDir(args.FileA) || isDir(args.FileB) {
+			if !isDir(args.FileA) || !isDir(args.FileB) {
+				return 2, errors.New("cannot diff a directory against a file (expected two directories)")
+			}
+			return runDirectoryDiff(args.Flags, cfg, args.FileA, args.FileB)
+		}
+		if chunk, _ := flagChunk(args.Flags); chunk > 0 {
+			return runChunked(args.Flags, cfg, args.FileA, args.FileB, chunk, opts.Jobs)
+		}
+		if args.Flags.enabled("tui") {
+			return runTUI(args.Flags, cfg, args.FileA, args.FileB)
+		}
+		if args.Flags.enabled("watch") {
+			if opts.Report != "" {
+				return 2, errors.New("--report is not supported with --watch")
+			}
+			return runWatch(args.Flags, cfg, args.FileA, args.FileB)
+		}
+		if args.Flags.enabled("split") {
+			return runSplit(args.Flags, cfg, args.FileA, args.FileB)
+		}
+		if args.Flags.enabled("ndjson") {
+			if opts.Report != "" || args.FileB == "" {
+				return 2, errors.New("--ndjson expects two input files and does not support --report")
+			}
+			return runNDJSON(args.Flags, cfg, args.FileA, args.FileB)
+		}
+		if args.Flags.enabled("interactive") {
+			return runInteractivePatch(args.Flags, cfg, args.FileA, args.FileB)
+		}
+		if args.Chain != nil {
+			return runPatchChain(args.Flags, cfg, args.FileB, args.Chain)
+		}
+		if flagHunks(args.Flags) {
+			return runHunks(args.Flags, cfg, args.FileA, args.FileB)
+		}
+		if socket, explicit := flagDaemonSocket(args); socket != "" {
+			if code, ok, err := runDaemonClient(args.Flags, cfg, socket, args.FileA, args.FileB, explicit); ok {
+				return code, err
+			}
+		}
+		if opts.Report == "" && args.FileB != "" && !args.Flags.enabled("validate-local") && flagPathsFormat(args.Flags) == "" &&
+			!flagSideBySide(args.Flags) && !flagHunks(args.Flags) && !args.Flags.enabled("explain") && shouldStream(args.Flags, args.FileA, args.FileB) {
+			return runStreamed(args.Flags, cfg, args.FileA, args.FileB)
 		}
-		out = append(out, a)
-		i++
+		return runPostgres(args.Flags, cfg, args.FileA, args.FileB, opts)
+	default:
+		return 2, fmt.Errorf("unsupported engine '%s' (supported: postgres, postgres-ephemeral)", cfg.Engine)
 	}
-	return out
 }
 
-func permissiveParseEnvArgs() (cfg string, a string, b string, err error) {
+// cliArgs holds the arguments that select what the runner executes.
+type cliArgs struct {
+	// Command is the subcommand given as the first argument (see commands), or empty.
+	Command string
+	// Flags are the args.Flags of the command as parsed.
+	Flags cliFlags
+	// Shell is the argument of the completion command.
+	Shell      string
+	ConfigPath string
+	FileA      string
+	FileB      string
+	// Manifest is a JSONL file of input pairs to run in batch mode instead of FileA/FileB.
+	Manifest string
+	// Spec is a spec case file or directory of case files to execute and verify.
+	Spec string
+	// Table selects table mode, which diffs the JSON columns of two tables.
+	Table *tableDiff
+	// QueryA and QueryB select query mode, which diffs the results of two queries. One
+	// of them may be empty, FileA or FileB then holding the document of that side.
+	QueryA, QueryB string
+	// Update selects update mode, which applies the diff in FileA to table rows.
+	Update *updateTarget
+	// Git selects git external diff mode; FileA and FileB are its old and new file.
+	Git *gitDiff
+	// FileC is the third input of merge3 (theirs); FileA is the base and FileB ours.
+	FileC string
+	// Chain holds the patch files applied in order to the document in FileB by a patch
+	// chain (see runPatchChain); FileA is then empty.
+	Chain []string
+}
+
+// parseArgs parses the command line into the command, its inputs and its args.Flags, which
+// the modes read from cliArgs.Flags.
+func parseArgs() (cliArgs, error) {
 	args := os.Args[1:]
-	// Remove config flags
-	i := 0
-	for i < len(args) {
-		s := args[i]
-		if s == "-c" || s == "--config" {
-			if i+1 < len(args) {
-				cfg = args[i+1]
-				args = append(args[:i], args[i+2:]...)
-				continue
+	if len(args) > 0 && isHelpArg(args[0]) {
+		printUsage(os.Stdout, nil)
+		return cliArgs{}, flag.ErrHelp
+	}
+	cmd, _ := lookupCommand("diff")
+	if len(args) > 0 {
+		if c, ok := lookupCommand(args[0]); ok {
+			cmd, args = c, args[1:]
+		}
+	}
+	fs := newFlagSet(cmd)
+	pos, err := parseFlags(fs, args)
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(os.Stdout, &cmd)
+		return cliArgs{}, err
+	}
+	if err != nil {
+		return cliArgs{}, usageError(cmd.name, err)
+	}
+	if err := checkOptionalValues(fs, args); err != nil {
+		return cliArgs{}, usageError(cmd.name, err)
+	}
+	flags := cliFlags{fs}
+	configPath := resolveConfigPath(coalesceNonEmpty(flags.value("c"), flags.value("config")))
+
+	switch cmd.name {
+	case "diff", "patch", "translate":
+		// An explicit command sets the flag of the diff mode it stands for
+		switch cmd.name {
+		case "patch":
+			// patch --check checks the patch instead of applying it
+			if !flags.enabled("check") {
+				fs.Set("patch", "true")
+			}
+		case "translate":
+			t, err := translateFlag(flags)
+			if err != nil {
+				return cliArgs{}, usageError(cmd.name, err)
+			}
+			if flags.value("t") == "" && flags.value("translate") == "" {
+				fs.Set("t", t)
+			}
+			if len(pos) == 0 {
+				// The diff is read from stdin
+				pos = []string{"-"}
 			}
-			args = append(args[:i], args[i+1:]...)
-			continue
-		} else if strings.HasPrefix(s, "-c=") {
-			cfg = strings.TrimPrefix(s, "-c=")
-			args = append(args[:i], args[i+1:]...)
-			continue
-		} else if strings.HasPrefix(s, "--config=") {
-			cfg = strings.TrimPrefix(s, "--config=")
-			args = append(args[:i], args[i+1:]...)
-			continue
 		}
-		i++
+		ca, err := parseDiffArgs(configPath, flags, pos)
+		ca.Flags = flags
+		return ca, err
 	}
-	if len(args) < 2 {
-		return "", "", "", errors.New("not enough args")
+
+	// Subcommands: install applies the packaged SQL, doctor checks the installed surface,
+	// dump writes its source, selftest runs the embedded corpus,
+	// bench measures a diff, fuzz checks diff/patch round trips, serve runs the REST API,
+	// merge3 merges three documents, hash prints canonical hashes, gen-trigger generates
+	// an audit trigger, cdc streams the diffs of a replication slot, snapshot saves the
+	// values of a table that drift later diffs the table with
+	ca := cliArgs{Command: cmd.name, ConfigPath: configPath, Flags: flags}
+	switch {
+	case cmd.name == "hash":
+		td, ok, err := getTableDiff(flags)
+		if ok {
+			if err != nil {
+				return cliArgs{}, usageError(cmd.name, err)
+			}
+			if len(pos) > 0 {
+				return cliArgs{}, usageError(cmd.name, fmt.Errorf("unexpected argument '%s'", pos[0]))
+			}
+			if td.sourced() {
+				return cliArgs{}, usageError(cmd.name, errors.New("--source-a and --source-b are not supported by hash"))
+			}
+			td.Hash = true
+			ca.Table = &td
+			break
+		}
+		if len(pos) != 1 {
+			return cliArgs{}, usageError(cmd.name, errors.New("hash expects one input file, or --table-a and --table-b"))
+		}
+		ca.FileA = pos[0]
+		if err := ensureFilesExist(ca.FileA, ""); err != nil {
+			return cliArgs{}, err
+		}
+	case cmd.name == "merge3":
+		if len(pos) != 3 {
+			return cliArgs{}, usageError(cmd.name, errors.New("merge3 expects three input files: base, ours and theirs"))
+		}
+		ca.FileA, ca.FileB, ca.FileC = pos[0], pos[1], pos[2]
+		if err := ensureFilesExist(ca.FileA, ca.FileB); err != nil {
+			return cliArgs{}, err
+		}
+		if err := ensureFilesExist(ca.FileC, ""); err != nil {
+			return cliArgs{}, err
+		}
+	case cmd.name == "drift":
+		if len(pos) != 1 {
+			return cliArgs{}, usageError(cmd.name, errors.New("drift expects one snapshot file"))
+		}
+		ca.FileA = pos[0]
+		if err := ensureFilesExist(ca.FileA, ""); err != nil {
+			return cliArgs{}, err
+		}
+	case cmd.name == "completion":
+		if len(pos) != 1 {
+			return cliArgs{}, usageError(cmd.name, fmt.Errorf("completion expects one shell (%s)", strings.Join(completionShells, ", ")))
+		}
+		ca.Shell = pos[0]
+	case cmd.name != "bench" && cmd.name != "fuzz":
+		if len(pos) > 0 {
+			return cliArgs{}, usageError(cmd.name, fmt.Errorf("unexpected argument '%s'", pos[0]))
+		}
+	case len(pos) == 2:
+		ca.FileA, ca.FileB = pos[0], pos[1]
+		if err := ensureFilesExist(ca.FileA, ca.FileB); err != nil {
+			return cliArgs{}, err
+		}
+	case len(pos) != 0 && cmd.name == "bench":
+		return cliArgs{}, errors.New("bench expects two input files, or none with --sweep")
+	case len(pos) != 0:
+		return cliArgs{}, errors.New("fuzz expects two input files to replay, or none")
 	}
-	return cfg, args[len(args)-2], args[len(args)-1], nil
+	return ca, nil
 }
 
-func loadConfig(path string) (Config, error) {
-	var cfg Config
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return cfg, fmt.Errorf("failed to read config file: %s: %w", path, err)
+// parseDiffArgs selects the mode of the diff command from its flags and positional
+// arguments.
+func parseDiffArgs(configPath string, flags cliFlags, pos []string) (cliArgs, error) {
+	if td, ok, err := getTableDiff(flags); ok {
+		if err != nil {
+			return cliArgs{}, err
+		}
+		return cliArgs{ConfigPath: configPath, Table: &td}, nil
+	}
+
+	if ut, ok, err := getUpdateTarget(flags); ok {
+		if err != nil {
+			return cliArgs{}, err
+		}
+		if len(pos) != 1 {
+			return cliArgs{}, errors.New("update mode expects one diff file")
+		}
+		if !existsFile(pos[0]) {
+			return cliArgs{}, fmt.Errorf("diff file does not exist: %s", pos[0])
+		}
+		return cliArgs{ConfigPath: configPath, Update: &ut, FileA: pos[0]}, nil
+	}
+
+	if q, ok, err := getQueryDiff(flags); ok {
+		if err != nil {
+			return cliArgs{}, err
+		}
+		q.ConfigPath = configPath
+		return q, nil
+	}
+
+	if spec := flags.value("spec"); spec != "" {
+		if _, err := os.Stat(spec); err != nil {
+			return cliArgs{}, fmt.Errorf("spec path does not exist: %s", spec)
+		}
+		return cliArgs{ConfigPath: configPath, Spec: spec}, nil
+	}
+
+	// Batch mode: inputs come from the manifest, not positional args
+	if manifest := flags.value("manifest"); manifest != "" {
+		if !existsFile(manifest) {
+			return cliArgs{}, fmt.Errorf("manifest file does not exist: %s", manifest)
+		}
+		return cliArgs{ConfigPath: configPath, Manifest: manifest}, nil
+	}
+
+	if flags.enabled("git") {
+		gd, err := getGitDiff(pos)
+		if err != nil {
+			return cliArgs{}, err
+		}
+		return cliArgs{ConfigPath: configPath, Git: &gd, FileA: gd.OldFile, FileB: gd.NewFile}, nil
 	}
-	if err := yaml.Unmarshal(b, &cfg); err != nil {
-		return cfg, fmt.Errorf("failed to parse YAML config: %s: %w", path, err)
+
+	// patch doc.json p1.jd p2.jd ... applies a chain of patches
+	if len(pos) > 2 && (flags.enabled("p") || flags.enabled("patch")) {
+		for _, f := range pos {
+			if err := ensureFilesExist(f, ""); err != nil {
+				return cliArgs{}, err
+			}
+		}
+		return cliArgs{ConfigPath: configPath, FileB: pos[0], Chain: pos[1:]}, nil
 	}
-	return cfg, nil
+
+	// Default: expect two files; in translate mode the single input is the diff content
+	switch len(pos) {
+	case 0:
+		return cliArgs{}, usageError("diff", errors.New("missing input files (expected two file paths)"))
+	case 1:
+		return cliArgs{ConfigPath: configPath, FileA: pos[0]}, nil
+	case 2:
+	default:
+		return cliArgs{}, errors.New("too many input files (expected two)")
+	}
+	if err := ensureFilesExist(pos[0], pos[1]); err != nil {
+		return cliArgs{}, err
+	}
+	return cliArgs{ConfigPath: configPath, FileA: pos[0], FileB: pos[1]}, nil
+}
+
+// registerDiffFlags registers the flags of the diff command and its modes.
+func registerDiffFlags(fs *flag.FlagSet) {
+	registerSharedFlags(fs)
+	fs.String("manifest", "", "JSONL manifest of input pairs (batch mode)")
+	fs.String("spec", "", "spec case file or directory to execute")
+	fs.String("report", "", "report format: csv|html|json|junit|tap|tsv")
+	fs.String("report-file", "", "write the report to this file instead of stdout")
+	fs.Bool("explain", false, "print the EXPLAIN (ANALYZE, BUFFERS) plan of the statement, as JSON, instead of its result")
+	fs.String("record-to", "", "also insert every diff, with the hashes of its inputs, into this table (schema.table), creating it if needed")
+	fs.Int("jobs", 1, "number of batch/spec cases to run concurrently")
+	fs.Var(&optionalValueFlag{values: []string{"bar", "plain"}}, "progress", "report progress on stderr in batch, spec, table and directory runs (--progress or --progress=bar|plain)")
+	fs.Bool("bulk", false, "diff the pairs of a batch or spec run in one statement over inputs loaded with COPY")
+	fs.String("checkpoint", "", "record the results of a batch or spec run in this file as it progresses")
+	fs.Bool("resume", false, "continue the batch or spec run recorded in --checkpoint after its last recorded case")
+	fs.String("cache", "", "directory of batch and spec results reused while the inputs and installed functions are unchanged")
+	fs.Bool("fail-fast", false, "stop a batch or spec run at the first failed case")
+	fs.Int("max-failures", 0, "stop a batch or spec run once this many cases failed")
+	fs.Var(new(repeatedFlag), "case", "run only the batch or spec cases whose name matches this glob (repeatable)")
+	fs.Var(new(repeatedFlag), "include-tags", "run only the batch or spec cases with a tag matching one of these comma separated globs")
+	fs.Var(new(repeatedFlag), "exclude-tags", "leave out the batch or spec cases with a tag matching one of these comma separated globs")
+	registerSinkFlags(fs)
+	fs.Var(&optionalValueFlag{values: []string{"literal", "psql"}}, "dry-run", "print the SQL instead of executing it (--dry-run or --dry-run=literal|psql)")
+	registerTableFlags(fs)
+	fs.String("query-a", "", "query mode: SQL query returning the first JSON document")
+	fs.String("query-b", "", "query mode: SQL query returning the second JSON document")
+	fs.String("a-query", "", "query mode: same as --query-a")
+	fs.String("b-query", "", "query mode: same as --query-b")
+	fs.String("a-file", "", "query mode: file holding the first document, diffed against --query-b")
+	fs.String("b-file", "", "query mode: file holding the second document, diffed against --query-a")
+	fs.String("apply-to", "", "update mode: table.column to apply the diff file to")
+	fs.String("where", "", "update mode: SQL condition selecting the rows to patch")
+	fs.Bool("commit", false, "update mode: commit the update (otherwise use --dry-run to preview)")
+	fs.Bool("stat", false, "print a summary of the diff (values added, removed and modified per top-level path) instead of the diff")
+	fs.Int("chunk", 0, "diff top-level arrays in chunks of this many elements, on up to --jobs connections")
+	fs.String("at", "", "diff only the subtree at this JSON Pointer (/spec/env) or jd path ([\"spec\",\"env\"])")
+	fs.Bool("ndjson", false, "diff two NDJSON files record by record")
+	fs.String("ndjson-key", "", "with --ndjson, pair records by the value at this JSON Pointer (e.g. /id)")
+	fs.Bool("split", false, "diff two multi-document YAML streams or JSON arrays of documents document by document")
+	fs.Var(new(repeatedFlag), "split-key", "with --split, pair documents by the value at this JSON Pointer (e.g. /metadata/name; repeatable)")
+	fs.Bool("validate-local", false, "parse the JSON inputs before connecting, reporting syntax errors by line and column")
+	fs.Bool("stream", false, "copy the inputs in chunks instead of binding them (automatic above 64 MiB)")
+	fs.Bool("watch", false, "re-run the diff whenever input file A or B changes")
+	fs.Bool("tui", false, "browse the diff in a terminal UI: a tree of the changed paths and their jd, patch or merge diff")
+	fs.String("oracle", "", "cross-check every result against an independent implementation: jd")
+	fs.Bool("git", false, "take git's external diff arguments (GIT_EXTERNAL_DIFF) instead of two files")
+	fs.String("daemon", "", "run the diff, patch or translate through the daemon listening on this unix socket (default: $JD_SQL_DAEMON when one listens)")
+	fs.Bool("append", false, "with -o in batch, spec and directory modes, append to the file")
+	fs.String("output-format", "", "render the output with this encoder: color|compact-json|paths|pretty-json|raw|sidebyside|stat (default: by the kind of output)")
+	fs.Var(&optionalValueFlag{values: []string{"auto", "always", "never"}}, "color", "colorize jd diffs: --color=auto (when stdout is a terminal), always or never; --color alone is always")
+}
+
+// registerTableFlags registers the table mode flags (see getTableDiff).
+func registerTableFlags(fs *flag.FlagSet) {
+	fs.String("table-a", "", "table mode: first table (optionally schema qualified)")
+	fs.String("table-b", "", "table mode: second table")
+	fs.String("key", "", "table mode: comma separated key columns joining the tables")
+	fs.String("column", "", "table mode: JSON column to diff")
+	fs.String("column-b", "", "table mode: JSON column of the second table (default: --column)")
+	fs.String("source-a", "", "read side A from this config engine or DSN and pair the rows by --key in the runner")
+	fs.String("source-b", "", "read side B from this config engine or DSN (see --source-a)")
+}
+
+// registerSharedFlags registers the diff flags that bench and fuzz share with the diff
+// command, so that their values are not taken for input files.
+func registerSharedFlags(fs *flag.FlagSet) {
+	fs.String("f", "", "diff/patch format: jd|jd2|patch|merge, paths|paths-json to list the changed paths, sidebyside, or hunks-ndjson to stream the hunks as JSON Lines")
+	fs.String("width", "", "width of -f sidebyside output in columns (default: COLUMNS or the terminal width, else 80)")
+	fs.String("format", "", "diff/patch format (same as -f)")
+	fs.String("t", "", "translate: <in>2<out> (e.g., jd2patch)")
+	fs.String("translate", "", "translate (same as -t)")
+	fs.Bool("p", false, "apply the diff in file A to the document in file B")
+	fs.Bool("patch", false, "apply the diff (same as -p)")
+	fs.Bool("interactive", false, "with -p, ask for each hunk of the diff whether to apply it (like git add -p)")
+	fs.String("residual", "", "with -p --interactive, write the diff of the skipped hunks to this file")
+	fs.String("conflict-format", "", "with -p, how to print a hunk that does not match the document: text|json (default text)")
+	fs.Bool("merge-strict", false, "with -f merge -p, reject merge patches whose objects target non-object values")
+	fs.Bool("strict-6902", false, "with -t patch2<out>, reject patch operations that cannot be translated instead of dropping them")
+	fs.String("from", "", "format of the input diff with -t, -p, --check or --invert: jd|jd2|patch|merge, or auto to detect it")
+	fs.Bool("invert", false, "print the inverse of the diff in the input file, which undoes it; with -p, apply the inverse to the document")
+	fs.String("verify-determinism", "", "run the diff (or patch, translate, ...) this many times and fail unless every run gives the same result")
+	fs.String("determinism-connections", "", "with --verify-determinism, spread the runs over this many connections (backends)")
+	fs.Bool("verify-roundtrip", false, "with -t, translate the result back and fail if the translation is lossy")
+	fs.Bool("check", false, "report whether the diff in the first file applies cleanly to the second, without printing the result")
+	fs.String("schema", "", "JSON Schema whose defaults are filled into both documents before diffing them")
+	fs.Bool("coerce", false, "with --schema, also convert strings holding numbers or booleans to the type of their schema, and back")
+	fs.String("normalize", "", "Unicode normalization of the strings and keys of both documents before diffing them: nfc|nfkc")
+	fs.Bool("equal", false, "report only through the exit code whether the documents are equal, without building a diff")
+	fs.Bool("canonicalize", false, "print the single input in its canonical form (sorted keys, normalized numbers)")
+	registerOptionFlags(fs)
+}
+
+// registerOptionFlags registers the jd diff option flags (see flagOptions).
+func registerOptionFlags(fs *flag.FlagSet) {
+	fs.Bool("set", false, "compare arrays as sets (jd -set)")
+	fs.Bool("mset", false, "compare arrays as multisets (jd -mset)")
+	fs.String("precision", "", "treat numbers within this tolerance as equal (jd -precision)")
+	fs.String("setkeys", "", "match objects in arrays by these comma separated keys (jd -setkeys)")
+	fs.String("opts", "", "jd options as a JSON array, an object like {\"set\":true} or @file, replacing -set, -mset, -precision and -setkeys (jd -opts)")
+	fs.Var(new(repeatedFlag), "path-opt", "apply a jd option to the subtree at a JSON Pointer or jd path only: PATH=set|mset|setkeys=KEY,...|precision=N (repeatable)")
+	fs.Var(new(repeatedFlag), "redact", "mask the values at this JSON Pointer or jd path in the output with \"***\"; the last pointer segment may be a glob (repeatable)")
+	fs.Var(new(repeatedFlag), "ignore", "exclude the values at this JSON Pointer or jd path from the diff; the last pointer segment may be a glob (repeatable)")
+}
+
+// ensureFilesExist checks that the local input files a and b exist. URLs are checked
+// when they are downloaded.
+func ensureFilesExist(a, b string) error {
+	for _, f := range []string{a, b} {
+		if f == "" || f == "-" || isRemoteInput(f) {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("input file does not exist: %s", f)
+		}
+	}
+	return nil
 }
 
 func resolveConfigPath(opt string) string {
@@ -215,239 +913,679 @@ func existsFile(p string) bool {
 	return !st.IsDir()
 }
 
-func runPostgres(cfg Config, fileA, fileB string) (int, error) {
-    // TODO(jd-sql): Upstream extended spec includes a `yaml_mode` case using the `-yaml` flag
-    // and YAML inputs. This runner intentionally passes inputs directly to the SQL implementation
-    // without YAML->JSON preprocessing. As a result, `yaml_mode` will currently fail here.
-    // The Java JUnit harness skips YAML-mode cases by default; this Go runner does NOT.
-    // If/when YAML support is added (or a preprocessing mode is introduced), consider adding
-    // a configurable skip or conversion similar to the Java tests.
-    // Read inputs as raw JSON text. We intentionally pass raw JSON strings to Postgres
-    // and let the database perform JSONB parsing/validation via ::jsonb casts.
+// queryMode reports whether args select query mode.
+func (a cliArgs) queryMode() bool {
+	return a.QueryA != "" || a.QueryB != ""
+}
+
+// runPostgres runs a single diff, patch or translate. With --report the run is also
+// written as a one-case report; see runSuite for where the report goes.
+func runPostgres(flags cliFlags, cfg Config, fileA, fileB string, opts suiteOptions) (int, error) {
+	// TODO(jd-sql): Upstream extended spec includes a `yaml_mode` case using the `-yaml` flag
+	// and YAML inputs. This runner intentionally passes inputs directly to the SQL implementation
+	// without YAML->JSON preprocessing. As a result, `yaml_mode` will currently fail here.
+	// The Java JUnit harness skips YAML-mode cases by default; this Go runner does NOT.
+	// If/when YAML support is added (or a preprocessing mode is introduced), consider adding
+	// a configurable skip or conversion similar to the Java tests.
+	// Read inputs as raw JSON text. We intentionally pass raw JSON strings to Postgres
+	// and let the database perform JSONB parsing/validation via ::jsonb casts.
 	// This mirrors the behavior of the previous Rust runner and ensures that invalid
-	// JSON surfaces as a SQL error (exit 2) instead of being pre-validated here.
-	aText, err := os.ReadFile(fileA)
+	// JSON surfaces as a SQL error (exit 2) instead of being pre-validated here, unless
+	// --validate-local asks for it.
+	aText, bText, err := readInputs(fileA, fileB)
 	if err != nil {
-		return 2, fmt.Errorf("failed to read input file A: %s: %w", fileA, err)
+		return 2, err
+	}
+	inv := flagInvocation(flags, aText, bText)
+	if flags.enabled("validate-local") {
+		if err := validateLocal(inv, fileA, fileB); err != nil {
+			return 2, err
+		}
 	}
-	bText, err := os.ReadFile(fileB)
+
+	db, err := openPostgres(cfg)
 	if err != nil {
-		return 2, fmt.Errorf("failed to read input file B: %s: %w", fileB, err)
+		return 2, err
+	}
+	defer db.Close()
+
+	if opts.Report != "" {
+		return runSingleReport(cfg, db, inv, opts)
+	}
+	if flags.enabled("explain") {
+		return printExplain(db, inv)
+	}
+	if runs, conns, _ := flagDeterminism(flags); runs > 0 {
+		// Validated by run
+		return verifyDeterminism(db, inv, runs, conns)
+	}
+	code, err := printInvocation(db, inv)
+	if c, ok := asPatchConflict(err); ok && inv.Patch {
+		// A conflict is a result of the patch rather than an error of the run
+		format, _ := flagConflictFormat(flags)
+		writeConflict(os.Stderr, c, format)
+		return 1, nil
+	}
+	if err != nil && inv.TranslateIn != "" {
+		err = describeTranslateError(db, inv, err)
+	}
+	return code, err
+}
+
+// printInvocation runs inv, checks the result with the oracle if one is selected and
+// writes the output to stdout.
+func printInvocation(db querier, inv invocation) (int, error) {
+	out, code, err := execInvocation(db, inv)
+	return printResult(inv, out, code, err)
+}
+
+// printResult checks the result of inv with the oracle if one is selected and writes
+// the output to stdout.
+func printResult(inv invocation, out string, code int, err error) (int, error) {
+	if oracle != nil {
+		if msg := checkOracle(inv, out, code, err); msg != "" {
+			return 2, errors.New(msg)
+		}
+	}
+	if err != nil {
+		return code, err
+	}
+	if err := writeOutput(inv, out); err != nil {
+		return 2, err
+	}
+	return code, nil
+}
+
+// writeOutput prints the output of inv to stdout with the encoder selected by
+// --output-format, else the one defaultEncoder picks for inv.
+func writeOutput(inv invocation, out string) error {
+	e := outputEncoder
+	if e == nil {
+		e = defaultEncoder(inv)
+	}
+	if err := e.Encode(os.Stdout, inv, out); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
 	}
+	return nil
+}
 
-	var aIsNull, bIsNull bool
-	if strings.TrimSpace(string(aText)) == "" {
-		aIsNull = true
+func runSingleReport(cfg Config, db *sql.DB, inv invocation, opts suiteOptions) (int, error) {
+	start := time.Now()
+	res := caseResult{Case: testCase{Name: strings.Join(os.Args[1:], " ")}, Status: statusPass}
+	res.Trace, res.Invocation = &execTrace{}, &inv
+	res.Output, res.Exit, res.Err = execInvocationTrace(db, inv, res.Trace)
+	res.Duration = time.Since(start)
+	if res.Err != nil {
+		res.Status, res.Message = statusFail, res.Err.Error()
 	}
-	if strings.TrimSpace(string(bText)) == "" {
-		bIsNull = true
+	if oracle != nil {
+		if msg := checkOracle(inv, res.Output, res.Exit, res.Err); msg != "" {
+			res.Status, res.Message = statusFail, msg
+			if res.Err == nil {
+				res.Exit = 2
+			}
+		}
 	}
 
-	dsn := cfg.DSN
-	// Default to disabling SSL unless explicitly configured. This matches local dev
-	// expectations and the prior Rust runner, and avoids lib/pq errors when the server
-	// does not have SSL enabled.
-	if !strings.Contains(strings.ToLower(dsn), "sslmode=") {
-		if strings.Contains(dsn, "?") {
-			dsn = dsn + "&sslmode=disable"
+	if opts.ReportFile != "" {
+		fmt.Fprint(os.Stdout, res.Output)
+	}
+	run := suiteRun{Kind: inv.mode(), Engine: cfg.Engine, Start: start, Elapsed: res.Duration, Results: []caseResult{res}}
+	if err := writeReport(opts, run); err != nil {
+		return 2, err
+	}
+	return res.Exit, res.Err
+}
+
+// flagInvocation builds the invocation of a single run from the command line flags.
+func flagInvocation(flags cliFlags, aText, bText []byte) invocation {
+	translateIn, translateOut := getTranslateFlag(flags)
+	format := getFormatFlag(flags)
+	if from := flagInputFormat(flags, aText); from != "" {
+		// --from names the format of the diff in file A: the input of a translation, or
+		// the diff applied in patch and check modes
+		if translateIn != "" {
+			translateIn = from
 		} else {
-			dsn = dsn + "?sslmode=disable"
+			format = from
 		}
+	} else if translateIn == jdsql.FormatAuto {
+		translateIn = jdsql.DetectDiffFormat(aText)
 	}
+	return invocation{
+		A:               aText,
+		B:               bText,
+		Format:          format,
+		TranslateIn:     translateIn,
+		TranslateOut:    translateOut,
+		Patch:           flags.enabled("p") || flags.enabled("patch"),
+		Check:           flags.enabled("check"),
+		Equal:           flags.enabled("equal"),
+		Canonicalize:    flags.enabled("canonicalize"),
+		Stat:            flags.enabled("stat"),
+		MergeStrict:     flags.enabled("merge-strict"),
+		Strict6902:      flags.enabled("strict-6902"),
+		VerifyRoundTrip: flags.enabled("verify-roundtrip"),
+		Invert:          flags.enabled("invert"),
+		Paths:           flagPathsFormat(flags),
+		SideBySide:      flagSideBySide(flags),
+		Width:           outputWidth(flags),
+		Hunks:           flagHunks(flags),
+		Schema:          diffSchema,
+		Coerce:          flags.enabled("coerce"),
+		Normalize:       flagNormalize(flags),
+		Options:         flagOptions(flags, aText, bText),
+		At:              flagAtPath(flags),
+		Redact:          flagRedacts(flags),
+	}
+}
 
-	db, err := sql.Open("postgres", dsn)
+// parsePrecision parses a -precision tolerance, which must be a finite number >= 0.
+func parsePrecision(v string) (float64, error) {
+	p, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || math.IsNaN(p) || math.IsInf(p, 0) || p < 0 {
+		return 0, fmt.Errorf("invalid -precision value '%s' (expected a finite number >= 0, e.g. 1e-9)", v)
+	}
+	return p, nil
+}
+
+// flagOptions builds the jd options array of a run from the command line flags, in the
+// same form as invocationFromArgs, or returns nil (NULL options) when no option is set.
+// Wildcards of --ignore paths are expanded against docs.
+func flagOptions(flags cliFlags, docs ...[]byte) []byte {
+	if v := flags.value("opts"); v != "" {
+		// Validated by run
+		raw, _ := readOpts(v)
+		return withIgnores(withPathOptions(raw, pathOptions(flags)), flagIgnores(flags), docs...)
+	}
+	opts := jdsql.Options{Set: flags.enabled("set"), MultiSet: flags.enabled("mset")}
+	if v := flags.value("precision"); v != "" {
+		// Validated by run
+		p, _ := parsePrecision(v)
+		opts.Precision = &p
+	}
+	for _, k := range strings.Split(flags.value("setkeys"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			opts.SetKeys = append(opts.SetKeys, k)
+		}
+	}
+	return withIgnores(withPathOptions(opts.JSON(), pathOptions(flags)), flagIgnores(flags), docs...)
+}
+
+// readInputs reads the raw text of the two input files. An empty fileB (single input
+// translate mode) yields empty text, which is bound as NULL.
+func readInputs(fileA, fileB string) ([]byte, []byte, error) {
+	aText, err := readInput(fileA)
 	if err != nil {
-		return 2, fmt.Errorf("failed to connect to postgres: %s: %w", dsn, err)
+		return nil, nil, fmt.Errorf("failed to read input file A: %s: %w", fileA, err)
 	}
-	defer db.Close()
+	if fileB == "" {
+		return aText, nil, nil
+	}
+	bText, err := readInput(fileB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read input file B: %s: %w", fileB, err)
+	}
+	return aText, bText, nil
+}
 
- // Determine mode based on flags
- format := getFormatFlag()
- translateIn, translateOut := getTranslateFlag()
-
- var sqlText string
- var args []any
- if translateIn != "" {
-     // Translate mode: use fileA as diff content
-     sqlText = "SELECT jd_translate_diff_format($1::jsonb, $2::jd_diff_format, $3::jd_diff_format)"
-     // Read A text (already read above as aText); if empty, pass NULL
-     var arg1 any
-     if aIsNull {
-         arg1 = nil
-     } else {
-         arg1 = string(aText)
-     }
-     args = []any{arg1, translateIn, translateOut}
- } else {
-     // Diff mode: 4-arg jd_diff, include options as NULL and format param
-     sqlText = "SELECT jd_diff($1::jsonb, $2::jsonb, NULL::jsonb, $3::jd_diff_format)"
-     var arg1 any
-     if aIsNull {
-         arg1 = nil
-     } else {
-         arg1 = string(aText)
-     }
-     var arg2 any
-     if bIsNull {
-         arg2 = nil
-     } else {
-         arg2 = string(bText)
-     }
-     args = []any{arg1, arg2, format}
- }
-
- // Prepare statement
- stmt, err := db.Prepare(sqlText)
- if err != nil {
-     return 2, fmt.Errorf("prepare SQL failed: %w", err)
- }
- defer stmt.Close()
-
- row := stmt.QueryRow(args...)
-
- // Try text first
- var textOut sql.NullString
- if err := row.Scan(&textOut); err == nil {
-     if textOut.Valid {
-         out := textOut.String
-         // If the text looks like JSON, attempt to decode.
-         var decoded any
-         if json.Unmarshal([]byte(out), &decoded) == nil {
-             switch v := decoded.(type) {
-             case string:
-                 // JSON string -> emit unquoted payload
-                 fmt.Fprint(os.Stdout, v)
-                 if strings.TrimSpace(v) == "" {
-                     return 0, nil
-                 }
-                 return 1, nil
-             default:
-                 // Valid JSON (object/array/number/bool/null): emit compact JSON
-                 enc, _ := json.Marshal(v)
-                 fmt.Fprint(os.Stdout, string(enc))
-                 if jsonDiffPresent(v) {
-                     return 1, nil
-                 }
-                 return 0, nil
-             }
-         }
-         // Not JSON: treat as plain text jd output
-         fmt.Fprint(os.Stdout, out)
-         if strings.TrimSpace(out) == "" {
-             return 0, nil
-         }
-         return 1, nil
-     }
-     return 0, nil
- } else {
-     // Re-query to get raw JSON bytes by executing again (since Scan consumed row)
-     row2 := db.QueryRow(sqlText, args...)
-     var jsonBytes []byte
-     if err2 := row2.Scan(&jsonBytes); err2 == nil {
-         // print compact JSON
- 			// Ensure bytes are valid JSON
- 			var v any
- 			if err := json.Unmarshal(jsonBytes, &v); err != nil {
- 				// Treat as text
- 				s := string(jsonBytes)
-				fmt.Fprint(os.Stdout, s)
-				if strings.TrimSpace(s) == "" {
-					return 0, nil
-				}
-				return 1, nil
-			}
-			enc, _ := json.Marshal(v)
-			fmt.Fprint(os.Stdout, string(enc))
-			if jsonDiffPresent(v) {
-				return 1, nil
-			}
-			return 0, nil
-		}
-		// If both scans fail, return error
-		return 2, fmt.Errorf("unsupported result type in first column; expected text or json")
-	}
-}
-
-func getFormatFlag() string {
-    // default jd
-    var fShort, fLong string
-    for _, a := range os.Args[1:] {
-        if strings.HasPrefix(a, "-f=") {
-            fShort = strings.TrimPrefix(a, "-f=")
-        } else if a == "-f" {
-            // next token
-            // handled below by scanning again in order
-        } else if strings.HasPrefix(a, "--format=") {
-            fLong = strings.TrimPrefix(a, "--format=")
-        }
-    }
-    // second pass for -f value
-    for i := 0; i < len(os.Args)-1; i++ {
-        if os.Args[i] == "-f" && !strings.HasPrefix(os.Args[i+1], "-") {
-            fShort = os.Args[i+1]
-            break
-        }
-    }
-    v := strings.TrimSpace(strings.ToLower(coalesceNonEmpty(fShort, fLong)))
-    if v == "" {
-        return "jd"
-    }
-    switch v {
-    case "jd", "patch", "merge":
-        return v
-    default:
-        return "jd"
-    }
-}
-
-func getTranslateFlag() (inFmt string, outFmt string) {
-    var t string
-    for _, a := range os.Args[1:] {
-        if strings.HasPrefix(a, "-t=") {
-            t = strings.TrimPrefix(a, "-t=")
-        } else if strings.HasPrefix(a, "--translate=") {
-            t = strings.TrimPrefix(a, "--translate=")
-        }
-    }
-    if t == "" {
-        return "", ""
-    }
-    // expect pattern X2Y
-    parts := strings.SplitN(t, "2", 2)
-    if len(parts) != 2 {
-        return "", ""
-    }
-    return strings.ToLower(parts[0]), strings.ToLower(parts[1])
+func openPostgres(cfg Config) (*sql.DB, error) {
+	if replaying {
+		return trafficDB(nil), nil
+	}
+	dsn, dialHost, err := postgresDSN(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %s: %w", cfg.DSN, err)
+	}
+	var dialer pq.Dialer = newKeepaliveDialer(cfg.Pool.Keepalive, dialHost)
+	if cfg.CloudSQL.Instance != "" {
+		dialer = newCloudSQLDialer(cfg.CloudSQL, newKeepaliveDialer(cfg.Pool.Keepalive, ""))
+	}
+	if cfg.Credentials.Provider != "" {
+		return trafficDB(newSecretConnector(cfg.Credentials, dsn, dialer)), nil
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %s: %w", cfg.DSN, err)
+	}
+	connector.Dialer(dialer)
+	return trafficDB(connector), nil
 }
 
-func coalesceNonEmpty(a, b string) string {
-    if strings.TrimSpace(a) != "" {
-        return a
-    }
-    return b
+// invocation is a single diff, patch or translate call against the SQL implementation.
+// Blank inputs are bound as SQL NULL; a nil Options binds NULL options.
+type invocation struct {
+	A            []byte
+	B            []byte
+	Format       string
+	Options      []byte
+	TranslateIn  string
+	TranslateOut string
+	// Patch applies the diff in A to the document in B (upstream jd -p).
+	Patch bool
+	// Chain, in patch mode, replaces A with the diffs applied in order to B, each in the
+	// format at the same index of ChainFormats (patch doc.json p1.jd p2.jd ...).
+	Chain        [][]byte
+	ChainFormats []string
+	// Invert outputs the inverse of the diff in A (--invert); with Patch, the inverse is
+	// applied to B instead, reverting the diff.
+	Invert bool
+	// Check reports whether the diff in A applies cleanly to the document in B, without
+	// printing the patched document (--check).
+	Check bool
+	// Equal tests A and B for equality with jd_equal under Options, printing nothing
+	// (--equal).
+	Equal bool
+	// Canonicalize renders the document in A in its canonical form with jd_canonicalize
+	// (--canonicalize).
+	Canonicalize bool
+	// Stat summarizes the diff of A and B with jd_diff_stat instead of printing it
+	// (--stat).
+	Stat bool
+	// Paths lists the paths of the diff of A and B with jd_diff_paths instead of
+	// printing it: one per line for paths, as a JSON array for paths-json (-f paths).
+	Paths string
+	// SideBySide prints the diff of A and B as two columns of old and new values,
+	// rendered from the elements of jd_diff_struct (-f sidebyside).
+	SideBySide bool
+	// Width is the width side-by-side output is laid out for; see outputWidth.
+	Width int
+	// Hunks streams the hunks of the diff of A and B from jd_diff_hunks as JSON Lines
+	// (-f hunks-ndjson); see runHunks.
+	Hunks bool
+	// Schema is a JSON Schema whose defaults are materialized in A and B with
+	// jd_schema_defaults before they are diffed or compared (--schema); Coerce also
+	// converts their values to the types of the schema (--coerce).
+	Schema []byte
+	Coerce bool
+	// Normalize is the Unicode normalization form (NFC or NFKC) the strings and keys of
+	// A and B are normalized to with jd_normalize_unicode before they are diffed or
+	// compared (--normalize).
+	Normalize string
+	// At restricts a diff to the subtree at this jd path (as JSON), with which the paths
+	// of the diff start (--at).
+	At []byte
+	// Redact masks the values at these paths in the output (--redact).
+	Redact []pathPattern
+	// MergeStrict rejects merge patches that would replace a non-object target with
+	// an object (see checkMergeTargets).
+	MergeStrict bool
+	// Strict6902 rejects RFC 6902 operations that translation cannot represent instead of
+	// dropping them (--strict-6902).
+	Strict6902 bool
+	// VerifyRoundTrip fails a translation that translating back does not undo
+	// (--verify-roundtrip).
+	VerifyRoundTrip bool
+	// QueryA and QueryB select query mode: they compute the documents inside the
+	// database in place of A and B, and Template is the config's sql (see queryModeSQL),
+	// which plain diffs of A and B use too.
+	QueryA, QueryB string
+	Template       string
 }
 
-func toJSONB(v any) any { return v }
+// mode names the kind of call: diff, patch, check, equal, canonicalize, stat or translate.
+func (inv invocation) mode() string {
+	switch {
+	case inv.Patch:
+		return "patch"
+	case inv.Check:
+		return "check"
+	case inv.Equal:
+		return "equal"
+	case inv.Canonicalize:
+		return "canonicalize"
+	case inv.Stat:
+		return "stat"
+	case inv.TranslateIn != "":
+		return "translate"
+	case inv.Invert:
+		return "invert"
+	default:
+		return "diff"
+	}
+}
+
+// outputFormat is the format of the output of inv: the translate target, the diff
+// format, or empty for documents (patch results and canonical forms), check reports and
+// equality tests.
+func (inv invocation) outputFormat() string {
+	switch {
+	case inv.Patch, inv.Check, inv.Equal, inv.Canonicalize, inv.Stat, inv.Paths != "", inv.SideBySide, inv.Hunks:
+		return ""
+	case inv.TranslateIn != "":
+		return inv.TranslateOut
+	default:
+		return inv.Format
+	}
+}
+
+// usesTemplate reports whether inv is a plain diff, whose built-in statement the
+// config's sql replaces; --at, --schema, --normalize, -f paths and the other modes keep
+// theirs.
+func (inv invocation) usesTemplate() bool {
+	return inv.mode() == "diff" && inv.At == nil && inv.Paths == "" && !inv.SideBySide && !inv.Hunks &&
+		inv.Schema == nil && inv.Normalize == ""
+}
+
+// query returns the statement of inv and its arguments, as rendered by renderSQL.
+func (inv invocation) query() (string, []any) {
+	if inv.QueryA != "" || inv.QueryB != "" {
+		// The config's sql template is used as written
+		return queryModeSQL(inv)
+	}
+	if diffTemplate != "" && inv.usesTemplate() {
+		// The config's sql replaces the built-in statement of a plain diff, with the
+		// documents bound as parameters
+		inv.Template = diffTemplate
+		return queryModeSQL(inv)
+	}
+	q, args := inv.statement()
+	if inv.Schema != nil {
+		q, args = withSchema(q, args, inv.Schema, inv.Coerce)
+	}
+	if inv.Normalize != "" {
+		q, args = withNormalize(q, args, inv.Normalize)
+	}
+	return renderSQL(q), args
+}
+
+func (inv invocation) statement() (string, []any) {
+	switch {
+	case inv.Patch && inv.Chain != nil:
+		return jdsql.PatchChainQuery(inv.B, inv.Chain, inv.ChainFormats)
+	case inv.Patch && inv.Invert:
+		// Revert mode: the inverse of the diff in A is applied to the document in B
+		return jdsql.RevertQuery(inv.A, inv.B, inv.Format)
+	case inv.Invert:
+		return jdsql.InvertQuery(inv.A, inv.Format)
+	case inv.Patch:
+		// Patch mode: A holds the diff in the requested format, B the document
+		return jdsql.PatchQuery(inv.A, inv.B, inv.Format)
+	case inv.Check:
+		// Check mode: as in patch mode, A holds the diff and B the document
+		return jdsql.CheckQuery(inv.A, inv.B, inv.Format)
+	case inv.Equal:
+		// Equal mode: jd_equal decides the exit code, no diff is built
+		return jdsql.EqualQuery(inv.A, inv.B, inv.Options)
+	case inv.Canonicalize:
+		return jdsql.CanonicalizeQuery(inv.A)
+	case inv.Stat:
+		// Stat mode: the summary is JSON, rendered by writeOutput
+		return jdsql.StatQuery(inv.A, inv.B, inv.Options)
+	case inv.Paths != "":
+		// Paths output: the JSON array of paths, rendered by writeOutput
+		return jdsql.PathsQuery(inv.A, inv.B, inv.Options)
+	case inv.SideBySide:
+		// Side-by-side output: the JSON array of diff elements, rendered by writeOutput
+		return jdsql.DiffElementsQuery(inv.A, inv.B, inv.Options)
+	case inv.Hunks:
+		// Hunks output: one row per hunk, written by runHunks as it arrives
+		return jdsql.HunksQuery(inv.A, inv.B, inv.Options)
+	case inv.TranslateIn != "":
+		// Translate mode: A holds the diff content
+		if inv.VerifyRoundTrip {
+			return jdsql.TranslateRoundTripQuery(inv.A, inv.TranslateIn, inv.TranslateOut, inv.Strict6902)
+		}
+		return jdsql.TranslateQuery(inv.A, inv.TranslateIn, inv.TranslateOut, inv.Strict6902)
+	case inv.At != nil:
+		// Diff mode restricted to a subtree
+		return jdsql.DiffAtQuery(inv.A, inv.B, inv.At, inv.Options, inv.Format)
+	default:
+		// Diff mode: 4-arg jd_diff, include options and format param
+		return jdsql.DiffQuery(inv.A, inv.B, inv.Options, inv.Format)
+	}
+}
+
+// modeFlags returns the flags selecting the mode of inv, of which at most one may be
+// given.
+func (inv invocation) modeFlags() []string {
+	var flags []string
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"-p", inv.Patch}, {"-t", inv.TranslateIn != ""}, {"--check", inv.Check}, {"--equal", inv.Equal},
+		{"--canonicalize", inv.Canonicalize}, {"--stat", inv.Stat}, {"--invert", inv.Invert && !inv.Patch},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return flags
+}
+
+// querier is the part of *sql.DB and *sql.Conn used to run invocations, so a case can
+// run on the pool or on a dedicated session.
+type querier interface {
+	rowQuerier
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
 
-func jsonDiffPresent(v any) bool {
+// rowQuerier is the part of querier shared with *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// execInvocation runs inv on db and returns the text that should be written to stdout
+// together with the exit code (0 no diff, 1 diff, 2 error). A successful patch exits 0.
+func execInvocation(db querier, inv invocation) (string, int, error) {
+	return execInvocationTrace(db, inv, nil)
+}
+
+// execTrace records how an invocation was executed, for reports.
+type execTrace struct {
+	SQL    string
+	Params []any
+	// Rows is the number of result rows read.
+	Rows int
+	// RoundTrip covers prepare, execution and reading the result, including retries.
+	RoundTrip time.Duration
+	// Attempts is the number of executions, more than 1 if transient errors were retried.
+	Attempts int
+	// ColumnType is the database type of the result column, e.g. JSONB or TEXT.
+	ColumnType string
+	// Cached is set when the result was taken from --cache instead of the database.
+	Cached bool
+	// Err is the error of the last attempt.
+	Err error
+	// log is the logger of the query, carrying the fields of its case; nil is logger.
+	log *slog.Logger
+}
+
+// execInvocationTrace is execInvocation that also fills trace when it is not nil.
+// Transient errors are retried according to retryPolicy.
+func execInvocationTrace(db querier, inv invocation, trace *execTrace) (string, int, error) {
+	return runInvocation(inv, trace, func(trace *execTrace) (string, int, error) {
+		return queryInvocation(baseContext, db, inv, trace)
+	})
+}
+
+// execInvocationContext is execInvocation with its queries cancelled with ctx, such as
+// the context of an HTTP request, as well as on interrupt.
+func execInvocationContext(ctx context.Context, db querier, inv invocation) (string, int, error) {
+	return runInvocation(inv, nil, func(trace *execTrace) (string, int, error) {
+		return queryInvocation(ctx, db, inv, trace)
+	})
+}
+
+// runInvocation is execInvocationTrace with query making a single attempt at inv, such
+// as one run by the daemon (see runDaemonClient).
+func runInvocation(inv invocation, trace *execTrace, query func(*execTrace) (string, int, error)) (string, int, error) {
+	if inv.MergeStrict && (inv.Patch || inv.Check) && inv.Format == "merge" {
+		if err := checkMergeTargets(inv.B, inv.A); err != nil {
+			if inv.Check {
+				// The patch does not apply under --merge-strict
+				return err.Error() + "\n", 1, nil
+			}
+			return "", 2, err
+		}
+	}
+	if verbose && trace == nil {
+		trace = &execTrace{}
+	}
+	log := logger
+	if trace != nil && trace.log != nil {
+		log = trace.log
+	}
+	if err := inputLimits.checkInvocation(inv); err != nil {
+		return "", exitInputLimit, err
+	}
+	warnDuplicateKeys(inv, log)
+	start := time.Now()
+	var out string
+	var code int
+	var err error
+	for attempt := 1; ; attempt++ {
+		out, code, err = query(trace)
+		if trace != nil {
+			trace.Attempts = attempt
+		}
+		if err == nil || attempt >= retryPolicy.attempts() || !retryPolicy.retryable(err) || stopped() != nil {
+			break
+		}
+		time.Sleep(retryPolicy.delay(attempt))
+	}
+	if trace != nil {
+		trace.RoundTrip = time.Since(start)
+	}
+	err = queryTimeouts.describe(err)
+	if trace != nil {
+		trace.Err = err
+	}
+	if verbose {
+		logTrace(trace)
+	}
+	if err == nil && (inv.Patch || inv.Canonicalize) {
+		code = 0
+	}
+	if err == nil {
+		// Masking after the diff is computed leaves the exit code as it is
+		out = redactOutput(inv, out)
+		if rerr := diffRecorder.record(inv, out, code); rerr != nil {
+			return out, 2, rerr
+		}
+	}
+	return out, code, err
+}
+
+// queryInvocation makes a single attempt at inv, within the query timeout of ctx.
+func queryInvocation(ctx context.Context, db querier, inv invocation, trace *execTrace) (string, int, error) {
+	sqlText, args := inv.query()
+	if trace != nil {
+		trace.SQL, trace.Params = sqlText, args
+	}
+
+	ctx, cancel := queryTimeouts.context(ctx)
+	defer cancel()
+
+	// Prepare statement (reused across cases when db is a stmtCache)
+	stmt, release, err := prepareStmt(ctx, db, sqlText)
+	if err != nil {
+		return "", 2, fmt.Errorf("prepare SQL failed: %w", err)
+	}
+	defer release()
+
+	// A statement timeout is set with SET LOCAL semantics, so the query runs in its own
+	// transaction
+	if t := queryTimeouts.statement(); t > 0 {
+		tx, err := beginWithStatementTimeout(ctx, db, t)
+		if err != nil {
+			return "", 2, err
+		}
+		defer tx.Rollback()
+		stmt = tx.StmtContext(ctx, stmt)
+	}
+
+	// Diff and translate statements return jd_diff_is_empty as a second column, which
+	// decides the exit code; other statements leave empty unset.
+	var result any
+	var empty sql.NullBool
+	if err := queryFirst(ctx, stmt, args, trace, &result, &empty); err != nil {
+		if errors.Is(err, errReplayMiss) {
+			// Not a failure of the query: the run is not the one recorded
+			return "", 2, err
+		}
+		return "", 2, fmt.Errorf("query failed: %w", err)
+	}
+	if trace != nil {
+		trace.Rows = 1
+	}
+	out, different, ok := decodeResultValue(result)
+	if !ok {
+		return "", 2, fmt.Errorf("unsupported result type %T in first column; expected text or json", result)
+	}
+	if empty.Valid {
+		different = !empty.Bool
+	}
+	if different {
+		return out, 1, nil
+	}
+	return out, 0, nil
+}
+
+// decodeResultValue decodes the first column of a result as scanned by the driver: text,
+// json and jsonb arrive as bytes or a string, booleans and numbers as themselves. NULL
+// is an empty result. ok is false for any other type.
+func decodeResultValue(v any) (out string, different, ok bool) {
 	switch t := v.(type) {
 	case nil:
-		return false
-	case bool:
-		return t
-	case float64:
-		return t != 0
+		return "", false, true
+	case []byte:
+		out, different = jdsql.DecodeResult(string(t))
 	case string:
-		return t != ""
-	case []any:
-		return len(t) > 0
-	case map[string]any:
-		return len(t) > 0
+		out, different = jdsql.DecodeResult(t)
+	case bool, int64, float64:
+		out, different = jdsql.DecodeResult(fmt.Sprint(t))
 	default:
-		return true
+		return "", false, false
+	}
+	return out, different, true
+}
+
+func getFormatFlag(flags cliFlags) string {
+	return jdsql.NormalizeFormat(coalesceNonEmpty(flags.value("f"), flags.value("format")))
+}
+
+// flagInputFormat returns the diff format given by --from, detecting it from the diff
+// text when it is auto, or "" without --from.
+func flagInputFormat(flags cliFlags, diff []byte) string {
+	from := strings.ToLower(strings.TrimSpace(flags.value("from")))
+	if from == jdsql.FormatAuto {
+		return jdsql.DetectDiffFormat(diff)
+	}
+	return from
+}
+
+func getTranslateFlag(flags cliFlags) (inFmt string, outFmt string) {
+	return jdsql.ParseTranslate(coalesceNonEmpty(flags.value("t"), flags.value("translate")))
+}
+
+func coalesceNonEmpty(a, b string) string {
+	if strings.TrimSpace(a) != "" {
+		return a
 	}
+	return b
 }
 
-type nopWriter struct{}
+func toJSONB(v any) any { return v }
+
+// repeatedFlag is a flag that may be given more than once; its values are read with
+// cliFlags.values.
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string     { return strings.Join(*f, ",") }
+func (f *repeatedFlag) Set(v string) error { *f = append(*f, v); return nil }
+
+// optionalValueFlag is a flag given alone or as -name=value, so a following argument is
+// never taken as its value.
+type optionalValueFlag struct {
+	value string
+	// values are the accepted values, rejected as separate arguments by
+	// checkOptionalValues.
+	values []string
+}
 
-func (n *nopWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (f *optionalValueFlag) String() string     { return f.value }
+func (f *optionalValueFlag) Set(v string) error { f.value = v; return nil }
+func (f *optionalValueFlag) IsBoolFlag() bool   { return true }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// manifestEntry is one line of a batch manifest (JSONL). Relative paths for A and B
+// are resolved against the directory containing the manifest.
+type manifestEntry struct {
+	Name string `json:"name"`
+	A    string `json:"a"`
+	B    string `json:"b"`
+	// Optional per-pair overrides; Format defaults to jd and Options to NULL.
+	Format    string          `json:"format"`
+	Translate string          `json:"translate"`
+	Options   json.RawMessage `json:"options"`
+	Tags      []string        `json:"tags"`
+	// Expected result, see testCase.
+	ExpectedDiff *string `json:"expected_diff"`
+	ExpectedExit *int    `json:"expected_exit"`
+	// Setup and teardown hooks of the pair, see caseHooks.
+	caseHooks
+	// Suite, on a line of its own, holds the hooks of every pair of the manifest.
+	Suite *caseHooks `json:"suite"`
+
+	line int
+}
+
+func (e manifestEntry) label() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return fmt.Sprintf("line %d", e.line)
+}
+
+func loadManifest(path string) ([]manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest file: %s: %w", path, err)
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(path)
+	var entries []manifestEntry
+	var suite *caseHooks
+	sc := bufio.NewScanner(textReader(f))
+	// Expected diffs can be large; allow long lines
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	n := 0
+	for sc.Scan() {
+		n++
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e manifestEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %s:%d: %w", path, n, err)
+		}
+		if e.Suite != nil {
+			if suite != nil || e.A != "" || e.B != "" || !e.caseHooks.empty() {
+				return nil, fmt.Errorf("invalid manifest entry: %s:%d: \"suite\" must be alone on its line, once per manifest", path, n)
+			}
+			suite = e.Suite
+			continue
+		}
+		if e.A == "" {
+			return nil, fmt.Errorf("invalid manifest entry: %s:%d: missing \"a\"", path, n)
+		}
+		e.A = resolveRelative(dir, e.A)
+		if e.B != "" {
+			e.B = resolveRelative(dir, e.B)
+		}
+		e.line = n
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest file: %s: %w", path, err)
+	}
+	if suite != nil {
+		for i := range entries {
+			entries[i].caseHooks = suite.around(entries[i].caseHooks)
+		}
+	}
+	return entries, nil
+}
+
+func resolveRelative(dir, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// runManifest executes every pair of the manifest over a single connection pool and
+// prints a PASS/FAIL line per pair followed by a summary. It exits 1 if any pair failed.
+func runManifest(flags cliFlags, cfg Config, path string, opts suiteOptions) (int, error) {
+	entries, err := loadManifest(path)
+	if err != nil {
+		return 2, err
+	}
+	cases := make([]testCase, 0, len(entries))
+	for _, e := range entries {
+		cases = append(cases, e.testCase(path))
+	}
+	return runSuite(flags, cfg, "manifest", cases, opts)
+}
+
+func (e manifestEntry) testCase(manifestPath string) testCase {
+	return testCase{
+		Name:           e.label(),
+		Class:          filepath.Base(manifestPath),
+		Tags:           e.Tags,
+		Source:         fmt.Sprintf("%s:%d", manifestPath, e.line),
+		ExpectedOutput: e.ExpectedDiff,
+		ExpectedExit:   e.ExpectedExit,
+		Hooks:          e.caseHooks,
+		prepare: func() (invocation, error) {
+			aText, bText, err := readInputs(e.A, e.B)
+			if err != nil {
+				return invocation{}, err
+			}
+			inv := invocation{
+				A:      aText,
+				B:      bText,
+				Format: jdsql.NormalizeFormat(e.Format),
+			}
+			if len(e.Options) > 0 && !bytes.Equal(bytes.TrimSpace(e.Options), []byte("null")) {
+				inv.Options = e.Options
+			}
+			inv.TranslateIn, inv.TranslateOut = jdsql.ParseTranslate(e.Translate)
+			return inv, nil
+		},
+	}
+}
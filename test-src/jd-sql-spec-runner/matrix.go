@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// NamedEngine is an entry of the config's engines list. Its settings override the
+// top-level ones; skips and xfail rules are added to the top-level rules.
+type NamedEngine struct {
+	Name   string `yaml:"name"`
+	Config `yaml:",inline"`
+}
+
+// engineConfig returns cfg with the settings of e applied.
+func (cfg Config) engineConfig(e NamedEngine) Config {
+	out := cfg
+	out.Engines = nil
+	if e.Engine != "" {
+		out.Engine = e.Engine
+	}
+	if e.DSN != "" {
+		out.DSN = e.DSN
+	}
+	if e.SQL != "" {
+		out.SQL = e.SQL
+	}
+	if e.Implementation != "" {
+		out.Implementation, out.Schema = e.Implementation, ""
+	}
+	if e.Schema != "" {
+		out.Schema = e.Schema
+	}
+	if e.FunctionPrefix != "" {
+		out.FunctionPrefix = e.FunctionPrefix
+	}
+	if e.Collation != "" {
+		out.Collation = e.Collation
+	}
+	if e.MergeNullPolicy != "" {
+		out.MergeNullPolicy = e.MergeNullPolicy
+	}
+	if e.Image != "" {
+		out.Image = e.Image
+	}
+	if e.TLS != (TLSConfig{}) {
+		out.TLS = e.TLS
+	}
+	if e.Credentials != (CredentialsConfig{}) {
+		out.Credentials = e.Credentials
+	}
+	if e.CloudSQL != (CloudSQLConfig{}) {
+		out.CloudSQL = e.CloudSQL
+	}
+	if e.Pool != (PoolConfig{}) {
+		out.Pool = e.Pool
+	}
+	out.Skips = append(append([]caseRule(nil), cfg.Skips...), e.Skips...)
+	out.XFail = append(append([]caseRule(nil), cfg.XFail...), e.XFail...)
+	return out
+}
+
+// selectEngines resolves an --engines value: "all" or a comma separated list of names.
+func selectEngines(cfg Config, names string) ([]NamedEngine, error) {
+	if len(cfg.Engines) == 0 {
+		return nil, fmt.Errorf("--engines requires an engines list in the config")
+	}
+	var out []NamedEngine
+	if strings.TrimSpace(names) == "all" {
+		for _, e := range cfg.Engines {
+			out = append(out, NamedEngine{Name: e.Name, Config: cfg.engineConfig(e)})
+		}
+		return out, nil
+	}
+	for _, n := range strings.Split(names, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		found := false
+		for _, e := range cfg.Engines {
+			if e.Name == n {
+				out = append(out, NamedEngine{Name: e.Name, Config: cfg.engineConfig(e)})
+				found = true
+				break
+			}
+		}
+		if !found {
+			var known []string
+			for _, e := range cfg.Engines {
+				known = append(known, e.Name)
+			}
+			return nil, fmt.Errorf("unknown engine '%s' (configured: %s)", n, strings.Join(known, ", "))
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("--engines: no engine selected")
+	}
+	return out, nil
+}
+
+// runMatrix runs the mode selected by args against every engine. install and doctor
+// run once per engine; diffs and batch/spec runs are compared across the engines.
+func runMatrix(engines []NamedEngine, args cliArgs) (int, error) {
+	if args.Command == "serve" {
+		return 2, fmt.Errorf("serve is not supported with --engines")
+	}
+	if args.Command != "" {
+		exit := 0
+		for _, e := range engines {
+			fmt.Fprintf(os.Stdout, "== %s ==\n", e.Name)
+			code, err := withEngine(e.Config, args.Flags.enabled("ephemeral"), func(cfg Config) (int, error) {
+				return runEngine(cfg, args)
+			})
+			if err != nil {
+				logger.Error(err.Error(), "engine", e.Name)
+			}
+			exit = max(exit, code)
+		}
+		return exit, nil
+	}
+	if args.Flags.value("report") != "" {
+		return 2, fmt.Errorf("--report is not supported with --engines")
+	}
+	if args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil {
+		return 2, fmt.Errorf("table, query, update and git modes are not supported with --engines")
+	}
+
+	if args.Manifest == "" && args.Spec == "" {
+		if isDir(args.FileA) || isDir(args.FileB) {
+			return 2, fmt.Errorf("directory mode is not supported with --engines")
+		}
+		return runSingleMatrix(engines, args)
+	}
+	kind, cases, err := loadSuiteCases(args)
+	if err != nil {
+		return 2, err
+	}
+	if cases, err = filterCases(args.Flags, cases); err != nil {
+		return 2, err
+	}
+
+	opts, err := getSuiteOptions(args.Flags)
+	if err != nil {
+		return 2, err
+	}
+	results := make([][]caseResult, len(engines))
+	for i, e := range engines {
+		engineCases := append([]testCase(nil), cases...)
+		_, err := withEngine(e.Config, args.Flags.enabled("ephemeral"), func(cfg Config) (int, error) {
+			db, err := openPostgres(cfg)
+			if err != nil {
+				return 2, err
+			}
+			defer db.Close()
+			configurePool(db, cfg, opts.Jobs)
+			stmts := newStmtCache(db)
+			defer stmts.Close()
+			applyCaseRules(cfg, engineCases)
+			results[i] = runCases(stmts, engineCases, opts.Jobs, nil, func(caseResult) {})
+			return 0, nil
+		})
+		if err != nil {
+			return 2, fmt.Errorf("%s: %w", e.Name, err)
+		}
+	}
+	return printMatrix(engines, kind, cases, results), nil
+}
+
+// sameOutcome reports whether two engines produced the same observable result, their
+// outputs compared after normalizeOutput.
+func sameOutcome(a, b caseResult) bool {
+	return a.Status == b.Status && a.Exit == b.Exit && normalizeOutput(a.Output) == normalizeOutput(b.Output)
+}
+
+// printMatrix prints a row per case whose outcome differs between engines, followed by
+// per engine summaries. It returns 1 if the engines diverge or any case failed.
+func printMatrix(engines []NamedEngine, kind string, cases []testCase, results [][]caseResult) int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	header := []string{"CASE"}
+	for _, e := range engines {
+		header = append(header, e.Name)
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	diverged := 0
+	var details []string
+	for i, c := range cases {
+		base := results[0][i]
+		same := true
+		for _, r := range results[1:] {
+			if !sameOutcome(base, r[i]) {
+				same = false
+			}
+		}
+		if same {
+			continue
+		}
+		diverged++
+		row := []string{c.Name}
+		for j, r := range results {
+			row = append(row, fmt.Sprintf("%s (exit %d)", r[i].Status, r[i].Exit))
+			if baseOut, out := normalizeOutput(base.Output), normalizeOutput(r[i].Output); j > 0 && baseOut != out {
+				details = append(details, fmt.Sprintf("%s: %s vs %s\n%s", c.Name, engines[0].Name, engines[j].Name,
+					unifiedDiff(engines[0].Name, engines[j].Name, baseOut, out)))
+			}
+		}
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+
+	for _, d := range details {
+		lines := strings.Split(strings.TrimRight(d, "\n"), "\n")
+		fmt.Fprintln(os.Stdout, lines[0])
+		for _, l := range lines[1:] {
+			fmt.Fprintf(os.Stdout, "    %s\n", l)
+		}
+	}
+
+	failed := false
+	for i, e := range engines {
+		s := summarize(results[i])
+		fmt.Fprintf(os.Stdout, "%s %s: %s\n", kind, e.Name, s)
+		failed = failed || s.Failed > 0
+	}
+	fmt.Fprintf(os.Stdout, "%s: %d of %d cases diverge across %d engines\n", kind, diverged, len(cases), len(engines))
+	if diverged > 0 || failed {
+		return 1
+	}
+	return 0
+}
+
+// runSingleMatrix runs a single diff, patch or translate on every engine. When all
+// engines agree the output is printed once with the common exit code; otherwise every
+// engine's output is printed and the run fails.
+func runSingleMatrix(engines []NamedEngine, args cliArgs) (int, error) {
+	aText, bText, err := readInputs(args.FileA, args.FileB)
+	if err != nil {
+		return 2, err
+	}
+	inv := flagInvocation(args.Flags, aText, bText)
+	results := make([]caseResult, len(engines))
+	for i, e := range engines {
+		_, err := withEngine(e.Config, args.Flags.enabled("ephemeral"), func(cfg Config) (int, error) {
+			db, err := openPostgres(cfg)
+			if err != nil {
+				return 2, err
+			}
+			defer db.Close()
+			results[i].Output, results[i].Exit, results[i].Err = execInvocation(db, inv)
+			return 0, nil
+		})
+		if err != nil {
+			return 2, fmt.Errorf("%s: %w", e.Name, err)
+		}
+		if results[i].Err != nil {
+			results[i].Output = "error: " + results[i].Err.Error()
+		}
+	}
+
+	agree := true
+	for _, r := range results[1:] {
+		if !sameOutcome(results[0], r) {
+			agree = false
+		}
+	}
+	if agree {
+		if err := writeOutput(inv, results[0].Output); err != nil {
+			return 2, err
+		}
+		return results[0].Exit, results[0].Err
+	}
+	for i, e := range engines {
+		fmt.Fprintf(os.Stdout, "== %s (exit %d) ==\n%s\n", e.Name, results[i].Exit, normalizeOutput(results[i].Output))
+	}
+	return 2, fmt.Errorf("engines disagree")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// mergeNullPolicies are the accepted merge_null_policy values; see
+// Config.MergeNullPolicy.
+var mergeNullPolicies = []string{"keep", "error", "drop", "sentinel"}
+
+func validateMergeNullPolicy(p string) error {
+	if !contains(mergeNullPolicies, strings.ToLower(p)) {
+		return fmt.Errorf("unsupported policy '%s' (supported: %s)", p, strings.Join(mergeNullPolicies, ", "))
+	}
+	return nil
+}
+
+// checkMergeTargets implements --merge-strict for applying an RFC 7386 merge patch.
+// RFC 7386 replaces a target that is not an object with {} wherever the patch holds an
+// object, silently dropping the value; in strict mode that is an error naming the path.
+// Members missing from the target and null targets are still created.
+func checkMergeTargets(target, patch []byte) error {
+	var t, p any
+	if err := json.Unmarshal(patch, &p); err != nil {
+		// Invalid JSON is reported by the database
+		return nil
+	}
+	if strings.TrimSpace(string(target)) != "" {
+		if err := json.Unmarshal(target, &t); err != nil {
+			return nil
+		}
+	}
+	return checkMergeTarget(t, p, "")
+}
+
+func checkMergeTarget(target, patch any, path string) error {
+	po, ok := patch.(map[string]any)
+	if !ok {
+		return nil
+	}
+	var to map[string]any
+	switch t := target.(type) {
+	case nil:
+	case map[string]any:
+		to = t
+	default:
+		where := "the target"
+		if path != "" {
+			where = fmt.Sprintf("the target at '%s'", path)
+		}
+		return fmt.Errorf("merge patch: %s is %s, not an object (--merge-strict)", where, jsonTypeName(t))
+	}
+	// Sorted, so that the first offending path is reported consistently
+	for _, k := range sortedKeys(po) {
+		if err := checkMergeTarget(to[k], po[k], path+"/"+strings.NewReplacer("~", "~0", "/", "~1").Replace(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case []any:
+		return "an array"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	default:
+		return "null"
+	}
+}
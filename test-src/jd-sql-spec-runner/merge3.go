@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// runMerge3 merges the changes that ours (FileB) and theirs (FileC) made to base (FileA)
+// with jd_merge3 and prints the merged document. Conflicts are listed on stderr and exit
+// 1; where the sides conflict the merged document holds ours.
+func runMerge3(cfg Config, args cliArgs) (int, error) {
+	var docs [3][]byte
+	for i, path := range []string{args.FileA, args.FileB, args.FileC} {
+		b, err := readInput(path)
+		if err != nil {
+			return 2, fmt.Errorf("failed to read input file: %s: %w", path, err)
+		}
+		docs[i] = b
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	q, qargs := jdsql.Merge3Query(docs[0], docs[1], docs[2], flagOptions(args.Flags, docs[:]...))
+	var merged sql.NullString
+	var raw []byte
+	if err := db.QueryRowContext(ctx, renderSQL(q), qargs...).Scan(&merged, &raw); err != nil {
+		return 2, queryTimeouts.describe(fmt.Errorf("query failed: %w", err))
+	}
+	var conflicts []jdsql.Conflict
+	if err := json.Unmarshal(raw, &conflicts); err != nil {
+		return 2, fmt.Errorf("invalid conflicts from jd_merge3: %w", err)
+	}
+
+	if merged.Valid {
+		out, _ := jdsql.DecodeResult(merged.String)
+		fmt.Fprintln(os.Stdout, out)
+	}
+	for _, c := range conflicts {
+		fmt.Fprintf(os.Stderr, "conflict at %s: base %s, ours %s, theirs %s\n",
+			c.Path, conflictValue(c.Base), conflictValue(c.Ours), conflictValue(c.Theirs))
+	}
+	if len(conflicts) > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// conflictValue renders a side of a conflict, compacted, or "absent".
+func conflictValue(v json.RawMessage) string {
+	if v == nil {
+		return "absent"
+	}
+	out, _ := jdsql.DecodeResult(string(v))
+	return out
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Histogram buckets of the serve metrics: request latency in seconds and document size
+// in bytes (1 KiB to 64 MiB, the request body limit).
+var (
+	latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+)
+
+// serveMetrics collects the metrics of serve and renders them in the Prometheus text
+// exposition format on GET /metrics. The format is simple enough to write directly,
+// which keeps the runner free of a client library.
+type serveMetrics struct {
+	db     *sql.DB
+	limits *serveLimits
+
+	mu       sync.Mutex
+	requests map[[2]string]uint64 // by endpoint and status code
+	errors   map[[2]string]uint64 // by endpoint and SQLSTATE class
+	rejected map[[2]string]uint64 // by endpoint and reason
+	latency  map[string]*histogram
+	size     map[string]*histogram
+}
+
+// histogram is a cumulative Prometheus histogram.
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newServeMetrics(db *sql.DB, limits *serveLimits) *serveMetrics {
+	return &serveMetrics{
+		db:       db,
+		limits:   limits,
+		requests: map[[2]string]uint64{},
+		errors:   map[[2]string]uint64{},
+		rejected: map[[2]string]uint64{},
+		latency:  map[string]*histogram{},
+		size:     map[string]*histogram{},
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// observe records a request to endpoint: its status, latency, the size of its documents
+// and, for failed requests, the class of the error.
+func (m *serveMetrics) observe(endpoint string, status int, elapsed time.Duration, size int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[2]string{endpoint, strconv.Itoa(status)}]++
+	if err != nil {
+		m.errors[[2]string{endpoint, errorClass(err)}]++
+	}
+	observeInto(m.latency, endpoint, latencyBuckets, elapsed.Seconds())
+	observeInto(m.size, endpoint, sizeBuckets, float64(size))
+}
+
+// reject records a request to endpoint turned away by the serve limits for reason.
+func (m *serveMetrics) reject(endpoint, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected[[2]string{endpoint, reason}]++
+}
+
+func observeInto(hs map[string]*histogram, endpoint string, bounds []float64, v float64) {
+	h := hs[endpoint]
+	if h == nil {
+		h = &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+		hs[endpoint] = h
+	}
+	h.observe(v)
+}
+
+// errorClass returns the SQLSTATE class of err, its first two characters, or "none" for
+// errors that do not come from the server, such as a malformed request or a lost
+// connection.
+func errorClass(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && len(pqErr.Code) >= 2 {
+		return string(pqErr.Code)[:2]
+	}
+	return "none"
+}
+
+// ServeHTTP writes the metrics.
+func (m *serveMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *serveMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP jd_sql_requests_total Requests served, by endpoint and HTTP status code.")
+	fmt.Fprintln(w, "# TYPE jd_sql_requests_total counter")
+	for _, k := range sortedLabels(m.requests) {
+		fmt.Fprintf(w, "jd_sql_requests_total{endpoint=%q,code=%q} %d\n", k[0], k[1], m.requests[k])
+	}
+	fmt.Fprintln(w, "# HELP jd_sql_errors_total Failed requests, by endpoint and SQLSTATE class (none for other errors).")
+	fmt.Fprintln(w, "# TYPE jd_sql_errors_total counter")
+	for _, k := range sortedLabels(m.errors) {
+		fmt.Fprintf(w, "jd_sql_errors_total{endpoint=%q,sqlstate_class=%q} %d\n", k[0], k[1], m.errors[k])
+	}
+	fmt.Fprintln(w, "# HELP jd_sql_rejected_total Requests turned away by the serve limits, by endpoint and reason.")
+	fmt.Fprintln(w, "# TYPE jd_sql_rejected_total counter")
+	for _, k := range sortedLabels(m.rejected) {
+		fmt.Fprintf(w, "jd_sql_rejected_total{endpoint=%q,reason=%q} %d\n", k[0], k[1], m.rejected[k])
+	}
+	writeHistograms(w, "jd_sql_request_duration_seconds", "Request latency, database round trip included.", m.latency)
+	writeHistograms(w, "jd_sql_document_size_bytes", "Size of the documents of a request.", m.size)
+
+	s := m.db.Stats()
+	for _, g := range []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"jd_sql_db_max_open_connections", "gauge", "Maximum number of open connections of the pool.", float64(s.MaxOpenConnections)},
+		{"jd_sql_db_open_connections", "gauge", "Open connections, in use and idle.", float64(s.OpenConnections)},
+		{"jd_sql_db_in_use_connections", "gauge", "Connections in use.", float64(s.InUse)},
+		{"jd_sql_db_idle_connections", "gauge", "Idle connections.", float64(s.Idle)},
+		{"jd_sql_db_wait_count_total", "counter", "Connections waited for.", float64(s.WaitCount)},
+		{"jd_sql_db_wait_duration_seconds_total", "counter", "Time spent waiting for a connection.", s.WaitDuration.Seconds()},
+		{"jd_sql_serve_running_requests", "gauge", "Requests holding a slot to run their query.", float64(len(m.limits.slots))},
+		{"jd_sql_serve_max_running_requests", "gauge", "Slots to run queries in (serve.max_concurrent).", float64(cap(m.limits.slots))},
+		{"jd_sql_serve_queued_requests", "gauge", "Requests waiting for a slot.", float64(m.limits.queued.Load())},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", g.name, g.help, g.name, g.kind, g.name, formatFloat(g.value))
+	}
+}
+
+func writeHistograms(w io.Writer, name, help string, hs map[string]*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	endpoints := make([]string, 0, len(hs))
+	for e := range hs {
+		endpoints = append(endpoints, e)
+	}
+	sort.Strings(endpoints)
+	for _, e := range endpoints {
+		h := hs[e]
+		for i, b := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket{endpoint=%q,le=%q} %d\n", name, e, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{endpoint=%q,le=\"+Inf\"} %d\n", name, e, h.count)
+		fmt.Fprintf(w, "%s_sum{endpoint=%q} %s\n", name, e, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{endpoint=%q} %d\n", name, e, h.count)
+	}
+}
+
+func sortedLabels(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], "\x00") < strings.Join(keys[j][:], "\x00")
+	})
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// ndjsonRecord is a non-blank line of an NDJSON file. Offset locates it for rereading.
+type ndjsonRecord struct {
+	Line   int
+	Offset int64
+	Text   []byte
+}
+
+// ndjsonReader reads the records of an NDJSON file, skipping blank lines.
+type ndjsonReader struct {
+	r      *bufio.Reader
+	line   int
+	offset int64
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	return &ndjsonReader{r: bufio.NewReaderSize(r, 1<<20)}
+}
+
+// next returns the next record, or io.EOF.
+func (nr *ndjsonReader) next() (ndjsonRecord, error) {
+	for {
+		b, err := nr.r.ReadBytes('\n')
+		if len(b) == 0 && err != nil {
+			return ndjsonRecord{}, err
+		}
+		nr.line++
+		rec := ndjsonRecord{Line: nr.line, Offset: nr.offset, Text: bytes.TrimSpace(b)}
+		nr.offset += int64(len(b))
+		if len(rec.Text) > 0 {
+			return rec, nil
+		}
+		if err != nil {
+			return ndjsonRecord{}, err
+		}
+	}
+}
+
+// ndjsonDiff is one output line of NDJSON mode.
+type ndjsonDiff struct {
+	// LineA and LineB are 0 for a record missing from that file.
+	LineA int             `json:"line_a"`
+	LineB int             `json:"line_b"`
+	Key   json.RawMessage `json:"key,omitempty"`
+	Diff  json.RawMessage `json:"diff"`
+}
+
+// runNDJSON diffs the records of the NDJSON files fileA and fileB, paired by line
+// position or, with --ndjson-key, by the value at a JSON Pointer. A record without a
+// counterpart is diffed against a missing document. Each pair with a non-empty diff is
+// written to stdout as a JSON line; the exit code is 1 if any pair differs.
+func runNDJSON(flags cliFlags, cfg Config, fileA, fileB string) (int, error) {
+	inv := flagInvocation(flags, nil, nil)
+	if inv.mode() != "diff" {
+		return 2, fmt.Errorf("%s mode is not supported with --ndjson", inv.mode())
+	}
+	keyPath := flags.value("ndjson-key")
+	if keyPath != "" && !strings.HasPrefix(keyPath, "/") {
+		return 2, fmt.Errorf("invalid --ndjson-key value '%s' (expected a JSON Pointer such as /id)", keyPath)
+	}
+
+	fa, err := openTextInput(fileA)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read input file A: %s: %w", fileA, err)
+	}
+	defer fa.Close()
+	// Pairing by key reads B at record offsets, so a URL is downloaded to a file first
+	fb, err := openInputFile(fileB)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read input file B: %s: %w", fileB, err)
+	}
+	defer fb.Close()
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	differ := false
+	emit := func(a, b ndjsonRecord, key json.RawMessage) error {
+		inv.A, inv.B = a.Text, b.Text
+		inv.Options = flagOptions(flags, a.Text, b.Text)
+		out, code, err := execInvocation(stmts, inv)
+		if err != nil {
+			return fmt.Errorf("record A:%d B:%d: %w", a.Line, b.Line, err)
+		}
+		if code == 0 {
+			return nil
+		}
+		differ = true
+		d := ndjsonDiff{LineA: a.Line, LineB: b.Line, Key: key, Diff: json.RawMessage(out)}
+		if jdsql.IsJdText(inv.Format) {
+			d.Diff, _ = json.Marshal(out)
+		}
+		enc, _ := json.Marshal(d)
+		_, err = fmt.Fprintf(w, "%s\n", enc)
+		return err
+	}
+
+	if keyPath == "" {
+		err = pairByLine(newNDJSONReader(fa), newNDJSONReader(fb), emit)
+	} else {
+		err = pairByKey(newNDJSONReader(fa), fb, keyPath, emit)
+	}
+	if err != nil {
+		return 2, err
+	}
+	if differ {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func pairByLine(ra, rb *ndjsonReader, emit func(a, b ndjsonRecord, key json.RawMessage) error) error {
+	for {
+		a, errA := ra.next()
+		b, errB := rb.next()
+		if errA != nil && errA != io.EOF {
+			return fmt.Errorf("failed to read input file A: %w", errA)
+		}
+		if errB != nil && errB != io.EOF {
+			return fmt.Errorf("failed to read input file B: %w", errB)
+		}
+		if errA == io.EOF && errB == io.EOF {
+			return nil
+		}
+		if err := emit(a, b, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// pairByKey indexes the records of B by key (keeping only their offsets), then pairs
+// every record of A with the record of B of the same key. Records of B that no record
+// of A matched are diffed last, in file order.
+func pairByKey(ra *ndjsonReader, fb *inputFile, keyPath string, emit func(a, b ndjsonRecord, key json.RawMessage) error) error {
+	type indexed struct {
+		rec     ndjsonRecord
+		matched bool
+	}
+	index := map[string]*indexed{}
+	var order []string
+	rb := newNDJSONReader(fb)
+	for {
+		b, err := rb.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read input file B: %w", err)
+		}
+		key, err := ndjsonKey(b.Text, keyPath)
+		if err != nil {
+			return fmt.Errorf("input file B line %d: %w", b.Line, err)
+		}
+		if prev := index[key]; prev != nil {
+			return fmt.Errorf("input file B line %d: duplicate key %s (first on line %d)", b.Line, key, prev.rec.Line)
+		}
+		index[key] = &indexed{rec: ndjsonRecord{Line: b.Line, Offset: b.Offset}}
+		order = append(order, key)
+	}
+
+	readB := func(e *indexed) (ndjsonRecord, error) {
+		rec := e.rec
+		r := newNDJSONReader(io.NewSectionReader(fb, rec.Offset, 1<<62))
+		got, err := r.next()
+		if err != nil {
+			return rec, fmt.Errorf("failed to reread input file B line %d: %w", rec.Line, err)
+		}
+		rec.Text = got.Text
+		return rec, nil
+	}
+
+	seen := map[string]int{}
+	for {
+		a, err := ra.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read input file A: %w", err)
+		}
+		key, err := ndjsonKey(a.Text, keyPath)
+		if err != nil {
+			return fmt.Errorf("input file A line %d: %w", a.Line, err)
+		}
+		if line, dup := seen[key]; dup {
+			return fmt.Errorf("input file A line %d: duplicate key %s (first on line %d)", a.Line, key, line)
+		}
+		seen[key] = a.Line
+		var b ndjsonRecord
+		if e := index[key]; e != nil {
+			e.matched = true
+			if b, err = readB(e); err != nil {
+				return err
+			}
+		}
+		if err := emit(a, b, json.RawMessage(key)); err != nil {
+			return err
+		}
+	}
+	for _, key := range order {
+		e := index[key]
+		if e.matched {
+			continue
+		}
+		b, err := readB(e)
+		if err != nil {
+			return err
+		}
+		if err := emit(ndjsonRecord{}, b, json.RawMessage(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ndjsonKey returns the compact JSON encoding of the value at the JSON Pointer path
+// of record.
+func ndjsonKey(record []byte, path string) (string, error) {
+	v, err := jdsql.DecodeJSON(record)
+	if err != nil {
+		return "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	for _, tok := range strings.Split(path, "/")[1:] {
+		tok = strings.NewReplacer("~1", "/", "~0", "~").Replace(tok)
+		switch t := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = t[tok]; !ok {
+				return "", fmt.Errorf("key %s not found", path)
+			}
+		case []any:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(t) {
+				return "", fmt.Errorf("key %s not found", path)
+			}
+			v = t[i]
+		default:
+			return "", fmt.Errorf("key %s not found", path)
+		}
+	}
+	enc, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.New("invalid key")
+	}
+	return string(enc), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// normalizeOutput returns out, the output of an engine, in a canonical form for
+// comparing and reporting it across engines: JSON values have their object keys sorted,
+// their numbers in minimal form and their strings escaped alike, so that key order,
+// whitespace and number formatting, which differ between engines, do not count as
+// divergence. Output that is a single JSON value is normalized as a whole, keeping it
+// indented if it was; otherwise each line is, along with the JSON after the marker of
+// the lines of jd diffs ("@ [...]", "- 1", "+ 2"). Text that is not JSON is kept.
+func normalizeOutput(out string) string {
+	trimmed := strings.TrimSpace(out)
+	if v, ok := canonicalJSON(trimmed); ok {
+		if !strings.Contains(trimmed, "\n") {
+			return v
+		}
+		var buf bytes.Buffer
+		if json.Indent(&buf, []byte(v), "", "  ") == nil {
+			return buf.String()
+		}
+		return v
+	}
+	lines := strings.Split(trimmed, "\n")
+	for i, l := range lines {
+		l = strings.TrimRight(l, " \t\r")
+		if v, ok := canonicalJSON(l); ok {
+			lines[i] = v
+		} else if len(l) > 2 && l[1] == ' ' {
+			if v, ok := canonicalJSON(l[2:]); ok {
+				lines[i] = l[:2] + v
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// canonicalJSON returns the canonical compact encoding of s, or false when s is not a
+// single JSON value.
+func canonicalJSON(s string) (string, bool) {
+	if s == "" {
+		return "", false
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil || dec.More() {
+		return "", false
+	}
+	var buf bytes.Buffer
+	writeCanonicalJSON(&buf, v)
+	return buf.String(), true
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalJSON(buf, k)
+			buf.WriteByte(':')
+			writeCanonicalJSON(buf, v[k])
+		}
+		buf.WriteByte('}')
+	case []any:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalJSON(buf, e)
+		}
+		buf.WriteByte(']')
+	case json.Number:
+		buf.WriteString(canonicalNumber(string(v)))
+	case string:
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		// Encode terminates the value with a newline
+		buf.Truncate(buf.Len() - 1)
+	default:
+		b, _ := json.Marshal(v)
+		buf.Write(b)
+	}
+}
+
+// canonicalNumber returns the JSON number n in minimal form, without losing precision:
+// no leading or trailing zeros, and the exponent form only outside the range where
+// JavaScript (and with it jd) writes numbers in full, so 1.50, 15e-1 and 1.5 are all
+// 1.5 and 1E21 is 1e+21.
+func canonicalNumber(n string) string {
+	sign := ""
+	if strings.HasPrefix(n, "-") {
+		sign, n = "-", n[1:]
+	}
+	mantissa, expText, _ := strings.Cut(strings.ToLower(n), "e")
+	exp := 0
+	if expText != "" {
+		if _, err := fmt.Sscan(expText, &exp); err != nil {
+			return sign + n
+		}
+	}
+	whole, frac, _ := strings.Cut(mantissa, ".")
+	// The value is digits × 10^exp
+	digits := strings.TrimLeft(whole+frac, "0")
+	exp -= len(frac)
+	if digits == "" {
+		return "0"
+	}
+	for strings.HasSuffix(digits, "0") {
+		digits = digits[:len(digits)-1]
+		exp++
+	}
+
+	// Position of the decimal point relative to the start of digits
+	point := len(digits) + exp
+	switch {
+	case exp >= 0 && point <= 21:
+		return sign + digits + strings.Repeat("0", exp)
+	case exp < 0 && point > 0:
+		return sign + digits[:point] + "." + digits[point:]
+	case exp < 0 && point > -6:
+		return sign + "0." + strings.Repeat("0", -point) + digits
+	}
+	s := digits[:1]
+	if len(digits) > 1 {
+		s += "." + digits[1:]
+	}
+	if point-1 >= 0 {
+		return fmt.Sprintf("%s%se+%d", sign, s, point-1)
+	}
+	return fmt.Sprintf("%s%se%d", sign, s, point-1)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// readOpts returns the jd options array given by --opts: raw JSON, or the contents of a
+// file when v is @file. See parseOpts.
+func readOpts(v string) ([]byte, error) {
+	raw := []byte(v)
+	if name, ok := strings.CutPrefix(v, "@"); ok {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -opts file: %s: %w", name, err)
+		}
+		raw = b
+	}
+	return parseOpts(raw)
+}
+
+// parseOpts validates raw -opts JSON. A jd options array is passed verbatim; an object
+// such as {"set":true,"precision":1e-6} is shorthand for the options of the matching
+// flags (set, mset, precision and setkeys) and is converted to an array.
+func parseOpts(raw []byte) ([]byte, error) {
+	raw = bytes.TrimSpace(raw)
+	if !json.Valid(raw) {
+		return nil, fmt.Errorf("invalid -opts JSON: %s", raw)
+	}
+	if len(raw) == 0 || raw[0] != '{' {
+		return raw, nil
+	}
+	var o struct {
+		Set       bool     `json:"set"`
+		MultiSet  bool     `json:"mset"`
+		Precision *float64 `json:"precision"`
+		SetKeys   []string `json:"setkeys"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&o); err != nil {
+		return nil, fmt.Errorf("invalid -opts object (expected set, mset, precision and setkeys): %w", err)
+	}
+	if p := o.Precision; p != nil && (math.IsNaN(*p) || math.IsInf(*p, 0) || *p < 0) {
+		return nil, fmt.Errorf("invalid -opts precision %g (expected a finite number >= 0)", *p)
+	}
+	opts := jdsql.Options{Set: o.Set, MultiSet: o.MultiSet, Precision: o.Precision, SetKeys: o.SetKeys}.JSON()
+	if opts == nil {
+		return []byte("[]"), nil
+	}
+	return opts, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// oracleFunc computes the output of inv independently of the database and reports
+// whether the SQL output is equivalent to it.
+type oracleFunc func(inv invocation, sqlOut string) (expected string, same bool, err error)
+
+// oracles maps --oracle values to implementations. Oracles with dependencies outside
+// the runner's module register themselves from files behind build tags (oracle_jd.go).
+var oracles = map[string]oracleFunc{}
+
+// oracle is the selected --oracle, nil when results are not cross-checked.
+var oracle oracleFunc
+
+func selectOracle(name string) (oracleFunc, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if fn := oracles[name]; fn != nil {
+		return fn, nil
+	}
+	if name == "jd" {
+		return nil, errors.New("--oracle jd requires a runner built with -tags jdoracle (task spec:build-runner-oracle)")
+	}
+	return nil, fmt.Errorf("unsupported oracle '%s' (supported: jd)", name)
+}
+
+// checkOracle returns a description of the divergence between the result of inv and
+// the oracle's, or "" when they agree. Both failing counts as agreement.
+func checkOracle(inv invocation, out string, exit int, err error) string {
+	expected, same, oerr := oracle(inv, out)
+	switch {
+	case err != nil && oerr != nil:
+		return ""
+	case err != nil:
+		return fmt.Sprintf("diverges from oracle: SQL failed but the oracle returned %q: %v", expected, err)
+	case oerr != nil:
+		return fmt.Sprintf("diverges from oracle: SQL returned exit %d but the oracle failed: %v", exit, oerr)
+	case !same:
+		return "diverges from oracle\n" + unifiedDiff("oracle", "sql", strings.TrimSpace(expected), strings.TrimSpace(out))
+	}
+	return ""
+}
+
+// jsonEquivalent reports whether a and b hold the same JSON value. Output that is not
+// JSON is taken as a string, since the runner prints string results unquoted.
+func jsonEquivalent(a, b string) bool {
+	decode := func(s string) any {
+		var v any
+		if json.Unmarshal([]byte(s), &v) != nil {
+			return s
+		}
+		return v
+	}
+	return reflect.DeepEqual(decode(a), decode(b))
+}
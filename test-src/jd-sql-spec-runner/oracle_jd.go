@@ -0,0 +1,123 @@
+//go:build jdoracle
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	jd "github.com/josephburnett/jd/v2"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// The jd oracle computes results with the upstream jd library in-process. It is built
+// with -tags jdoracle against the external/jd submodule; see the spec:build-runner-oracle
+// task.
+func init() {
+	oracles["jd"] = jdOracle
+}
+
+func jdOracle(inv invocation, sqlOut string) (string, bool, error) {
+	switch inv.mode() {
+	case "patch":
+		doc, err := jd.ReadJsonString(string(inv.B))
+		if err != nil {
+			return "", false, err
+		}
+		d, err := readJdDiff(string(inv.A), inv.Format)
+		if err != nil {
+			return "", false, err
+		}
+		patched, err := doc.Patch(d)
+		if err != nil {
+			return "", false, err
+		}
+		out := patched.Json()
+		return out, jsonEquivalent(out, sqlOut), nil
+	case "check":
+		// The oracle agrees when both sides apply the diff, or both fail to
+		doc, err := jd.ReadJsonString(string(inv.B))
+		if err != nil {
+			return "", false, err
+		}
+		d, err := readJdDiff(string(inv.A), inv.Format)
+		if err != nil {
+			return "", false, err
+		}
+		if _, err := doc.Patch(d); err != nil {
+			return "does not apply: " + err.Error(), sqlOut != "", nil
+		}
+		return "", sqlOut == "", nil
+	case "translate":
+		d, err := readJdDiff(unwrapJdText(inv.A, inv.TranslateIn), inv.TranslateIn)
+		if err != nil {
+			return "", false, err
+		}
+		return renderJdDiff(d, inv.TranslateOut, sqlOut, nil)
+	default:
+		a, err := jd.ReadJsonString(string(inv.A))
+		if err != nil {
+			return "", false, err
+		}
+		b, err := jd.ReadJsonString(string(inv.B))
+		if err != nil {
+			return "", false, err
+		}
+		var opts []jd.Option
+		if len(inv.Options) > 0 {
+			if opts, err = jd.ReadOptionsString(string(inv.Options)); err != nil {
+				return "", false, err
+			}
+		}
+		if inv.Format == "merge" {
+			opts = append(opts, jd.MERGE)
+		}
+		return renderJdDiff(a.Diff(b, opts...), inv.Format, sqlOut, opts)
+	}
+}
+
+func readJdDiff(s, format string) (jd.Diff, error) {
+	switch format {
+	case "patch":
+		return jd.ReadPatchString(s)
+	case "merge":
+		return jd.ReadMergeString(s)
+	default:
+		return jd.ReadDiffString(s)
+	}
+}
+
+// renderJdDiff renders d in format and compares it with sqlOut: JSON formats as JSON
+// values, jd diffs after parsing and rendering the SQL output the same way.
+func renderJdDiff(d jd.Diff, format, sqlOut string, opts []jd.Option) (string, bool, error) {
+	var out string
+	var err error
+	switch format {
+	case "patch":
+		out, err = d.RenderPatch()
+	case "merge":
+		out, err = d.RenderMerge()
+	default:
+		out = d.Render(opts...)
+		sqlDiff, perr := jd.ReadDiffString(sqlOut)
+		if perr != nil {
+			return out, false, nil
+		}
+		return out, sqlDiff.Render(opts...) == out, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to render %s diff: %w", format, err)
+	}
+	return out, jsonEquivalent(out, sqlOut), nil
+}
+
+// unwrapJdText returns jd diff content given as a JSON string as plain text, mirroring
+// diffContentArg.
+func unwrapJdText(content []byte, format string) string {
+	var s string
+	if jdsql.IsJdText(format) && json.Unmarshal(content, &s) == nil {
+		return s
+	}
+	return string(content)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// outputFile is the target of -o/--output. Output is written to a temporary file next to
+// path and renamed over it when the run completes, so readers never see a partial
+// result. With --append it is written to path directly instead.
+type outputFile struct {
+	*os.File
+	path string
+	// tmp is the temporary file renamed to path, or empty with --append.
+	tmp string
+}
+
+// openOutput opens the output file of a run.
+func openOutput(path string, appendMode bool) (*outputFile, error) {
+	if appendMode {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open output file: %s: %w", path, err)
+		}
+		return &outputFile{File: f, path: path}, nil
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %s: %w", path, err)
+	}
+	mode := os.FileMode(0o644)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to create output file: %s: %w", path, err)
+	}
+	return &outputFile{File: f, path: path, tmp: f.Name()}, nil
+}
+
+// finish closes the output file. When ok, the output replaces path; otherwise (the run
+// failed with exit 2) it is discarded and path is left as it was.
+func (o *outputFile) finish(ok bool) error {
+	err := o.Sync()
+	if cerr := o.Close(); err == nil {
+		err = cerr
+	}
+	if o.tmp == "" {
+		if err != nil {
+			return fmt.Errorf("failed to write output file: %s: %w", o.path, err)
+		}
+		return nil
+	}
+	if err == nil && ok {
+		err = os.Rename(o.tmp, o.path)
+	}
+	if err != nil || !ok {
+		os.Remove(o.tmp)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write output file: %s: %w", o.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// PathOption applies array and number options to the subtree at a path only, as a jd
+// PathOption ({"@": path, "^": options}), so that one diff can match the elements of one
+// array by key while another stays an ordered list.
+type PathOption struct {
+	// Path is a JSON Pointer (/spec/ports) or a jd path (["spec","ports"]).
+	Path      string   `yaml:"path"`
+	Set       bool     `yaml:"set"`
+	MultiSet  bool     `yaml:"mset"`
+	SetKeys   []string `yaml:"setkeys"`
+	Precision *float64 `yaml:"precision"`
+}
+
+// configPathOptions holds the path_options of the config, added to the jd options of
+// every run by flagOptions.
+var configPathOptions []PathOption
+
+// directive returns the jd PathOption of po.
+func (po PathOption) directive() (json.RawMessage, error) {
+	if po.Path == "" {
+		return nil, errors.New("missing path")
+	}
+	path, err := parseOptionPath(po.Path)
+	if err != nil {
+		return nil, err
+	}
+	if p := po.Precision; p != nil && (math.IsNaN(*p) || math.IsInf(*p, 0) || *p < 0) {
+		return nil, fmt.Errorf("invalid precision %g (expected a finite number >= 0)", *p)
+	}
+	opts := jdsql.Options{Set: po.Set, MultiSet: po.MultiSet, SetKeys: po.SetKeys, Precision: po.Precision}.JSON()
+	if opts == nil {
+		return nil, fmt.Errorf("no options for %s (expected set, mset, setkeys or precision)", po.Path)
+	}
+	return pathDirective(path, opts), nil
+}
+
+// parseOptionPath parses the path of a path option, a JSON Pointer or a jd path, into a
+// jd path as JSON. Unlike --ignore paths, it takes no wildcards.
+func parseOptionPath(v string) ([]byte, error) {
+	path, err := parseAtPath(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path '%s' (expected a JSON Pointer such as /spec/ports or a jd path such as [\"spec\",\"ports\"])", v)
+	}
+	return path, nil
+}
+
+// pathDirective returns the jd PathOption applying the options array opts at path.
+func pathDirective(path, opts []byte) json.RawMessage {
+	enc, _ := json.Marshal(map[string]json.RawMessage{"@": path, "^": opts})
+	return enc
+}
+
+// parsePathOpt parses a --path-opt value, PATH=OPTION, where PATH is a JSON Pointer or a
+// jd path and OPTION is set, mset, setkeys=KEY,..., precision=N or a jd options array.
+func parsePathOpt(v string) (json.RawMessage, error) {
+	invalid := fmt.Errorf("invalid --path-opt value '%s' (expected PATH=OPTION, such as /spec/ports=setkeys=name or /tags=set)", v)
+	var rawPath, option string
+	if strings.HasPrefix(strings.TrimSpace(v), "[") {
+		// A jd path may hold '=' in its keys, so it ends where its JSON does
+		dec := json.NewDecoder(strings.NewReader(v))
+		var p json.RawMessage
+		if dec.Decode(&p) != nil {
+			return nil, invalid
+		}
+		rest, ok := strings.CutPrefix(v[dec.InputOffset():], "=")
+		if !ok {
+			return nil, invalid
+		}
+		rawPath, option = v[:dec.InputOffset()], rest
+	} else {
+		var ok bool
+		if rawPath, option, ok = strings.Cut(v, "="); !ok {
+			return nil, invalid
+		}
+	}
+	path, err := parseOptionPath(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --path-opt value '%s': %w", v, err)
+	}
+	name, arg, _ := strings.Cut(strings.TrimSpace(option), "=")
+	var po PathOption
+	switch strings.ToLower(name) {
+	case "set":
+		po.Set = true
+	case "mset":
+		po.MultiSet = true
+	case "setkeys":
+		for _, k := range strings.Split(arg, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				po.SetKeys = append(po.SetKeys, k)
+			}
+		}
+		if po.SetKeys == nil {
+			return nil, fmt.Errorf("invalid --path-opt value '%s' (setkeys needs keys, such as setkeys=name,namespace)", v)
+		}
+	case "precision":
+		p, err := parsePrecision(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --path-opt value '%s': %w", v, err)
+		}
+		po.Precision = &p
+	default:
+		if raw := bytes.TrimSpace([]byte(option)); len(raw) > 0 && raw[0] == '[' {
+			if !json.Valid(raw) {
+				return nil, fmt.Errorf("invalid --path-opt value '%s' (the options array is not valid JSON)", v)
+			}
+			return pathDirective(path, raw), nil
+		}
+		return nil, invalid
+	}
+	opts := jdsql.Options{Set: po.Set, MultiSet: po.MultiSet, SetKeys: po.SetKeys, Precision: po.Precision}.JSON()
+	return pathDirective(path, opts), nil
+}
+
+// validatePathOpts checks the --path-opt values.
+func validatePathOpts(flags cliFlags) error {
+	for _, v := range flags.values("path-opt") {
+		if _, err := parsePathOpt(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathOptions returns the jd PathOptions of a run: those of the config, then those of
+// the --path-opt flags.
+func pathOptions(flags cliFlags) []json.RawMessage {
+	var out []json.RawMessage
+	for _, po := range configPathOptions {
+		// Validated with the config
+		if d, err := po.directive(); err == nil {
+			out = append(out, d)
+		}
+	}
+	for _, v := range flags.values("path-opt") {
+		// Validated by run
+		if d, err := parsePathOpt(v); err == nil {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// withPathOptions appends directives to the jd options array options (nil for none).
+func withPathOptions(options []byte, directives []json.RawMessage) []byte {
+	if len(directives) == 0 {
+		return options
+	}
+	var opts []json.RawMessage
+	if options != nil && json.Unmarshal(options, &opts) != nil {
+		return options
+	}
+	enc, _ := json.Marshal(append(opts, directives...))
+	return enc
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// The -f values listing the paths a diff touches with jd_diff_paths instead of printing
+// the diff: one path per line, or the JSON array of paths.
+const (
+	formatPaths     = "paths"
+	formatPathsJSON = "paths-json"
+)
+
+// pathsFormats are the -f values of paths output, which the runner handles itself
+// rather than as a jd_diff_format.
+var pathsFormats = []string{formatPaths, formatPathsJSON}
+
+// flagPathsFormat returns the paths output selected by -f, or "".
+func flagPathsFormat(flags cliFlags) string {
+	f := strings.ToLower(strings.TrimSpace(coalesceNonEmpty(flags.value("f"), flags.value("format"))))
+	if contains(pathsFormats, f) {
+		return f
+	}
+	return ""
+}
+
+// validatePaths rejects -f paths outside a plain diff of two input files: the paths
+// are those of the diff of the whole documents.
+func validatePaths(args cliArgs, inv invocation) error {
+	if flags := inv.modeFlags(); len(flags) > 0 || inv.At != nil {
+		if inv.At != nil {
+			flags = append(flags, "--at")
+		}
+		return errors.New("-f " + inv.Paths + " cannot be combined with " + strings.Join(flags, " and "))
+	}
+	if args.Command != "" || args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil ||
+		args.Manifest != "" || args.Spec != "" || isDir(args.FileA) || args.FileB == "" ||
+		args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.value("chunk") != "" {
+		return errors.New("-f " + inv.Paths + " is only supported for a single diff of two input files")
+	}
+	return nil
+}
+
+// renderPaths renders the JSON array of paths out as one compact path per line. An
+// equal pair renders as nothing; out is returned as is if it is not an array of paths.
+func renderPaths(out string) string {
+	var paths []json.RawMessage
+	if err := json.Unmarshal([]byte(out), &paths); err != nil {
+		return out
+	}
+	var b strings.Builder
+	for _, p := range paths {
+		b.WriteString(compactJSON(p))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"sync"
+	"time"
+)
+
+// PoolConfig tunes the connection pool shared by the cases of a batch, spec or directory
+// run. Zero values keep the defaults.
+type PoolConfig struct {
+	// MaxOpen caps open connections (default: --jobs).
+	MaxOpen int `yaml:"max_open"`
+	// MaxIdle is the number of idle connections kept for reuse (default: MaxOpen).
+	MaxIdle int `yaml:"max_idle"`
+	// MaxIdleTime closes connections idle for longer, e.g. "5m" (default: never).
+	MaxIdleTime time.Duration `yaml:"max_idle_time"`
+	// Keepalive is the TCP keepalive period of new connections (default: 30s), so that
+	// idle pooled connections survive NAT and load balancer timeouts during long runs.
+	Keepalive time.Duration `yaml:"keepalive"`
+}
+
+const defaultKeepalive = 30 * time.Second
+
+// configurePool applies cfg.Pool to db, sizing it for jobs concurrent cases.
+func configurePool(db *sql.DB, cfg Config, jobs int) {
+	maxOpen := cfg.Pool.MaxOpen
+	if maxOpen <= 0 {
+		maxOpen = max(jobs, 1)
+	}
+	maxIdle := cfg.Pool.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = maxOpen
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	if cfg.Pool.MaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(cfg.Pool.MaxIdleTime)
+	}
+}
+
+// keepaliveDialer is the lib/pq dialer with a configurable TCP keepalive period. When
+// host is set, connections are dialed to it instead of the host of the DSN (see
+// TLSConfig.ServerName).
+type keepaliveDialer struct {
+	d    net.Dialer
+	host string
+}
+
+func newKeepaliveDialer(period time.Duration, host string) keepaliveDialer {
+	if period <= 0 {
+		period = defaultKeepalive
+	}
+	return keepaliveDialer{d: net.Dialer{KeepAlive: period}, host: host}
+}
+
+func (k keepaliveDialer) address(address string) string {
+	if k.host == "" {
+		return address
+	}
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		return net.JoinHostPort(k.host, port)
+	}
+	return address
+}
+
+func (k keepaliveDialer) Dial(network, address string) (net.Conn, error) {
+	return k.d.Dial(network, k.address(address))
+}
+
+func (k keepaliveDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	d := k.d
+	d.Timeout = timeout
+	return d.Dial(network, k.address(address))
+}
+
+func (k keepaliveDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return k.d.DialContext(ctx, network, k.address(address))
+}
+
+// stmtCache is a querier over a pool that prepares each distinct SQL text once and
+// reuses the statement for every case; database/sql transparently prepares it on each
+// pooled connection the first time that connection runs it.
+type stmtCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{db: db, stmts: map[string]*sql.Stmt{}}
+}
+
+func (c *stmtCache) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// PrepareContext prepares an uncached statement; see prepareStmt for cached use.
+func (c *stmtCache) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return c.db.PrepareContext(ctx, query)
+}
+
+// Conn checks out a session of the pool.
+func (c *stmtCache) Conn(ctx context.Context) (*sql.Conn, error) {
+	return c.db.Conn(ctx)
+}
+
+func (c *stmtCache) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return c.db.BeginTx(ctx, opts)
+}
+
+func (c *stmtCache) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.db.QueryRowContext(ctx, query, args...)
+}
+
+// Close closes the cached statements; the pool itself is closed by its owner.
+func (c *stmtCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for q, stmt := range c.stmts {
+		stmt.Close()
+		delete(c.stmts, q)
+	}
+}
+
+// session returns a querier over one session of the pool of c, which is checked out by
+// the first statement that runs on it.
+func (c *stmtCache) session() *sessionStmts {
+	return &sessionStmts{db: c.db, stmts: map[string]*sql.Stmt{}}
+}
+
+// sessionStmts is a querier over a single session of a pool that prepares each distinct
+// SQL text once on that session. runCases gives one to each of its workers, so that all
+// the statements of a case run on the same session and concurrently running cases never
+// share one, while the statements are still prepared once per worker rather than per
+// case. A session that broke is replaced by a new one at the next statement. It is not
+// safe for concurrent use.
+type sessionStmts struct {
+	db    *sql.DB
+	conn  *sql.Conn
+	stmts map[string]*sql.Stmt
+}
+
+// session returns the session of s, checking one out of the pool if s has none or its
+// connection broke.
+func (s *sessionStmts) session(ctx context.Context) (*sql.Conn, error) {
+	if s.conn != nil {
+		err := s.conn.Raw(func(dc any) error {
+			if v, ok := dc.(driver.Validator); ok && !v.IsValid() {
+				return driver.ErrBadConn
+			}
+			return nil
+		})
+		if err != nil {
+			s.Close()
+		}
+	}
+	if s.conn == nil {
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.conn = conn
+	}
+	return s.conn, nil
+}
+
+func (s *sessionStmts) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	conn, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+// PrepareContext prepares an uncached statement on the session; see prepareStmt for
+// cached use.
+func (s *sessionStmts) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	conn, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.PrepareContext(ctx, query)
+}
+
+func (s *sessionStmts) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	conn, err := s.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.BeginTx(ctx, opts)
+}
+
+func (s *sessionStmts) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	conn, err := s.session(ctx)
+	if err != nil {
+		// A *sql.Row cannot carry the error; the pool reports it again
+		return s.db.QueryRowContext(ctx, query, args...)
+	}
+	return conn.QueryRowContext(ctx, query, args...)
+}
+
+// discard closes the session of s instead of returning it to the pool, so that what was
+// changed in it does not leak into later cases (see runHooked). The next statement
+// checks out a new session.
+func (s *sessionStmts) discard() {
+	if s.conn != nil {
+		// database/sql closes a connection reported bad instead of reusing it
+		s.conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	s.Close()
+}
+
+// Close closes the prepared statements and returns the session to the pool.
+func (s *sessionStmts) Close() {
+	for q, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, q)
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// prepareStmt prepares query on db, through the cache when db is a *stmtCache or a
+// *sessionStmts. The returned release function must be called once the statement is no
+// longer used.
+func prepareStmt(ctx context.Context, db querier, query string) (*sql.Stmt, func(), error) {
+	if c, ok := db.(interface {
+		prepare(context.Context, string) (*sql.Stmt, error)
+	}); ok {
+		stmt, err := c.prepare(ctx, query)
+		return stmt, func() {}, err
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stmt, func() { stmt.Close() }, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import "reflect"
+
+// profileConfig returns cfg with the settings of profile name applied. Like an engines
+// entry, the profile overrides the settings it sets; its engines, retry,
+// timeouts, limits and path options replace those of the top level as a whole.
+func (cfg Config) profileConfig(name string) Config {
+	p := cfg.Profiles[name]
+	out := cfg.engineConfig(NamedEngine{Config: p})
+	out.Profiles = nil
+	out.Engines = cfg.Engines
+	if len(p.Engines) > 0 {
+		out.Engines = p.Engines
+	}
+	if !reflect.DeepEqual(p.Retry, RetryConfig{}) {
+		out.Retry = p.Retry
+	}
+	if p.Timeouts != (TimeoutConfig{}) {
+		out.Timeouts = p.Timeouts
+	}
+	if p.Fetch != (FetchConfig{}) {
+		out.Fetch = p.Fetch
+	}
+	if p.Serve != (ServeConfig{}) {
+		out.Serve = p.Serve
+	}
+	if p.Limits != (LimitsConfig{}) {
+		out.Limits = p.Limits
+	}
+	if p.PathOptions != nil {
+		out.PathOptions = p.PathOptions
+	}
+	return out
+}
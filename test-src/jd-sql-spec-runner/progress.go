@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressBarWidth is the number of cells of the --progress bar.
+	progressBarWidth = 30
+	// progressBarInterval and progressPlainInterval bound how often the bar is redrawn
+	// and how often a plain progress line is written.
+	progressBarInterval   = 100 * time.Millisecond
+	progressPlainInterval = 5 * time.Second
+)
+
+// progressMode returns the --progress style: "bar" (a line redrawn in place), "plain"
+// (a line every few seconds, for CI logs) or "" without --progress. --progress alone
+// draws the bar when stderr is a terminal and writes plain lines otherwise.
+func progressMode(flags cliFlags) (string, error) {
+	switch v := flags.value("progress"); v {
+	case "true":
+		if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			return "bar", nil
+		}
+		return "plain", nil
+	case "false":
+		return "", nil
+	case "", "bar", "plain":
+		return v, nil
+	default:
+		return "", fmt.Errorf("unsupported --progress style '%s' (supported: bar, plain)", v)
+	}
+}
+
+// progressReporter reports the progress of a batch, spec, table or directory run on
+// stderr: completed and total cases, failures so far, the ETA and the current case.
+// A nil *progressReporter reports nothing, so callers need not check for --progress.
+type progressReporter struct {
+	w     io.Writer
+	style string
+	// total is the number of cases, or 0 when it is not known in advance (table mode).
+	total int
+	start time.Time
+
+	mu      sync.Mutex
+	done    int
+	failed  int
+	current string
+	last    time.Time
+}
+
+// newProgress returns the reporter of a run of total cases, or nil without --progress.
+// The style was validated by run.
+func newProgress(flags cliFlags, total int) *progressReporter {
+	style, _ := progressMode(flags)
+	if style == "" {
+		return nil
+	}
+	return &progressReporter{w: os.Stderr, style: style, total: total, start: time.Now()}
+}
+
+// running sets the name of the case in progress.
+func (p *progressReporter) running(name string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = name
+	p.report(false)
+}
+
+// finished counts a completed case, failed or not.
+func (p *progressReporter) finished(failed bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if failed {
+		p.failed++
+	}
+	p.report(false)
+}
+
+// close writes the final state and ends the bar's line.
+func (p *progressReporter) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = ""
+	p.report(true)
+	if p.style == "bar" {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// report writes the progress unless it was written less than an interval ago; final
+// reports are always written. p.mu is held.
+func (p *progressReporter) report(final bool) {
+	interval := progressPlainInterval
+	if p.style == "bar" {
+		interval = progressBarInterval
+	}
+	now := time.Now()
+	if !final && now.Sub(p.last) < interval {
+		return
+	}
+	p.last = now
+
+	var b strings.Builder
+	if p.total > 0 {
+		fmt.Fprintf(&b, "%d/%d (%d%%)", p.done, p.total, p.done*100/p.total)
+	} else {
+		fmt.Fprintf(&b, "%d", p.done)
+	}
+	fmt.Fprintf(&b, ", %d failed", p.failed)
+	if p.total > 0 && p.done > 0 && p.done < p.total {
+		elapsed := now.Sub(p.start)
+		eta := time.Duration(float64(elapsed) / float64(p.done) * float64(p.total-p.done))
+		fmt.Fprintf(&b, ", eta %s", eta.Round(time.Second))
+	} else if final {
+		fmt.Fprintf(&b, " in %s", now.Sub(p.start).Round(time.Millisecond))
+	}
+	if p.current != "" {
+		fmt.Fprintf(&b, ", %s", p.current)
+	}
+
+	if p.style == "plain" {
+		fmt.Fprintf(p.w, "progress: %s\n", b.String())
+		return
+	}
+	bar := strings.Repeat(" ", progressBarWidth)
+	if p.total > 0 {
+		n := p.done * progressBarWidth / p.total
+		bar = strings.Repeat("=", n) + strings.Repeat(" ", progressBarWidth-n)
+	}
+	// \033[K clears what a longer previous line left behind
+	fmt.Fprintf(p.w, "\r[%s] %s\033[K", bar, b.String())
+}
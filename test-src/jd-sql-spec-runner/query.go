@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// defaultDiffTemplate is the diff statement of query mode when the config has no sql.
+const defaultDiffTemplate = "SELECT jd_diff($1::jsonb, $2::jsonb, $3::jsonb, $4::jd_diff_format)"
+
+// diffTemplate is the config's sql, which replaces the built-in statement of plain diffs
+// (see invocation.usesTemplate) and of query mode. withEngine sets it with sqlNaming.
+var diffTemplate string
+
+// sqlTemplateData are the values of the text/template fields of the config's sql: the
+// placeholders of the documents, options and format, which stay bind parameters.
+var sqlTemplateData = struct{ A, B, Options, Format string }{"$1", "$2", "$3", "$4"}
+
+// templateFlags are the flags bound by the options ($3) and format ($4) of the config's
+// sql, with the placeholder each needs.
+var templateFlags = []struct {
+	name, flag string
+	param      int
+}{
+	{"f", "-f", 4}, {"format", "--format", 4},
+	{"set", "-set", 3}, {"mset", "-mset", 3}, {"setkeys", "-setkeys", 3}, {"precision", "-precision", 3},
+	{"opts", "--opts", 3}, {"path-opt", "--path-opt", 3}, {"ignore", "--ignore", 3},
+}
+
+// validateTemplateFlags rejects the option and format flags of a run whose diffs use the
+// config's sql when the statement does not bind them, rather than ignoring them.
+func validateTemplateFlags(args cliArgs, inv invocation) error {
+	if diffTemplate == "" || args.Table != nil || args.Update != nil || !args.queryMode() && !inv.usesTemplate() {
+		return nil
+	}
+	used := boundParams(diffTemplate)
+	for _, f := range templateFlags {
+		if !args.Flags.given(f.name) || used[f.param] {
+			continue
+		}
+		if f.param == 4 {
+			return fmt.Errorf("%s is not supported by the config's sql, which does not bind the format ({{.Format}} or $4)", f.flag)
+		}
+		return fmt.Errorf("%s is not supported by the config's sql, which does not bind the options ({{.Options}} or $3)", f.flag)
+	}
+	return nil
+}
+
+// boundParams returns the numbers of the bind parameters stmt uses.
+func boundParams(stmt string) map[int]bool {
+	used := map[int]bool{}
+	for _, m := range sqlPlaceholder.FindAllStringSubmatch(stmt, -1) {
+		n, _ := strconv.Atoi(m[1])
+		used[n] = true
+	}
+	return used
+}
+
+// expandSQLTemplate renders the config's sql as a Go text/template,
+// replacing {{.A}}, {{.B}}, {{.Options}} and {{.Format}} with $1 to $4. A statement
+// without template actions is returned as written.
+func expandSQLTemplate(sqlText string) (string, error) {
+	if !strings.Contains(sqlText, "{{") {
+		return sqlText, nil
+	}
+	t, err := template.New("sql").Option("missingkey=error").Parse(sqlText)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, sqlTemplateData); err != nil {
+		return "", fmt.Errorf("%w (the fields are .A, .B, .Options and .Format)", err)
+	}
+	return b.String(), nil
+}
+
+// getQueryDiff reads the query mode flags into the query mode fields of a cliArgs; ok
+// is false when no query is given. Either side may be a file instead (--a-file or
+// --b-file), bound as a parameter, which diffs a document against a live row.
+func getQueryDiff(flags cliFlags) (q cliArgs, ok bool, err error) {
+	q.QueryA = coalesceNonEmpty(flags.value("query-a"), flags.value("a-query"))
+	q.QueryB = coalesceNonEmpty(flags.value("query-b"), flags.value("b-query"))
+	q.FileA, q.FileB = flags.value("a-file"), flags.value("b-file")
+	if q.QueryA == "" && q.QueryB == "" {
+		if q.FileA != "" || q.FileB != "" {
+			return q, true, errors.New("--a-file and --b-file require a query for the other side (--query-a or --query-b)")
+		}
+		return q, false, nil
+	}
+	for _, side := range []struct{ name, query, file string }{{"a", q.QueryA, q.FileA}, {"b", q.QueryB, q.FileB}} {
+		switch {
+		case side.query == "" && side.file == "":
+			return q, true, fmt.Errorf("query mode requires --query-%s or --%s-file", side.name, side.name)
+		case side.query != "" && side.file != "":
+			return q, true, fmt.Errorf("--query-%s cannot be combined with --%s-file", side.name, side.name)
+		}
+	}
+	if err := ensureFilesExist(q.FileA, q.FileB); err != nil {
+		return q, true, err
+	}
+	return q, true, nil
+}
+
+// queryModeSQL returns the diff statement of an invocation in query mode: the config's
+// sql template (or defaultDiffTemplate) with $1 and $2 replaced by the two queries as
+// scalar subqueries, so both documents are computed and diffed inside the database. A
+// side without a query is the document in A or B, bound as a parameter like the
+// options ($3) and format ($4); parameters are renumbered in order of use.
+func queryModeSQL(inv invocation) (string, []any) {
+	stmt := strings.TrimRight(coalesceNonEmpty(inv.Template, renderSQL(defaultDiffTemplate)), " \t\r\n;")
+	used := boundParams(stmt)
+	// A trailing semicolon would end the statement inside the subquery
+	subquery := func(q string) string { return "(" + strings.TrimRight(q, " \t\r\n;") + ")" }
+	var params []any
+	side := func(n int, q string, doc []byte) string {
+		switch {
+		case q != "":
+			return subquery(q)
+		case used[n]:
+			params = append(params, jdsql.NullableText(doc))
+			return fmt.Sprintf("$%d", len(params))
+		}
+		return ""
+	}
+	values := []string{side(1, inv.QueryA, inv.A), side(2, inv.QueryB, inv.B), "", ""}
+	if used[3] {
+		params = append(params, jdsql.NullableText(inv.Options))
+		values[2] = fmt.Sprintf("$%d", len(params))
+	}
+	if used[4] {
+		params = append(params, inv.Format)
+		values[3] = fmt.Sprintf("$%d", len(params))
+	}
+	return inlineParams(stmt, values), params
+}
+
+// flagQueryInvocation builds the invocation of a query mode run from the flags and
+// the config's sql template, reading the file of a side without a query.
+func flagQueryInvocation(cfg Config, args cliArgs) (invocation, error) {
+	var docs [2][]byte
+	for i, f := range []string{args.FileA, args.FileB} {
+		if f == "" {
+			continue
+		}
+		b, err := readInput(f)
+		if err != nil {
+			return invocation{}, fmt.Errorf("failed to read input file: %s: %w", f, err)
+		}
+		docs[i] = b
+	}
+	inv := flagInvocation(args.Flags, docs[0], docs[1])
+	if inv.mode() != "diff" {
+		return inv, fmt.Errorf("%s mode is not supported in query mode", inv.mode())
+	}
+	inv.QueryA, inv.QueryB, inv.Template = args.QueryA, args.QueryB, cfg.SQL
+	return inv, nil
+}
+
+// runQueryDiff diffs the JSON results of the two queries of query mode and prints the
+// diff like a diff of two files.
+func runQueryDiff(cfg Config, args cliArgs) (int, error) {
+	inv, err := flagQueryInvocation(cfg, args)
+	if err != nil {
+		return 2, err
+	}
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	out, code, err := execInvocation(db, inv)
+	if err != nil {
+		return code, err
+	}
+	if err := writeOutput(inv, out); err != nil {
+		return 2, err
+	}
+	return code, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// diffRecorder inserts the diffs computed by the run into the --record-to table. It is
+// nil without --record-to.
+var diffRecorder *recorder
+
+// recorder is the --record-to table of a run. Its rows share the id of the run, so the
+// diffs of one batch can be selected together.
+type recorder struct {
+	db    *sql.DB
+	table string
+	runID string
+	// insert is the statement adding a row, for the quoted table.
+	insert string
+}
+
+// recordTableSQL creates the --record-to table. %s is the quoted table name.
+const recordTableSQL = `create table if not exists %s
+(
+    id             bigint generated always as identity primary key,
+    run_id         text        not null,
+    recorded_at    timestamptz not null default now(),
+    runner_version text        not null,
+    a_sha256       text,
+    b_sha256       text,
+    options        jsonb,
+    format         text        not null,
+    diff           text        not null,
+    differs        boolean     not null
+)`
+
+// validateRecordTo rejects --record-to in the modes whose diffs are not computed one
+// pair at a time by the runner, and with several engines.
+func validateRecordTo(args cliArgs, inv invocation, impls []string) error {
+	if args.Flags.value("record-to") == "" {
+		return nil
+	}
+	if args.Command != "" && args.Command != "diff" || inv.mode() != "diff" {
+		return errors.New("--record-to records diffs: it is not supported with other commands and modes")
+	}
+	if args.Table != nil || args.Update != nil || args.Flags.enabled("stream") || args.Flags.value("chunk") != "" {
+		return errors.New("--record-to is not supported in table, update, streaming and chunked modes")
+	}
+	if args.Flags.value("engines") != "" || len(impls) > 1 {
+		return errors.New("--record-to cannot be combined with --engines or several --impl")
+	}
+	return nil
+}
+
+// openRecorder connects to the database of cfg and creates the table, a name optionally
+// schema qualified, unless it exists.
+func openRecorder(cfg Config, table string) (*recorder, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return nil, err
+	}
+	quoted := quoteQualifiedIdent(table)
+	if _, err := db.ExecContext(baseContext, fmt.Sprintf(recordTableSQL, quoted)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create --record-to table %s: %w", table, err)
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &recorder{
+		db:    db,
+		table: table,
+		runID: time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(id),
+		insert: "insert into " + quoted + " (run_id, runner_version, a_sha256, b_sha256, options, format, diff, differs) " +
+			"values ($1, $2, $3, $4, $5::jsonb, $6, $7, $8)",
+	}, nil
+}
+
+// record inserts out, the diff computed by inv with exit code code. Other modes are not
+// recorded; the paths of -f paths are, with the format paths.
+func (r *recorder) record(inv invocation, out string, code int) error {
+	if r == nil || inv.mode() != "diff" {
+		return nil
+	}
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	_, err := r.db.ExecContext(ctx, r.insert, r.runID, runnerVersion(), inputHash(inv.A), inputHash(inv.B),
+		jdsql.NullableText(inv.Options), coalesceNonEmpty(inv.Paths, inv.Format), out, code == 1)
+	if err != nil {
+		return fmt.Errorf("failed to record the diff in %s: %w", r.table, err)
+	}
+	return nil
+}
+
+func (r *recorder) close() {
+	if r != nil {
+		r.db.Close()
+	}
+}
+
+// inputHash returns the hex SHA-256 of an input document, or nil (NULL) when there is
+// none, as in query mode.
+func inputHash(doc []byte) any {
+	if doc == nil {
+		return nil
+	}
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:])
+}
+
+// runnerVersion identifies the build of the runner: its module version, or the VCS
+// revision it was built from, or "devel".
+func runnerVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	revision, dirty := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if dirty {
+		revision += "-dirty"
+	}
+	return revision
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// redactMask replaces the values matched by --redact.
+const redactMask = "***"
+
+// flagRedacts returns the --redact paths given.
+func flagRedacts(flags cliFlags) []pathPattern {
+	var pps []pathPattern
+	for _, v := range flags.values("redact") {
+		// Validated by run
+		if pp, err := parsePathPattern("redact", v); err == nil {
+			pps = append(pps, pp)
+		}
+	}
+	return pps
+}
+
+// validateRedacts checks the --redact values.
+func validateRedacts(flags cliFlags) error {
+	for _, v := range flags.values("redact") {
+		if _, err := parsePathPattern("redact", v); err != nil {
+			return err
+		}
+	}
+	if len(flags.values("redact")) > 0 && flags.value("oracle") != "" {
+		return errors.New("--redact cannot be combined with --oracle")
+	}
+	return nil
+}
+
+// covers reports whether the jd path p is at or below a path matched by pp.
+func (pp pathPattern) covers(p []any) bool {
+	n := len(pp.Path)
+	if pp.Glob != "" {
+		n++
+	}
+	if len(p) < n {
+		return false
+	}
+	for i, seg := range pp.Path {
+		if segmentKey(seg) != segmentKey(p[i]) {
+			return false
+		}
+	}
+	if pp.Glob == "" {
+		return true
+	}
+	text, _ := strings.CutPrefix(segmentKey(p[len(pp.Path)]), "#")
+	ok, _ := path.Match(pp.Glob, text)
+	return ok
+}
+
+// segmentKey identifies a jd path segment: object keys are prefixed with "." and array
+// indexes with "#", so the key "0" and the index 0 differ.
+func segmentKey(seg any) string {
+	switch t := seg.(type) {
+	case string:
+		return "." + t
+	case int:
+		return "#" + strconv.Itoa(t)
+	case json.Number:
+		return "#" + t.String()
+	case float64:
+		return "#" + strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		enc, _ := json.Marshal(t)
+		return string(enc)
+	}
+}
+
+// redactValue masks the parts of v, the value at the jd path at, that pps cover. It
+// reports whether anything was masked; objects and arrays are changed in place.
+func redactValue(v any, at []any, pps []pathPattern) (any, bool) {
+	for _, pp := range pps {
+		if pp.covers(at) {
+			return redactMask, true
+		}
+	}
+	changed := false
+	switch t := v.(type) {
+	case map[string]any:
+		for k, c := range t {
+			if nc, ch := redactValue(c, append(at[:len(at):len(at)], k), pps); ch {
+				t[k], changed = nc, true
+			}
+		}
+	case []any:
+		for i, c := range t {
+			if nc, ch := redactValue(c, append(at[:len(at):len(at)], i), pps); ch {
+				t[i], changed = nc, true
+			}
+		}
+	}
+	return v, changed
+}
+
+// redactJSON masks the parts of the JSON text s, the value at the jd path at, that pps
+// cover. Text that is not JSON, or has nothing to mask, is returned unchanged.
+func redactJSON(s string, at []any, pps []pathPattern) string {
+	v, err := jdsql.DecodeJSON([]byte(s))
+	if err != nil {
+		return s
+	}
+	v, changed := redactValue(v, at, pps)
+	if !changed {
+		return s
+	}
+	return compactJSON(v)
+}
+
+// compactJSON encodes v without escaping HTML characters, as the database renders JSON.
+func compactJSON(v any) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// redactDiff masks the values covered by pps in a diff in format, as printed by the
+// runner (jd diffs as text). The paths of the diff are kept.
+func redactDiff(diff, format string, pps []pathPattern) string {
+	switch format {
+	case "patch":
+		v, err := jdsql.DecodeJSON([]byte(diff))
+		ops, ok := v.([]any)
+		if err != nil || !ok {
+			return diff
+		}
+		changed := false
+		for _, op := range ops {
+			o, ok := op.(map[string]any)
+			if !ok {
+				continue
+			}
+			ptr, _ := o["path"].(string)
+			if value, ok := o["value"]; ok {
+				if nv, ch := redactValue(value, pointerPath(pointerSegments(ptr)), pps); ch {
+					o["value"], changed = nv, true
+				}
+			}
+		}
+		if !changed {
+			return diff
+		}
+		return compactJSON(ops)
+	case "merge":
+		return redactJSON(diff, []any{}, pps)
+	default:
+		// jd text: the values of a hunk are at the path of its @ header
+		lines := strings.SplitAfter(diff, "\n")
+		var at []any
+		for i, line := range lines {
+			body := strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(body, "@ "):
+				at = nil
+				if v, err := jdsql.DecodeJSON([]byte(body[2:])); err == nil {
+					at, _ = v.([]any)
+				}
+			case at != nil && (strings.HasPrefix(body, "- ") || strings.HasPrefix(body, "+ ") || strings.HasPrefix(body, "  ")):
+				if red := redactJSON(body[2:], at, pps); red != body[2:] {
+					lines[i] = body[:2] + red + line[len(body):]
+				}
+			}
+		}
+		return strings.Join(lines, "")
+	}
+}
+
+// redactOutput masks the values covered by inv.Redact in the output of inv: diffs and
+// translations, and patched documents.
+func redactOutput(inv invocation, out string) string {
+	if len(inv.Redact) == 0 {
+		return out
+	}
+	switch inv.mode() {
+	case "diff", "translate":
+		return redactDiff(out, inv.outputFormat(), inv.Redact)
+	case "patch":
+		return redactJSON(out, []any{}, inv.Redact)
+	default:
+		return out
+	}
+}
+
+// redactDocument masks the values covered by pps in the JSON document doc.
+func redactDocument(doc []byte, pps []pathPattern) []byte {
+	if len(pps) == 0 {
+		return doc
+	}
+	return []byte(redactJSON(string(doc), []any{}, pps))
+}
+
+// redactInputDiff masks the values covered by pps in diff, an input diff in format.
+func redactInputDiff(diff []byte, format string, pps []pathPattern) []byte {
+	if len(pps) == 0 {
+		return diff
+	}
+	return []byte(redactDiff(string(diff), format, pps))
+}
+
+// redactTableDiff masks the values covered by inv.Redact in a table mode diff, which is
+// a JSON string for jd diffs.
+func redactTableDiff(diff []byte, inv invocation) []byte {
+	out, _ := jdsql.DecodeResult(string(diff))
+	red := redactDiff(out, inv.Format, inv.Redact)
+	if red == out {
+		return diff
+	}
+	if jdsql.IsJdText(inv.Format) {
+		return []byte(compactJSON(red))
+	}
+	return []byte(red)
+}
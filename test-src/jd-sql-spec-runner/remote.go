@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FetchConfig configures the download of inputs given as URLs (http, https, s3 and gs).
+type FetchConfig struct {
+	// Timeout bounds each download (default 60s).
+	Timeout time.Duration `yaml:"timeout"`
+	// TokenEnv names an environment variable holding a bearer token sent with http and
+	// https downloads.
+	TokenEnv string `yaml:"token_env"`
+	// GCSTokenEnv names the environment variable holding the OAuth access token of gs
+	// downloads (default GOOGLE_OAUTH_ACCESS_TOKEN, as printed by gcloud auth
+	// print-access-token). Without a token only public objects can be read.
+	GCSTokenEnv string `yaml:"gcs_token_env"`
+}
+
+// fetchSettings is set from the config by run before any input is read.
+var fetchSettings FetchConfig
+
+const defaultFetchTimeout = 60 * time.Second
+
+// remoteSchemes are the URL schemes of inputs that are downloaded rather than read from
+// disk.
+var remoteSchemes = []string{"http://", "https://", "s3://", "gs://"}
+
+// isRemoteInput reports whether name is a URL of a remote input.
+func isRemoteInput(name string) bool {
+	for _, s := range remoteSchemes {
+		if strings.HasPrefix(strings.ToLower(name), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// readInput returns the contents of the input file or URL name, decompressed and read
+// as text (see textReader).
+func readInput(name string) ([]byte, error) {
+	rc, err := openTextInput(name)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(rc)
+	if cerr := rc.Close(); err == nil {
+		err = cerr
+	}
+	return b, err
+}
+
+// openInput opens the input file or URL name, or stdin for "-", for reading. gzip and
+// zstd data is decompressed as it is read, and bounded by inputLimits.
+func openInput(name string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	var err error
+	if isRemoteInput(name) {
+		rc, err = fetchSettings.open(name)
+	} else if name == "-" {
+		rc = io.NopCloser(os.Stdin)
+	} else {
+		rc, err = os.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rc, err = decompress(rc); err != nil {
+		return nil, err
+	}
+	return inputLimits.reader(rc), nil
+}
+
+// openInputFile opens the text input file or URL name as a file, for random access. A
+// URL, a compressed file or a file that is not plain UTF-8 (see textReader) is
+// downloaded, decompressed or transcoded to a temporary file, which is removed when the
+// file is closed. Like openInput, it is bounded by inputLimits.
+func openInputFile(name string) (*inputFile, error) {
+	if !isRemoteInput(name) {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		head := make([]byte, len(zstdMagic))
+		n, _ := io.ReadFull(f, head)
+		if bom, order := textEncoding(head[:n]); compressionOf(head[:n]) == "" && bom == 0 && order == nil {
+			if fi, err := f.Stat(); err == nil && inputLimits.MaxInputBytes > 0 && fi.Size() > inputLimits.MaxInputBytes {
+				f.Close()
+				return nil, fmt.Errorf("%w: larger than limits.max_input_bytes (%d bytes)", errInputLimit, inputLimits.MaxInputBytes)
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return &inputFile{File: f}, nil
+		}
+		f.Close()
+	}
+	rc, err := openTextInput(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	f, err := os.CreateTemp("", "jd-sql-input-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp := &inputFile{File: f, temp: true}
+	if _, err := io.Copy(f, rc); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// inputFile is an opened input, temp when it holds a download.
+type inputFile struct {
+	*os.File
+	temp bool
+}
+
+func (f *inputFile) Close() error {
+	err := f.File.Close()
+	if f.temp {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// open starts the download of the object at the URL name; the timeout covers reading
+// the body. s3 URLs are signed with AWS Signature Version 4 when AWS credentials are
+// found; gs URLs are read through the Cloud Storage download endpoint.
+func (f FetchConfig) open(name string) (io.ReadCloser, error) {
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(baseContext, timeout)
+	req, err := f.request(ctx, name)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("GET %s: %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return cancelOnClose{resp.Body, cancel}, nil
+}
+
+// cancelOnClose releases the context of a download when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// request builds the GET request of the URL name.
+func (f FetchConfig) request(ctx context.Context, name string) (*http.Request, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "s3":
+		return s3Request(ctx, u.Host, strings.TrimPrefix(u.Path, "/"))
+	case "gs":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			"https://storage.googleapis.com/"+u.Host+"/"+escapePath(strings.TrimPrefix(u.Path, "/")), nil)
+		if err != nil {
+			return nil, err
+		}
+		if tok := os.Getenv(coalesceNonEmpty(f.GCSTokenEnv, "GOOGLE_OAUTH_ACCESS_TOKEN")); tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		return req, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.TokenEnv != "" {
+		if tok := os.Getenv(f.TokenEnv); tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+	}
+	return req, nil
+}
+
+// escapePath percent-encodes each segment of an object key, keeping the slashes.
+func escapePath(key string) string {
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = strings.ReplaceAll(url.PathEscape(s), "+", "%2B")
+	}
+	return strings.Join(segs, "/")
+}
+
+// awsCredentials are the credentials of s3 downloads.
+type awsCredentials struct {
+	AccessKeyID, SecretAccessKey, SessionToken string
+}
+
+// s3Request builds the GET request of an S3 object. The endpoint is the regional
+// virtual-hosted one, or AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL) with path-style
+// addressing, for S3 compatible stores. The region comes from AWS_REGION or
+// AWS_DEFAULT_REGION (default us-east-1).
+func s3Request(ctx context.Context, bucket, key string) (*http.Request, error) {
+	region := coalesceNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"))
+	if region == "" {
+		region = "us-east-1"
+	}
+	target := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, escapePath(key))
+	if ep := coalesceNonEmpty(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); ep != "" {
+		target = strings.TrimSuffix(ep, "/") + "/" + bucket + "/" + escapePath(key)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID != "" {
+		signV4(req, creds, region, "s3", nil, time.Now())
+	}
+	return req, nil
+}
+
+// loadAWSCredentials finds AWS credentials as the AWS SDKs do for static keys: in
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, then in the profile
+// AWS_PROFILE (default "default") of the shared credentials file. No credentials is
+// not an error: the request is then sent unsigned, which reads public objects.
+func loadAWSCredentials() (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{id, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return awsCredentials{}, nil
+	} else if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read AWS credentials: %w", err)
+	}
+	defer f.Close()
+
+	profile := coalesceNonEmpty(os.Getenv("AWS_PROFILE"), "default")
+	var creds awsCredentials
+	section := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+		case section == profile:
+			k, v, _ := strings.Cut(line, "=")
+			switch strings.TrimSpace(k) {
+			case "aws_access_key_id":
+				creds.AccessKeyID = strings.TrimSpace(v)
+			case "aws_secret_access_key":
+				creds.SecretAccessKey = strings.TrimSpace(v)
+			case "aws_session_token":
+				creds.SessionToken = strings.TrimSpace(v)
+			}
+		}
+	}
+	return creds, sc.Err()
+}
+
+// emptyPayloadHash is the SHA-256 of an empty body, which GET requests have.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 signs req, whose body is payload, with AWS Signature Version 4. The host and
+// all headers already set on req are signed.
+func signV4(req *http.Request, creds awsCredentials, region, service string, payload []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := emptyPayloadHash
+	if len(payload) > 0 {
+		payloadHash = sha256Hex(string(payload))
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonical.String(), signed,
+		payloadHash}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(request)}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
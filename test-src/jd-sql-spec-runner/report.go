@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// suiteRun is the outcome of a batch or spec run handed to report writers. A single
+// diff/patch/translate run is reported as a suite with one case.
+type suiteRun struct {
+	Kind    string
+	Engine  string
+	Start   time.Time
+	Elapsed time.Duration
+	Results []caseResult
+}
+
+type reportWriter func(w io.Writer, run suiteRun) error
+
+// reportFormats maps --report values to their writers.
+var reportFormats = map[string]reportWriter{
+	"csv":   writeCSVReport,
+	"html":  writeHTMLReport,
+	"json":  writeJSONReport,
+	"junit": writeJUnitReport,
+	"tap":   writeTAPReport,
+	"tsv":   writeTSVReport,
+}
+
+func reportFormatNames() []string {
+	names := make([]string, 0, len(reportFormats))
+	for n := range reportFormats {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeReport(opts suiteOptions, run suiteRun) error {
+	write := reportFormats[opts.Report]
+	if opts.ReportFile == "" {
+		return write(os.Stdout, run)
+	}
+	f, err := os.Create(opts.ReportFile)
+	if err != nil {
+		return fmt.Errorf("failed to create report file: %s: %w", opts.ReportFile, err)
+	}
+	if err := write(f, run); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write report file: %s: %w", opts.ReportFile, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write report file: %s: %w", opts.ReportFile, err)
+	}
+	return nil
+}
+
+// JUnit XML, in the subset understood by Jenkins and the GitHub Actions test reporters.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnitReport writes one testsuite per case class (spec category or manifest file).
+// Cases that failed because the runner reported an unexpected error are written as
+// <error>, assertion mismatches and unexpected passes of xfail cases as <failure>.
+func writeJUnitReport(w io.Writer, run suiteRun) error {
+	root := junitTestSuites{Name: "jd-sql-spec-runner " + run.Kind, Time: junitSeconds(run.Elapsed)}
+	index := map[string]int{}
+	var durations []time.Duration
+	for _, r := range run.Results {
+		class := r.Case.Class
+		if class == "" {
+			class = run.Kind
+		}
+		i, ok := index[class]
+		if !ok {
+			i = len(root.Suites)
+			index[class] = i
+			root.Suites = append(root.Suites, junitTestSuite{Name: class, Timestamp: run.Start.Format(time.RFC3339)})
+			durations = append(durations, 0)
+		}
+		suite := &root.Suites[i]
+		durations[i] += r.Duration
+
+		tc := junitTestCase{
+			Name:      r.Case.Name,
+			ClassName: class,
+			Time:      junitSeconds(r.Duration),
+			File:      r.Case.Source,
+		}
+		switch r.Status {
+		case statusFail:
+			first, _, _ := strings.Cut(r.Message, "\n")
+			msg := &junitMessage{Message: first, Body: r.Message}
+			if r.Err != nil && (r.Case.ExpectedExit == nil || *r.Case.ExpectedExit != 2) {
+				tc.Error = msg
+				suite.Errors++
+			} else {
+				tc.Failure = msg
+				suite.Failures++
+			}
+			tc.SystemOut = r.Output
+		case statusXPass:
+			tc.Failure = &junitMessage{Message: r.Message, Body: r.Message}
+			suite.Failures++
+		case statusXFail:
+			// An expected failure passes; keep the details for reviewers
+			tc.SystemOut = r.Message
+		case statusSkip:
+			tc.Skipped = &junitMessage{Message: r.Message}
+			suite.Skipped++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+	for i := range root.Suites {
+		s := &root.Suites[i]
+		s.Time = junitSeconds(durations[i])
+		root.Tests += s.Tests
+		root.Failures += s.Failures
+		root.Errors += s.Errors
+		root.Skipped += s.Skipped
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetryConfig is the retry policy for transient database errors, such as a failover
+// terminating connections or a serialization failure. Zero values keep the defaults.
+type RetryConfig struct {
+	// MaxAttempts is the number of executions per invocation (default 1, no retries).
+	MaxAttempts int `yaml:"max_attempts"`
+	// Backoff is the delay before the first retry, doubled for every further retry up to
+	// MaxBackoff (defaults 100ms and 5s). Each delay is jittered between half and all of it.
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	// SQLStates lists retryable SQLSTATE codes; two character entries match a whole
+	// class (default: 08, 40001, 40P01, 57P01, 57P02, 57P03).
+	SQLStates []string `yaml:"sqlstates"`
+}
+
+var defaultRetrySQLStates = []string{"08", "40001", "40P01", "57P01", "57P02", "57P03"}
+
+// retryPolicy is set from the config by run before any query executes.
+var retryPolicy RetryConfig
+
+func (r RetryConfig) attempts() int {
+	return max(r.MaxAttempts, 1)
+}
+
+// delay returns the wait before retry number n (1 for the first retry).
+func (r RetryConfig) delay(n int) time.Duration {
+	d := r.Backoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	limit := r.MaxBackoff
+	if limit <= 0 {
+		limit = 5 * time.Second
+	}
+	for i := 1; i < n && d < limit; i++ {
+		d *= 2
+	}
+	d = min(d, limit)
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryable reports whether err is a transient error worth another attempt: a
+// configured SQLSTATE, or a connection that was reset or dropped.
+func (r RetryConfig) retryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		// Timeouts satisfy net.Error but retrying them would only multiply the wait
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		states := r.SQLStates
+		if len(states) == 0 {
+			states = defaultRetrySQLStates
+		}
+		code := string(pqErr.Code)
+		for _, s := range states {
+			if code == s || (len(s) == 2 && strings.HasPrefix(code, s)) {
+				return true
+			}
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &netErr)
+}
+
+func validateRetryConfig(r RetryConfig) error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("retry.max_attempts must not be negative")
+	}
+	for _, s := range r.SQLStates {
+		if len(s) != 2 && len(s) != 5 {
+			return fmt.Errorf("retry.sqlstates: '%s' is neither a SQLSTATE class (2 characters) nor a code (5 characters)", s)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// diffSchema is the JSON Schema given by --schema, whose defaults are materialized in
+// both documents before they are diffed. It is nil without --schema.
+var diffSchema []byte
+
+// readSchema reads and checks the --schema file.
+func readSchema(path string) ([]byte, error) {
+	b, err := readInput(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --schema file: %s: %w", path, err)
+	}
+	b = bytes.TrimSpace(b)
+	v, err := jdsql.DecodeJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --schema file: %s: %w", path, err)
+	}
+	if _, ok := v.(map[string]any); !ok {
+		return nil, fmt.Errorf("invalid --schema file: %s: a JSON Schema is an object", path)
+	}
+	return b, nil
+}
+
+// validateSchema rejects --schema and --coerce outside the modes that diff or compare
+// two documents.
+func validateSchema(args cliArgs, inv invocation) error {
+	if args.Flags.value("schema") == "" {
+		if args.Flags.enabled("coerce") {
+			return errors.New("--coerce requires --schema")
+		}
+		return nil
+	}
+	if m := inv.mode(); m != "diff" && m != "stat" && m != "equal" {
+		return fmt.Errorf("--schema is not supported in %s mode", m)
+	}
+	if oracle != nil {
+		return errors.New("--oracle cannot be combined with --schema")
+	}
+	if args.Table != nil || args.queryMode() || args.Update != nil || args.Manifest != "" || args.Spec != "" ||
+		args.Flags.enabled("stream") || args.Flags.value("chunk") != "" {
+		return errors.New("--schema is not supported in table, query, update, batch, spec, streaming and chunked modes")
+	}
+	return nil
+}
+
+// schemaDocParams matches the casts of the documents of the statements --schema applies
+// to, which bind them to $1 and $2.
+var schemaDocParams = regexp.MustCompile(`\$([12])::jsonb\b`)
+
+// withSchema returns the statement q, with its arguments, with the documents passed
+// through jd_schema_defaults, which materializes the defaults of schema in them.
+func withSchema(q string, args []any, schema []byte, coerce bool) (string, []any) {
+	call := fmt.Sprintf("jd_schema_defaults($$${1}::jsonb, $$%d::jsonb, $$%d)", len(args)+1, len(args)+2)
+	return schemaDocParams.ReplaceAllString(q, call), append(args, string(schema), coerce)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	_ "embed"
+)
+
+// selftestCases is the corpus of selftest: spec cases of the canonical behaviors of
+// jd-sql (empty diffs, type changes, list context, set semantics, patching, merge
+// patches and translation), whose outputs do not depend on the server.
+//
+//go:embed selftest.json
+var selftestCases []byte
+
+// runSelftest runs the embedded corpus against the configured database as a spec run,
+// printing a line per case and a "selftest: ..." summary. It exits 1 if any case fails,
+// so it can gate an install or upgrade of the SQL functions.
+func runSelftest(flags cliFlags, cfg Config) (int, error) {
+	cases, err := parseSpecCases(selftestCases, "selftest.json")
+	if err != nil {
+		return 2, err
+	}
+	return runSuite(flags, cfg, "selftest", cases, suiteOptions{Jobs: 1})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// diffRequest is the body of POST /v1/diff: the two documents, the diff format
+// (default jd) and an optional jd options array.
+type diffRequest struct {
+	A       json.RawMessage `json:"a"`
+	B       json.RawMessage `json:"b"`
+	Format  string          `json:"format"`
+	Options json.RawMessage `json:"options"`
+}
+
+// patchRequest is the body of POST /v1/patch: the diff, in format (default jd), and the
+// document to apply it to. A jd diff is given as a JSON string.
+type patchRequest struct {
+	Diff   json.RawMessage `json:"diff"`
+	Doc    json.RawMessage `json:"doc"`
+	Format string          `json:"format"`
+}
+
+// translateRequest is the body of POST /v1/translate: the diff and its source and
+// target formats.
+type translateRequest struct {
+	Diff json.RawMessage `json:"diff"`
+	From string          `json:"from"`
+	To   string          `json:"to"`
+}
+
+// serveResponse is the body of every serve response. Output is the result as JSON: a
+// string for jd diffs, the JSON value otherwise. Different is set by diffs only.
+type serveResponse struct {
+	Output    json.RawMessage `json:"output,omitempty"`
+	Different *bool           `json:"different,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// runServe serves the diff, patch and translate endpoints on --listen until interrupted,
+// and their metrics on GET /metrics. Requests share one connection pool and its
+// prepared statements, within the limits of cfg.Serve.
+func runServe(flags cliFlags, cfg Config) (int, error) {
+	addr := flags.value("listen")
+	if addr == "" {
+		addr = ":8080"
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	configurePool(db, cfg, runtime.GOMAXPROCS(0))
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	limits := newServeLimits(cfg.Serve, db.Stats().MaxOpenConnections)
+	metrics := newServeMetrics(db, limits)
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics)
+	mux.HandleFunc("POST /v1/diff", serveHandler(stmts, limits, metrics, "diff", func(r diffRequest) (invocation, error) {
+		format, err := requestFormat(r.Format)
+		if err != nil {
+			return invocation{}, err
+		}
+		inv := invocation{A: r.A, B: r.B, Format: format, Options: r.Options}
+		if string(r.Options) == "null" {
+			inv.Options = nil
+		}
+		return inv, nil
+	}))
+	mux.HandleFunc("POST /v1/patch", serveHandler(stmts, limits, metrics, "patch", func(r patchRequest) (invocation, error) {
+		format, err := requestFormat(r.Format)
+		if err != nil {
+			return invocation{}, err
+		}
+		diff := []byte(r.Diff)
+		if jdsql.IsJdText(format) {
+			// jd_patch_text takes the diff as text
+			var s string
+			if err := json.Unmarshal(r.Diff, &s); err != nil {
+				return invocation{}, errors.New("a jd diff must be given as a JSON string")
+			}
+			diff = []byte(s)
+		}
+		return invocation{A: diff, B: r.Doc, Format: format, Patch: true}, nil
+	}))
+	mux.HandleFunc("POST /v1/translate", serveHandler(stmts, limits, metrics, "translate", func(r translateRequest) (invocation, error) {
+		if !jdsql.KnownFormat(r.From) || !jdsql.KnownFormat(r.To) {
+			return invocation{}, fmt.Errorf("unknown translate formats '%s' and '%s' (expected jd, jd2, patch or merge)", r.From, r.To)
+		}
+		return invocation{A: r.Diff, TranslateIn: r.From, TranslateOut: r.To}, nil
+	}))
+
+	// A request's queries are cancelled when its client disconnects, and all of them on
+	// SIGINT or SIGTERM, which also shuts the server down
+	ctx := baseContext
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context { return ctx }}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	logger.Info("serving", "addr", addr)
+
+	select {
+	case err := <-errc:
+		return 2, fmt.Errorf("failed to serve: %s: %w", addr, err)
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdown); err != nil {
+		return 2, fmt.Errorf("failed to shut down: %w", err)
+	}
+	return 0, nil
+}
+
+// requestFormat returns the diff format of a request, jd when it is not given. Unknown
+// formats are rejected, not taken for jd.
+func requestFormat(f string) (string, error) {
+	v := strings.ToLower(strings.TrimSpace(f))
+	if v == "" {
+		return jdsql.FormatJd, nil
+	}
+	if !jdsql.KnownFormat(v) {
+		return "", fmt.Errorf("unknown format '%s' (expected jd, jd2, patch or merge)", f)
+	}
+	return v, nil
+}
+
+// serveHandler decodes a request of type T, turns it into an invocation with build and
+// writes its result. Malformed requests get 400, SQL errors (such as invalid JSON input)
+// 422 and other failures 500; requests turned away by limits get 413, 429 or 503. The
+// body is read before the request waits for a slot, so slow uploads hold no connection.
+// Every request is recorded in m under endpoint.
+func serveHandler[T any](db querier, limits *serveLimits, m *serveMetrics, endpoint string, build func(T) (invocation, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{r: http.MaxBytesReader(w, r.Body, limits.maxBody)}
+		status := http.StatusOK
+		var failure error
+		defer func() { m.observe(endpoint, status, time.Since(start), body.n, failure) }()
+		reject := func(rej *rejection) {
+			status, failure = rej.status, rej
+			m.reject(endpoint, rej.reason)
+			rej.write(w)
+		}
+
+		if rej := limits.admit(r); rej != nil {
+			reject(rej)
+			return
+		}
+		var req T
+		dec := json.NewDecoder(body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				reject(&rejection{status: http.StatusRequestEntityTooLarge, reason: "too_large"})
+				return
+			}
+			status, failure = http.StatusBadRequest, err
+			writeServeResponse(w, status, serveResponse{Error: "invalid request: " + err.Error()})
+			return
+		}
+		inv, err := build(req)
+		if err != nil {
+			status, failure = http.StatusBadRequest, err
+			writeServeResponse(w, status, serveResponse{Error: err.Error()})
+			return
+		}
+		release, rej := limits.acquire(r.Context())
+		if rej != nil {
+			reject(rej)
+			return
+		}
+		out, code, err := execInvocationContext(r.Context(), db, inv)
+		release()
+		if err != nil {
+			status, failure = http.StatusInternalServerError, err
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) {
+				status = http.StatusUnprocessableEntity
+			} else if errors.Is(err, errInputLimit) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeServeResponse(w, status, serveResponse{Error: err.Error()})
+			return
+		}
+		resp := serveResponse{Output: json.RawMessage(out)}
+		if jdsql.IsJdText(inv.outputFormat()) {
+			resp.Output, _ = json.Marshal(out)
+		}
+		if inv.mode() == "diff" {
+			different := code == 1
+			resp.Different = &different
+		}
+		writeServeResponse(w, http.StatusOK, resp)
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeServeResponse(w http.ResponseWriter, status int, resp serveResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServeConfig bounds the load serve puts on the database, so that one client cannot
+// starve the others of the shared pool. Zero values keep the defaults.
+type ServeConfig struct {
+	// MaxConcurrent caps the requests running queries at once (default: pool.max_open,
+	// else the number of CPUs, the size of the pool).
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// MaxQueue caps the requests waiting for one of those slots (default: 4 times
+	// MaxConcurrent). Requests beyond it get 429.
+	MaxQueue int `yaml:"max_queue"`
+	// QueueTimeout bounds the wait for a slot (default 30s). Requests that time out get
+	// 503.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	// MaxRequestBytes caps the size of a request body (default 64 MiB). Larger requests
+	// get 413.
+	MaxRequestBytes int64 `yaml:"max_request_bytes"`
+	// RateLimit is the number of requests per second each client may send on average
+	// (default: no limit), and Burst the number it may send at once (default: RateLimit
+	// rounded up). Requests over the limit get 429.
+	RateLimit float64 `yaml:"rate_limit"`
+	Burst     int     `yaml:"burst"`
+	// ClientHeader names the request header identifying a client for RateLimit, such as
+	// X-Api-Key (default: the remote address).
+	ClientHeader string `yaml:"client_header"`
+}
+
+const (
+	defaultMaxRequestBody = 64 << 20
+	defaultQueueTimeout   = 30 * time.Second
+	// rateBucketsPrune is the number of client buckets above which full buckets, of
+	// clients idle long enough to have refilled, are dropped.
+	rateBucketsPrune = 1024
+)
+
+// validateServeConfig checks the serve settings of the config.
+func validateServeConfig(s ServeConfig) error {
+	if s.MaxConcurrent < 0 || s.MaxQueue < 0 || s.QueueTimeout < 0 || s.MaxRequestBytes < 0 || s.Burst < 0 {
+		return errors.New("serve limits must not be negative")
+	}
+	if s.RateLimit < 0 || math.IsNaN(s.RateLimit) || math.IsInf(s.RateLimit, 0) {
+		return errors.New("serve.rate_limit must be a finite number of requests per second >= 0")
+	}
+	return nil
+}
+
+// serveLimits applies ServeConfig to the requests of serve.
+type serveLimits struct {
+	slots        chan struct{}
+	maxQueue     int64
+	queueTimeout time.Duration
+	maxBody      int64
+	rate         float64
+	burst        float64
+	clientHeader string
+
+	queued atomic.Int64
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+// rateBucket is the token bucket of a client.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newServeLimits resolves the defaults of s for a pool of poolSize connections.
+func newServeLimits(s ServeConfig, poolSize int) *serveLimits {
+	concurrent := s.MaxConcurrent
+	if concurrent <= 0 {
+		concurrent = max(poolSize, 1)
+	}
+	l := &serveLimits{
+		slots:        make(chan struct{}, concurrent),
+		maxQueue:     int64(s.MaxQueue),
+		queueTimeout: s.QueueTimeout,
+		maxBody:      s.MaxRequestBytes,
+		rate:         s.RateLimit,
+		burst:        float64(s.Burst),
+		clientHeader: s.ClientHeader,
+		buckets:      map[string]*rateBucket{},
+	}
+	if l.maxQueue <= 0 {
+		l.maxQueue = 4 * int64(concurrent)
+	}
+	if l.queueTimeout <= 0 {
+		l.queueTimeout = defaultQueueTimeout
+	}
+	if l.maxBody <= 0 {
+		l.maxBody = defaultMaxRequestBody
+	}
+	if l.burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(l.rate))
+	}
+	return l
+}
+
+// rejection is a request turned away by the limits: its status, the reason recorded in
+// the metrics, and the seconds after which to retry (0 for none).
+type rejection struct {
+	status     int
+	reason     string
+	retryAfter int
+}
+
+func (r *rejection) Error() string {
+	switch r.reason {
+	case "rate_limit":
+		return "rate limit exceeded"
+	case "too_large":
+		return "request body too large"
+	case "queue_full":
+		return "too many requests queued"
+	default:
+		return "timed out waiting for a free slot"
+	}
+}
+
+// admit checks a request before its body is read: against the rate limit of its client
+// and, when it declares its length, against the size limit.
+func (l *serveLimits) admit(r *http.Request) *rejection {
+	if r.ContentLength > l.maxBody {
+		return &rejection{status: http.StatusRequestEntityTooLarge, reason: "too_large"}
+	}
+	if l.rate <= 0 {
+		return nil
+	}
+	if wait, ok := l.allow(l.client(r), time.Now()); !ok {
+		return &rejection{status: http.StatusTooManyRequests, reason: "rate_limit", retryAfter: int(math.Ceil(wait.Seconds()))}
+	}
+	return nil
+}
+
+// client returns the key of the client of r for the rate limit.
+func (l *serveLimits) client(r *http.Request) string {
+	if l.clientHeader != "" {
+		if v := r.Header.Get(l.clientHeader); v != "" {
+			return v
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// allow takes a token from the bucket of client, or returns how long until one is
+// available.
+func (l *serveLimits) allow(client string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) > rateBucketsPrune {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// acquire waits for a slot to run a request in, unless the queue of waiting requests is
+// full. The returned function releases the slot.
+func (l *serveLimits) acquire(ctx context.Context) (func(), *rejection) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return nil, &rejection{status: http.StatusTooManyRequests, reason: "queue_full", retryAfter: 1}
+	}
+	defer l.queued.Add(-1)
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-timer.C:
+		return nil, &rejection{status: http.StatusServiceUnavailable, reason: "queue_timeout", retryAfter: 1}
+	case <-ctx.Done():
+		return nil, &rejection{status: http.StatusServiceUnavailable, reason: "queue_timeout"}
+	}
+}
+
+func (l *serveLimits) release() {
+	<-l.slots
+}
+
+// write writes the response of the rejected request.
+func (r *rejection) write(w http.ResponseWriter) {
+	if r.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(r.retryAfter))
+	}
+	writeServeResponse(w, r.status, serveResponse{Error: r.Error()})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatSideBySide is the -f value printing the diff as two aligned columns of old and
+// new values, which the runner renders itself from the structural diff.
+const formatSideBySide = "sidebyside"
+
+// defaultWidth is the width of side-by-side output when neither --width, COLUMNS nor
+// the terminal gives one.
+const defaultWidth = 80
+
+// flagSideBySide reports whether -f selects side-by-side output.
+func flagSideBySide(flags cliFlags) bool {
+	f := coalesceNonEmpty(flags.value("f"), flags.value("format"))
+	return strings.ToLower(strings.TrimSpace(f)) == formatSideBySide
+}
+
+// validateSideBySide rejects -f sidebyside outside a plain diff of two input files, and
+// invalid --width values.
+func validateSideBySide(args cliArgs, inv invocation) error {
+	if v := args.Flags.value("width"); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 20 {
+			return fmt.Errorf("invalid --width value '%s' (expected a number of columns >= 20)", v)
+		}
+		if !inv.SideBySide {
+			return errors.New("--width requires -f sidebyside")
+		}
+	}
+	if !inv.SideBySide {
+		return nil
+	}
+	if flags := inv.modeFlags(); len(flags) > 0 || inv.At != nil {
+		if inv.At != nil {
+			flags = append(flags, "--at")
+		}
+		return errors.New("-f sidebyside cannot be combined with " + strings.Join(flags, " and "))
+	}
+	if len(inv.Redact) > 0 {
+		return errors.New("-f sidebyside cannot be combined with --redact")
+	}
+	if args.Command != "" || args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil ||
+		args.Manifest != "" || args.Spec != "" || isDir(args.FileA) || args.FileB == "" ||
+		args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.value("chunk") != "" {
+		return errors.New("-f sidebyside is only supported for a single diff of two input files")
+	}
+	return nil
+}
+
+// outputWidth returns the width side-by-side output is laid out for: --width, else
+// COLUMNS, else the width of the terminal on stdout, else defaultWidth.
+func outputWidth(flags cliFlags) int {
+	for _, v := range []string{flags.value("width"), os.Getenv("COLUMNS")} {
+		if n, err := strconv.Atoi(v); err == nil && n >= 20 {
+			return n
+		}
+	}
+	if n, _ := terminalSize(os.Stdout); n >= 20 {
+		return n
+	}
+	return defaultWidth
+}
+
+// renderSideBySide renders out, the JSON array of the elements of a diff, as a header
+// line with the path of each hunk followed by its removed values on the left and its
+// added values on the right, indented and wrapped to width. Array context is shown on
+// both sides. out is returned as is if it is not an array of diff elements.
+func renderSideBySide(out string, width int, color bool) string {
+	var elems []diffElement
+	if err := json.Unmarshal([]byte(out), &elems); err != nil {
+		return out
+	}
+	col := (width - 3) / 2
+	paint := func(s, ansi string) string {
+		if !color || ansi == "" {
+			return s
+		}
+		return ansi + s + "\x1b[0m"
+	}
+	var b strings.Builder
+	row := func(left, right, leftColor, rightColor string) {
+		// Pad before coloring, so the escapes do not count toward the width
+		pad := strings.Repeat(" ", col-utf8.RuneCountInString(left))
+		b.WriteString(paint(left, leftColor) + pad + " │")
+		if right != "" {
+			b.WriteString(" " + paint(right, rightColor))
+		}
+		b.WriteString("\n")
+	}
+	for _, e := range elems {
+		b.WriteString(paint("@ "+compactJSON(e.Path), "\x1b[2m"))
+		b.WriteString("\n")
+		for _, v := range e.Before {
+			for _, l := range sideLines("  ", v, col) {
+				row(l, l, "", "")
+			}
+		}
+		var left, right []string
+		for _, v := range e.Remove {
+			left = append(left, sideLines("- ", v, col)...)
+		}
+		for _, v := range e.Add {
+			right = append(right, sideLines("+ ", v, col)...)
+		}
+		for i := 0; i < len(left) || i < len(right); i++ {
+			var l, r string
+			if i < len(left) {
+				l = left[i]
+			}
+			if i < len(right) {
+				r = right[i]
+			}
+			row(l, r, "\x1b[31m", "\x1b[32m")
+		}
+		for _, v := range e.After {
+			for _, l := range sideLines("  ", v, col) {
+				row(l, l, "", "")
+			}
+		}
+	}
+	return b.String()
+}
+
+// sideLines returns the lines of the JSON value v in a column of width col: v indented,
+// its first line after marker and the others aligned with it, and lines longer than the
+// column wrapped. The array context markers of jd_diff_struct are shown as [ and ].
+func sideLines(marker string, v json.RawMessage, col int) []string {
+	text := compactJSON(v)
+	switch {
+	case bytes.Equal(v, openMarker):
+		text = "["
+	case bytes.Equal(v, closeMarker):
+		text = "]"
+	default:
+		var buf bytes.Buffer
+		if json.Indent(&buf, v, "", "  ") == nil {
+			text = buf.String()
+		}
+	}
+	var lines []string
+	indent := strings.Repeat(" ", len(marker))
+	for i, line := range strings.Split(text, "\n") {
+		prefix := indent
+		if i == 0 {
+			prefix = marker
+		}
+		r := []rune(prefix + line)
+		for len(r) > col {
+			lines = append(lines, string(r[:col]))
+			r = append([]rune(indent), r[col:]...)
+		}
+		lines = append(lines, string(r))
+	}
+	return lines
+}
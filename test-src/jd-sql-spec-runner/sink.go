@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// registerSinkFlags registers the flags publishing the non-empty diffs of a run as
+// events (see eventSink).
+func registerSinkFlags(fs *flag.FlagSet) {
+	fs.Var(new(repeatedFlag), "sink", "also publish each non-empty diff as an event: webhook:URL, kafka:URL of a REST proxy topic or sns:TOPIC-ARN (repeatable)")
+	fs.String("sink-template", "", "Go template of the --sink event body, or @file (default: the event as JSON)")
+}
+
+// sinkKinds are the accepted prefixes of --sink values.
+var sinkKinds = []string{"webhook", "kafka", "sns"}
+
+// eventSink publishes events to a webhook, a Kafka topic through a Kafka REST Proxy, or
+// an SNS topic (--sink). Batch, spec, table, drift and cdc runs publish an event for
+// each non-empty diff, in addition to their output.
+type eventSink struct {
+	kind string
+	// target is the URL of webhook and kafka sinks, and the topic ARN of sns sinks.
+	target string
+	// region is the region of an sns topic.
+	region string
+}
+
+// eventSinks are the sinks of the run; run sets them from the --sink flags.
+var eventSinks sinkSet
+
+// sinkTemplate renders the body of the events, or is nil for the event as JSON.
+var sinkTemplate *template.Template
+
+// parseSink parses a --sink value, KIND:TARGET.
+func parseSink(v string) (*eventSink, error) {
+	kind, target, ok := strings.Cut(v, ":")
+	s := &eventSink{kind: strings.ToLower(strings.TrimSpace(kind)), target: strings.TrimSpace(target)}
+	if !ok || !contains(sinkKinds, s.kind) || s.target == "" {
+		return nil, fmt.Errorf("invalid --sink value '%s' (expected webhook:URL, kafka:URL or sns:TOPIC-ARN)", v)
+	}
+	switch s.kind {
+	case "webhook", "kafka":
+		if u, err := url.Parse(s.target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid --sink value '%s' (expected an http or https URL)", v)
+		}
+	case "sns":
+		// arn:aws:sns:REGION:ACCOUNT:TOPIC
+		parts := strings.Split(s.target, ":")
+		if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" || parts[5] == "" {
+			return nil, fmt.Errorf("invalid --sink value '%s' (expected sns:arn:aws:sns:REGION:ACCOUNT:TOPIC)", v)
+		}
+		s.region = parts[3]
+	}
+	return s, nil
+}
+
+// flagSinks returns the sinks of the --sink flags and sets sinkTemplate from
+// --sink-template.
+func flagSinks(flags cliFlags) (sinkSet, error) {
+	var sinks sinkSet
+	for _, v := range flags.values("sink") {
+		s, err := parseSink(v)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	text := flags.value("sink-template")
+	if text == "" {
+		return sinks, nil
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("--sink-template requires --sink")
+	}
+	if name, ok := strings.CutPrefix(text, "@"); ok {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --sink-template file: %s: %w", name, err)
+		}
+		text = string(b)
+	}
+	t, err := template.New("sink").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --sink-template: %w", err)
+	}
+	sinkTemplate = t
+	return sinks, nil
+}
+
+// validateSinks rejects --sink outside the runs that publish events.
+func validateSinks(args cliArgs, impls []string) error {
+	if len(args.Flags.values("sink")) == 0 && args.Flags.value("sink-template") == "" {
+		return nil
+	}
+	publishes := args.Command == "cdc" || args.Command == "drift" ||
+		args.Command == "" && (args.Manifest != "" || args.Spec != "" || args.Table != nil)
+	if !publishes || args.Flags.value("engines") != "" || len(impls) > 1 {
+		return errors.New("--sink is only supported in batch, spec, table, drift and cdc runs")
+	}
+	return nil
+}
+
+// sinkSet is the sinks of a run.
+type sinkSet []*eventSink
+
+// publish sends the event ev of kind to every sink. The event is the JSON object of ev
+// with a "kind" member; with --sink-template its body is the template executed on that
+// object. An event that a sink does not accept is an error.
+func (ss sinkSet) publish(kind string, ev any) error {
+	if len(ss) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	// Numbers stay json.Number, so that large keys are not rounded
+	var data map[string]any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return err
+	}
+	data["kind"] = kind
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if sinkTemplate != nil {
+		var sb bytes.Buffer
+		if err := sinkTemplate.Execute(&sb, data); err != nil {
+			return fmt.Errorf("failed to render --sink-template: %w", err)
+		}
+		body = sb.Bytes()
+	}
+	for _, s := range ss {
+		if err := s.send(body, data["key"]); err != nil {
+			return fmt.Errorf("failed to publish %s event to %s sink: %w", kind, s.kind, err)
+		}
+	}
+	return nil
+}
+
+// send delivers body, with key as the record key of kafka sinks when it is not nil.
+func (s *eventSink) send(body []byte, key any) error {
+	ctx, cancel := context.WithTimeout(baseContext, defaultFetchTimeout)
+	defer cancel()
+	var req *http.Request
+	var err error
+	switch s.kind {
+	case "webhook":
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if json.Valid(body) {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	case "kafka":
+		// The JSON embedded format of the REST Proxy v2 API, which needs a JSON value
+		record := map[string]any{"value": json.RawMessage(body)}
+		if !json.Valid(body) {
+			record["value"] = string(body)
+		}
+		if key != nil {
+			record["key"] = key
+		}
+		b, _ := json.Marshal(map[string]any{"records": []any{record}})
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.target, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	case "sns":
+		if req, err = s.snsRequest(ctx, body); err != nil {
+			return err
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// snsRequest builds the signed Publish request of body to the topic of an sns sink. The
+// endpoint is the regional one of the topic, or AWS_ENDPOINT_URL_SNS (or
+// AWS_ENDPOINT_URL); the credentials are found as for s3 inputs.
+func (s *eventSink) snsRequest(ctx context.Context, body []byte) (*http.Request, error) {
+	target := fmt.Sprintf("https://sns.%s.amazonaws.com/", s.region)
+	if ep := coalesceNonEmpty(os.Getenv("AWS_ENDPOINT_URL_SNS"), os.Getenv("AWS_ENDPOINT_URL")); ep != "" {
+		target = strings.TrimSuffix(ep, "/") + "/"
+	}
+	form := url.Values{"Action": {"Publish"}, "Version": {"2010-03-31"}, "TopicArn": {s.target}, "Message": {string(body)}}
+	payload := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" {
+		return nil, errors.New("no AWS credentials (set AWS_ACCESS_KEY_ID or a profile of the shared credentials file)")
+	}
+	signV4(req, creds, s.region, "sns", payload, time.Now())
+	return req, nil
+}
+
+// caseEvent is the event of a batch or spec case whose diff is not empty.
+type caseEvent struct {
+	Case   string          `json:"case"`
+	Class  string          `json:"class,omitempty"`
+	Source string          `json:"source"`
+	Status caseStatus      `json:"status"`
+	Diff   json.RawMessage `json:"diff"`
+}
+
+// rowEvent is the event of a row pair of table mode, or a row of drift, that differs.
+type rowEvent struct {
+	Table string          `json:"table,omitempty"`
+	Key   json.RawMessage `json:"key"`
+	Diff  json.RawMessage `json:"diff"`
+}
+
+// publishCase publishes the event of res, a result of a run of kind, if it is a diff
+// that is not empty.
+func publishCase(kind string, res caseResult) error {
+	inv := res.Invocation
+	if inv == nil || res.Err != nil || res.Exit != 1 || inv.mode() != "diff" {
+		return nil
+	}
+	return eventSinks.publish(kind, caseEvent{Case: res.Case.Name, Class: res.Case.Class, Source: res.Case.Source,
+		Status: res.Status, Diff: sinkDiff(res.Output, inv.Format)})
+}
+
+// sinkDiff returns the diff out of format as the JSON value of an event: a string for
+// jd diffs, otherwise the JSON of the diff.
+func sinkDiff(out, format string) json.RawMessage {
+	if !jdsql.IsJdText(format) && json.Valid([]byte(out)) {
+		return json.RawMessage(out)
+	}
+	b, _ := json.Marshal(out)
+	return b
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+func registerSnapshotFlags(fs *flag.FlagSet) {
+	fs.String("table", "", "table whose rows are snapshotted (optionally schema qualified)")
+	fs.String("column", "", "JSON column to snapshot")
+	fs.String("key", "", "comma separated key columns identifying the rows")
+	fs.String("where", "", "SQL condition selecting the rows to snapshot")
+}
+
+func registerDriftFlags(fs *flag.FlagSet) {
+	fs.String("table", "", "table to compare with the snapshot (default: the table of the snapshot)")
+	fs.String("column", "", "JSON column to compare (default: the column of the snapshot)")
+	fs.String("where", "", "SQL condition selecting the live rows (default: the condition of the snapshot)")
+	fs.String("f", "", "format of the diffs: jd|jd2|patch|merge")
+	fs.String("format", "", "format of the diffs (same as -f)")
+	registerOptionFlags(fs)
+	registerSinkFlags(fs)
+}
+
+// snapshotHeader is the first line of a snapshot file. The other lines are the rows,
+// as {"key": {...}, "value": ...}, in the order of their key.
+type snapshotHeader struct {
+	Snapshot int       `json:"jd_sql_snapshot"`
+	Table    string    `json:"table"`
+	Column   string    `json:"column"`
+	Key      []string  `json:"key"`
+	Where    string    `json:"where,omitempty"`
+	TakenAt  time.Time `json:"taken_at"`
+}
+
+// snapshotVersion is the version of the snapshot file format.
+const snapshotVersion = 1
+
+type snapshotRow struct {
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// rowsQuery returns the statement selecting the key (as a JSON object) and the value of
+// the column of the rows of h, in the order of their key.
+func (h snapshotHeader) rowsQuery() string {
+	keys := make([]string, len(h.Key))
+	pairs := make([]string, len(h.Key))
+	for i, k := range h.Key {
+		keys[i] = quoteIdent(k)
+		pairs[i] = fmt.Sprintf("%s, %s", sqlLiteral(k), keys[i])
+	}
+	where := ""
+	if h.Where != "" {
+		where = "\nWHERE " + h.Where
+	}
+	return fmt.Sprintf(`SELECT jsonb_build_object(%s) AS key, %s::jsonb AS value
+FROM %s%s
+ORDER BY %s`,
+		strings.Join(pairs, ", "), quoteIdent(h.Column), quoteQualifiedIdent(h.Table), where, strings.Join(keys, ", "))
+}
+
+// runSnapshot writes the rows of the snapshot flags to stdout (or -o) as a snapshot
+// file, which drift later compares with the live table.
+func runSnapshot(flags cliFlags, cfg Config) (int, error) {
+	h := snapshotHeader{
+		Snapshot: snapshotVersion,
+		Table:    flags.value("table"),
+		Column:   flags.value("column"),
+		Where:    strings.TrimSpace(flags.value("where")),
+		TakenAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	for _, k := range strings.Split(flags.value("key"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			h.Key = append(h.Key, k)
+		}
+	}
+	switch {
+	case h.Table == "":
+		return 2, errors.New("snapshot requires --table (the table to snapshot)")
+	case h.Column == "":
+		return 2, errors.New("snapshot requires --column (the JSON column to snapshot)")
+	case len(h.Key) == 0:
+		return 2, errors.New("snapshot requires --key (comma separated key columns)")
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, h.rowsQuery())
+	if err != nil {
+		return 2, queryTimeouts.describe(fmt.Errorf("snapshot query failed: %w", err))
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	header, _ := json.Marshal(h)
+	fmt.Fprintf(w, "%s\n", header)
+	n := 0
+	for rows.Next() {
+		var key []byte
+		var value sql.NullString
+		if err := rows.Scan(&key, &value); err != nil {
+			return 2, fmt.Errorf("failed to read snapshot row: %w", err)
+		}
+		v := "null"
+		if value.Valid {
+			v = value.String
+		}
+		fmt.Fprintf(w, "{\"key\":%s,\"value\":%s}\n", key, v)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 2, queryTimeouts.describe(fmt.Errorf("snapshot query failed: %w", err))
+	}
+	logger.Info("snapshot taken", "table", h.Table, "column", h.Column, "rows", n)
+	return 0, nil
+}
+
+// readSnapshot reads a snapshot file written by snapshot.
+func readSnapshot(path string) (snapshotHeader, []snapshotRow, error) {
+	var h snapshotHeader
+	b, err := readInput(path)
+	if err != nil {
+		return h, nil, fmt.Errorf("failed to read snapshot: %s: %w", path, err)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	sc.Buffer(nil, len(b)+1)
+	if !sc.Scan() || json.Unmarshal(sc.Bytes(), &h) != nil || h.Snapshot == 0 {
+		return h, nil, fmt.Errorf("invalid snapshot: %s: the first line is not a snapshot header", path)
+	}
+	if h.Snapshot != snapshotVersion {
+		return h, nil, fmt.Errorf("unsupported snapshot: %s: version %d (this runner reads version %d)", path, h.Snapshot, snapshotVersion)
+	}
+	if h.Table == "" || h.Column == "" || len(h.Key) == 0 {
+		return h, nil, fmt.Errorf("invalid snapshot: %s: the header has no table, column or key", path)
+	}
+	var rows []snapshotRow
+	for line := 2; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var r snapshotRow
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil || len(r.Key) == 0 {
+			return h, nil, fmt.Errorf("invalid snapshot: %s:%d: expected {\"key\": ..., \"value\": ...}", path, line)
+		}
+		rows = append(rows, r)
+	}
+	return h, rows, nil
+}
+
+// driftQuery diffs the rows copied into jd_sql_snapshot with the live rows of h, paired
+// by key, and yields the key and diff of every row that changed. Rows present on only
+// one side are diffed against NULL, which jd_diff treats as a missing document.
+func driftQuery(h snapshotHeader) string {
+	return fmt.Sprintf(`SELECT key, d FROM (
+  SELECT coalesce(s.key, l.key) AS key, jd_diff(s.value::jsonb, l.value, $1::jsonb, $2::jd_diff_format) AS d
+  FROM jd_sql_snapshot AS s FULL JOIN (%s) AS l ON l.key = s.key
+) AS x
+WHERE NOT jd_diff_is_empty(d, $2::jd_diff_format)
+ORDER BY key`, h.rowsQuery())
+}
+
+// runDrift compares the live rows of a table with the snapshot file path: the snapshot
+// is copied into a temporary table and diffed with the table inside the database, and
+// the diff of every row that changed since is written as a JSON line
+// ({"key": {...}, "diff": ...}), as in table mode. It exits 1 when any row drifted.
+func runDrift(flags cliFlags, cfg Config, path string) (int, error) {
+	h, snapshot, err := readSnapshot(path)
+	if err != nil {
+		return 2, err
+	}
+	h.Table = coalesceNonEmpty(flags.value("table"), h.Table)
+	h.Column = coalesceNonEmpty(flags.value("column"), h.Column)
+	if flags.given("where") {
+		h.Where = strings.TrimSpace(flags.value("where"))
+	}
+	if flagPathsFormat(flags) != "" {
+		return 2, errors.New("drift emits diffs: -f paths is not supported")
+	}
+	inv := flagInvocation(flags, nil, nil)
+	inv.Options = flagOptions(flags)
+	sqlText := renderSQL(driftQuery(h))
+	params := []any{jdsql.NullableText(inv.Options), inv.Format}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	// The temporary table belongs to the session, so everything runs in one transaction
+	var tx *sql.Tx
+	if t := queryTimeouts.statement(); t > 0 {
+		tx, err = beginWithStatementTimeout(ctx, db, t)
+	} else {
+		tx, err = db.BeginTx(ctx, nil)
+	}
+	if err != nil {
+		return 2, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE jd_sql_snapshot (key jsonb, value text) ON COMMIT DROP"); err != nil {
+		return 2, fmt.Errorf("failed to create snapshot table: %w", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("jd_sql_snapshot", "key", "value"))
+	if err != nil {
+		return 2, fmt.Errorf("failed to start copy: %w", err)
+	}
+	for _, r := range snapshot {
+		var value any
+		if string(r.Value) != "null" && len(r.Value) > 0 {
+			value = string(r.Value)
+		}
+		if _, err := stmt.ExecContext(ctx, string(r.Key), value); err != nil {
+			stmt.Close()
+			return 2, fmt.Errorf("failed to copy snapshot: %w", err)
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return 2, fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+	if err := stmt.Close(); err != nil {
+		return 2, fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+
+	trace := &execTrace{SQL: sqlText, Params: params, Attempts: 1}
+	start := time.Now()
+	finish := func(err error) error {
+		trace.RoundTrip = time.Since(start)
+		trace.Err = queryTimeouts.describe(err)
+		if verbose {
+			logTrace(trace)
+		}
+		return trace.Err
+	}
+	rows, err := tx.QueryContext(ctx, sqlText, params...)
+	if err != nil {
+		return 2, fmt.Errorf("drift query failed: %w", finish(err))
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	for rows.Next() {
+		var key, diff []byte
+		if err := rows.Scan(&key, &diff); err != nil {
+			return 2, fmt.Errorf("failed to read drift row: %w", err)
+		}
+		trace.Rows++
+		if len(inv.Redact) > 0 {
+			diff = redactTableDiff(diff, inv)
+		}
+		fmt.Fprintf(w, "{\"key\":%s,\"diff\":%s}\n", key, diff)
+		if err := eventSinks.publish("drift", rowEvent{Table: h.Table, Key: key, Diff: diff}); err != nil {
+			return 2, err
+		}
+	}
+	if err := finish(rows.Err()); err != nil {
+		return 2, fmt.Errorf("drift query failed: %w", err)
+	}
+	logger.Info("drift checked", "table", h.Table, "snapshot_rows", len(snapshot), "taken_at", h.TakenAt, "drifted", trace.Rows)
+	if trace.Rows > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
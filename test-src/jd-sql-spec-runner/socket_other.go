@@ -0,0 +1,34 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// daemonSocketDir returns the directory of the daemon socket without --socket, the
+// temporary directory of the user.
+func daemonSocketDir() (string, error) {
+	return os.TempDir(), nil
+}
+
+// listenPrivate listens on the unix socket path, restricted to the user afterwards: the
+// umask is not supported on this platform.
+func listenPrivate(path string) (net.Listener, error) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// checkSocketOwner accepts any socket: the owner of a file is not known on this
+// platform.
+func checkSocketOwner(string) error {
+	return nil
+}
@@ -0,0 +1,61 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// daemonSocketDir returns the directory of the daemon socket without --socket:
+// $XDG_RUNTIME_DIR, which only the user can access, else a jdsql-<uid> directory of the
+// temporary directory, created with mode 0700. A directory of that name that another
+// user owns or can access is an error rather than used.
+func daemonSocketDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir := filepath.Join(os.TempDir(), "jdsql-"+strconv.Itoa(os.Getuid()))
+	if err := os.Mkdir(dir, 0o700); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create the socket directory: %s: %w", dir, err)
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the socket directory: %s: %w", dir, err)
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0o700 || !ownedByUser(fi) {
+		return "", fmt.Errorf("the socket directory %s must be a directory of mode 0700 owned by the user", dir)
+	}
+	return dir, nil
+}
+
+// listenPrivate listens on the unix socket path, created with mode 0600 so that no other
+// user can connect to it in the meantime.
+func listenPrivate(path string) (net.Listener, error) {
+	// The umask is that of the process, which does not create files concurrently here
+	old := syscall.Umask(0o077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
+
+// checkSocketOwner fails unless the socket path is owned by the user, so that a client
+// does not send its documents to a daemon another user started on that path.
+func checkSocketOwner(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !ownedByUser(fi) {
+		return fmt.Errorf("the socket %s is owned by another user", path)
+	}
+	return nil
+}
+
+func ownedByUser(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
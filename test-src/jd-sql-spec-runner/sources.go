@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// sourced reports whether the sides are read from other databases (--source-a and
+// --source-b) rather than joined inside the database of the config.
+func (td tableDiff) sourced() bool {
+	return td.SourceA != "" || td.SourceB != ""
+}
+
+// validateSources checks that both sources are given, each with a table or a query.
+func (td tableDiff) validateSources(flags cliFlags) error {
+	switch {
+	case td.SourceA == "" || td.SourceB == "":
+		return errors.New("pairing rows across sources requires both --source-a and --source-b")
+	case flags.value("a-file") != "" || flags.value("b-file") != "":
+		return errors.New("--a-file and --b-file cannot be combined with --source-a and --source-b")
+	}
+	for _, side := range []struct{ name, table, query string }{{"a", td.TableA, td.QueryA}, {"b", td.TableB, td.QueryB}} {
+		switch {
+		case side.table == "" && side.query == "":
+			return fmt.Errorf("--source-%s requires --table-%s or --query-%s", side.name, side.name, side.name)
+		case side.table != "" && side.query != "":
+			return fmt.Errorf("--table-%s cannot be combined with --query-%s", side.name, side.name)
+		}
+	}
+	return nil
+}
+
+// sourceQuery returns the statement reading one side of a sourced table diff from the
+// table, or the rows of the query: the key of each row as the text of a JSON object,
+// and its column as JSON text. The rows are ordered by that text in the C collation,
+// which is byte order whatever the collation of the database, so both sides come in
+// the order runSourceDiff merges them in. The statement calls no jd-sql function.
+func (td tableDiff) sourceQuery(table, query, column string) string {
+	from := quoteQualifiedIdent(table)
+	if query != "" {
+		// A trailing semicolon would end the statement inside the subquery
+		from = "(" + strings.TrimRight(query, " \t\r\n;") + ")"
+	}
+	pairs := make([]string, len(td.Key))
+	for i, k := range td.Key {
+		pairs[i] = fmt.Sprintf("%s, s.%s", sqlLiteral(k), quoteIdent(k))
+	}
+	return fmt.Sprintf(`SELECT k, d FROM (
+  SELECT jsonb_build_object(%s)::text AS k, s.%s::jsonb::text AS d FROM %s AS s
+) AS t
+ORDER BY k COLLATE "C"`,
+		strings.Join(pairs, ", "), quoteIdent(column), from)
+}
+
+// openSource opens the database of a --source-a or --source-b value: the config engine
+// of that name, or else a DSN, which takes the other connection settings of the config.
+func openSource(cfg Config, source string) (*sql.DB, error) {
+	c := cfg
+	c.DSN = source
+	for _, e := range cfg.Engines {
+		if e.Name == source {
+			c = cfg.engineConfig(e)
+			break
+		}
+	}
+	if strings.EqualFold(c.Engine, "postgres-ephemeral") {
+		return nil, fmt.Errorf("source '%s': an ephemeral engine cannot be a source", source)
+	}
+	return openPostgres(c)
+}
+
+// sourceRows reads the rows of one side of a sourced table diff in key order.
+type sourceRows struct {
+	side  string
+	rows  *sql.Rows
+	trace *execTrace
+	start time.Time
+	// key and doc are those of the current row; done is set after the last one.
+	key, doc []byte
+	done     bool
+}
+
+// readSource runs the statement of a side on q and positions it on its first row.
+func readSource(ctx context.Context, q rowsQuerier, side, sqlText string) (*sourceRows, error) {
+	r := &sourceRows{side: side, trace: &execTrace{SQL: sqlText, Attempts: 1}, start: time.Now()}
+	rows, err := q.QueryContext(ctx, sqlText)
+	if err != nil {
+		return nil, fmt.Errorf("query of source %s failed: %w", side, r.finish(err))
+	}
+	r.rows = rows
+	return r, r.next()
+}
+
+// next moves to the next row. Two rows with the same key could not be paired, so they
+// fail the run.
+func (r *sourceRows) next() error {
+	if !r.rows.Next() {
+		r.done = true
+		if err := r.finish(r.rows.Err()); err != nil {
+			return fmt.Errorf("query of source %s failed: %w", r.side, err)
+		}
+		return nil
+	}
+	var key, doc []byte
+	if err := r.rows.Scan(&key, &doc); err != nil {
+		return fmt.Errorf("failed to read a row of source %s: %w", r.side, err)
+	}
+	r.trace.Rows++
+	if bytes.Equal(key, r.key) {
+		return fmt.Errorf("source %s has more than one row with the key %s", r.side, key)
+	}
+	r.key, r.doc = key, doc
+	return nil
+}
+
+// finish records the end of the statement in its trace and returns err as described
+// by queryTimeouts.
+func (r *sourceRows) finish(err error) error {
+	r.trace.RoundTrip = time.Since(r.start)
+	r.trace.Err = queryTimeouts.describe(err)
+	if verbose {
+		logTrace(r.trace)
+	}
+	return r.trace.Err
+}
+
+func (r *sourceRows) close() {
+	if r != nil && r.rows != nil {
+		r.rows.Close()
+	}
+}
+
+// sourceQuerier is implemented by *sql.DB and *sql.Tx.
+type sourceQuerier interface {
+	rowsQuerier
+	rowQuerier
+}
+
+// boundedQuerier returns db, or a transaction on it bounded by the statement timeout.
+// The returned function ends the transaction.
+func boundedQuerier(ctx context.Context, db *sql.DB) (sourceQuerier, func(), error) {
+	t := queryTimeouts.statement()
+	if t <= 0 {
+		return db, func() {}, nil
+	}
+	tx, err := beginWithStatementTimeout(ctx, db, t)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, func() { tx.Rollback() }, nil
+}
+
+// runSourceDiff diffs the sides of td read from two other databases, where a single
+// join is impossible: each source streams its rows in key order (see sourceQuery), the
+// runner pairs them by key, and the pairs are diffed in batches with the jd-sql
+// functions of the config's database, so the sources need not have them installed. A
+// row present on one side only is diffed against NULL, as in table mode. The output
+// and exit code are those of runTableDiff.
+func runSourceDiff(flags cliFlags, cfg Config, td tableDiff, inv invocation) (int, error) {
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	dbA, err := openSource(cfg, td.SourceA)
+	if err != nil {
+		return 2, err
+	}
+	defer dbA.Close()
+	dbB, err := openSource(cfg, td.SourceB)
+	if err != nil {
+		return 2, err
+	}
+	defer dbB.Close()
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	// The diffs run on q[0], and the sides are read from q[1] and q[2]
+	var q [3]sourceQuerier
+	for i, d := range []*sql.DB{db, dbA, dbB} {
+		var end func()
+		if q[i], end, err = boundedQuerier(ctx, d); err != nil {
+			return 2, err
+		}
+		defer end()
+	}
+	a, err := readSource(ctx, q[1], "a", td.sourceQuery(td.TableA, td.QueryA, td.ColumnA))
+	defer a.close()
+	if err != nil {
+		return 2, err
+	}
+	b, err := readSource(ctx, q[2], "b", td.sourceQuery(td.TableB, td.QueryB, td.ColumnB))
+	defer b.close()
+	if err != nil {
+		return 2, err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	progress := newProgress(flags, 0)
+	defer progress.close()
+	var keys [][]byte
+	var pairs [][2][]byte
+	differ := 0
+	// flush diffs the pending pairs and writes those that differ; with --equal it stops
+	// at the first
+	flush := func() error {
+		if len(pairs) == 0 {
+			return nil
+		}
+		sqlText, params := jdsql.BatchDiffQuery(pairs, inv.Options, inv.Format)
+		sqlText = renderSQL(sqlText)
+		trace := &execTrace{SQL: sqlText, Params: params, Attempts: 1}
+		start := time.Now()
+		var raw []byte
+		err := q[0].QueryRowContext(ctx, sqlText, params...).Scan(&raw)
+		trace.RoundTrip, trace.Err = time.Since(start), queryTimeouts.describe(err)
+		if verbose {
+			logTrace(trace)
+		}
+		if trace.Err != nil {
+			return fmt.Errorf("query failed: %w", trace.Err)
+		}
+		var results [][2]json.RawMessage
+		if err := json.Unmarshal(raw, &results); err != nil || len(results) != len(pairs) {
+			return errors.New("query failed: unexpected result of the batch diff")
+		}
+		for i, res := range results {
+			if string(res[1]) == "true" {
+				continue
+			}
+			differ++
+			progress.finished(false)
+			if inv.Equal {
+				break
+			}
+			diff := []byte(res[0])
+			if len(inv.Redact) > 0 {
+				diff = redactTableDiff(diff, inv)
+			}
+			fmt.Fprintf(w, "{\"key\":%s,\"diff\":%s}\n", keys[i], diff)
+			if err := eventSinks.publish("table", rowEvent{Key: keys[i], Diff: diff}); err != nil {
+				return err
+			}
+		}
+		keys, pairs = keys[:0], pairs[:0]
+		return nil
+	}
+
+	for !a.done || !b.done {
+		var pair [2][]byte
+		var key []byte
+		switch c := bytes.Compare(a.key, b.key); {
+		case b.done || !a.done && c < 0:
+			key, pair = a.key, [2][]byte{a.doc, nil}
+			err = a.next()
+		case a.done || c > 0:
+			key, pair = b.key, [2][]byte{nil, b.doc}
+			err = b.next()
+		default:
+			key, pair = a.key, [2][]byte{a.doc, b.doc}
+			if err = a.next(); err == nil {
+				err = b.next()
+			}
+		}
+		if err != nil {
+			return 2, err
+		}
+		keys, pairs = append(keys, key), append(pairs, pair)
+		if len(pairs) == jdsql.DefaultBatchSize {
+			if err := flush(); err != nil {
+				return 2, err
+			}
+		}
+		if inv.Equal && differ > 0 {
+			return 1, nil
+		}
+	}
+	if err := flush(); err != nil {
+		return 2, err
+	}
+	if differ > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
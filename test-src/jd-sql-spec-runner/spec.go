@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// specCase mirrors the spec case JSON shared with the upstream jd spec and the Java
+// harness (see test-src/java-tests/.../SpecCase.java). Case files hold a JSON array of cases.
+type specCase struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Category       string   `json:"category"`
+	ContentA       string   `json:"content_a"`
+	ContentB       string   `json:"content_b"`
+	ExpectedDiff   *string  `json:"expected_diff"`
+	ExpectedResult *string  `json:"expected_result"`
+	ExpectedExit   int      `json:"expected_exit"`
+	ShouldError    bool     `json:"should_error"`
+	Args           []string `json:"args"`
+	SQLFunction    string   `json:"sql_function"`
+	// Tags is a jd-sql extension used by the config's skips/xfail rules.
+	Tags []string `json:"tags"`
+	// Setup and teardown hooks are a jd-sql extension too, see caseHooks. An element
+	// holding only Suite declares the hooks of every case of the file.
+	caseHooks
+	Suite *caseHooks `json:"suite"`
+}
+
+// runSpec executes the spec cases found in path (a case file or a directory of *.json
+// case files) and compares each result with the expected output and exit code.
+func runSpec(flags cliFlags, cfg Config, path string, opts suiteOptions) (int, error) {
+	cases, err := loadSpecCases(path)
+	if err != nil {
+		return 2, err
+	}
+	return runSuite(flags, cfg, "spec", cases, opts)
+}
+
+func loadSpecCases(path string) ([]testCase, error) {
+	files := []string{path}
+	if isDir(path) {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list spec directory: %s: %w", path, err)
+		}
+		files = files[:0]
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+	var cases []testCase
+	for _, f := range files {
+		fileCases, err := loadSpecFile(f)
+		if err != nil {
+			return nil, err
+		}
+		cases = append(cases, fileCases...)
+	}
+	return cases, nil
+}
+
+func loadSpecFile(path string) ([]testCase, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		b, err = decodeText(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec file: %s: %w", path, err)
+	}
+	return parseSpecCases(b, path)
+}
+
+// parseSpecCases parses the spec cases of a case file read from path.
+func parseSpecCases(b []byte, path string) ([]testCase, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("failed to parse spec file: %s: expected a JSON array of cases", path)
+	}
+	var cases []testCase
+	var suite *caseHooks
+	for dec.More() {
+		// Line of the case's opening brace, for clickable locations in failures
+		line := 1 + bytes.Count(b[:skipSpace(b, int(dec.InputOffset()))], []byte("\n"))
+		var sc specCase
+		if err := dec.Decode(&sc); err != nil {
+			return nil, fmt.Errorf("failed to parse spec file: %s:%d: %w", path, line, err)
+		}
+		if sc.Suite != nil {
+			if suite != nil || sc.Name != "" || len(sc.Args) > 0 || !sc.caseHooks.empty() {
+				return nil, fmt.Errorf("failed to parse spec file: %s:%d: \"suite\" must be alone in its element, once per file", path, line)
+			}
+			suite = sc.Suite
+			continue
+		}
+		cases = append(cases, sc.testCase(fmt.Sprintf("%s:%d", path, line)))
+	}
+	if suite != nil {
+		for i := range cases {
+			cases[i].Hooks = suite.around(cases[i].Hooks)
+		}
+	}
+	return cases, nil
+}
+
+// skipSpace returns the offset of the next value in b, skipping whitespace and commas.
+func skipSpace(b []byte, off int) int {
+	for off < len(b) && strings.IndexByte(" \t\r\n,", b[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+func (sc specCase) testCase(source string) testCase {
+	name := sc.Name
+	if sc.Category != "" {
+		name = sc.Category + "/" + sc.Name
+	}
+	exit := sc.ExpectedExit
+	c := testCase{
+		Name:         name,
+		Class:        sc.Category,
+		Tags:         sc.Tags,
+		Source:       source,
+		ExpectedExit: &exit,
+		Hooks:        sc.caseHooks,
+		prepare: func() (invocation, error) {
+			return invocationFromArgs(sc.Args, []byte(sc.ContentA), []byte(sc.ContentB))
+		},
+	}
+	if sc.Category != "" {
+		c.Tags = append([]string{sc.Category}, sc.Tags...)
+	}
+	switch {
+	case sc.ExpectedDiff != nil:
+		c.ExpectedOutput = sc.ExpectedDiff
+	case sc.ExpectedResult != nil:
+		c.ExpectedOutput = sc.ExpectedResult
+	case exit == 0:
+		empty := ""
+		c.ExpectedOutput = &empty
+	}
+
+	switch {
+	case sc.SQLFunction != "" && sc.SQLFunction != "jd_diff":
+		c.Skip = "sql_function cases are only supported by the Java harness"
+	case sc.ShouldError && validJSONOrEmpty(sc.ContentA) && validJSONOrEmpty(sc.ContentB):
+		// Errors such as too many args or a nonexistent file are raised by the CLI, not SQL
+		c.Skip = "CLI-only error case"
+	}
+	return c
+}
+
+func validJSONOrEmpty(s string) bool {
+	return strings.TrimSpace(s) == "" || json.Valid([]byte(s))
+}
+
+// invocationFromArgs maps upstream jd CLI arguments (as used by spec cases) onto an
+// invocation, building the jd options array the same way the Java harness does.
+func invocationFromArgs(args []string, a, b []byte) (invocation, error) {
+	inv := invocation{A: a, B: b, Format: "jd"}
+	var opts []string
+	var rawOpts string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		switch name {
+		case "f", "format":
+			if !hasValue && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			inv.Format = jdsql.NormalizeFormat(value)
+		case "t", "translate":
+			inv.TranslateIn, inv.TranslateOut = jdsql.ParseTranslate(value)
+		case "p":
+			inv.Patch = true
+		case "strict-6902":
+			inv.Strict6902 = true
+		case "verify-roundtrip":
+			inv.VerifyRoundTrip = true
+		case "set":
+			opts = append(opts, `"SET"`)
+		case "mset":
+			opts = append(opts, `"MULTISET"`)
+		case "color":
+			opts = append(opts, `"COLOR"`)
+		case "precision":
+			if strings.TrimSpace(value) != "" {
+				opts = append(opts, fmt.Sprintf(`{"precision":%s}`, strings.TrimSpace(value)))
+			}
+		case "setkeys":
+			var keys []string
+			for _, k := range strings.Split(value, ",") {
+				if k = strings.TrimSpace(k); k != "" {
+					keys = append(keys, k)
+				}
+			}
+			if len(keys) > 0 {
+				enc, _ := json.Marshal(keys)
+				opts = append(opts, fmt.Sprintf(`{"setkeys":%s}`, enc))
+			}
+		case "opts":
+			rawOpts = value
+		case "yaml":
+			// YAML input is not supported by the SQL implementation; see runPostgres
+		}
+	}
+	switch {
+	case rawOpts != "":
+		raw, err := parseOpts([]byte(rawOpts))
+		if err != nil {
+			return inv, err
+		}
+		inv.Options = raw
+	case len(opts) > 0:
+		inv.Options = []byte("[" + strings.Join(opts, ",") + "]")
+	}
+	return inv, nil
+}
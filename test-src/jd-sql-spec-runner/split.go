@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// validateSplit rejects --split outside a plain diff of two input files, and
+// --split-key without --split.
+func validateSplit(args cliArgs, inv invocation, impls []string) error {
+	keys := args.Flags.values("split-key")
+	if !args.Flags.enabled("split") {
+		if len(keys) > 0 {
+			return errors.New("--split-key requires --split")
+		}
+		return nil
+	}
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "/") {
+			return fmt.Errorf("invalid --split-key value '%s' (expected a JSON Pointer such as /metadata/name)", k)
+		}
+	}
+	if flags := inv.modeFlags(); len(flags) > 0 {
+		return errors.New("--split cannot be combined with " + strings.Join(flags, " and "))
+	}
+	if inv.Paths != "" || inv.SideBySide || inv.Hunks {
+		return errors.New("--split cannot be combined with -f paths, -f sidebyside or -f hunks-ndjson")
+	}
+	if args.Command != "" || args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil ||
+		args.Chain != nil || args.Manifest != "" || args.Spec != "" || isDir(args.FileA) || args.FileB == "" ||
+		args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.enabled("watch") ||
+		args.Flags.enabled("tui") || args.Flags.value("chunk") != "" ||
+		args.Flags.value("engines") != "" || len(impls) > 1 {
+		return errors.New("--split is only supported for a single diff of two input files")
+	}
+	if args.Flags.value("report") != "" || args.Flags.enabled("explain") ||
+		args.Flags.value("verify-determinism") != "" || oracle != nil {
+		return errors.New("--split cannot be combined with --report, --explain, --verify-determinism or --oracle")
+	}
+	return nil
+}
+
+// splitDiff is one output line of --split.
+type splitDiff struct {
+	// IndexA and IndexB are the 1-based positions of the documents in their files, 0
+	// for a document missing from that file.
+	IndexA int             `json:"index_a"`
+	IndexB int             `json:"index_b"`
+	Key    json.RawMessage `json:"key,omitempty"`
+	Diff   json.RawMessage `json:"diff"`
+}
+
+// splitDoc is a document of a split input file.
+type splitDoc struct {
+	Index int
+	Text  []byte
+}
+
+// runSplit diffs the documents of fileA and fileB (see splitDocuments), paired by
+// position or, with --split-key, by the values at JSON Pointers, as NDJSON mode pairs
+// records. A document without a counterpart is diffed against a missing document.
+// Each pair with a non-empty diff is written to stdout as a JSON line; the exit code is
+// 1 if any pair differs.
+func runSplit(flags cliFlags, cfg Config, fileA, fileB string) (int, error) {
+	inv := flagInvocation(flags, nil, nil)
+	var docs [2][]splitDoc
+	for i, name := range []string{fileA, fileB} {
+		side := string(rune('A' + i))
+		b, err := readInput(name)
+		if err != nil {
+			return 2, fmt.Errorf("failed to read input file %s: %s: %w", side, name, err)
+		}
+		texts, err := splitDocuments(b)
+		if err != nil {
+			return 2, fmt.Errorf("input file %s: %s: %w", side, name, err)
+		}
+		for j, t := range texts {
+			docs[i] = append(docs[i], splitDoc{Index: j + 1, Text: t})
+		}
+	}
+	pairs, err := pairDocuments(docs[0], docs[1], flags.values("split-key"))
+	if err != nil {
+		return 2, err
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	differ := false
+	for _, p := range pairs {
+		inv.A, inv.B = p.a.Text, p.b.Text
+		inv.Options = flagOptions(flags, p.a.Text, p.b.Text)
+		out, code, err := execInvocation(stmts, inv)
+		if err != nil {
+			return 2, fmt.Errorf("document A:%d B:%d: %w", p.a.Index, p.b.Index, err)
+		}
+		if code == 0 {
+			continue
+		}
+		differ = true
+		d := splitDiff{IndexA: p.a.Index, IndexB: p.b.Index, Key: p.key, Diff: json.RawMessage(out)}
+		if jdsql.IsJdText(inv.Format) {
+			d.Diff, _ = json.Marshal(out)
+		}
+		enc, _ := json.Marshal(d)
+		if _, err := fmt.Fprintf(w, "%s\n", enc); err != nil {
+			return 2, err
+		}
+	}
+	if differ {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// splitPair is a document of A and its counterpart in B; either is the zero splitDoc
+// when missing.
+type splitPair struct {
+	a, b splitDoc
+	key  json.RawMessage
+}
+
+// pairDocuments pairs the documents of a and b by position, or by the values at the
+// JSON Pointers keys: the value itself with one pointer, the array of the values with
+// several. Documents of B that no document of A matched come last, in file order.
+func pairDocuments(a, b []splitDoc, keys []string) ([]splitPair, error) {
+	var pairs []splitPair
+	if len(keys) == 0 {
+		for i := 0; i < len(a) || i < len(b); i++ {
+			var p splitPair
+			if i < len(a) {
+				p.a = a[i]
+			}
+			if i < len(b) {
+				p.b = b[i]
+			}
+			pairs = append(pairs, p)
+		}
+		return pairs, nil
+	}
+	index := func(side string, docs []splitDoc) (map[string]int, []string, error) {
+		byKey := map[string]int{}
+		order := make([]string, len(docs))
+		for i, d := range docs {
+			key, err := splitKey(d.Text, keys)
+			if err != nil {
+				return nil, nil, fmt.Errorf("input file %s document %d: %w", side, d.Index, err)
+			}
+			if j, dup := byKey[key]; dup {
+				return nil, nil, fmt.Errorf("input file %s document %d: duplicate key %s (first in document %d)", side, d.Index, key, docs[j].Index)
+			}
+			byKey[key], order[i] = i, key
+		}
+		return byKey, order, nil
+	}
+	_, orderA, err := index("A", a)
+	if err != nil {
+		return nil, err
+	}
+	byKeyB, orderB, err := index("B", b)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]bool, len(b))
+	for i, key := range orderA {
+		p := splitPair{a: a[i], key: json.RawMessage(key)}
+		if j, ok := byKeyB[key]; ok {
+			p.b, matched[j] = b[j], true
+		}
+		pairs = append(pairs, p)
+	}
+	for j, key := range orderB {
+		if !matched[j] {
+			pairs = append(pairs, splitPair{b: b[j], key: json.RawMessage(key)})
+		}
+	}
+	return pairs, nil
+}
+
+// splitKey returns the key of doc for the JSON Pointers keys (see pairDocuments).
+func splitKey(doc []byte, keys []string) (string, error) {
+	if len(keys) == 1 {
+		return ndjsonKey(doc, keys[0])
+	}
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		var err error
+		if parts[i], err = ndjsonKey(doc, k); err != nil {
+			return "", err
+		}
+	}
+	return "[" + strings.Join(parts, ",") + "]", nil
+}
+
+// splitDocuments returns the documents of an input file of --split as JSON: the
+// elements of a top-level JSON array, or the documents of a YAML stream (a single YAML
+// document that is a sequence is split into its elements, as a JSON array is). Empty
+// YAML documents, such as the one after a trailing ---, are skipped. Any other JSON
+// value is a single document.
+func splitDocuments(b []byte) ([]json.RawMessage, error) {
+	if json.Valid(b) {
+		var docs []json.RawMessage
+		if json.Unmarshal(b, &docs) == nil {
+			return docs, nil
+		}
+		return []json.RawMessage{bytes.TrimSpace(b)}, nil
+	}
+	var nodes []*yaml.Node
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var n yaml.Node
+		err := dec.Decode(&n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("neither JSON nor YAML: %w", err)
+		}
+		if len(n.Content) == 0 || n.Content[0].ShortTag() == "!!null" {
+			continue
+		}
+		nodes = append(nodes, n.Content[0])
+	}
+	if len(nodes) == 1 && nodes[0].Kind == yaml.SequenceNode {
+		nodes = nodes[0].Content
+	}
+	docs := make([]json.RawMessage, len(nodes))
+	for i, n := range nodes {
+		v, err := yamlValue(n)
+		if err != nil {
+			return nil, fmt.Errorf("YAML document %d: %w", i+1, err)
+		}
+		if docs[i], err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("YAML document %d: %w", i+1, err)
+		}
+	}
+	return docs, nil
+}
+
+// yamlValue returns the YAML node n as a value that encodes to JSON. Numbers keep
+// their literal where it is a JSON number, so large integers are not rounded; scalars
+// of other tags, such as timestamps, are strings. Aliases are expanded and merge keys
+// (<<) applied.
+func yamlValue(n *yaml.Node) (any, error) {
+	switch n.Kind {
+	case yaml.AliasNode:
+		return yamlValue(n.Alias)
+	case yaml.SequenceNode:
+		arr := make([]any, len(n.Content))
+		for i, c := range n.Content {
+			var err error
+			if arr[i], err = yamlValue(c); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case yaml.MappingNode:
+		obj := map[string]any{}
+		var merged []map[string]any
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			val, err := yamlValue(v)
+			if err != nil {
+				return nil, err
+			}
+			if k.ShortTag() == "!!merge" {
+				switch m := val.(type) {
+				case map[string]any:
+					merged = append(merged, m)
+				case []any:
+					for _, e := range m {
+						if em, ok := e.(map[string]any); ok {
+							merged = append(merged, em)
+						}
+					}
+				}
+				continue
+			}
+			if k.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: a key that is not a scalar has no JSON equivalent", k.Line)
+			}
+			obj[k.Value] = val
+		}
+		// Keys of the mapping itself win over merged ones, and earlier merges over later
+		for _, m := range merged {
+			for k, v := range m {
+				if _, ok := obj[k]; !ok {
+					obj[k] = v
+				}
+			}
+		}
+		return obj, nil
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!null":
+			return nil, nil
+		case "!!bool":
+			var v bool
+			err := n.Decode(&v)
+			return v, err
+		case "!!int", "!!float":
+			if json.Valid([]byte(n.Value)) {
+				return json.Number(n.Value), nil
+			}
+			// Such as 0x1F, 1_000 or .inf
+			var v any
+			if err := n.Decode(&v); err != nil {
+				return nil, err
+			}
+			if f, ok := v.(float64); ok && (math.IsInf(f, 0) || math.IsNaN(f)) {
+				return nil, fmt.Errorf("line %d: %s has no JSON equivalent", n.Line, n.Value)
+			}
+			return v, nil
+		}
+		return n.Value, nil
+	}
+	return nil, fmt.Errorf("line %d: unsupported YAML node", n.Line)
+}
@@ -0,0 +1,2690 @@
+-- PostgreSQL PL/pgSQL implementation surface for jd-sql (PL/pgSQL variant).
+--
+-- License: MIT
+-- This file is licensed under the MIT License. See the LICENSE file at
+-- github.com/deinspanjer/jd-sql/LICENSE for full license text.
+--
+-- Copyright (c) 2025 Daniel Einspanjer
+
+-- --------------------------------------------------------------------------------
+-- Drop existing objects (dev-friendly)
+-- --------------------------------------------------------------------------------
+do
+$$
+    begin
+        if exists (select 1
+                   from pg_type
+                   where typname = 'jd_diff_element') then
+            execute 'drop type jd_diff_element cascade';
+        end if;
+    end
+$$;
+do
+$$
+    begin
+        if exists (select 1
+                   from pg_type
+                   where typname = 'jd_metadata') then
+            execute 'drop type jd_metadata cascade';
+        end if;
+    end
+$$;
+do
+$$
+    begin
+        if exists (select 1
+                   from pg_type
+                   where typname = 'jd_option') then
+            execute 'drop domain jd_option cascade';
+        end if;
+    end
+$$;
+do
+$$
+    begin
+        if exists (select 1
+                   from pg_type
+                   where typname = 'jd_path') then
+            execute 'drop domain jd_path cascade';
+        end if;
+    end
+$$;
+do
+$$
+    begin
+        if exists (select 1
+                   from pg_type
+                   where typname = 'jd_patch') then
+            execute 'drop domain jd_patch cascade';
+        end if;
+    end
+$$;
+do
+$$
+    begin
+        if exists (select 1
+                   from pg_type
+                   where typname = 'jd_merge') then
+            execute 'drop domain jd_merge cascade';
+        end if;
+    end
+$$;
+do
+$$
+    begin
+        if exists (select 1
+                   from pg_type
+                   where typname = 'jd_diff_format') then
+            execute 'drop type jd_diff_format cascade';
+        end if;
+    end
+$$;
+
+-- --------------------------------------------------------------------------------
+-- Validators
+-- --------------------------------------------------------------------------------
+create or replace function _jd_validate_options(options jsonb) returns boolean
+    language plpgsql
+    immutable as
+$$
+begin
+    -- Initial milestone: be permissive; accept any JSON array as options.
+    if options is null then return false; end if;
+    return jsonb_typeof(options) = 'array';
+end
+$$;
+
+create or replace function _jd_validate_path(path jsonb) returns boolean
+    language plpgsql
+    immutable as
+$$
+declare
+    elem jsonb;
+    t    text;
+begin
+    if path is null or jsonb_typeof(path) <> 'array' then return false; end if;
+    for elem in select e from jsonb_array_elements(path) as z(e)
+        loop
+            t := jsonb_typeof(elem);
+            if t in ('string', 'number') then continue; end if;
+            if t = 'object' then continue; end if;
+            if t = 'array' then
+                if jsonb_array_length(elem) = 0 then continue; end if;
+                if jsonb_array_length(elem) = 1 and jsonb_typeof(elem -> 0) = 'object' then continue; end if;
+                return false;
+            end if;
+            return false;
+        end loop;
+    return true;
+end
+$$;
+
+create or replace function _jd_validate_rfc6902(patch jsonb) returns boolean
+    language plpgsql
+    immutable as
+$$
+declare
+    op jsonb;
+    o  text;
+begin
+    if patch is null or jsonb_typeof(patch) <> 'array' then return false; end if;
+    for op in select e from jsonb_array_elements(patch) as z(e)
+        loop
+            if jsonb_typeof(op) <> 'object' then return false; end if;
+            o := op ->> 'op';
+            if o not in ('add', 'remove', 'replace', 'move', 'copy', 'test') then return false; end if;
+            if (o in ('add', 'replace', 'test')) and not (op ? 'value') then return false; end if;
+            if not (op ? 'path') then return false; end if;
+        end loop;
+    return true;
+end
+$$;
+
+-- --------------------------------------------------------------------------------
+-- Domains and Types
+-- --------------------------------------------------------------------------------
+create domain jd_option as jsonb check (value is null or _jd_validate_options(value));
+create domain jd_path as jsonb check (value is null or _jd_validate_path(value));
+create domain jd_patch as jsonb check (value is null or _jd_validate_rfc6902(value));
+create domain jd_merge as jsonb check (value is null or jsonb_typeof(value) = 'object');
+
+-- diff format enum (Milestone 6)
+create type jd_diff_format as enum ('jd','patch','merge','jd2');
+
+create type jd_metadata as
+(
+    merge boolean
+);
+
+create type jd_diff_element as
+(
+    metadata jd_metadata,
+    options  jd_option,
+    path     jd_path,
+    before   jsonb[],
+    remove   jsonb[],
+    add      jsonb[],
+    after    jsonb[]
+);
+
+-- --------------------------------------------------------------------------------
+-- Helpers
+-- --------------------------------------------------------------------------------
+create or replace function _jd_render_json_compact(j jsonb) returns text
+    language plpgsql
+    immutable as
+$$
+declare
+    t   text;
+    out text;
+begin
+    -- normalize numbers: strip trailing .0 and zeros by casting to numeric then to text
+    if j is null then return 'null'; end if;
+    if jsonb_typeof(j) = 'number' then
+        t := j::text;
+        if position('.' in t) > 0 then t := rtrim(rtrim(t, '0'), '.'); end if;
+        return t;
+    end if;
+    -- For non-numbers, render compactly (no spaces after ':' or ',')
+    out := j::text;
+    out := replace(replace(out, ': ', ':'), ', ', ',');
+    return out;
+end
+$$;
+
+-- option helpers
+create or replace function _jd_option_has(options jd_option, name text) returns boolean
+    language sql
+    immutable as
+$$
+select exists (select 1
+               from jsonb_array_elements(coalesce($1, '[]'::jsonb)) as z(e)
+               where (jsonb_typeof(e) = 'string' and e::text = to_jsonb($2)::text)
+                  or (jsonb_typeof(e) = 'object' and (e ? lower($2) or e ? $2)))
+$$;
+
+create or replace function _jd_option_get_setkeys(options jd_option) returns text[]
+    language plpgsql
+    immutable as
+$$
+declare
+    e   jsonb;
+    out text[] := array []::text[];
+    arr jsonb;
+    i   int;
+begin
+    for e in select x from jsonb_array_elements(coalesce(options, '[]'::jsonb)) as t(x)
+        loop
+            if jsonb_typeof(e) = 'object' and (e ? 'setkeys') then
+                arr := e -> 'setkeys';
+                if jsonb_typeof(arr) = 'array' then
+                    i := 0;
+                    while i < jsonb_array_length(arr)
+                        loop
+                            out := out || (arr ->> i);
+                            i := i + 1;
+                        end loop;
+                end if;
+            end if;
+        end loop;
+    if array_length(out, 1) is null then return null; end if;
+    return out;
+end
+$$;
+
+-- Sort keys with the collation named by the jd_sql.collation setting (e.g. "C" for a
+-- byte order that is the same on every server), or the database default when unset.
+create or replace function _jd_sorted_keys(keys text[]) returns setof text
+    language plpgsql
+    stable as
+$$
+declare
+    coll text := nullif(current_setting('jd_sql.collation', true), '');
+begin
+    if coll is null then
+        return query select k from unnest(keys) as t(k) order by k;
+    else
+        return query execute format('select k from unnest($1) as t(k) order by k collate %I', coll) using keys;
+    end if;
+end
+$$;
+
+create or replace function _jd_object_identity(v jsonb, setkeys text[]) returns jsonb
+    language plpgsql
+    immutable as
+$$
+declare
+    ident jsonb := '{}'::jsonb;
+    k     text;
+begin
+    if v is null or jsonb_typeof(v) <> 'object' then return null; end if;
+    if setkeys is null or array_length(setkeys, 1) is null then return null; end if;
+    -- ensure deterministic key order: sort keys lexicographically
+    for k in select keyname from unnest(setkeys) as t(keyname) order by 1
+        loop
+            ident := jsonb_set(ident, array [k], v -> k, true);
+        end loop;
+    return ident;
+end
+$$;
+
+create or replace function _jd_array_key(v jsonb, setkeys text[]) returns text
+    language plpgsql
+    immutable as
+$$
+declare
+    ident jsonb;
+begin
+    if setkeys is not null and jsonb_typeof(v) = 'object' then
+        ident := _jd_object_identity(v, setkeys);
+        return ident::text;
+    else
+        return v::text;
+    end if;
+end
+$$;
+
+-- Path helpers for DIFF_ON/DIFF_OFF path gating
+create or replace function _jd_path_is_prefix(prefix jsonb, path jsonb) returns boolean
+    language plpgsql
+    immutable as
+$$
+declare
+    lp int;
+    l  int;
+    i  int := 0;
+begin
+    if prefix is null or jsonb_typeof(prefix) <> 'array' then return false; end if;
+    if path is null or jsonb_typeof(path) <> 'array' then return false; end if;
+    lp := jsonb_array_length(prefix); l := jsonb_array_length(path);
+    if lp > l then return false; end if;
+    while i < lp
+        loop
+            if (prefix -> i) is distinct from (path -> i) then return false; end if;
+            i := i + 1;
+        end loop;
+    return true;
+end
+$$;
+
+-- Compute effective options for a given path by combining global options
+-- with path-scoped directives that apply to cur_path. Excludes DIFF_ON/OFF.
+create or replace function _jd_effective_options(options jd_option, cur_path jd_path) returns jd_option
+    language plpgsql
+    immutable as
+$$
+declare
+    e   jsonb;
+    out jsonb := '[]'::jsonb;
+    dir jsonb;
+    atp jsonb;
+    d   jsonb;
+begin
+    if options is null or jsonb_typeof(options) <> 'array' then return '[]'::jsonb; end if;
+    -- global entries (no '@'/'^')
+    for e in select x from jsonb_array_elements(options) as t(x)
+        loop
+            if jsonb_typeof(e) = 'string' then
+                if e::text in ('"SET"', '"MULTISET"', '"MERGE"') then out := out || jsonb_build_array(e); end if;
+            elsif jsonb_typeof(e) = 'object' then
+                if (not (e ? '@') and not (e ? '^')) then
+                    if (e ? 'setkeys') or (e ? 'precision') then out := out || jsonb_build_array(e); end if;
+                end if;
+            end if;
+        end loop;
+    -- path-scoped directives
+    for e in select x from jsonb_array_elements(options) as t(x)
+        loop
+            if jsonb_typeof(e) = 'object' and (e ? '@') and (e ? '^') then
+                atp := e -> '@'; dir := e -> '^';
+                if jsonb_typeof(atp) = 'array' and jsonb_typeof(dir) = 'array' then
+                    if _jd_path_is_prefix(atp, coalesce(cur_path, '[]'::jsonb)) then
+                        for d in select x from jsonb_array_elements(dir) as t2(x)
+                            loop
+                                if jsonb_typeof(d) = 'string' then
+                                    if d::text in ('"SET"', '"MULTISET"', '"MERGE"') then
+                                        out := out || jsonb_build_array(d);
+                                    end if; -- ignore DIFF_ON/OFF
+                                elsif jsonb_typeof(d) = 'object' then
+                                    if (d ? 'setkeys') or (d ? 'precision') then
+                                        out := out || jsonb_build_array(d);
+                                    end if;
+                                end if;
+                            end loop;
+                    end if;
+                end if;
+            end if;
+        end loop;
+    return out;
+end
+$$;
+
+create or replace function _jd_diff_allowed(cur_path jd_path, options jd_option) returns boolean
+    language plpgsql
+    immutable as
+$$
+declare
+    e         jsonb;
+    atp       jsonb;
+    dir       jsonb;
+    on_depth  int     := null;
+    off_depth int     := null;
+    depth     int;
+    on_any    boolean := false;
+begin
+    -- Default allow when no gating options present
+    if options is null or jsonb_typeof(options) <> 'array' then return true; end if;
+    for e in select x from jsonb_array_elements(options) as t(x)
+        loop
+            if jsonb_typeof(e) = 'object' and (e ? '@') and (e ? '^') then
+                atp := e -> '@'; dir := e -> '^';
+                if jsonb_typeof(atp) = 'array' and jsonb_typeof(dir) = 'array' then
+                    -- track presence of any DIFF_ON directives globally
+                    if exists(select 1
+                              from jsonb_array_elements(dir) d0(x)
+                              where jsonb_typeof(d0.x) = 'string' and (d0.x::text) = '"DIFF_ON"') then
+                        on_any := true;
+                    end if;
+                    if _jd_path_is_prefix(atp, coalesce(cur_path, '[]'::jsonb)) then
+                        depth := jsonb_array_length(atp);
+                        -- scan directives for DIFF_ON/OFF
+                        if exists(select 1 from jsonb_array_elements(dir) d(x) where jsonb_typeof(d.x) = 'string'
+                                                                                 and (d.x::text) = '"DIFF_ON"') then
+                            if on_depth is null or depth > on_depth then on_depth := depth; end if;
+                        end if;
+                        if exists(select 1 from jsonb_array_elements(dir) d2(x) where jsonb_typeof(d2.x) = 'string'
+                                                                                  and (d2.x::text) = '"DIFF_OFF"') then
+                            if off_depth is null or depth > off_depth then off_depth := depth; end if;
+                        end if;
+                    end if;
+                end if;
+            end if;
+        end loop;
+    -- If any DIFF_ON directive exists globally, enforce allowlist semantics:
+    -- only paths under a DIFF_ON-prefixed entry are allowed unless also explicitly turned off deeper.
+    if on_any and on_depth is null then
+        -- No matching DIFF_ON prefix for this path; suppress it regardless of DIFF_OFF
+        return false;
+    end if;
+    if on_depth is not null then return true; end if;
+    if off_depth is not null then return false; end if;
+    return true;
+end
+$$;
+
+-- --------------------------------------------------------------------------------
+-- Public API (struct-first)
+-- --------------------------------------------------------------------------------
+
+create or replace function _jd_option_get_precision(options jd_option) returns numeric
+    language plpgsql
+    immutable as
+$$
+declare
+    e jsonb;
+    p jsonb;
+begin
+    for e in select x from jsonb_array_elements(coalesce(options, '[]'::jsonb)) as t(x)
+        loop
+            if jsonb_typeof(e) = 'object' and (e ? 'precision') then
+                p := e -> 'precision';
+                if p is null then continue; end if;
+                if jsonb_typeof(p) = 'number' then return (p::text)::numeric; end if;
+            end if;
+        end loop;
+    return null;
+end
+$$;
+
+create or replace function _jd_numbers_equal(a jsonb, b jsonb, tol numeric) returns boolean
+    language plpgsql
+    immutable as
+$$
+declare
+    av      numeric;
+    bv      numeric;
+    eff_tol numeric;
+begin
+    if jsonb_typeof(a) <> 'number' or jsonb_typeof(b) <> 'number' then return null; end if;
+    av := (a::text)::numeric; bv := (b::text)::numeric;
+    -- Default tolerance to a small epsilon to smooth floating-point textual variants
+    eff_tol := coalesce(tol, 1e-15);
+    if eff_tol = 0 then return av = bv; end if;
+    return abs(av - bv) <= eff_tol;
+end
+$$;
+
+create or replace function _jd_json_equal(a jsonb, b jsonb, options jd_option) returns boolean
+    language plpgsql
+    immutable as
+$$
+declare
+begin
+    if a is null and b is null then return true; end if;
+    if a is null or b is null then return false; end if;
+    if jsonb_typeof(a) = 'number' and jsonb_typeof(b) = 'number' then
+        return _jd_numbers_equal(a, b, _jd_option_get_precision(options));
+    end if;
+    return a is not distinct from b;
+end
+$$;
+
+-- Whether a and b have no diff under options, without building the diff when it can be
+-- avoided: equal values never differ, and without options nothing but jsonb equality
+-- can make them equal. Only the remaining case (options such as SET or precision that
+-- may equate different values) walks the structural diff.
+create or replace function jd_equal(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns boolean
+    language plpgsql
+    stable as
+$$
+begin
+    if a is null or b is null then return a is null and b is null; end if;
+    if a = b then return true; end if;
+    if options is null or options = '[]'::jsonb then return false; end if;
+    return not exists (select 1 from jd_diff_struct(a, b, options));
+end
+$$;
+
+-- Canonical text of a document for jd_canonical_hash: object keys sorted bytewise, no
+-- whitespace, and numbers without trailing fractional zeros, so documents that are
+-- equal as jsonb have the same text.
+create or replace function _jd_canonical_text(value jsonb) returns text
+    language plpgsql
+    immutable as
+$$
+declare
+    n text;
+begin
+    case jsonb_typeof(value)
+        when 'object' then
+            return '{' || coalesce((select string_agg(to_jsonb(e.key)::text || ':' || _jd_canonical_text(e.value), ','
+                                                      order by e.key collate "C")
+                                    from jsonb_each(value) e), '') || '}';
+        when 'array' then
+            return '[' || coalesce((select string_agg(_jd_canonical_text(e.value), ',' order by e.ord)
+                                    from jsonb_array_elements(value) with ordinality e(value, ord)), '') || ']';
+        when 'number' then
+            n := value::numeric::text;
+            if position('.' in n) > 0 then
+                n := rtrim(rtrim(n, '0'), '.');
+            end if;
+            return n;
+        else
+            return value::text;
+        end case;
+end
+$$;
+
+-- Canonical form of value as compact JSON text (see _jd_canonical_text).
+create or replace function jd_canonicalize(value jsonb) returns text
+    language sql
+    immutable as
+$$
+select _jd_canonical_text($1)
+$$;
+
+-- Hex SHA-256 of the canonical text of value. Documents that are equal as jsonb have
+-- the same hash; different hashes mean a non-empty diff when no options are given.
+create or replace function jd_canonical_hash(value jsonb) returns text
+    language sql
+    immutable as
+$$
+select encode(sha256(convert_to(_jd_canonical_text($1), 'UTF8')), 'hex')
+$$;
+
+-- Internal recursive helper with explicit path
+create or replace function _jd_diff_struct(a jsonb, b jsonb, cur_path jd_path, options jd_option, debug bool default false) returns setof jd_diff_element
+    language plpgsql
+    stable as
+$$
+declare
+    elem     jd_diff_element;
+    k        text;
+    la       int;
+    lb       int;
+    i        int;
+    p        int;
+    s        int;
+    wa       int;
+    wb       int;
+    loc_opts jd_option := _jd_effective_options(options, cur_path);
+    is_merge boolean := null; -- effective MERGE option at current path
+begin
+    if debug then
+        raise debug 'jd_diff_struct(%, %, %, %); eq?=%; eff_opts=%', a, b, cur_path, options, _jd_json_equal(a, b, loc_opts), loc_opts;
+    end if;
+    -- cache effective merge flag for this path
+    is_merge := _jd_option_has(loc_opts, 'MERGE');
+    if _jd_json_equal(a, b, loc_opts) then return; end if;
+
+    -- Handle void (SQL NULL) on either side as add-only or remove-only at current path
+    if a is null or b is null then
+        if debug then
+            if a is null then
+                raise debug 'null-handling at %: a is null, add b', coalesce(cur_path, '[]'::jsonb);
+            elsif b is null then
+                raise debug 'null-handling at %: b is null, remove a', coalesce(cur_path, '[]'::jsonb);
+            end if;
+        end if;
+        elem.metadata := row (is_merge)::jd_metadata;
+        elem.options := coalesce(options, '[]'::jsonb);
+        elem.path := coalesce(cur_path, '[]'::jsonb);
+        elem.before := null;
+        if a is null then
+            elem.remove := null;
+            elem.add := array [b];
+        elsif b is null then
+            elem.remove := array [a];
+            elem.add := null;
+        end if;
+        elem.after := null;
+        return next elem;
+        return;
+    end if;
+
+    if jsonb_typeof(a) = 'object' and jsonb_typeof(b) = 'object' then
+        if debug then
+            raise debug 'object branch at %', coalesce(cur_path, '[]'::jsonb);
+        end if;
+        -- removals (emit first)
+        if debug then
+            raise debug 'object removals at %', coalesce(cur_path, '[]'::jsonb);
+        end if;
+        for k in select key
+                 from (select key
+                       from jsonb_object_keys(a) as key
+                       except
+                       select key
+                       from jsonb_object_keys(b) as key) s
+                 order by 1
+            loop
+                if debug then
+                    raise debug ' - remove key %', k;
+                end if;
+                elem.metadata := row (is_merge)::jd_metadata;
+                elem.options := coalesce(options, '[]'::jsonb);
+                elem.path := coalesce(cur_path, '[]'::jsonb) || jsonb_build_array(to_jsonb(k));
+                elem.before := null;
+                elem.remove := array [a -> k];
+                elem.add := null;
+                elem.after := null;
+                return next elem;
+            end loop;
+
+        -- replacements or nested diffs (emit second)
+        if debug then
+            raise debug 'object common keys (recurse/replace) at %', coalesce(cur_path, '[]'::jsonb);
+        end if;
+        for k in select key
+                 from (select key
+                       from jsonb_object_keys(a) as key
+                       intersect
+                       select key
+                       from jsonb_object_keys(b) as key) s
+                 order by 1
+            loop
+                declare
+                    child_path jsonb     := coalesce(cur_path, '[]'::jsonb) || jsonb_build_array(to_jsonb(k));
+                    child_opts jd_option := _jd_effective_options(options, child_path);
+                    child_is_merge boolean := _jd_option_has(child_opts, 'MERGE');
+                begin
+                    if ((jsonb_typeof(a -> k) = 'object' and jsonb_typeof(b -> k) = 'object') or
+                        (jsonb_typeof(a -> k) = 'array' and jsonb_typeof(b -> k) = 'array')) then
+                        -- Recurse; deeper level will use its own effective options for equality
+                        if debug then
+                            raise debug ' - recurse into %', child_path;
+                        end if;
+                        return query select * from _jd_diff_struct(a -> k, b -> k, child_path, options, debug);
+                    else
+                        -- Scalars or differing types: decide using child-specific options (e.g., precision)
+                        if not _jd_json_equal(a -> k, b -> k, child_opts) then
+                            if debug then
+                                raise debug ' - replace scalar at % (opts=%)', child_path, child_opts;
+                            end if;
+                            elem.metadata := row (child_is_merge)::jd_metadata;
+                            elem.options := coalesce(options, '[]'::jsonb);
+                            elem.path := child_path;
+                            elem.before := null;
+                            elem.remove := array [a -> k];
+                            elem.add := array [b -> k];
+                            elem.after := null;
+                            return next elem;
+                        end if;
+                    end if;
+                end;
+            end loop;
+
+        -- additions (emit last)
+        if debug then
+            raise debug 'object additions at %', coalesce(cur_path, '[]'::jsonb);
+        end if;
+        for k in select key
+                 from (select key
+                       from jsonb_object_keys(b) as key
+                       except
+                       select key
+                       from jsonb_object_keys(a) as key) s
+                 order by 1
+            loop
+                if debug then
+                    raise debug ' - add key %', k;
+                end if;
+                elem.metadata := row (is_merge)::jd_metadata;
+                elem.options := coalesce(options, '[]'::jsonb);
+                elem.path := coalesce(cur_path, '[]'::jsonb) || jsonb_build_array(to_jsonb(k));
+                elem.before := null;
+                elem.remove := null;
+                elem.add := array [b -> k];
+                elem.after := null;
+                return next elem;
+            end loop;
+        return;
+    end if;
+
+    if jsonb_typeof(a) = 'array' and jsonb_typeof(b) = 'array' then
+        if debug then
+            raise debug 'array branch at % (opts=%)', coalesce(cur_path, '[]'::jsonb), loc_opts;
+        end if;
+        -- If MERGE semantics are enabled at this path, arrays are replaced wholesale
+        if _jd_option_has(loc_opts, 'MERGE') then
+            if debug then
+                raise debug 'array MERGE at %', coalesce(cur_path, '[]'::jsonb);
+            end if;
+            elem.metadata := row (is_merge)::jd_metadata; -- mark merge semantics awareness
+            elem.options := coalesce(options, '[]'::jsonb);
+            elem.path := coalesce(cur_path, '[]'::jsonb);
+            elem.before := null;
+            elem.remove := null;
+            elem.add := array [b];
+            elem.after := null;
+            return next elem;
+            return;
+        end if;
+
+        -- Option: SET/MULTISET or setkeys for arrays
+        if _jd_option_has(loc_opts, 'MULTISET') or _jd_option_has(loc_opts, 'SET') or
+           _jd_option_get_setkeys(loc_opts) is not null then
+            -- Handle arrays as sets/multisets; for setkeys, treat objects by identity
+            declare
+                is_multi boolean := _jd_option_has(loc_opts, 'MULTISET');
+                setkeys  text[]  := _jd_option_get_setkeys(loc_opts);
+                ah       jsonb;
+                bh       jsonb; -- element during iteration
+                hkey     text; -- hash key
+                -- maps stored as temporary jsonb objects mapping key->count or key->jsonb element
+                amap     jsonb   := '{}'::jsonb;
+                bmap     jsonb   := '{}'::jsonb;
+                counts   boolean := is_multi; -- whether to track counts
+            begin
+                if debug then
+                    raise debug 'array set-mode at %: mode=%, setkeys=%', coalesce(cur_path, '[]'::jsonb), case when counts then 'MULTISET' else 'SET' end, setkeys;
+                end if;
+                -- build amap
+                i := 0; la := coalesce(jsonb_array_length(a), 0);
+                while i < la
+                    loop
+                        ah := a -> i; hkey := _jd_array_key(ah, setkeys);
+                        if counts then
+                            if (amap ? hkey) then
+                                amap := jsonb_set(amap, array [hkey], to_jsonb(((amap ->> hkey)::int + 1)), true);
+                            else
+                                amap := jsonb_set(amap, array [hkey], to_jsonb(1), true);
+                            end if;
+                        else
+                            -- preserve first occurrence for representative when duplicates exist
+                            if not (amap ? hkey) then amap := jsonb_set(amap, array [hkey], ah, true); end if;
+                        end if;
+                        i := i + 1;
+                    end loop;
+                -- build bmap
+                i := 0; lb := coalesce(jsonb_array_length(b), 0);
+                while i < lb
+                    loop
+                        bh := b -> i; hkey := _jd_array_key(bh, setkeys);
+                        if counts then
+                            if (bmap ? hkey) then
+                                bmap := jsonb_set(bmap, array [hkey], to_jsonb(((bmap ->> hkey)::int + 1)), true);
+                            else
+                                bmap := jsonb_set(bmap, array [hkey], to_jsonb(1), true);
+                            end if;
+                        else
+                            if not (bmap ? hkey) then bmap := jsonb_set(bmap, array [hkey], bh, true); end if;
+                        end if;
+                        i := i + 1;
+                    end loop;
+                if debug then
+                    raise debug 'built maps at %: |A|=%, |B|=%', coalesce(cur_path, '[]'::jsonb), la, lb;
+                end if;
+
+                -- For setkeys and objects present in both, recurse into changed objects
+                if setkeys is not null then
+                    for hkey in select _jd_sorted_keys(array(select key
+                                                             from jsonb_object_keys(amap) as key
+                                                             intersect
+                                                             select key
+                                                             from jsonb_object_keys(bmap) as key))
+                        loop
+                            ah := amap -> hkey; bh := bmap -> hkey;
+                            -- when counts, value is count. fetch real objects from original arrays by searching first match
+                            if counts then
+                                -- find representative objects for this key from arrays
+                                ah := null; bh := null;
+                                i := 0;
+                                while i < la and ah is null
+                                    loop
+                                        if _jd_array_key(a -> i, setkeys) = hkey then ah := a -> i; end if; i := i + 1;
+                                    end loop;
+                                i := 0;
+                                while i < lb and bh is null
+                                    loop
+                                        if _jd_array_key(b -> i, setkeys) = hkey then bh := b -> i; end if; i := i + 1;
+                                    end loop;
+                            end if;
+                            -- For identity-matched objects, emit shallow field replacements for differing scalar fields
+                            if ah is distinct from bh then
+                                declare
+                                    kk    text;
+                                    aval  jsonb;
+                                    bval  jsonb;
+                                    ipath jsonb := coalesce(cur_path, '[]'::jsonb) ||
+                                                   jsonb_build_array(_jd_object_identity(ah, setkeys));
+                                begin
+                                    if debug then
+                                        raise debug 'identity match at % key %, checking scalar fields', ipath, hkey;
+                                    end if;
+                                    for kk in select _jd_sorted_keys(array(select key
+                                                                           from jsonb_object_keys(ah) as key
+                                                                           union
+                                                                           select key
+                                                                           from jsonb_object_keys(bh) as key))
+                                        loop
+                                            aval := ah -> kk; bval := bh -> kk;
+                                            if aval is null or bval is null then
+                                                -- additions/removals at fields are not required by current edge case; skip to keep scope tight
+                                                continue;
+                                            end if;
+                                            if jsonb_typeof(aval) <> 'object' and jsonb_typeof(aval) <> 'array' and
+                                               jsonb_typeof(bval) <> 'object' and
+                                               jsonb_typeof(bval) <> 'array' and
+                                               not _jd_json_equal(aval, bval, loc_opts) then
+                                                if debug then
+                                                    raise debug ' - field replace at %/%', ipath, kk;
+                                                end if;
+                                                -- compute effective options for the field path and set merge accordingly
+                                                declare
+                                                    fld_path jsonb := ipath || jsonb_build_array(to_jsonb(kk));
+                                                    fld_opts jd_option := _jd_effective_options(options, fld_path);
+                                                    fld_is_merge boolean := _jd_option_has(fld_opts, 'MERGE');
+                                                begin
+                                                    elem :=
+                                                        row (row (fld_is_merge)::jd_metadata, coalesce(options, '[]'::jsonb), fld_path, null, array [aval], array [bval], null);
+                                                    return next elem; elem := null;
+                                                end;
+                                            end if;
+                                        end loop;
+                                end;
+                            end if;
+                        end loop;
+                    -- handle multiplicity for setkeys: remove extra duplicates in A beyond presence in B
+                    declare
+                        countsA jsonb := '{}'::jsonb;
+                        ca      int;
+                        cb      int;
+                        need    int;
+                    begin
+                        -- build counts in A by identity key
+                        i := 0;
+                        while i < la
+                            loop
+                                hkey := _jd_array_key(a -> i, setkeys);
+                                if (countsA ? hkey) then
+                                    countsA := jsonb_set(countsA, array [hkey], to_jsonb(((countsA ->> hkey)::int + 1)),
+                                                         true);
+                                else
+                                    countsA := jsonb_set(countsA, array [hkey], to_jsonb(1), true);
+                                end if;
+                                i := i + 1;
+                            end loop;
+                        for hkey in select key from jsonb_object_keys(countsA) as key
+                            loop
+                                ca := (countsA ->> hkey)::int;
+                                cb := case when (bmap ? hkey) then 1 else 0 end; -- presence only for set semantics
+                                need := ca - cb;
+                                if need > 0 then
+                                    if debug then
+                                        raise debug ' - multiplicity trim at % key %: removing % extra', coalesce(cur_path, '[]'::jsonb), hkey, need;
+                                    end if;
+                                    -- remove from the end to match expected index positions
+                                    i := la - 1;
+                                    while i >= 0 and need > 0
+                                        loop
+                                            if _jd_array_key(a -> i, setkeys) = hkey then
+                                                elem :=
+                                                        row (row (is_merge)::jd_metadata, coalesce(options, '[]'::jsonb), coalesce(cur_path, '[]'::jsonb) || jsonb_build_array(to_jsonb(i)), null, array [a -> i], null, null);
+                                                return next elem; elem := null;
+                                                need := need - 1;
+                                            end if;
+                                            i := i - 1;
+                                        end loop;
+                                end if;
+                            end loop;
+                    end;
+                    return; -- completed setkeys handling
+                end if;
+
+                -- For MULTISET (bag) or pure SET of scalars (no setkeys), emit removals/additions here and return.
+                if counts or setkeys is null then
+                    if debug then
+                        raise debug 'set/multiset scalar handling at %', coalesce(cur_path, '[]'::jsonb);
+                    end if;
+                    elem.metadata := row (is_merge)::jd_metadata;
+                    elem.options := coalesce(options, '[]'::jsonb);
+                    -- path segment differs for SET vs MULTISET
+                    if counts then
+                        elem.path := coalesce(cur_path, '[]'::jsonb) || jsonb_build_array('[]'::jsonb);
+                    else
+                        elem.path := coalesce(cur_path, '[]'::jsonb) || jsonb_build_array('{}'::jsonb);
+                    end if;
+                    elem.before := null; elem.after := null; elem.remove := null; elem.add := null;
+
+                    -- removals
+                    for hkey in select _jd_sorted_keys(array(select jsonb_object_keys(amap)))
+                        loop
+                            if counts then
+                                declare
+                                    ca  int := (amap ->> hkey)::int;
+                                    cb  int := coalesce((bmap ->> hkey)::int, 0);
+                                    j   int;
+                                    val jsonb;
+                                begin
+                                    if ca > cb then
+                                        -- recover value to output
+                                        val := null;
+                                        if setkeys is not null then
+                                            i := 0;
+                                            while i < la and val is null
+                                                loop
+                                                    if _jd_array_key(a -> i, setkeys) = hkey then val := a -> i; end if;
+                                                    i := i + 1;
+                                                end loop;
+                                        else
+                                            -- for scalars, key is value::text; rebuild by casting text to jsonb
+                                            val := (hkey)::jsonb; -- hkey is text-form JSON
+                                        end if;
+                                        j := 1;
+                                        while j <= (ca - cb)
+                                            loop
+                                                if elem.remove is null then
+                                                    elem.remove := array [val];
+                                                else
+                                                    elem.remove := array_cat(elem.remove, array [val]);
+                                                end if;
+                                                j := j + 1;
+                                            end loop;
+                                    end if;
+                                end;
+                            else
+                                if not (bmap ? hkey) then
+                                    -- set scalar removal, collect under [] path
+                                    if elem.remove is null then
+                                        elem.remove := array [(hkey)::jsonb];
+                                    else
+                                        elem.remove := array_cat(elem.remove, array [(hkey)::jsonb]);
+                                    end if;
+                                end if;
+                            end if;
+                        end loop;
+
+                    -- additions
+                    for hkey in select _jd_sorted_keys(array(select jsonb_object_keys(bmap)))
+                        loop
+                            if counts then
+                                declare
+                                    ca  int := coalesce((amap ->> hkey)::int, 0);
+                                    cb  int := (bmap ->> hkey)::int;
+                                    j   int;
+                                    val jsonb;
+                                begin
+                                    if cb > ca then
+                                        val := null;
+                                        if setkeys is not null then
+                                            i := 0;
+                                            while i < lb and val is null
+                                                loop
+                                                    if _jd_array_key(b -> i, setkeys) = hkey then val := b -> i; end if;
+                                                    i := i + 1;
+                                                end loop;
+                                        else
+                                            val := (hkey)::jsonb;
+                                        end if;
+                                        j := 1;
+                                        while j <= (cb - ca)
+                                            loop
+                                                if elem.add is null then
+                                                    elem.add := array [val];
+                                                else
+                                                    elem.add := array_cat(elem.add, array [val]);
+                                                end if; j := j + 1;
+                                            end loop;
+                                    end if;
+                                end;
+                            else
+                                if not (amap ? hkey) then
+                                    if elem.add is null then
+                                        elem.add := array [(hkey)::jsonb];
+                                    else
+                                        elem.add := array_cat(elem.add, array [(hkey)::jsonb]);
+                                    end if;
+                                end if;
+                            end if;
+                        end loop;
+
+                    -- emit combined hunk if present
+                    if elem.path is not null and (elem.remove is not null or elem.add is not null) then
+                        if debug then
+                            raise debug 'emit set/multiset hunk at % (remove=% add=%)', elem.path, coalesce(array_length(elem.remove,1),0), coalesce(array_length(elem.add,1),0);
+                        end if;
+                        return next elem;
+                    end if;
+                    return;
+                end if;
+                -- When setkeys are present (set of objects) we defer multiplicity changes to index-based diff.
+            end;
+        end if;
+
+        -- index-based array diff with common prefix/suffix trimming
+        -- When setkeys are active, all handling is done above; do not fall through to index window logic
+        if _jd_option_get_setkeys(loc_opts) is not null then return; end if;
+        la := coalesce(jsonb_array_length(a), 0);
+        lb := coalesce(jsonb_array_length(b), 0);
+        p := 0;
+        -- common prefix
+        while p < least(la, lb)
+            loop
+                if not _jd_json_equal(a -> p, b -> p, loc_opts) then exit; end if;
+                p := p + 1;
+            end loop;
+        -- common suffix (avoid overlap with prefix)
+        -- When setkeys are active, avoid suffix trimming so trailing multiplicity changes become explicit removals/additions.
+        if _jd_option_get_setkeys(loc_opts) is null then
+            s := 0; i := 0;
+            while (p + s) < la and (p + s) < lb
+                loop
+                    if not _jd_json_equal(a -> (la - 1 - i), b -> (lb - 1 - i), loc_opts) then exit; end if;
+                    s := s + 1; i := i + 1;
+                end loop;
+        else
+            s := 0;
+        end if;
+
+        wa := la - p - s; -- window size in a
+        wb := lb - p - s; -- window size in b
+
+        if wa = 0 and wb = 0 then
+            return; -- arrays equal (should have been caught earlier)
+        end if;
+
+        if debug then
+            raise debug 'array window at %: p=% s=% wa=% wb=%', coalesce(cur_path, '[]'::jsonb), p, s, wa, wb;
+        end if;
+
+        -- Emit a single hunk for the changed window at index p with context before/after
+        elem.metadata := row (is_merge)::jd_metadata;
+        elem.options := coalesce(options, '[]'::jsonb);
+        elem.path := coalesce(cur_path, '[]'::jsonb) || jsonb_build_array(to_jsonb(p));
+
+        -- before context: omit context when setkeys are active; otherwise include previous or OPEN marker
+        if _jd_option_get_setkeys(loc_opts) is not null then
+            elem.before := null;
+        else
+            if p > 0 then
+                elem.before := array [a -> (p - 1)];
+            else
+                elem.before := array [to_jsonb('__OPEN__'::text)];
+            end if;
+        end if;
+
+        -- window removals (all elements in a's window, in order)
+        if wa > 0 then
+            elem.remove := null; -- build incrementally
+            i := p;
+            while i <= (p + wa - 1)
+                loop
+                    if elem.remove is null or array_length(elem.remove, 1) is null then
+                        elem.remove := array [a -> i];
+                    else
+                        elem.remove := array_cat(elem.remove, array [a -> i]);
+                    end if;
+                    i := i + 1;
+                end loop;
+        else
+            elem.remove := null;
+        end if;
+
+        -- window additions (all elements in b's window, in order)
+        if wb > 0 then
+            elem.add := null;
+            i := p;
+            while i <= (p + wb - 1)
+                loop
+                    if elem.add is null or array_length(elem.add, 1) is null then
+                        elem.add := array [b -> i];
+                    else
+                        elem.add := array_cat(elem.add, array [b -> i]);
+                    end if;
+                    i := i + 1;
+                end loop;
+        else
+            elem.add := null;
+        end if;
+
+        -- after context: omit when setkeys are active; else include next element or CLOSE marker
+        if _jd_option_get_setkeys(loc_opts) is not null then
+            elem.after := null;
+        else
+            if s > 0 then
+                elem.after := array [a -> (la - s)];
+            else
+                elem.after := array [to_jsonb('__CLOSE__'::text)];
+            end if;
+        end if;
+
+        return next elem;
+        return;
+    end if;
+
+    -- Fallback: single hunk at current path
+    if debug then
+        raise debug 'fallback hunk at %', coalesce(cur_path, '[]'::jsonb);
+    end if;
+    elem.metadata := row (is_merge)::jd_metadata;
+    elem.options := coalesce(options, '[]'::jsonb);
+    elem.path := coalesce(cur_path, '[]'::jsonb);
+    elem.before := null;
+    elem.remove := array [a];
+    elem.add := array [b];
+    elem.after := null;
+    return next elem;
+end
+$$;
+
+create or replace function jd_diff_struct(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns setof jd_diff_element
+    language plpgsql
+    stable as
+$$
+declare
+    opt jd_option := options;
+begin
+    return query select * from _jd_diff_struct(a, b, '[]'::jsonb, opt) d where _jd_diff_allowed(d.path, opt);
+end
+$$;
+
+create or replace function jd_render_diff_text(diff_elements jd_diff_element[],
+                                               options jd_option default '[]'::jsonb) returns text
+    language plpgsql
+    stable as
+$$
+declare
+    out       text := '';
+    i         int  := 1;
+    n         int  := coalesce(array_length(diff_elements, 1), 0);
+    e         jd_diff_element;
+    v         jsonb;
+    path_text text;
+    opt       jsonb;
+    seg       jsonb;
+    j         int;
+begin
+    -- if no diffs, return empty string (no headers)
+    if n = 0 then return ''; end if;
+    -- render option header lines if provided and there are diffs
+    if options is not null and jsonb_typeof(options) = 'array' and jsonb_array_length(options) > 0 then
+        for opt in select x from jsonb_array_elements(options) as t(x)
+            loop
+                out := out || '^ ' || _jd_render_json_compact(opt) || E'\n';
+            end loop;
+    end if;
+    while i <= n
+        loop
+            e := diff_elements[i];
+            -- render path compactly using compact segment renderer
+            if e.path is null or jsonb_typeof(e.path) <> 'array' then
+                path_text := '[]';
+            else
+                path_text := '[';
+                j := 0;
+                while j < jsonb_array_length(e.path)
+                    loop
+                        seg := e.path -> j;
+                        if j > 0 then path_text := path_text || ','; end if;
+                        path_text := path_text || _jd_render_json_compact(seg);
+                        j := j + 1;
+                    end loop;
+                path_text := path_text || ']';
+            end if;
+            out := out || '@ ' || path_text || E'\n';
+            -- optional context before
+            if e.before is not null then
+                foreach v in array e.before
+                    loop
+                        if v = to_jsonb('__OPEN__'::text) then
+                            out := out || E'[\n';
+                        else
+                            out := out || '  ' || _jd_render_json_compact(v) || E'\n';
+                        end if;
+                    end loop;
+            end if;
+            if e.remove is not null then
+                foreach v in array e.remove
+                    loop
+                        out := out || '- ' || _jd_render_json_compact(v) || E'\n';
+                    end loop;
+            end if;
+            if e.add is not null then
+                foreach v in array e.add
+                    loop
+                        out := out || '+ ' || _jd_render_json_compact(v) || E'\n';
+                    end loop;
+            end if;
+            -- optional context after
+            if e.after is not null then
+                foreach v in array e.after
+                    loop
+                        if v = to_jsonb('__CLOSE__'::text) then
+                            out := out || E']\n';
+                        else
+                            out := out || '  ' || _jd_render_json_compact(v) || E'\n';
+                        end if;
+                    end loop;
+            end if;
+            i := i + 1;
+        end loop;
+    return out;
+end
+$$;
+
+create or replace function jd_diff_text(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns text
+    language plpgsql
+    stable as
+$$
+declare
+    elems jd_diff_element[];
+begin
+    select array_agg(d) into elems from jd_diff_struct(a, b, options) as d;
+    if elems is null or array_length(elems, 1) is null then return ''; end if;
+    return jd_render_diff_text(elems, options);
+end
+$$;
+
+-- Milestone 6: format-aware diff wrapper
+create or replace function jd_diff(a jsonb, b jsonb, options jd_option,
+                                   format jd_diff_format default 'jd') returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    t text;
+begin
+    if format in ('jd', 'jd2') then
+        t := jd_diff_text(a, b, options);
+        return to_jsonb(t);
+    elsif format = 'patch' then
+        return jd_diff_patch(a, b, options);
+    elsif format = 'merge' then
+        return jd_diff_merge(a, b, options);
+    else
+        raise exception 'jd_diff: unknown format %', format;
+    end if;
+end
+$$;
+
+-- Note: Only 4-arg jd_diff(a,b,options,format) is supported from Milestone 6 onward.
+
+-- jd_diff of the values at path in a and b. The values are extracted with #> and diffed
+-- starting from path, so every path of the diff is prefixed with it and the diff applies
+-- to the whole documents. A path missing from a document is diffed as a missing value.
+create or replace function jd_diff_at(a jsonb, b jsonb, path jd_path, options jd_option,
+                                      format jd_diff_format default 'jd') returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    keys  text[] := array(select e #>> '{}' from jsonb_array_elements(path) as z(e));
+    opt   jd_option := coalesce(options, '[]'::jsonb);
+    elems jd_diff_element[];
+begin
+    if path is null or path = '[]'::jsonb then return jd_diff(a, b, options, format); end if;
+    if exists (select 1 from jsonb_array_elements(path) as z(e) where jsonb_typeof(e) not in ('string', 'number')) then
+        raise exception 'jd_diff_at: path must hold only object keys and array indexes: %', path;
+    end if;
+    if format = 'merge' then opt := opt || '["MERGE"]'::jsonb; end if;
+    select array_agg(d) into elems
+    from _jd_diff_struct(a #> keys, b #> keys, path, opt) as d
+    where _jd_diff_allowed(d.path, opt);
+    if format in ('jd', 'jd2') then
+        if elems is null then return to_jsonb(''::text); end if;
+        return to_jsonb(jd_render_diff_text(elems, options));
+    elsif format = 'patch' then
+        if elems is null then return '[]'::jsonb; end if;
+        return jd_render_diff_patch(elems);
+    elsif format = 'merge' then
+        if elems is null then return '{}'::jsonb; end if;
+        return jd_render_diff_merge(elems);
+    else
+        raise exception 'jd_diff_at: unknown format %', format;
+    end if;
+end
+$$;
+
+-- Summary of the diff of a and b, like git diff --stat: the number of values added,
+-- removed and modified (removed and added in the same hunk), in total and per top-level
+-- path. A change of the whole document is counted under the path [].
+create or replace function jd_diff_stat(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns jsonb
+    language sql
+    stable as
+$$
+with e as (select case
+                      when coalesce(jsonb_array_length(d.path), 0) = 0 then '[]'::jsonb
+                      else jsonb_build_array(d.path -> 0)
+                      end                            as top,
+                  coalesce(array_length(d.remove, 1), 0) as r,
+                  coalesce(array_length(d.add, 1), 0)    as n
+           from jd_diff_struct($1, $2, $3) as d),
+     t as (select top,
+                  sum(n - least(r, n))::int as additions,
+                  sum(r - least(r, n))::int as removals,
+                  sum(least(r, n))::int     as modifications
+           from e
+           group by top)
+select jsonb_build_object(
+               'additions', coalesce(sum(additions), 0),
+               'removals', coalesce(sum(removals), 0),
+               'modifications', coalesce(sum(modifications), 0),
+               'paths', coalesce(jsonb_agg(jsonb_build_object('path', top, 'additions', additions, 'removals', removals,
+                                                              'modifications', modifications) order by top),
+                                 '[]'::jsonb))
+from t
+$$;
+
+-- The paths of the hunks of the diff of a and b, as a JSON array of jd paths without
+-- values, each listed once in the order of the diff. A change of the whole document is
+-- the path []. For invalidating caches by path without fetching the diff.
+create or replace function jd_diff_paths(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns jsonb
+    language sql
+    stable as
+$$
+select coalesce(jsonb_agg(p order by first), '[]'::jsonb)
+from (select coalesce(d.path, '[]'::jsonb) as p, min(d.n) as first
+      from jd_diff_struct($1, $2, $3) with ordinality as d(metadata, options, path, before, remove, add, after, n)
+      group by 1) as u
+$$;
+
+-- The hunks of the diff of a and b, one row each in the order of the diff: to_jsonb of
+-- each jd_diff_element, which jsonb_populate_record(null::jd_diff_element, h) turns back
+-- into one. For clients that consume a large diff row by row instead of as one value,
+-- which text and jsonb cap at 1 GB.
+create or replace function jd_diff_hunks(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns setof jsonb
+    language sql
+    stable as
+$$
+select to_jsonb(d) - 'ordinality'
+from jd_diff_struct($1, $2, $3) with ordinality as d
+order by d.ordinality
+$$;
+
+-- Whether a diff produced by jd_diff or jd_translate_diff_format in format is empty: an
+-- empty jd text, an empty RFC 6902 patch or an empty merge patch. Any other value,
+-- including a merge patch replacing the document with false or null, is a difference.
+create or replace function jd_diff_is_empty(diff jsonb, format jd_diff_format) returns boolean
+    language sql
+    immutable as
+$$
+select case
+           when diff is null then true
+           when format in ('jd', 'jd2') then jsonb_typeof(diff) = 'string' and btrim(diff #>> '{}') = ''
+           when format = 'patch' then diff = '[]'::jsonb
+           else diff = '{}'::jsonb
+           end
+$$;
+
+-- Downgrade jd v2 diff text to the v1 layout: drop the '^' options/metadata lines and
+-- the context lines, keeping only '@' headers and '-'/'+' changes.
+create or replace function _jd_diff_text_v1(diff_text text) returns text
+    language sql
+    immutable as
+$$
+select coalesce(string_agg(l, E'\n' order by n) || E'\n', '')
+from unnest(string_to_array(coalesce(diff_text, ''), E'\n')) with ordinality as u(l, n)
+where left(l, 2) in ('@ ', '- ', '+ ')
+$$;
+
+-- Read diff content in format as jd_diff_element[]. jd diffs are JSON strings holding the
+-- native text. With strict, RFC 6902 operations that cannot be represented raise an error.
+create or replace function _jd_read_diff(diff_content jsonb, format jd_diff_format, strict boolean) returns jd_diff_element[]
+    language plpgsql
+    stable as
+$$
+begin
+    if format in ('jd', 'jd2') then
+        return _jd_read_diff_text(_jd_jsonb_string_value(diff_content));
+    elsif format = 'patch' then
+        return _jd_read_diff_patch(diff_content, strict);
+    elsif format = 'merge' then
+        return jd_read_diff_merge(diff_content);
+    end if;
+    raise exception 'jd_translate_diff_format: unknown input format %', format;
+end
+$$;
+
+-- Milestone 6: translation helper stub (jd-involved flows only in this milestone)
+-- 'jd2' names the v2 native text explicitly; translating jd2 to jd yields the v1 layout.
+create or replace function jd_translate_diff_format(diff_content jsonb, input_format jd_diff_format,
+                                                    output_format jd_diff_format,
+                                                    strict boolean default false) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    elems jd_diff_element[];
+    t     text;
+begin
+    -- No-op when formats identical
+    if input_format = output_format then return diff_content; end if;
+
+    -- Normalize input to struct elements
+    elems := _jd_read_diff(diff_content, input_format, strict);
+
+    if elems is null or array_length(elems, 1) is null then
+        -- empty diff translates to empty in any format
+        if output_format in ('jd', 'jd2') then
+            return to_jsonb(''::text);
+        elsif output_format = 'patch' then
+            return '[]'::jsonb;
+        elsif output_format = 'merge' then
+            return '{}'::jsonb;
+        end if;
+    end if;
+
+    -- Render to desired output
+    if output_format = 'jd' and input_format = 'jd2' then
+        return to_jsonb(_jd_diff_text_v1(_jd_jsonb_string_value(diff_content)));
+    elsif output_format in ('jd', 'jd2') then
+        -- include MERGE header when elements originated from merge
+        if input_format = 'merge' then
+            t := jd_render_diff_text(elems, '[
+              "MERGE"
+            ]'::jsonb);
+        else
+            t := jd_render_diff_text(elems, '[]'::jsonb);
+        end if;
+        return to_jsonb(t);
+    elsif output_format = 'patch' then
+        return jd_render_diff_patch(elems);
+    elsif output_format = 'merge' then
+        return jd_render_diff_merge(elems);
+    else
+        raise exception 'jd_translate_diff_format: unknown output format %', output_format;
+    end if;
+end
+$$;
+
+-- The hunks of diff elements as JSON, for comparing diffs read from different formats:
+-- paths, context, values and options, but not the MERGE metadata.
+create or replace function _jd_diff_hunks(elems jd_diff_element[]) returns jsonb
+    language sql
+    immutable as
+$$
+select coalesce(jsonb_agg(jsonb_build_object('path', coalesce(e.path, '[]'::jsonb),
+                                             'options', coalesce(e.options, '[]'::jsonb),
+                                             'before', to_jsonb(e.before),
+                                             'remove', to_jsonb(e.remove),
+                                             'add', to_jsonb(e.add),
+                                             'after', to_jsonb(e.after)) order by e.n), '[]'::jsonb)
+from unnest(elems) with ordinality as e(metadata, options, path, before, remove, add, after, n)
+$$;
+
+-- Translate like jd_translate_diff_format, then translate the result back and raise an
+-- error, showing what came back, unless it has the hunks of the original: the
+-- translation is then lossy, as a merge patch is for array changes and removed values.
+create or replace function jd_translate_roundtrip(diff_content jsonb, input_format jd_diff_format,
+                                                  output_format jd_diff_format,
+                                                  strict boolean default false) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    translated jsonb := jd_translate_diff_format(diff_content, input_format, output_format, strict);
+    back       jsonb := jd_translate_diff_format(translated, output_format, input_format, strict);
+begin
+    if _jd_diff_hunks(_jd_read_diff(diff_content, input_format, strict)) is distinct from
+       _jd_diff_hunks(_jd_read_diff(back, input_format, strict)) then
+        raise exception 'jd_translate_roundtrip: %2% is lossy: translating back gives %', input_format, output_format,
+            case when input_format in ('jd', 'jd2') then _jd_jsonb_string_value(back) else back::text end;
+    end if;
+    return translated;
+end
+$$;
+
+-- Invert diff, in format: return the diff, in the same format, that undoes it, so that
+-- patching the result of applying diff with it gives back the original document. The
+-- hunks are reversed in order and their removed and added values swapped; context lines
+-- and the options header are kept. Merge patches do not record the values they replace,
+-- and neither do RFC 6902 remove and replace operations without a value or a test of
+-- their path before them, so these raise an error instead.
+create or replace function jd_invert_diff(diff jsonb, format jd_diff_format) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    elems    jd_diff_element[];
+    inverted jd_diff_element[] := array []::jd_diff_element[];
+    e        jd_diff_element;
+    op       jsonb;
+begin
+    if diff is null then return null; end if;
+    if format = 'merge' then
+        raise exception 'jd_invert_diff: a merge patch cannot be inverted: it does not record the values it replaces';
+    end if;
+    if format = 'patch' and jsonb_typeof(diff) = 'array' then
+        select o.e
+        into op
+        from jsonb_array_elements(diff) with ordinality as o(e, n)
+        where o.e ->> 'op' in ('remove', 'replace')
+          and not o.e ? 'value'
+          and not exists (select 1
+                          from jsonb_array_elements(diff) with ordinality as t(e, m)
+                          where t.m < o.n
+                            and t.e ->> 'op' = 'test'
+                            and t.e ->> 'path' = o.e ->> 'path')
+        order by o.n
+        limit 1;
+        if op is not null then
+            raise exception 'jd_invert_diff: % at % does not record the value it replaces (test the path first)',
+                op ->> 'op', op ->> 'path';
+        end if;
+    end if;
+
+    elems := _jd_read_diff(diff, format, true);
+    foreach e in array coalesce(elems, array []::jd_diff_element[])
+        loop
+            if (e.metadata).merge or e.options @> '["MERGE"]'::jsonb or e.options @> '[{"Merge": true}]'::jsonb then
+                raise exception 'jd_invert_diff: a diff with merge semantics cannot be inverted: it does not record the values it replaces';
+            end if;
+            inverted := array [row (e.metadata, e.options, e.path, e.before, e.add, e.remove, e.after)::jd_diff_element] ||
+                        inverted;
+        end loop;
+
+    if format in ('jd', 'jd2') then
+        return to_jsonb(jd_render_diff_text(inverted, coalesce((elems[1]).options, '[]'::jsonb)));
+    end if;
+    return jd_render_diff_patch(inverted);
+end
+$$;
+
+-- Minimal RFC 6902 applier: supports /key at root for add/remove/replace
+create or replace function jd_apply_patch(value jsonb, patch jd_patch) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    cur jsonb := value;
+    op  jsonb;
+    o   text;
+    p   text;
+    key text;
+    val jsonb;
+begin
+    if jsonb_typeof(patch) <> 'array' then raise exception 'jd_apply_patch expects array'; end if;
+    for op in select e from jsonb_array_elements(patch) as z(e)
+        loop
+            o := op ->> 'op'; p := op ->> 'path'; val := op -> 'value';
+            if p is null or left(p, 1) <> '/' or position('/' in substr(p, 2)) > 0 then
+                raise exception 'unsupported path % (only /key supported)', p;
+            end if;
+            key := substr(p, 2);
+            if o = 'remove' then
+                if jsonb_typeof(cur) <> 'object' then raise exception 'remove requires object root'; end if;
+                cur := cur - key;
+            elsif o = 'add' or o = 'replace' then
+                if jsonb_typeof(cur) <> 'object' then raise exception '% requires object root', o; end if;
+                cur := jsonb_set(cur, array [key], val, true);
+            else
+                raise exception 'unsupported op %', o;
+            end if;
+        end loop;
+    return cur;
+end
+$$;
+
+-- --------------------------------------------------------------------------------
+-- Remaining API stubs (to be implemented in later milestones)
+-- --------------------------------------------------------------------------------
+-- Path helper: convert jd_path (jsonb array) to RFC6901 pointer
+create or replace function _jd_path_to_pointer(path jd_path) returns text
+    language plpgsql
+    immutable as
+$$
+declare
+    i   int  := 0;
+    n   int;
+    out text := '';
+    v   jsonb;
+    seg text;
+begin
+    n := coalesce(jsonb_array_length(path), 0);
+    while i < n
+        loop
+            v := path -> i;
+            if jsonb_typeof(v) = 'string' then
+                seg := v::text;
+                seg := substr(seg, 2, length(seg) - 2);
+                seg := replace(replace(seg, '~', '~0'), '/', '~1');
+                out := out || '/' || seg;
+            elsif jsonb_typeof(v) = 'number' then
+                out := out || '/' || (v::text);
+            else
+                out := out || '/' || replace(replace(v::text, '~', '~0'), '/', '~1');
+            end if;
+            i := i + 1;
+        end loop;
+    return out;
+end
+$$;
+
+-- Render RFC 6902 JSON Patch from diff struct
+create or replace function jd_render_diff_patch(diff_elements jd_diff_element[]) returns jd_patch
+    language plpgsql
+    stable as
+$$
+declare
+    ops           jsonb := '[]'::jsonb;
+    i             int   := 1;
+    n             int   := coalesce(array_length(diff_elements, 1), 0);
+    e             jd_diff_element;
+    p             text;
+    last          jsonb;
+    last_is_index boolean;
+    j             int;
+    cnt           int;
+begin
+    while i <= n
+        loop
+            e := diff_elements[i];
+            p := _jd_path_to_pointer(e.path);
+            if coalesce(jsonb_array_length(e.path), 0) > 0 then
+                last := e.path -> (jsonb_array_length(e.path) - 1);
+                last_is_index := (jsonb_typeof(last) = 'number');
+            else
+                last_is_index := false;
+            end if;
+
+            if e.before is null and e.after is null then
+                if e.remove is not null and e.add is not null and array_length(e.remove, 1) = 1 and
+                   array_length(e.add, 1) = 1 then
+                    -- emit test + remove + add (upstream format expectations)
+                    ops := ops || jsonb_build_array(jsonb_build_object('op', 'test', 'path', p, 'value', e.remove[1]));
+                    ops := ops ||
+                           jsonb_build_array(jsonb_build_object('op', 'remove', 'path', p, 'value', e.remove[1]));
+                    ops := ops || jsonb_build_array(jsonb_build_object('op', 'add', 'path', p, 'value', e.add[1]));
+                elsif e.remove is not null and array_length(e.remove, 1) = 1 and e.add is null then
+                    ops := ops || jsonb_build_array(jsonb_build_object('op', 'test', 'path', p, 'value', e.remove[1]));
+                    ops := ops ||
+                           jsonb_build_array(jsonb_build_object('op', 'remove', 'path', p, 'value', e.remove[1]));
+                elsif e.add is not null and array_length(e.add, 1) = 1 and e.remove is null then
+                    ops := ops || jsonb_build_array(jsonb_build_object('op', 'add', 'path', p, 'value', e.add[1]));
+                end if;
+            else
+                if last_is_index then
+                    -- deletions at index path
+                    if e.remove is not null and array_length(e.remove, 1) is not null then
+                        cnt := array_length(e.remove, 1);
+                        j := 1;
+                        while j <= cnt
+                            loop
+                                ops := ops ||
+                                       jsonb_build_array(jsonb_build_object('op', 'test', 'path', p, 'value', e.remove[j]));
+                                ops := ops ||
+                                       jsonb_build_array(jsonb_build_object('op', 'remove', 'path', p, 'value', e.remove[j]));
+                                j := j + 1;
+                            end loop;
+                    end if;
+                    -- additions at index path (append if e.after indicates close and not a replacement)
+                    if e.add is not null and array_length(e.add, 1) is not null then
+                        cnt := array_length(e.add, 1); j := 1;
+                        while j <= cnt
+                            loop
+                                -- If this hunk also has removals, treat as in-place replacements at index path
+                                if e.remove is not null and array_length(e.remove, 1) is not null then
+                                    ops := ops ||
+                                           jsonb_build_array(jsonb_build_object('op', 'add', 'path', p, 'value', e.add[j]));
+                                elsif e.after is not null and array_length(e.after, 1) is not null and
+                                      e.after[1] = to_jsonb('__CLOSE__'::text) then
+                                    ops := ops || jsonb_build_array(jsonb_build_object('op', 'add', 'path',
+                                                                                       coalesce(nullif(p, ''), '') ||
+                                                                                       '/-', 'value', e.add[j]));
+                                else
+                                    ops := ops ||
+                                           jsonb_build_array(jsonb_build_object('op', 'add', 'path', p, 'value', e.add[j]));
+                                end if;
+                                j := j + 1;
+                            end loop;
+                    end if;
+                end if;
+            end if;
+            i := i + 1;
+        end loop;
+    return ops;
+end
+$$;
+
+create or replace function jd_diff_patch(a jsonb, b jsonb, options jd_option default '[]'::jsonb) returns jd_patch
+    language plpgsql
+    stable as
+$$
+declare
+    elems jd_diff_element[];
+begin
+    select array_agg(d) into elems from jd_diff_struct(a, b, options) as d;
+    if elems is null or array_length(elems, 1) is null then return '[]'::jsonb; end if;
+    return jd_render_diff_patch(elems);
+end
+$$;
+
+-- Render RFC 7386 Merge Patch from diff struct (objects only at leaf keys)
+-- For array element diffs, RFC 7386 semantics require replacing the entire array.
+-- A merge patch reads null as the removal of a key, so it cannot set a value to null. The
+-- jd_sql.merge_null_policy setting chooses what happens to such hunks: keep (the default)
+-- writes the null anyway, turning the assignment into a removal; error raises an error;
+-- drop leaves the hunk out; sentinel writes the jd_sql.merge_null_sentinel string
+-- (default "__jd_null__") for the consumer of the patch to replace.
+create or replace function jd_render_diff_merge(diff_elements jd_diff_element[]) returns jd_merge
+    language plpgsql
+    stable as
+$$
+declare
+    out jsonb := '{}'::jsonb;
+    i   int   := 1;
+    n   int   := coalesce(array_length(diff_elements, 1), 0);
+    e   jd_diff_element;
+    path_arr   text[];
+    parent_arr text[];
+    last_key   text;
+    parent_obj jsonb;
+    add_val    jsonb;
+    null_policy text := coalesce(nullif(current_setting('jd_sql.merge_null_policy', true), ''), 'keep');
+begin
+    if null_policy not in ('keep', 'error', 'drop', 'sentinel') then
+        raise exception 'jd_render_diff_merge: unsupported jd_sql.merge_null_policy % (supported: keep, error, drop, sentinel)', null_policy;
+    end if;
+    while i <= n
+        loop
+            e := diff_elements[i];
+            if coalesce(jsonb_array_length(e.path), 0) = 0 then
+                -- root-level replacement under merge semantics
+                if e.add is not null and array_length(e.add, 1) = 1 then
+                    out := e.add[1];
+                end if;
+            elsif jsonb_typeof(e.path -> (jsonb_array_length(e.path) - 1)) = 'string' then
+                -- Treat presence of an add value as a replacement/addition regardless of remove presence
+                -- Note: jsonb_set does not create missing intermediate parents; build/update parent objects first
+                -- Compute ordered text[] path, its parent, and last key
+                select array_agg(val order by ord)
+                into path_arr
+                from jsonb_array_elements_text(e.path) with ordinality as t(val, ord);
+
+                if path_arr is not null and array_length(path_arr, 1) >= 1 then
+                    if array_length(path_arr, 1) = 1 then
+                        parent_arr := null; -- top-level
+                        last_key := path_arr[1];
+                    else
+                        parent_arr := path_arr[1:array_length(path_arr, 1) - 1];
+                        last_key := path_arr[array_length(path_arr, 1)];
+                    end if;
+                end if;
+
+                add_val := null;
+                if e.add is not null and array_length(e.add, 1) = 1 then
+                    add_val := e.add[1];
+                    if add_val = 'null'::jsonb and null_policy <> 'keep' then
+                        if null_policy = 'error' then
+                            raise exception 'jd_render_diff_merge: % is set to null, which a merge patch cannot express (jd_sql.merge_null_policy = error)', e.path;
+                        elsif null_policy = 'drop' then
+                            add_val := null;
+                        else
+                            add_val := to_jsonb(coalesce(nullif(current_setting('jd_sql.merge_null_sentinel', true), ''), '__jd_null__'));
+                        end if;
+                    end if;
+                end if;
+                if add_val is not null then
+                    if parent_arr is null then
+                        -- set at top-level
+                        out := coalesce(out, '{}'::jsonb) || jsonb_build_object(last_key, add_val);
+                    else
+                        parent_obj := coalesce(out #> parent_arr, '{}'::jsonb);
+                        parent_obj := parent_obj || jsonb_build_object(last_key, add_val);
+                        out := jsonb_set(out, parent_arr, parent_obj, true);
+                    end if;
+                elsif e.remove is not null and array_length(e.remove, 1) = 1 and e.add is null then
+                    if parent_arr is null then
+                        out := coalesce(out, '{}'::jsonb) || jsonb_build_object(last_key, 'null'::jsonb);
+                    else
+                        parent_obj := coalesce(out #> parent_arr, '{}'::jsonb);
+                        parent_obj := parent_obj || jsonb_build_object(last_key, 'null'::jsonb);
+                        out := jsonb_set(out, parent_arr, parent_obj, true);
+                    end if;
+                end if;
+            else
+                -- Non-string terminal (arrays/indices) do not directly contribute to merge object; skip
+                null;
+            end if;
+            i := i + 1;
+        end loop;
+    return out;
+end
+$$;
+
+-- Compute RFC 7386 (JSON Merge Patch)
+create or replace function jd_diff_merge(a jsonb, b jsonb, options jd_option default '["MERGE"]'::jsonb) returns jd_merge
+    language plpgsql
+    stable as
+$$
+declare
+    elems   jd_diff_element[];
+    eff_opt jd_option := (coalesce(options, '[]'::jsonb) || '["MERGE"]'::jsonb);
+begin
+    -- Imply MERGE semantics when rendering merge format regardless of caller options
+    select array_agg(d) into elems from jd_diff_struct(a, b, eff_opt) as d;
+    if elems is null or array_length(elems, 1) is null then return '{}'::jsonb; end if;
+    return jd_render_diff_merge(elems);
+end
+$$;
+
+-- Render diff elements given as a JSON array, such as the to_jsonb of jd_diff_struct rows,
+-- in format like jd_diff. A client can so assemble one diff from parts computed apart,
+-- e.g. the chunks of a large array diffed on several connections.
+create or replace function jd_render_diff(diff_elements jsonb, options jd_option,
+                                          format jd_diff_format default 'jd') returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    elems jd_diff_element[] := array(select jsonb_populate_record(null::jd_diff_element, e)
+                                     from jsonb_array_elements(coalesce(diff_elements, '[]'::jsonb))
+                                         with ordinality as t(e, n)
+                                     order by n);
+begin
+    if format in ('jd', 'jd2') then
+        return to_jsonb(jd_render_diff_text(elems, options));
+    elsif array_length(elems, 1) is null then
+        return case when format = 'patch' then '[]'::jsonb else '{}'::jsonb end;
+    elsif format = 'patch' then
+        return jd_render_diff_patch(elems);
+    elsif format = 'merge' then
+        return jd_render_diff_merge(elems);
+    else
+        raise exception 'jd_render_diff: unknown format %', format;
+    end if;
+end
+$$;
+
+-- Raise the conflict of a patch hunk that does not match the document, with SQLSTATE
+-- JDP01 and, as DETAIL, a JSON object of the 1-based hunk, its path, and the expected
+-- and actual values, each left out when there is no value (SQL NULL).
+create or replace function _jd_patch_conflict(hunk int, path jd_path, expected jsonb, actual jsonb, message text)
+    returns void
+    language plpgsql
+    immutable as
+$$
+begin
+    raise exception using errcode = 'JDP01', message = message,
+        detail = (jsonb_build_object('hunk', hunk, 'path', coalesce(path, '[]'::jsonb))
+            || case when expected is null then '{}'::jsonb else jsonb_build_object('expected', expected) end
+            || case when actual is null then '{}'::jsonb else jsonb_build_object('actual', actual) end)::text;
+end
+$$;
+
+-- Apply struct elements (objects at leaf keys)
+create or replace function jd_patch_struct(value jsonb, diff_elements jd_diff_element[]) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    cur           jsonb := value;
+    i             int   := 1;
+    n             int   := coalesce(array_length(diff_elements, 1), 0);
+    e             jd_diff_element;
+    last          jsonb;
+    idx           int;
+    parent_path   text[];
+    full_path     text[];
+    arr           jsonb;
+    prev_expected jsonb;
+    next_expected jsonb;
+    prev_actual   jsonb;
+    next_actual   jsonb;
+    v             jsonb;
+begin
+    while i <= n
+        loop
+            e := diff_elements[i];
+            if coalesce(jsonb_array_length(e.path), 0) = 0 then
+                if e.add is not null and array_length(e.add, 1) = 1 then cur := e.add[1]; end if;
+            elsif jsonb_typeof(e.path -> (jsonb_array_length(e.path) - 1)) = 'string' then
+                if e.add is not null and array_length(e.add, 1) = 1 then
+                    cur := jsonb_set(cur, (select array_agg(val)
+                                           from jsonb_array_elements_text(e.path) t(val)), e.add[1], true);
+                elsif e.remove is not null and e.add is null then
+                    -- set null then remove if top-level
+                    cur := jsonb_set(cur, (select array_agg(val)
+                                           from jsonb_array_elements_text(e.path) t(val)), 'null'::jsonb, true);
+                    if jsonb_array_length(e.path) = 1 then cur := cur - (e.path ->> 0); end if;
+                end if;
+            elsif jsonb_typeof(e.path -> (jsonb_array_length(e.path) - 1)) = 'number' then
+                -- Array index context: support in-place replacement with optional simple context checks
+                last := e.path -> (jsonb_array_length(e.path) - 1);
+                idx := (last::text)::int;
+                -- zero-based index
+                -- Build full and parent paths as text[]
+                select array_agg(val) into full_path from jsonb_array_elements_text(e.path) t(val);
+                if jsonb_array_length(e.path) > 1 then
+                    select array_agg(val)
+                    into parent_path
+                    from jsonb_array_elements_text(e.path - (jsonb_array_length(e.path) - 1)) t(val);
+                else
+                    parent_path := array []::text[];
+                end if;
+                -- Extract current array at parent
+                if array_length(parent_path, 1) is null or array_length(parent_path, 1) = 0 then
+                    arr := cur;
+                else
+                    arr := cur #> parent_path;
+                end if;
+                if jsonb_typeof(arr) <> 'array' then
+                    perform _jd_patch_conflict(i, e.path - (jsonb_array_length(e.path) - 1), null, arr,
+                        format('jd_patch_struct: expected array at %s, got %s', parent_path, coalesce(jsonb_typeof(arr), 'no value')));
+                end if;
+                -- Optional context: last non-marker from before serves as previous element expectation
+                prev_expected := null;
+                if e.before is not null and array_length(e.before, 1) is not null then
+                    foreach v in array e.before
+                        loop
+                            if v <> to_jsonb('__OPEN__'::text) then prev_expected := v; end if;
+                        end loop;
+                end if;
+                next_expected := null;
+                if e.after is not null and array_length(e.after, 1) is not null then
+                    foreach v in array e.after
+                        loop
+                            if v <> to_jsonb('__CLOSE__'::text) then
+                                if next_expected is null then next_expected := v; end if;
+                            end if;
+                        end loop;
+                end if;
+                -- Actual neighbors
+                if idx > 0 then prev_actual := arr -> (idx - 1); else prev_actual := null; end if;
+                if (idx + 1) < coalesce((arr ->> '#')::int, jsonb_array_length(arr)) then
+                    next_actual := arr -> (idx + 1);
+                else
+                    next_actual := null;
+                end if;
+                if prev_expected is not null and prev_actual is not null and prev_actual <> prev_expected then
+                    perform _jd_patch_conflict(i, (e.path - (jsonb_array_length(e.path) - 1)) || to_jsonb(idx - 1),
+                        prev_expected, prev_actual,
+                        format('jd_patch_struct: context mismatch before index %s: expected %s, got %s', idx, prev_expected, prev_actual));
+                end if;
+                if next_expected is not null and next_actual is not null and next_actual <> next_expected then
+                    perform _jd_patch_conflict(i, (e.path - (jsonb_array_length(e.path) - 1)) || to_jsonb(idx + 1),
+                        next_expected, next_actual,
+                        format('jd_patch_struct: context mismatch after index %s: expected %s, got %s', idx, next_expected, next_actual));
+                end if;
+                -- Replacement: require remove match when provided
+                if e.remove is not null and array_length(e.remove, 1) is not null then
+                    if (cur #> full_path) <> e.remove[1] then
+                        perform _jd_patch_conflict(i, e.path, e.remove[1], cur #> full_path,
+                            format('jd_patch_struct: value mismatch at index %s', idx));
+                    end if;
+                end if;
+                if e.add is not null and array_length(e.add, 1) is not null then
+                    -- Use create_missing=true to ensure array element is updated
+                    cur := jsonb_set(cur, full_path, e.add[1], true);
+                elsif e.remove is not null and (e.add is null or array_length(e.add, 1) is null) then
+                    -- pure removal at index: rebuild array without element at idx
+                    declare
+                        j      int   := 0;
+                        newarr jsonb := '[]'::jsonb;
+                        len    int;
+                        elem   jsonb;
+                    begin
+                        len := jsonb_array_length(arr);
+                        while j < len
+                            loop
+                                if j <> idx then
+                                    elem := arr -> j;
+                                    newarr := newarr || jsonb_build_array(elem);
+                                end if;
+                                j := j + 1;
+                            end loop;
+                        if array_length(parent_path, 1) is null or array_length(parent_path, 1) = 0 then
+                            cur := newarr;
+                        else
+                            cur := jsonb_set(cur, parent_path, newarr, false);
+                        end if;
+                    end;
+                end if;
+            end if;
+            i := i + 1;
+        end loop;
+    return cur;
+end
+$$;
+
+-- Apply RFC 7386 JSON Merge Patch
+create or replace function jd_apply_merge(target jsonb, patch jd_merge) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    result jsonb := target;
+    k      text;
+    v      jsonb;
+    cur    jsonb;
+begin
+    -- If patch is not an object, the result is the patch itself
+    if patch is null or jsonb_typeof(patch) <> 'object' then
+        return patch;
+    end if;
+
+    -- If target is not an object, treat it as an empty object
+    if result is null or jsonb_typeof(result) <> 'object' then
+        result := '{}'::jsonb;
+    end if;
+
+    for k, v in select key, value from jsonb_each(patch)
+        loop
+            if v is null or v = 'null'::jsonb then
+                -- remove key if present
+                result := result - k;
+            elsif jsonb_typeof(v) = 'object' then
+                -- recursively merge objects
+                cur := result -> k;
+                result := jsonb_set(result, array [k], jd_apply_merge(cur, v), true);
+            else
+                -- arrays and scalars replace
+                result := jsonb_set(result, array [k], v, true);
+            end if;
+        end loop;
+
+    return result;
+end
+$$;
+
+-- Parse jd native diff text into structured elements (array form)
+create or replace function _jd_read_diff_text(diff_text text) returns jd_diff_element[]
+    language plpgsql
+    stable as
+$$
+declare
+    lines       text[]            := string_to_array(coalesce(diff_text, ''), E'\n');
+    i           int               := 1;
+    n           int               := coalesce(array_length(lines, 1), 0);
+    cur         jd_diff_element;
+    out         jd_diff_element[] := array []::jd_diff_element[];
+    opts        jsonb             := '[]'::jsonb;
+    line        text;
+    trimmed     text;
+    val         jsonb;
+    started     boolean           := false; -- saw a header '@'
+    has_changes boolean           := false; -- saw +/- line
+begin
+    while i <= n
+        loop
+            line := lines[i];
+            -- skip empty lines (e.g., trailing newline)
+            if line is null or line = '' then i := i + 1; continue; end if;
+
+            if left(line, 2) = '^ ' then
+                -- option line before first hunk
+                val := (substr(line, 3))::jsonb;
+                opts := opts || jsonb_build_array(val);
+            elsif left(line, 2) = '@ ' then
+                -- finalize previous element if any
+                if started then
+                    if cur.options is null then cur.options := opts; end if;
+                    out := out || array [cur];
+                end if;
+                -- start new element
+                started := true; has_changes := false;
+                cur.metadata := row (false)::jd_metadata;
+                cur.options := opts; -- capture global options into element
+                cur.path := (substr(line, 3))::jsonb; -- path is compact JSON array
+                cur.before := null; cur.remove := null; cur.add := null; cur.after := null;
+            elsif left(line, 2) = '- ' then
+                val := (substr(line, 3))::jsonb;
+                if cur.remove is null then
+                    cur.remove := array [val];
+                else
+                    cur.remove := cur.remove || array [val];
+                end if;
+                has_changes := true;
+            elsif left(line, 2) = '+ ' then
+                val := (substr(line, 3))::jsonb;
+                if cur.add is null then cur.add := array [val]; else cur.add := cur.add || array [val]; end if;
+                has_changes := true;
+            else
+                -- context lines: either '[' or ']' or '  <json>'
+                trimmed := btrim(line);
+                if trimmed = '[' then
+                    val := to_jsonb('__OPEN__'::text);
+                elsif trimmed = ']' then
+                    val := to_jsonb('__CLOSE__'::text);
+                else
+                    -- expect two-space indent followed by compact json
+                    if left(line, 2) = '  ' then
+                        val := (substr(line, 3))::jsonb;
+                    else
+                        raise exception 'Invalid diff text line (expected context with two-space indent): %', line;
+                    end if;
+                end if;
+                if not has_changes then
+                    if cur.before is null then
+                        cur.before := array [val];
+                    else
+                        cur.before := cur.before || array [val];
+                    end if;
+                else
+                    if cur.after is null then
+                        cur.after := array [val];
+                    else
+                        cur.after := cur.after || array [val];
+                    end if;
+                end if;
+            end if;
+            i := i + 1;
+        end loop;
+    if started then
+        if cur.options is null then cur.options := opts; end if;
+        out := out || array [cur];
+    end if;
+    return out;
+end
+$$;
+
+create or replace function jd_read_diff_text(diff_text text) returns setof jd_diff_element
+    language plpgsql
+    stable as
+$$
+declare
+    arr jd_diff_element[];
+    e   jd_diff_element;
+begin
+    arr := _jd_read_diff_text(diff_text);
+    if arr is null or array_length(arr, 1) is null then return; end if;
+    foreach e in array arr
+        loop
+            return next e;
+        end loop;
+end
+$$;
+
+-- Helpers for translation/parsing
+create or replace function _jd_jsonb_string_value(j jsonb) returns text
+    language plpgsql
+    immutable as
+$$
+declare
+    t text;
+begin
+    if j is null then return null; end if;
+    if jsonb_typeof(j) <> 'string' then raise exception 'Expected JSON string content for jd format'; end if;
+    t := j::text; -- quoted JSON string
+    t := substr(t, 2, greatest(0, length(t) - 2));
+    return _jd_unescape_json_string(t);
+end
+$$;
+
+-- Unescape JSON string escapes to raw text (handles \n, \r, \t, \", \\)
+create or replace function _jd_unescape_json_string(s text) returns text
+    language plpgsql
+    immutable as
+$$
+declare
+    r text := s;
+begin
+    if r is null then return null; end if;
+    -- First collapse escaped backslashes
+    r := replace(r, E'\\\\', E'\\');
+    -- Then unescape quotes and control sequences
+    r := replace(r, E'\\"', E'"');
+    r := replace(r, E'\\n', E'\n');
+    r := replace(r, E'\\r', E'\r');
+    r := replace(r, E'\\t', E'\t');
+    return r;
+end
+$$;
+
+create or replace function _jd_pointer_to_path(pointer text) returns jd_path
+    language plpgsql
+    immutable as
+$$
+declare
+    parts text[];
+    i     int   := 1;
+    n     int;
+    seg   text;
+    out   jsonb := '[]'::jsonb;
+    num   numeric;
+begin
+    if pointer is null or pointer = '' then return '[]'::jsonb; end if;
+    if left(pointer, 1) <> '/' then raise exception 'Invalid JSON Pointer: %', pointer; end if;
+    parts := string_to_array(substr(pointer, 2), '/');
+    n := coalesce(array_length(parts, 1), 0);
+    while i <= n
+        loop
+            seg := replace(replace(parts[i], '~1', '/'), '~0', '~');
+            begin
+                num := seg::numeric;
+                out := out || to_jsonb(num);
+            exception
+                when others then out := out || to_jsonb(seg);
+            end;
+            i := i + 1;
+        end loop;
+    return out;
+end
+$$;
+
+-- Parse RFC 6902 JSON Patch into jd_diff_element[]
+-- Read RFC 6902 operations as jd_diff_element[]. RFC 6902 carries no old values, so they
+-- come from test operations: a test at a path gives the value of a following remove or
+-- replace there (a modification), or of the source of a move or copy. A remove and an
+-- add at the same path in a row are one modification, as in jd's own patches. With
+-- strict, operations that cannot be represented (a test not paired with a later
+-- operation, a move or copy whose source value is unknown) raise an error; otherwise
+-- they are dropped.
+create or replace function _jd_read_diff_patch(patch jd_patch, strict boolean) returns jd_diff_element[]
+    language plpgsql
+    stable as
+$$
+declare
+    op     jsonb;
+    out    jd_diff_element[] := array []::jd_diff_element[];
+    cur    jd_diff_element;
+    prev   jd_diff_element;
+    n      int;
+    p      text;
+    src    text;
+    tested jsonb             := '{}'::jsonb;
+    v      jsonb;
+begin
+    if patch is null or jsonb_typeof(patch) <> 'array' then return null; end if;
+    for op in select e from jsonb_array_elements(patch) as z(e)
+        loop
+            p := op ->> 'path';
+            src := op ->> 'from';
+            cur.metadata := row (false)::jd_metadata;
+            cur.options := '[]'::jsonb;
+            cur.path := _jd_pointer_to_path(p);
+            cur.before := null; cur.after := null; cur.remove := null; cur.add := null;
+            n := coalesce(array_length(out, 1), 0);
+            if op ->> 'op' = 'test' then
+                tested := tested || jsonb_build_object(p, op -> 'value');
+                continue;
+            elsif op ->> 'op' = 'add' then
+                if n > 0 then
+                    prev := out[n];
+                    if prev.path = cur.path and prev.add is null and array_length(prev.remove, 1) = 1 then
+                        -- remove + add: a modification
+                        prev.add := array [op -> 'value'];
+                        out[n] := prev;
+                        continue;
+                    end if;
+                end if;
+                cur.add := array [op -> 'value'];
+            elsif op ->> 'op' = 'remove' then
+                if op ? 'value' then
+                    cur.remove := array [op -> 'value'];
+                elsif tested ? p then
+                    cur.remove := array [tested -> p];
+                else
+                    cur.remove := array ['null'::jsonb];
+                end if;
+                tested := tested - p;
+            elsif op ->> 'op' = 'replace' then
+                if tested ? p then cur.remove := array [tested -> p]; end if;
+                -- replacement without prior value: represent as add only
+                cur.add := array [op -> 'value'];
+                tested := tested - p;
+            elsif op ->> 'op' in ('move', 'copy') then
+                v := tested -> src;
+                if v is null then
+                    if strict then
+                        raise exception 'jd_translate_diff_format: % from % to % needs a test of its source value',
+                            op ->> 'op', src, p;
+                    end if;
+                    continue;
+                end if;
+                tested := tested - src;
+                if op ->> 'op' = 'move' then
+                    out := out || array [row (cur.metadata, cur.options, _jd_pointer_to_path(src), null, array [v], null,
+                        null)::jd_diff_element];
+                end if;
+                cur.add := array [v];
+            end if;
+            out := out || array [cur];
+        end loop;
+    if strict and tested <> '{}'::jsonb then
+        raise exception 'jd_translate_diff_format: test at % is not followed by an operation on its path',
+            (select min(k) from jsonb_object_keys(tested) as k);
+    end if;
+    return out;
+end
+$$;
+
+create or replace function jd_read_diff_patch(patch jd_patch) returns jd_diff_element[]
+    language sql
+    stable as
+$$
+select _jd_read_diff_patch(patch, false)
+$$;
+
+-- Parse RFC 7386 Merge Patch into jd_diff_element[]
+create or replace function jd_read_diff_merge(merge jd_merge) returns jd_diff_element[]
+    language plpgsql
+    stable as
+$$
+declare
+    k    text;
+    v    jsonb;
+    cur  jd_diff_element;
+    out  jd_diff_element[] := array []::jd_diff_element[];
+    keys text[] := array []::text[];
+    i    int := 1;
+    n    int;
+    sub  jd_diff_element[];
+    se   jd_diff_element;
+begin
+    if merge is null or jsonb_typeof(merge) <> 'object' then return null; end if;
+    -- Collect and sort keys for deterministic order
+    select array_agg(key order by key) into keys from jsonb_each(merge);
+    n := coalesce(array_length(keys, 1), 0);
+    while i <= n loop
+        k := keys[i];
+        v := merge -> k;
+        if v is null or v = 'null'::jsonb then
+            cur.metadata := row (false)::jd_metadata;
+            cur.options := '[]'::jsonb;
+            cur.path := jsonb_build_array(to_jsonb(k));
+            cur.before := null; cur.after := null; cur.remove := array ['null'::jsonb]; cur.add := null;
+            out := out || array [cur];
+        elsif jsonb_typeof(v) = 'object' then
+            -- recurse into nested object to produce leaf hunks
+            sub := jd_read_diff_merge(v);
+            if sub is not null and array_length(sub, 1) is not null then
+                foreach se in array sub
+                    loop
+                        -- prefix the path with current key
+                        se.path := jsonb_build_array(to_jsonb(k)) || coalesce(se.path, '[]'::jsonb);
+                        out := out || array [se];
+                    end loop;
+            end if;
+        else
+            -- scalar or array replacement at this key
+            cur.metadata := row (false)::jd_metadata;
+            cur.options := '[]'::jsonb;
+            cur.path := jsonb_build_array(to_jsonb(k));
+            cur.before := null; cur.after := null; cur.remove := null; cur.add := array [v];
+            out := out || array [cur];
+        end if;
+        i := i + 1;
+    end loop;
+    return out;
+end
+$$;
+
+-- Apply jd native diff text to a JSONB value via struct applier
+create or replace function jd_patch_text(value jsonb, diff_text text) returns jsonb
+    language plpgsql
+    stable as
+$$
+declare
+    elems jd_diff_element[];
+begin
+    elems := _jd_read_diff_text(diff_text);
+    if elems is null or array_length(elems, 1) is null then return value; end if;
+    return jd_patch_struct(value, elems);
+end
+$$;
+
+-- Check whether diff, in format, applies cleanly to value without returning the patched
+-- document. Hunks (jd hunks or JSON Patch operations) are applied one at a time; the
+-- first one that fails is returned with its 1-based position, its path and the error,
+-- and no row means the diff applies. Unlike jd_patch_text, a jd object hunk whose '-'
+-- value does not match the document, or that adds an existing key, fails (merge hunks
+-- excepted). A merge patch always applies (RFC 7386).
+create or replace function jd_patch_check(value jsonb, diff jsonb, format jd_diff_format)
+    returns table
+            (
+                hunk  int,
+                path  jd_path,
+                error text
+            )
+    language plpgsql
+    stable as
+$$
+declare
+    cur    jsonb := value;
+    el     jd_diff_element;
+    op     jsonb;
+    i      int   := 0;
+    keys   text[];
+    actual jsonb;
+begin
+    if diff is null or format = 'merge' then return; end if;
+    if format = 'patch' then
+        if jsonb_typeof(diff) <> 'array' then raise exception 'jd_patch_check: expected a JSON Patch array'; end if;
+        for op in select z.o from jsonb_array_elements(diff) as z(o)
+            loop
+                i := i + 1;
+                begin
+                    cur := jd_apply_patch(cur, jsonb_build_array(op));
+                exception
+                    when others then
+                        hunk := i;
+                        path := case when op ? 'path' then _jd_pointer_to_path(op ->> 'path') end;
+                        error := sqlerrm;
+                        return next;
+                        return;
+                end;
+            end loop;
+        return;
+    end if;
+
+    if jsonb_typeof(diff) <> 'string' then raise exception 'jd_patch_check: expected jd diff text as a JSON string'; end if;
+    foreach el in array coalesce(_jd_read_diff_text(diff #>> '{}'), array []::jd_diff_element[])
+        loop
+            i := i + 1;
+            begin
+                if jsonb_array_length(el.path) > 0 and jsonb_typeof(el.path -> -1) = 'string'
+                    and not coalesce((el.metadata).merge, false) then
+                    select array_agg(t.v) into keys from jsonb_array_elements_text(el.path) t(v);
+                    actual := cur #> keys;
+                    if el.remove is not null and array_length(el.remove, 1) = 1 then
+                        if actual is distinct from el.remove[1] then
+                            raise exception 'expected % at %, found %', el.remove[1], el.path, coalesce(actual::text, 'no value');
+                        end if;
+                    elsif actual is not null then
+                        raise exception 'expected no value at %, found %', el.path, actual;
+                    end if;
+                end if;
+                cur := jd_patch_struct(cur, array [el]);
+            exception
+                when others then
+                    hunk := i;
+                    path := el.path;
+                    error := sqlerrm;
+                    return next;
+                    return;
+            end;
+        end loop;
+end
+$$;
+
+-- Three-way merge helper with explicit path. SQL NULL stands for an absent value, so a
+-- key deleted on one side and unchanged on the other is deleted. Objects are merged key
+-- by key; any other value (including arrays) is replaced as a whole. A value changed
+-- differently on both sides is a conflict: ours is kept and the conflict is recorded.
+create or replace function _jd_merge3(base jsonb, ours jsonb, theirs jsonb, options jd_option, cur_path jd_path,
+                                      out merged jsonb, out conflicts jsonb)
+    language plpgsql
+    stable as
+$$
+declare
+    k   text;
+    sub record;
+begin
+    conflicts := '[]'::jsonb;
+    if _jd_json_equal(ours, theirs, options) or _jd_json_equal(base, theirs, options) then
+        merged := ours;
+        return;
+    end if;
+    if _jd_json_equal(base, ours, options) then
+        merged := theirs;
+        return;
+    end if;
+    if jsonb_typeof(ours) = 'object' and jsonb_typeof(theirs) = 'object'
+        and (base is null or jsonb_typeof(base) = 'object') then
+        merged := '{}'::jsonb;
+        for k in select key from jsonb_object_keys(ours) as t(key)
+                 union
+                 select key from jsonb_object_keys(theirs) as t(key)
+                 union
+                 select key from jsonb_object_keys(coalesce(base, '{}'::jsonb)) as t(key)
+                 order by 1
+            loop
+                sub := _jd_merge3(base -> k, ours -> k, theirs -> k, options, cur_path || to_jsonb(k));
+                if sub.merged is not null then
+                    merged := merged || jsonb_build_object(k, sub.merged);
+                end if;
+                conflicts := conflicts || sub.conflicts;
+            end loop;
+        return;
+    end if;
+    merged := ours;
+    conflicts := jsonb_build_array(jsonb_build_object('path', cur_path) ||
+                                   case when base is null then '{}'::jsonb else jsonb_build_object('base', base) end ||
+                                   case when ours is null then '{}'::jsonb else jsonb_build_object('ours', ours) end ||
+                                   case when theirs is null then '{}'::jsonb else jsonb_build_object('theirs', theirs) end);
+end
+$$;
+
+-- Three-way merge of ours and theirs, both derived from base. Returns the merged
+-- document and the conflicts, a JSON array of {"path", "base", "ours", "theirs"} objects
+-- (members absent on a side are omitted). Where the sides conflict, merged holds ours.
+-- Values are compared with the precision of options.
+create or replace function jd_merge3(base jsonb, ours jsonb, theirs jsonb, options jd_option default '[]'::jsonb)
+    returns table
+            (
+                merged    jsonb,
+                conflicts jsonb
+            )
+    language sql
+    stable as
+$$
+select m.merged, m.conflicts
+from _jd_merge3($1, $2, $3, coalesce($4, '[]'::jsonb), '[]'::jsonb) as m
+$$;
+
+-- Resolves the local $ref of the JSON Schema node, a JSON Pointer fragment into root
+-- ("#/$defs/name", or "#" for root itself). Chains of references are followed; other
+-- references are left as is.
+create or replace function _jd_schema_resolve(node jsonb, root jsonb) returns jsonb
+    language plpgsql
+    immutable as
+$$
+declare
+    ref   text;
+    depth int := 0;
+begin
+    while jsonb_typeof(node) = 'object' and jsonb_typeof(node -> '$ref') = 'string' and depth < 32
+        loop
+            ref := node ->> '$ref';
+            if ref = '#' then
+                node := root;
+            elsif left(ref, 2) = '#/' then
+                node := root #> array(select jsonb_array_elements_text(_jd_pointer_to_path(substr(ref, 2))));
+            else
+                return node;
+            end if;
+            depth := depth + 1;
+        end loop;
+    return node;
+end
+$$;
+
+-- Converts value to the single JSON Schema type, when it is a string holding a number
+-- or boolean of that type, or a number or boolean for a string. Other values are kept.
+create or replace function _jd_schema_coerce(value jsonb, type jsonb) returns jsonb
+    language plpgsql
+    immutable as
+$$
+declare
+    t   text := type #>> '{}';
+    s   text;
+    num numeric;
+begin
+    if jsonb_typeof(type) is distinct from 'string' then
+        return value;
+    end if;
+    if jsonb_typeof(value) = 'string' then
+        s := btrim(value #>> '{}');
+        if t in ('number', 'integer') and s ~ '^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$' then
+            num := s::numeric;
+            if t = 'number' or num = trunc(num) then
+                return to_jsonb(num);
+            end if;
+        elsif t = 'boolean' and lower(s) in ('true', 'false') then
+            return to_jsonb(lower(s)::boolean);
+        end if;
+    elsif t = 'string' and jsonb_typeof(value) in ('number', 'boolean') then
+        return to_jsonb(value #>> '{}');
+    end if;
+    return value;
+end
+$$;
+
+-- Internal recursive helper of jd_schema_defaults, applying the schema node to value.
+create or replace function _jd_schema_apply(value jsonb, node jsonb, root jsonb, coerce boolean) returns jsonb
+    language plpgsql
+    immutable as
+$$
+declare
+    k      text;
+    sub    jsonb;
+    prefix jsonb;
+    rest   jsonb;
+begin
+    node := _jd_schema_resolve(node, root);
+    if value is null or jsonb_typeof(node) is distinct from 'object' then
+        return value;
+    end if;
+    for sub in select s from jsonb_array_elements(coalesce(node -> 'allOf', '[]'::jsonb)) as e(s)
+        loop
+            value := _jd_schema_apply(value, sub, root, coerce);
+        end loop;
+    if coerce then
+        value := _jd_schema_coerce(value, node -> 'type');
+    end if;
+
+    if jsonb_typeof(value) = 'object' then
+        for k, sub in select key, s from jsonb_each(coalesce(node -> 'properties', '{}'::jsonb)) as p(key, s)
+            loop
+                sub := _jd_schema_resolve(sub, root);
+                if value ? k then
+                    value := jsonb_set(value, array [k], _jd_schema_apply(value -> k, sub, root, coerce));
+                elsif jsonb_typeof(sub) = 'object' and sub ? 'default' then
+                    value := jsonb_set(value, array [k], _jd_schema_apply(sub -> 'default', sub, root, coerce));
+                end if;
+            end loop;
+        for k in select key from jsonb_object_keys(value) as t(key)
+            loop
+                continue when node -> 'properties' ? k;
+                rest := null;
+                for sub in select s
+                           from jsonb_each(coalesce(node -> 'patternProperties', '{}'::jsonb)) as p(pattern, s)
+                           where k ~ p.pattern
+                    loop
+                        value := jsonb_set(value, array [k], _jd_schema_apply(value -> k, sub, root, coerce));
+                        rest := 'false'::jsonb;
+                    end loop;
+                if rest is null and jsonb_typeof(node -> 'additionalProperties') = 'object' then
+                    value := jsonb_set(value, array [k],
+                                       _jd_schema_apply(value -> k, node -> 'additionalProperties', root, coerce));
+                end if;
+            end loop;
+    elsif jsonb_typeof(value) = 'array' then
+        -- prefixItems (2020-12) or an items array (draft 7) apply by position, and the
+        -- items or additionalItems schema to the elements after them
+        prefix := case
+                      when jsonb_typeof(node -> 'prefixItems') = 'array' then node -> 'prefixItems'
+                      when jsonb_typeof(node -> 'items') = 'array' then node -> 'items'
+                      else '[]'::jsonb end;
+        rest := case
+                    when jsonb_typeof(node -> 'items') = 'object' then node -> 'items'
+                    else node -> 'additionalItems' end;
+        select coalesce(jsonb_agg(_jd_schema_apply(a.e, coalesce(prefix -> (a.n::int - 1), rest), root, coerce)
+                                  order by a.n), '[]'::jsonb)
+        into value
+        from jsonb_array_elements(value) with ordinality as a(e, n);
+    end if;
+    return value;
+end
+$$;
+
+-- The document value with the defaults of the JSON Schema schema materialized: a
+-- property absent from an object is set to the default of its schema, so that a field
+-- left out and a field set to its default diff as equal. The properties,
+-- patternProperties, additionalProperties, items, prefixItems, additionalItems, allOf
+-- and local $ref keywords are followed; conditional keywords (anyOf, oneOf, if) are
+-- not, as the branch that applies is ambiguous. With coerce, strings holding a number or
+-- boolean are converted to the type of their schema, and numbers and booleans to
+-- strings, where the type is a single one.
+create or replace function jd_schema_defaults(value jsonb, schema jsonb, coerce boolean default false) returns jsonb
+    language sql
+    immutable as
+$$
+select _jd_schema_apply($1, $2, $2, coalesce($3, false))
+$$;
+
+-- Normalize s to the Unicode normalization form (NFC, NFD, NFKC or NFKD). plpgsql defers
+-- the check of normalize(), which needs PostgreSQL 13, to the first call.
+create or replace function _jd_normalize_text(s text, form text) returns text
+    language plpgsql
+    immutable as
+$$
+begin
+    return case form
+               when 'NFC' then normalize(s, nfc)
+               when 'NFD' then normalize(s, nfd)
+               when 'NFKC' then normalize(s, nfkc)
+               else normalize(s, nfkd)
+        end;
+end
+$$;
+
+-- Internal recursive helper of jd_normalize_unicode.
+create or replace function _jd_normalize_unicode(value jsonb, form text) returns jsonb
+    language plpgsql
+    immutable as
+$$
+begin
+    case jsonb_typeof(value)
+        when 'string' then
+            return to_jsonb(_jd_normalize_text(value #>> '{}', form));
+        when 'object' then
+            return (select coalesce(jsonb_object_agg(_jd_normalize_text(e.key, form), _jd_normalize_unicode(e.value, form)),
+                                    '{}'::jsonb)
+                    from jsonb_each(value) as e);
+        when 'array' then
+            return (select coalesce(jsonb_agg(_jd_normalize_unicode(e.v, form) order by e.n), '[]'::jsonb)
+                    from jsonb_array_elements(value) with ordinality as e(v, n));
+        else
+            return value;
+        end case;
+end
+$$;
+
+-- value with its strings and object keys normalized to the Unicode normalization form
+-- (NFC, NFD, NFKC or NFKD), so that differently composed spellings of the same text
+-- compare equal. Keys that normalize alike are merged, the last one winning.
+create or replace function jd_normalize_unicode(value jsonb, form text default 'NFC') returns jsonb
+    language plpgsql
+    immutable as
+$$
+begin
+    form := upper(coalesce(form, 'NFC'));
+    if form not in ('NFC', 'NFD', 'NFKC', 'NFKD') then
+        raise exception 'unsupported normalization form: % (supported: NFC, NFD, NFKC, NFKD)', form;
+    end if;
+    return _jd_normalize_unicode(value, form);
+end
+$$;
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// diffStat is the summary returned by jd_diff_stat: the values added, removed and
+// modified by a diff, in total and per top-level path.
+type diffStat struct {
+	statCounts
+	Paths []struct {
+		Path json.RawMessage `json:"path"`
+		statCounts
+	} `json:"paths"`
+}
+
+type statCounts struct {
+	Additions     int `json:"additions"`
+	Removals      int `json:"removals"`
+	Modifications int `json:"modifications"`
+}
+
+// String lists the non-zero counts of c, as in "2 added, 1 removed".
+func (c statCounts) String() string {
+	var parts []string
+	for _, n := range []struct {
+		count int
+		verb  string
+	}{{c.Additions, "added"}, {c.Removals, "removed"}, {c.Modifications, "modified"}} {
+		if n.count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n.count, n.verb))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// renderStat renders the jd_diff_stat summary out in the style of git diff --stat: one
+// line per top-level path and a total line. An equal pair renders as nothing; out is
+// returned as is if it is not a summary.
+func renderStat(out string) string {
+	var s diffStat
+	if err := json.Unmarshal([]byte(out), &s); err != nil {
+		return out
+	}
+	if len(s.Paths) == 0 {
+		return ""
+	}
+	width := 0
+	paths := make([]string, len(s.Paths))
+	for i, p := range s.Paths {
+		paths[i] = compactJSON(p.Path)
+		width = max(width, len(paths[i]))
+	}
+	var b strings.Builder
+	for i, p := range s.Paths {
+		fmt.Fprintf(&b, " %-*s | %s\n", width, paths[i], p.statCounts)
+	}
+	fmt.Fprintf(&b, " %s changed, %s, %s, %s\n", counted(len(s.Paths), "path"), counted(s.Additions, "addition"),
+		counted(s.Removals, "removal"), counted(s.Modifications, "modification"))
+	return b.String()
+}
+
+// counted returns n followed by noun, pluralized unless n is 1.
+func counted(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
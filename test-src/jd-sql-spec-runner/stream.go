@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// streamThreshold is the input file size above which diffs are streamed.
+	streamThreshold = 64 << 20
+	// streamChunkSize is the size of the chunks inputs are copied in.
+	streamChunkSize = 1 << 20
+)
+
+// shouldStream reports whether the diff of fileA and fileB is run with runStreamed:
+// with --stream, or for a diff without --oracle, --at, --schema, --normalize or --ignore wildcards
+// when an input is larger than streamThreshold.
+func shouldStream(flags cliFlags, fileA, fileB string) bool {
+	if flags.enabled("stream") {
+		return true
+	}
+	if inv := flagInvocation(flags, nil, nil); oracle != nil || inv.mode() != "diff" || inv.At != nil || inv.Schema != nil || inv.Normalize != "" || ignoreGlobs(flags) {
+		return false
+	}
+	for _, f := range []string{fileA, fileB} {
+		if fi, err := os.Stat(f); err == nil && fi.Size() > streamThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// streamInputQuery assembles the input named doc from the chunks copied by runStreamed.
+// The chunks are bytea, so they may split multibyte characters.
+const streamInputQuery = "SELECT convert_from(string_agg(chunk, ''::bytea ORDER BY seq), 'UTF8') FROM jd_sql_input WHERE doc = '%s'"
+
+// runStreamed diffs fileA and fileB without reading them into memory: the files are
+// copied in chunks into a temporary table with COPY, and jd_diff is called on the values
+// assembled from the chunks inside the database (see queryModeSQL).
+func runStreamed(flags cliFlags, cfg Config, fileA, fileB string) (int, error) {
+	inv := flagInvocation(flags, nil, nil)
+	if inv.mode() != "diff" {
+		return 2, fmt.Errorf("%s mode is not supported with --stream", inv.mode())
+	}
+	if oracle != nil {
+		return 2, fmt.Errorf("--oracle is not supported with --stream")
+	}
+	if inv.At != nil {
+		return 2, fmt.Errorf("--at is not supported with --stream")
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	// The temporary table belongs to the session, so everything runs on one connection
+	ctx := baseContext
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 2, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	if err := copyInputs(ctx, conn, map[string]string{"a": fileA, "b": fileB}); err != nil {
+		return 2, err
+	}
+
+	inv.QueryA = fmt.Sprintf(streamInputQuery, "a")
+	inv.QueryB = fmt.Sprintf(streamInputQuery, "b")
+	return printInvocation(conn, inv)
+}
+
+// copyInputs creates the jd_sql_input temporary table on conn and copies each file of
+// inputs into it in chunks, under the name it is mapped from.
+func copyInputs(ctx context.Context, conn *sql.Conn, inputs map[string]string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "CREATE TEMPORARY TABLE jd_sql_input (doc text, seq bigint, chunk bytea)"); err != nil {
+		return fmt.Errorf("failed to create input table: %w", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("jd_sql_input", "doc", "seq", "chunk"))
+	if err != nil {
+		return fmt.Errorf("failed to start copy: %w", err)
+	}
+	defer stmt.Close()
+
+	for name, path := range inputs {
+		if err := copyFile(ctx, stmt, name, path); err != nil {
+			return err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("failed to copy inputs: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to copy inputs: %w", err)
+	}
+	return nil
+}
+
+func copyFile(ctx context.Context, stmt *sql.Stmt, name, path string) error {
+	f, err := openTextInput(path)
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %s: %w", path, err)
+	}
+	defer f.Close()
+	buf := make([]byte, streamChunkSize)
+	for seq := int64(0); ; seq++ {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if _, err := stmt.ExecContext(ctx, name, seq, buf[:n]); err != nil {
+				return fmt.Errorf("failed to copy input file: %s: %w", path, err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read input file: %s: %w", path, err)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// testCase is a single runnable case of a batch (manifest) or spec run.
+type testCase struct {
+	Name string
+	// Class groups cases in reports (spec category or manifest file name).
+	Class string
+	// Source locates the case definition (file:line) for error messages.
+	Source string
+	// Tags are matched by the config's skips/xfail rules. Spec cases are tagged with their
+	// category; both spec and manifest cases may list additional "tags".
+	Tags []string
+	// Skip, when non-empty, is the reason the case is not executed.
+	Skip string
+	// XFail, when non-empty, is the reason the case is expected to fail. Such a case
+	// reports XFAIL when it fails and XPASS (counted as a failure) when it passes.
+	XFail string
+	// prepare builds the invocation; reading input files is deferred until the case runs
+	// so that a missing file fails only that case.
+	prepare func() (invocation, error)
+	// Expected result. A nil field is not asserted, but a runner error (exit 2)
+	// always fails the case unless ExpectedExit is 2.
+	ExpectedOutput *string
+	ExpectedExit   *int
+	// Hooks run before and after the case, in its session (see runHooked).
+	Hooks caseHooks
+	// bulk is the result of the case already computed by runBulk (--bulk), if any.
+	bulk *bulkOutcome
+}
+
+type caseStatus string
+
+const (
+	statusPass caseStatus = "PASS"
+	statusFail caseStatus = "FAIL"
+	statusSkip caseStatus = "SKIP"
+	// statusXFail is an expected failure; statusXPass an unexpected pass of an xfail case.
+	statusXFail caseStatus = "XFAIL"
+	statusXPass caseStatus = "XPASS"
+)
+
+// failed reports whether the status counts as a failure of the run.
+func (s caseStatus) failed() bool {
+	return s == statusFail || s == statusXPass
+}
+
+type caseResult struct {
+	Case     testCase
+	Status   caseStatus
+	Output   string
+	Exit     int
+	Err      error
+	Message  string
+	Duration time.Duration
+	// Trace is nil for skipped cases and cases whose inputs could not be prepared.
+	Trace *execTrace
+	// Invocation holds the inputs of the case; it is nil when Trace is.
+	Invocation *invocation
+	// Halted is set on the cases not run because the run reached --max-failures.
+	Halted bool
+}
+
+// runCase executes c on db and evaluates the outcome against the expectations.
+func runCase(db querier, c testCase) caseResult {
+	res := caseResult{Case: c}
+	if c.Skip != "" {
+		res.Status = statusSkip
+		res.Message = c.Skip
+		return res
+	}
+	if err := stopped(); err != nil {
+		// The cases left when the run is stopped are reported as skipped
+		res.Status = statusSkip
+		res.Message = err.Error()
+		return res
+	}
+	start := time.Now()
+	var hookErr error
+	inv, err := c.prepare()
+	if err != nil {
+		res.Exit, res.Err = 2, err
+	} else if c.bulk != nil {
+		res.Trace, res.Invocation = c.bulk.trace, &inv
+		res.Output, res.Exit = redactOutput(inv, c.bulk.output), c.bulk.exit
+	} else if !c.Hooks.empty() {
+		// The hooks can change the result, which is therefore not cached
+		res.Trace, res.Invocation = &execTrace{log: logger.With("case", c.Name)}, &inv
+		res.Output, res.Exit, res.Err, hookErr = runHooked(db, c, inv, res.Trace)
+	} else if output, exit, ok := resultCache.lookup(inv); ok {
+		sqlText, params := inv.query()
+		res.Trace, res.Invocation = &execTrace{SQL: sqlText, Params: params, Cached: true}, &inv
+		res.Output, res.Exit = output, exit
+	} else {
+		res.Trace, res.Invocation = &execTrace{log: logger.With("case", c.Name)}, &inv
+		res.Output, res.Exit, res.Err = execInvocationTrace(db, inv, res.Trace)
+		resultCache.store(inv, res.Output, res.Exit, res.Err)
+	}
+	res.Duration = time.Since(start)
+	res.Message = evaluateCase(c, res)
+	if hookErr != nil {
+		res.Message = hookErr.Error()
+	}
+	if res.Message == "" && oracle != nil && res.Trace != nil {
+		res.Message = checkOracle(inv, res.Output, res.Exit, res.Err)
+	}
+	switch {
+	case c.XFail != "" && res.Message != "":
+		res.Status = statusXFail
+		res.Message = fmt.Sprintf("expected failure (%s): %s", c.XFail, res.Message)
+	case c.XFail != "":
+		res.Status = statusXPass
+		res.Message = fmt.Sprintf("unexpectedly passed (xfail: %s)", c.XFail)
+	case res.Message != "":
+		res.Status = statusFail
+	default:
+		res.Status = statusPass
+	}
+	return res
+}
+
+// evaluateCase returns a failure description, or "" when res matches the expectations.
+// Outputs are compared ignoring leading and trailing whitespace, like the Java harness,
+// and as JSON values with --json-type json (see outputsEqual).
+func evaluateCase(c testCase, res caseResult) string {
+	if c.ExpectedExit != nil && res.Exit != *c.ExpectedExit {
+		if res.Err != nil {
+			return fmt.Sprintf("exit %d, expected %d: %v", res.Exit, *c.ExpectedExit, res.Err)
+		}
+		return fmt.Sprintf("exit %d, expected %d", res.Exit, *c.ExpectedExit)
+	}
+	if c.ExpectedExit == nil && res.Err != nil {
+		return res.Err.Error()
+	}
+	if c.ExpectedOutput != nil && res.Err == nil {
+		// Fixtures written on Windows end their lines with CRLF
+		expected := strings.TrimSpace(strings.ReplaceAll(*c.ExpectedOutput, "\r\n", "\n"))
+		actual := strings.TrimSpace(res.Output)
+		if !outputsEqual(expected, actual) {
+			return "output mismatch\n" + unifiedDiff("expected", "actual", expected, actual)
+		}
+	}
+	return ""
+}
+
+// suiteOptions control how runs report their results.
+type suiteOptions struct {
+	// Report selects a report format (see reportFormats); empty prints PASS/FAIL lines only.
+	Report string
+	// ReportFile receives the report. When empty the report is written to stdout in
+	// place of the PASS/FAIL lines.
+	ReportFile string
+	// Jobs is the number of cases executed concurrently, each on its own session.
+	Jobs int
+	// Bulk diffs the plain diff cases in a single statement first (see runBulk).
+	Bulk bool
+	// Checkpoint, when set, records the results in this file as the run progresses.
+	Checkpoint string
+	// Resume continues the run recorded in Checkpoint after its last recorded case.
+	Resume bool
+	// Cache, when set, is the directory of the results reused across runs (see
+	// resultCache).
+	Cache string
+	// MaxFailures stops the run once this many cases failed; 0 is no limit. --fail-fast
+	// is a limit of 1.
+	MaxFailures int
+}
+
+func getSuiteOptions(flags cliFlags) (suiteOptions, error) {
+	opts := suiteOptions{
+		Report:     strings.ToLower(strings.TrimSpace(flags.value("report"))),
+		ReportFile: flags.value("report-file"),
+		Bulk:       flags.enabled("bulk"),
+		Checkpoint: flags.value("checkpoint"),
+		Resume:     flags.enabled("resume"),
+		Cache:      flags.value("cache"),
+	}
+	if opts.Report != "" && reportFormats[opts.Report] == nil {
+		return opts, fmt.Errorf("unsupported report format '%s' (supported: %s)", opts.Report, strings.Join(reportFormatNames(), ", "))
+	}
+	if opts.Report == "" && opts.ReportFile != "" {
+		return opts, errors.New("--report-file requires --report")
+	}
+	if opts.Resume && opts.Checkpoint == "" {
+		return opts, errors.New("--resume requires --checkpoint")
+	}
+	opts.Jobs = 1
+	if v := flags.value("jobs"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid --jobs value '%s' (expected a positive integer)", v)
+		}
+		opts.Jobs = n
+	}
+	if v := flags.value("max-failures"); v != "" {
+		if flags.enabled("fail-fast") {
+			return opts, errors.New("--fail-fast and --max-failures cannot be combined")
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid --max-failures value '%s' (expected a positive integer)", v)
+		}
+		opts.MaxFailures = n
+	} else if flags.enabled("fail-fast") {
+		opts.MaxFailures = 1
+	}
+	return opts, nil
+}
+
+// loadSuiteCases loads the cases of the manifest or spec selected by args and returns
+// them with the run kind ("manifest" or "spec").
+func loadSuiteCases(args cliArgs) (string, []testCase, error) {
+	if args.Manifest != "" {
+		entries, err := loadManifest(args.Manifest)
+		if err != nil {
+			return "", nil, err
+		}
+		cases := make([]testCase, 0, len(entries))
+		for _, e := range entries {
+			cases = append(cases, e.testCase(args.Manifest))
+		}
+		return "manifest", cases, nil
+	}
+	cases, err := loadSpecCases(args.Spec)
+	return "spec", cases, err
+}
+
+// runSuite executes cases over a single connection pool, preparing each distinct
+// statement once per session, and prints a line per case
+// followed by a "<kind>: ..." summary, or writes the requested report. It exits 1 if
+// any case failed. With --resume the cases recorded in the checkpoint are not run
+// again; their recorded results are printed and reported with the others.
+func runSuite(flags cliFlags, cfg Config, kind string, cases []testCase, opts suiteOptions) (int, error) {
+	cases, err := filterCases(flags, cases)
+	if err != nil {
+		return 2, err
+	}
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	// The PASS/FAIL lines are replaced by the report when it goes to stdout
+	var console io.Writer = os.Stdout
+	if opts.Report != "" && opts.ReportFile == "" {
+		console = io.Discard
+	}
+
+	configurePool(db, cfg, opts.Jobs)
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	if opts.Cache != "" {
+		if resultCache, err = openCaseCache(baseContext, db, cfg, opts.Cache); err != nil {
+			return 2, err
+		}
+		defer func() {
+			logger.Info("result cache", "dir", opts.Cache, "hits", resultCache.hits.Load(), "stored", resultCache.stored.Load())
+			resultCache = nil
+		}()
+	}
+
+	applyCaseRules(cfg, cases)
+	var cp *checkpoint
+	var results []caseResult
+	if opts.Checkpoint != "" {
+		if cp, results, err = openCheckpoint(opts.Checkpoint, kind, cases, opts.Resume); err != nil {
+			return 2, err
+		}
+		if len(results) > 0 {
+			logger.Info("resuming from checkpoint", "checkpoint", opts.Checkpoint, "done", len(results), "total", len(cases))
+		}
+		for _, res := range results {
+			printCaseResult(console, res)
+		}
+	}
+	pending := cases[len(results):]
+
+	start := time.Now()
+	if opts.Bulk {
+		if err := runBulk(db, pending); err != nil {
+			logger.Warn("running the pairs one by one", "error", err)
+		}
+	}
+	// Results are emitted in case order, so the case after the last one emitted is the
+	// one the output waits for
+	progress := newProgress(flags, len(pending))
+	if len(pending) > 0 {
+		progress.running(pending[0].Name)
+	}
+	emitted := 0
+	limit := newFailureLimit(opts.MaxFailures)
+	var sinkErr error
+	results = append(results, runCases(stmts, pending, opts.Jobs, limit, func(res caseResult) {
+		printCaseResult(console, res)
+		if sinkErr == nil {
+			sinkErr = publishCase(kind, res)
+		}
+		logCase(cfg.Engine, res)
+		cp.record(res)
+		progress.finished(res.Status == statusFail || res.Status == statusXPass)
+		if emitted++; emitted < len(pending) {
+			progress.running(pending[emitted].Name)
+		}
+	})...)
+	progress.close()
+	if err := cp.close(); err != nil {
+		return 2, err
+	}
+	s := summarize(results)
+	fmt.Fprintf(console, "%s: %s\n", kind, s)
+	if n := countHalted(results); n > 0 {
+		logger.Warn("run stopped at the failure limit", "max_failures", opts.MaxFailures, "not_run", n)
+	}
+
+	if opts.Report != "" {
+		run := suiteRun{Kind: kind, Engine: cfg.Engine, Start: start, Elapsed: time.Since(start), Results: results}
+		if err := writeReport(opts, run); err != nil {
+			return 2, err
+		}
+	}
+	if err := stopped(); err != nil {
+		return exitCode(err), err
+	}
+	if sinkErr != nil {
+		return 2, sinkErr
+	}
+	if s.Failed > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// runCases executes cases and calls emit for each result in case order. With jobs > 1
+// the cases run concurrently, on at most as many workers as the pool of db has
+// connections. Every worker runs its cases on a session of its own (see sessionStmts),
+// so a case runs on a single session and concurrently running cases never share one.
+// Results are still emitted in case order as soon as all earlier cases have finished.
+// Once limit is reached no more cases start (see failureLimit).
+func runCases(db *stmtCache, cases []testCase, jobs int, limit *failureLimit, emit func(caseResult)) []caseResult {
+	results := make([]caseResult, len(cases))
+	if n := db.db.Stats().MaxOpenConnections; n > 0 && jobs > n {
+		jobs = n
+	}
+	if jobs <= 1 {
+		session := db.session()
+		defer session.Close()
+		for i, c := range cases {
+			results[i] = limit.run(session, c)
+			emit(results[i])
+		}
+		return results
+	}
+
+	work := make(chan int)
+	done := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session := db.session()
+			defer session.Close()
+			for i := range work {
+				results[i] = limit.run(session, cases[i])
+				done <- i
+			}
+		}()
+	}
+	go func() {
+		for i := range cases {
+			work <- i
+		}
+		close(work)
+		wg.Wait()
+		close(done)
+	}()
+
+	finished := make([]bool, len(cases))
+	next := 0
+	for i := range done {
+		finished[i] = true
+		for next < len(cases) && finished[next] {
+			emit(results[next])
+			next++
+		}
+	}
+	return results
+}
+
+// failureLimit stops a batch or spec run once max cases have failed (--fail-fast,
+// --max-failures), so that a broken install does not grind through every case. The
+// cases running at that point finish; the cases not started are reported as skipped.
+// A nil *failureLimit never stops the run.
+type failureLimit struct {
+	max    int
+	failed atomic.Int64
+}
+
+// newFailureLimit returns the limit of max failures, or nil for max 0.
+func newFailureLimit(max int) *failureLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &failureLimit{max: max}
+}
+
+// run executes c with runCase unless the limit was reached, and counts its failure.
+func (l *failureLimit) run(db querier, c testCase) caseResult {
+	if l == nil {
+		return runCase(db, c)
+	}
+	if l.failed.Load() >= int64(l.max) && c.Skip == "" {
+		return caseResult{Case: c, Status: statusSkip, Halted: true,
+			Message: fmt.Sprintf("not run: the failure limit (%d) was reached", l.max)}
+	}
+	res := runCase(db, c)
+	if res.Status.failed() {
+		l.failed.Add(1)
+	}
+	return res
+}
+
+// countHalted returns the number of results not run because of the failure limit.
+func countHalted(results []caseResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Halted {
+			n++
+		}
+	}
+	return n
+}
+
+func printCaseResult(w io.Writer, res caseResult) {
+	if res.Message == "" {
+		fmt.Fprintf(w, "%s %s\n", res.Status, res.Case.Name)
+		return
+	}
+	lines := strings.Split(strings.TrimRight(res.Message, "\n"), "\n")
+	fmt.Fprintf(w, "%s %s: %s\n", res.Status, res.Case.Name, lines[0])
+	for _, l := range lines[1:] {
+		fmt.Fprintf(w, "    %s\n", l)
+	}
+}
+
+// suiteSummary counts results; Failed includes XPASS results.
+type suiteSummary struct {
+	Passed, Failed, Skipped, XFailed, Total int
+}
+
+func summarize(results []caseResult) suiteSummary {
+	s := suiteSummary{Total: len(results)}
+	for _, r := range results {
+		switch r.Status {
+		case statusPass:
+			s.Passed++
+		case statusFail, statusXPass:
+			s.Failed++
+		case statusSkip:
+			s.Skipped++
+		case statusXFail:
+			s.XFailed++
+		}
+	}
+	return s
+}
+
+func (s suiteSummary) String() string {
+	return fmt.Sprintf("%d passed, %d failed, %d skipped, %d xfailed, %d total", s.Passed, s.Failed, s.Skipped, s.XFailed, s.Total)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// upstreamJdVersion is the josephburnett/jd release whose spec cases sync-spec fetches
+// by default. Bump it together with the external/jd submodule.
+const upstreamJdVersion = "v2.2.0"
+
+// upstreamCasesDir is the directory of the spec case files in the jd repository.
+const upstreamCasesDir = "spec/test/cases"
+
+// upstreamCasePrefix names the case files sync-spec writes, so that a later sync can
+// replace them without touching the jd-sql cases next to them.
+const upstreamCasePrefix = "upstream-"
+
+// specCaseFields are the JSON fields of specCase. Upstream fields outside this set are
+// not converted and are reported.
+var specCaseFields = []string{
+	"name", "description", "category", "content_a", "content_b", "expected_diff", "expected_result",
+	"expected_exit", "should_error", "args", "sql_function", "tags",
+}
+
+func registerSyncSpecFlags(fs *flag.FlagSet) {
+	fs.String("version", upstreamJdVersion, "jd release (tag or commit) to take the spec cases from")
+	fs.String("source", "", "jd source to read instead of downloading the release: a .tar.gz archive (file or URL) or a checkout such as external/jd")
+	fs.String("out", filepath.Join("test-src", "testdata", "cases"), "spec directory to write the upstream-*.json case files to")
+}
+
+// runSyncSpec converts the spec cases of upstream jd at a pinned version into spec case
+// files of the runner: each upstream case file becomes out/upstream-<name>.json, its
+// cases tagged upstream and jd-<version> for skips and xfail rules. Upstream files
+// that the version no longer has are removed, so the directory tracks the version.
+func runSyncSpec(flags cliFlags) (int, error) {
+	version := coalesceNonEmpty(flags.value("version"), upstreamJdVersion)
+	out := coalesceNonEmpty(flags.value("out"), filepath.Join("test-src", "testdata", "cases"))
+	source := flags.value("source")
+	if source == "" {
+		source = "https://github.com/josephburnett/jd/archive/" + version + ".tar.gz"
+	}
+
+	files, err := readUpstreamCases(source)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read the jd spec cases from %s: %w", source, err)
+	}
+	if len(files) == 0 {
+		return 2, fmt.Errorf("no spec cases found under %s in %s", upstreamCasesDir, source)
+	}
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		return 2, err
+	}
+
+	written := map[string]bool{}
+	total := 0
+	for _, name := range sortedMapKeys(files) {
+		cases, err := convertUpstreamCases(name, files[name], version)
+		if err != nil {
+			return 2, err
+		}
+		enc, err := json.MarshalIndent(cases, "", "  ")
+		if err != nil {
+			return 2, err
+		}
+		target := upstreamCasePrefix + name
+		f, err := openOutput(filepath.Join(out, target), false)
+		if err != nil {
+			return 2, err
+		}
+		_, werr := f.Write(append(enc, '\n'))
+		if err := f.finish(werr == nil); err != nil {
+			return 2, err
+		}
+		if werr != nil {
+			return 2, werr
+		}
+		written[target] = true
+		total += len(cases)
+	}
+	stale, _ := filepath.Glob(filepath.Join(out, upstreamCasePrefix+"*.json"))
+	for _, f := range stale {
+		if !written[filepath.Base(f)] {
+			if err := os.Remove(f); err != nil {
+				return 2, err
+			}
+			logger.Info("removed spec file no longer upstream", "file", f)
+		}
+	}
+	fmt.Fprintf(os.Stdout, "synced %d cases in %d files from jd %s to %s\n", total, len(written), version, out)
+	return 0, nil
+}
+
+// readUpstreamCases returns the case files of the jd source by base name: a checkout
+// directory, or a .tar.gz archive of the repository as GitHub serves it (file or URL).
+func readUpstreamCases(source string) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	if isDir(source) {
+		paths, err := filepath.Glob(filepath.Join(source, filepath.FromSlash(upstreamCasesDir), "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return nil, err
+			}
+			files[filepath.Base(p)] = b
+		}
+		return files, nil
+	}
+
+	// openInput downloads URLs and decompresses gzip
+	r, err := openInput(source)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Archive entries are under a top-level directory such as jd-2.2.0/
+		_, rel, _ := strings.Cut(h.Name, "/")
+		if h.Typeflag != tar.TypeReg || path.Dir(rel) != upstreamCasesDir || path.Ext(rel) != ".json" {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Base(rel)] = b
+	}
+}
+
+// convertUpstreamCases parses the upstream case file name and returns its cases in the
+// runner's spec format: the fields of specCase as upstream wrote them, plus the tags.
+func convertUpstreamCases(name string, b []byte, version string) ([]map[string]json.RawMessage, error) {
+	var cases []map[string]json.RawMessage
+	if err := json.Unmarshal(b, &cases); err != nil {
+		return nil, fmt.Errorf("failed to parse upstream spec file %s: %w", name, err)
+	}
+	for i, fields := range cases {
+		for _, k := range sortedMapKeys(fields) {
+			if !contains(specCaseFields, k) {
+				logger.Warn("upstream field not converted", "file", name, "case", i, "field", k)
+				delete(fields, k)
+			}
+		}
+		enc, _ := json.Marshal(fields)
+		var sc specCase
+		if err := json.Unmarshal(enc, &sc); err != nil {
+			return nil, fmt.Errorf("invalid upstream case %d in %s: %w", i, name, err)
+		}
+		for _, tag := range []string{"upstream", "jd-" + version} {
+			if !contains(sc.Tags, tag) {
+				sc.Tags = append(sc.Tags, tag)
+			}
+		}
+		fields["tags"], _ = json.Marshal(sc.Tags)
+	}
+	return cases, nil
+}
+
+func sortedMapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
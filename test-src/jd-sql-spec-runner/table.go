@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// tableDiff selects two tables whose JSON columns are diffed row by row inside the
+// database (table mode). Rows are paired by the key columns.
+type tableDiff struct {
+	TableA, TableB   string
+	Key              []string
+	ColumnA, ColumnB string
+	// Hash compares the canonical hashes of the columns instead of diffing them, and
+	// yields only the keys of the row pairs that differ (hash --table-a).
+	Hash bool
+	// SourceA and SourceB read the sides from two other databases, each a config engine
+	// or a DSN, which the runner pairs by key itself (see runSourceDiff). A side is then
+	// the table TableA or the rows of the query QueryA (likewise for B).
+	SourceA, SourceB string
+	QueryA, QueryB   string
+}
+
+// getTableDiff reads the table mode flags; ok is false when neither --table-a nor
+// --source-a is given.
+func getTableDiff(flags cliFlags) (td tableDiff, ok bool, err error) {
+	td = tableDiff{
+		TableA:  flags.value("table-a"),
+		TableB:  flags.value("table-b"),
+		ColumnA: flags.value("column"),
+		ColumnB: flags.value("column-b"),
+		SourceA: flags.value("source-a"),
+		SourceB: flags.value("source-b"),
+	}
+	if td.sourced() {
+		td.QueryA = coalesceNonEmpty(flags.value("query-a"), flags.value("a-query"))
+		td.QueryB = coalesceNonEmpty(flags.value("query-b"), flags.value("b-query"))
+		if err := td.validateSources(flags); err != nil {
+			return td, true, err
+		}
+	} else if td.TableA == "" && td.TableB == "" {
+		return td, false, nil
+	}
+	for _, k := range strings.Split(flags.value("key"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			td.Key = append(td.Key, k)
+		}
+	}
+	if td.ColumnB == "" {
+		td.ColumnB = td.ColumnA
+	}
+	switch {
+	case !td.sourced() && (td.TableA == "" || td.TableB == ""):
+		return td, true, errors.New("table mode requires both --table-a and --table-b")
+	case len(td.Key) == 0:
+		return td, true, errors.New("table mode requires --key (comma separated key columns)")
+	case td.ColumnA == "":
+		return td, true, errors.New("table mode requires --column (the JSON column to diff)")
+	}
+	return td, true, nil
+}
+
+// query returns the statement of a table mode run of inv: hashQuery for hash, equalQuery
+// with --equal, otherwise diffQuery.
+func (td tableDiff) query(inv invocation) (string, []any) {
+	var q string
+	var params []any
+	switch {
+	case td.Hash:
+		q = td.hashQuery()
+	case inv.Equal:
+		q, params = td.equalQuery(inv.Options)
+	default:
+		q, params = td.diffQuery(inv.Format, inv.Options)
+	}
+	return renderSQL(q), params
+}
+
+// diffQuery returns the statement that diffs the tables with jd_diff and yields the key
+// (as a JSON object) and diff of every row pair whose diff is not empty. Rows present in
+// only one table are diffed against NULL, which jd_diff treats as a missing document.
+func (td tableDiff) diffQuery(format string, options []byte) (string, []any) {
+	keys := make([]string, len(td.Key))
+	pairs := make([]string, len(td.Key))
+	for i, k := range td.Key {
+		keys[i] = quoteIdent(k)
+		pairs[i] = fmt.Sprintf("%s, %s", sqlLiteral(k), keys[i])
+	}
+	sqlText := fmt.Sprintf(`SELECT jsonb_build_object(%s) AS key, d FROM (
+  SELECT %s, jd_diff(a.%s::jsonb, b.%s::jsonb, $1::jsonb, $2::jd_diff_format) AS d
+  FROM %s AS a FULL JOIN %s AS b USING (%s)
+) AS s
+WHERE NOT jd_diff_is_empty(d, $2::jd_diff_format)
+ORDER BY %s`,
+		strings.Join(pairs, ", "),
+		strings.Join(keys, ", "), quoteIdent(td.ColumnA), quoteIdent(td.ColumnB),
+		quoteQualifiedIdent(td.TableA), quoteQualifiedIdent(td.TableB), strings.Join(keys, ", "),
+		strings.Join(keys, ", "))
+	return sqlText, []any{jdsql.NullableText(options), format}
+}
+
+// equalQuery returns the statement that tests the row pairs of the tables with jd_equal
+// (--equal). It stops at the first pair that differs, yielding its key, so no diff is
+// built and not every row need be compared.
+func (td tableDiff) equalQuery(options []byte) (string, []any) {
+	keys := make([]string, len(td.Key))
+	pairs := make([]string, len(td.Key))
+	for i, k := range td.Key {
+		keys[i] = quoteIdent(k)
+		pairs[i] = fmt.Sprintf("%s, %s", sqlLiteral(k), keys[i])
+	}
+	sqlText := fmt.Sprintf(`SELECT jsonb_build_object(%s) AS key, NULL::jsonb AS d
+FROM %s AS a FULL JOIN %s AS b USING (%s)
+WHERE NOT jd_equal(a.%s::jsonb, b.%s::jsonb, coalesce($1::jsonb, '[]'::jsonb))
+LIMIT 1`,
+		strings.Join(pairs, ", "),
+		quoteQualifiedIdent(td.TableA), quoteQualifiedIdent(td.TableB), strings.Join(keys, ", "),
+		quoteIdent(td.ColumnA), quoteIdent(td.ColumnB))
+	return sqlText, []any{jdsql.NullableText(options)}
+}
+
+// hashQuery returns the statement that compares the jd_canonical_hash of the columns of
+// every row pair and yields the key of each pair whose hashes differ, with a NULL diff.
+// Only those pairs can have a non-empty diff, so they are the ones worth diffing.
+func (td tableDiff) hashQuery() string {
+	keys := make([]string, len(td.Key))
+	pairs := make([]string, len(td.Key))
+	for i, k := range td.Key {
+		keys[i] = quoteIdent(k)
+		pairs[i] = fmt.Sprintf("%s, %s", sqlLiteral(k), keys[i])
+	}
+	return fmt.Sprintf(`SELECT jsonb_build_object(%s) AS key, NULL::jsonb AS d
+FROM %s AS a FULL JOIN %s AS b USING (%s)
+WHERE jd_canonical_hash(a.%s::jsonb) IS DISTINCT FROM jd_canonical_hash(b.%s::jsonb)
+ORDER BY %s`,
+		strings.Join(pairs, ", "),
+		quoteQualifiedIdent(td.TableA), quoteQualifiedIdent(td.TableB), strings.Join(keys, ", "),
+		quoteIdent(td.ColumnA), quoteIdent(td.ColumnB),
+		strings.Join(keys, ", "))
+}
+
+// quoteIdent quotes name as an SQL identifier, so it is used exactly as written.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteQualifiedIdent quotes each dot separated part of a schema qualified name.
+func quoteQualifiedIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = quoteIdent(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// rowsQuerier is implemented by *sql.DB and *sql.Tx.
+type rowsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// runTableDiff streams the non-empty diffs of the row pairs of td to stdout as JSON
+// lines ({"key": {...}, "diff": ...}) and exits 1 if any row pair differs. With --equal
+// nothing is printed, and with td.Hash only the keys ({"key": {...}}).
+func runTableDiff(flags cliFlags, cfg Config, td tableDiff) (int, error) {
+	inv := flagInvocation(flags, nil, nil)
+	if inv.mode() != "diff" && inv.mode() != "equal" {
+		return 2, fmt.Errorf("%s mode is not supported with --table-a", inv.mode())
+	}
+	if td.sourced() {
+		return runSourceDiff(flags, cfg, td, inv)
+	}
+	sqlText, params := td.query(inv)
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	var q rowsQuerier = db
+	if t := queryTimeouts.statement(); t > 0 {
+		tx, err := beginWithStatementTimeout(ctx, db, t)
+		if err != nil {
+			return 2, err
+		}
+		defer tx.Rollback()
+		q = tx
+	}
+
+	trace := &execTrace{SQL: sqlText, Params: params, Attempts: 1}
+	start := time.Now()
+	finish := func(err error) error {
+		trace.RoundTrip = time.Since(start)
+		trace.Err = queryTimeouts.describe(err)
+		if verbose {
+			logTrace(trace)
+		}
+		return trace.Err
+	}
+	rows, err := q.QueryContext(ctx, sqlText, params...)
+	if err != nil {
+		return 2, fmt.Errorf("query failed: %w", finish(err))
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	// Only the differing rows come back, so their number is not known in advance
+	progress := newProgress(flags, 0)
+	defer progress.close()
+	for rows.Next() {
+		var key, diff []byte
+		if err := rows.Scan(&key, &diff); err != nil {
+			return 2, fmt.Errorf("failed to read table diff row: %w", err)
+		}
+		trace.Rows++
+		progress.finished(false)
+		if inv.Equal {
+			continue
+		}
+		if td.Hash {
+			fmt.Fprintf(w, "{\"key\":%s}\n", key)
+			continue
+		}
+		if len(inv.Redact) > 0 {
+			diff = redactTableDiff(diff, inv)
+		}
+		fmt.Fprintf(w, "{\"key\":%s,\"diff\":%s}\n", key, diff)
+		if err := eventSinks.publish("table", rowEvent{Key: key, Diff: diff}); err != nil {
+			return 2, err
+		}
+	}
+	if err := finish(rows.Err()); err != nil {
+		return 2, fmt.Errorf("query failed: %w", err)
+	}
+	if trace.Rows > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
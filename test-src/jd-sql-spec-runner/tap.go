@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tapDiagnostic is the YAML diagnostic block emitted below a "not ok" line.
+type tapDiagnostic struct {
+	Message      string  `yaml:"message"`
+	Severity     string  `yaml:"severity"`
+	At           string  `yaml:"at,omitempty"`
+	ExpectedExit *int    `yaml:"expected_exit,omitempty"`
+	ActualExit   int     `yaml:"actual_exit"`
+	DurationMS   float64 `yaml:"duration_ms"`
+	Diff         string  `yaml:"diff,omitempty"`
+	Output       string  `yaml:"output,omitempty"`
+}
+
+// writeTAPReport writes TAP version 14: one test point per case, SKIP directives for
+// skipped cases, TODO directives for expected failures and a YAML diagnostic block for
+// failures (including XPASS, which is not reported as a TODO pass).
+func writeTAPReport(w io.Writer, run suiteRun) error {
+	var sb strings.Builder
+	sb.WriteString("TAP version 14\n")
+	fmt.Fprintf(&sb, "1..%d\n", len(run.Results))
+	for i, r := range run.Results {
+		desc := tapEscape(r.Case.Name)
+		switch r.Status {
+		case statusPass:
+			fmt.Fprintf(&sb, "ok %d - %s\n", i+1, desc)
+		case statusSkip:
+			fmt.Fprintf(&sb, "ok %d - %s # SKIP %s\n", i+1, desc, tapEscape(r.Message))
+		case statusXFail:
+			// TODO points are expected to fail and do not count as failures
+			fmt.Fprintf(&sb, "not ok %d - %s # TODO %s\n", i+1, desc, tapEscape(r.Case.XFail))
+		default:
+			fmt.Fprintf(&sb, "not ok %d - %s\n", i+1, desc)
+			if err := writeTAPDiagnostic(&sb, r); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeTAPDiagnostic(sb *strings.Builder, r caseResult) error {
+	msg, diff, _ := strings.Cut(r.Message, "\n")
+	d := tapDiagnostic{
+		Message:      msg,
+		Severity:     "fail",
+		At:           r.Case.Source,
+		ExpectedExit: r.Case.ExpectedExit,
+		ActualExit:   r.Exit,
+		DurationMS:   float64(r.Duration.Microseconds()) / 1000,
+		Diff:         diff,
+	}
+	if diff == "" {
+		d.Output = r.Output
+	}
+	var buf strings.Builder
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	sb.WriteString("  ---\n")
+	for _, l := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		sb.WriteString("  " + l + "\n")
+	}
+	sb.WriteString("  ...\n")
+	return nil
+}
+
+// tapEscape escapes characters with special meaning in a TAP description.
+func tapEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "#", `\#`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
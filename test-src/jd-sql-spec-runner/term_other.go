@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// terminalSize returns zeros: the size of the terminal is not known on this platform, so
+// side-by-side output uses --width, COLUMNS or defaultWidth.
+func terminalSize(*os.File) (cols, rows int) {
+	return 0, 0
+}
+
+// makeRaw fails: raw terminal input, which --tui needs, is not supported on this
+// platform.
+func makeRaw(*os.File) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// openTextInput is openInput for inputs of text (JSON, YAML and NDJSON documents), read
+// through textReader.
+func openTextInput(name string) (io.ReadCloser, error) {
+	rc, err := openInput(name)
+	if err != nil {
+		return nil, err
+	}
+	return textReader(rc), nil
+}
+
+// decodeText is textReader for text already in memory.
+func decodeText(b []byte) ([]byte, error) {
+	return io.ReadAll(textReader(io.NopCloser(bytes.NewReader(b))))
+}
+
+// textReader returns rc as UTF-8 without a byte order mark. Files saved on Windows often
+// start with one, which is not JSON, or are UTF-16: a UTF-8 BOM is stripped, and UTF-16
+// text, marked by its BOM or, without one, detected from the NUL bytes of its first two
+// characters as RFC 4627 describes, is transcoded as it is read.
+func textReader(rc io.ReadCloser) io.ReadCloser {
+	br := bufio.NewReader(rc)
+	head, _ := br.Peek(4)
+	bom, order := textEncoding(head)
+	br.Discard(bom)
+	if order == nil {
+		return readCloser{br, rc}
+	}
+	return readCloser{&utf16Reader{r: br, order: order}, rc}
+}
+
+// textEncoding returns the length of the byte order mark that text starting with head
+// begins with, and the byte order of UTF-16 text, nil for UTF-8.
+func textEncoding(head []byte) (int, binary.ByteOrder) {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		return 3, nil
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		return 2, binary.LittleEndian
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		return 2, binary.BigEndian
+	case len(head) >= 4 && head[0] != 0 && head[1] == 0 && head[2] != 0 && head[3] == 0:
+		return 0, binary.LittleEndian
+	case len(head) >= 4 && head[0] == 0 && head[1] != 0 && head[2] == 0 && head[3] != 0:
+		return 0, binary.BigEndian
+	}
+	return 0, nil
+}
+
+// utf16Reader transcodes the UTF-16 text of r to UTF-8.
+type utf16Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	// out holds the UTF-8 of a character that did not fit in the last Read.
+	out []byte
+}
+
+var errInvalidUTF16 = errors.New("invalid UTF-16 text: odd number of bytes")
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+	var unit [2]byte
+	for n < len(p) {
+		if _, err := io.ReadFull(u.r, unit[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = errInvalidUTF16
+			}
+			if n > 0 && err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		r := rune(u.order.Uint16(unit[:]))
+		if utf16.IsSurrogate(r) {
+			// A lone surrogate decodes to U+FFFD, like encoding/json does
+			if b, err := u.r.Peek(2); err == nil {
+				if dec := utf16.DecodeRune(r, rune(u.order.Uint16(b))); dec != utf8.RuneError {
+					u.r.Discard(2)
+					r = dec
+				} else {
+					r = utf8.RuneError
+				}
+			} else {
+				r = utf8.RuneError
+			}
+		}
+		var buf [utf8.UTFMax]byte
+		enc := buf[:utf8.EncodeRune(buf[:], r)]
+		c := copy(p[n:], enc)
+		n += c
+		u.out = append(u.out, enc[c:]...)
+	}
+	return n, nil
+}
+
+// flagCRLF reports whether --newline asks for CRLF line ends: crlf, or native on
+// Windows.
+func flagCRLF(flags cliFlags) (bool, error) {
+	v := strings.ToLower(strings.TrimSpace(flags.value("newline")))
+	switch v {
+	case "", "lf":
+		return false, nil
+	case "crlf":
+		return true, nil
+	case "native":
+		return runtime.GOOS == "windows", nil
+	}
+	return false, fmt.Errorf("invalid --newline value '%s' (expected lf, crlf or native)", v)
+}
+
+// crlfOutput returns a file whose writes reach dst with their LF line ends turned into
+// CRLF, and the function that flushes it once everything is written. Line ends that are
+// already CRLF are kept. Like compressOutput, the file is a pipe standing in for
+// os.Stdout.
+func crlfOutput(dst *os.File) (*os.File, func() error, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		br, w := bufio.NewReader(pr), bufio.NewWriter(dst)
+		var prev byte
+		for {
+			b, err := br.ReadByte()
+			if err != nil {
+				break
+			}
+			if b == '\n' && prev != '\r' {
+				w.WriteByte('\r')
+			}
+			w.WriteByte(b)
+			prev = b
+			if br.Buffered() == 0 {
+				// Nothing more written yet; streamed output is not held back
+				w.Flush()
+			}
+		}
+		err := w.Flush()
+		pr.Close()
+		done <- err
+	}()
+	finish := func() error {
+		err := pw.Close()
+		if werr := <-done; werr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to write output: %w", werr))
+		}
+		return err
+	}
+	return pw, finish, nil
+}
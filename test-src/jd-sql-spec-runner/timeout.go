@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// defaultConnectTimeout bounds establishing a connection when timeouts.connect is unset,
+// so that an unreachable database fails a run fast.
+const defaultConnectTimeout = 10 * time.Second
+
+// TimeoutConfig bounds each query so a pathological diff of two huge documents cannot
+// hang a run. Zero values disable the respective timeout, except Connect.
+type TimeoutConfig struct {
+	// Connect bounds establishing each connection, TLS and authentication included
+	// (default 10s). --connect-timeout overrides it.
+	Connect time.Duration `yaml:"connect"`
+	// Query is the client side deadline of a query, including retries of the result
+	// scan. --query-timeout (or --timeout) overrides it.
+	Query time.Duration `yaml:"query"`
+	// Statement is the server side statement_timeout of the query (default: Query). The
+	// server cancels the statement itself, which also stops it when the client is gone.
+	Statement time.Duration `yaml:"statement"`
+	// Total bounds the whole run, all its queries and downloads included.
+	// --total-timeout overrides it.
+	Total time.Duration `yaml:"total"`
+}
+
+// timeoutFlags are the flags overriding TimeoutConfig, by name; --timeout is the older
+// name of --query-timeout.
+var timeoutFlags = []struct {
+	name  string
+	field func(*TimeoutConfig) *time.Duration
+}{
+	{"connect-timeout", func(t *TimeoutConfig) *time.Duration { return &t.Connect }},
+	{"timeout", func(t *TimeoutConfig) *time.Duration { return &t.Query }},
+	{"query-timeout", func(t *TimeoutConfig) *time.Duration { return &t.Query }},
+	{"total-timeout", func(t *TimeoutConfig) *time.Duration { return &t.Total }},
+}
+
+// applyTimeoutFlags overrides the timeouts of t set on the command line.
+func applyTimeoutFlags(flags cliFlags, t *TimeoutConfig) error {
+	for _, f := range timeoutFlags {
+		v := flags.value(f.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid --%s value '%s' (expected a duration such as 30s)", f.name, v)
+		}
+		*f.field(t) = d
+	}
+	return nil
+}
+
+// connect returns the connect timeout.
+func (t TimeoutConfig) connect() time.Duration {
+	if t.Connect > 0 {
+		return t.Connect
+	}
+	return defaultConnectTimeout
+}
+
+// queryTimeouts is set from the config and --timeout by run before any query executes.
+var queryTimeouts TimeoutConfig
+
+// context returns ctx bounded by the query deadline.
+func (t TimeoutConfig) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.Query <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, t.Query)
+}
+
+func (t TimeoutConfig) statement() time.Duration {
+	if t.Statement > 0 {
+		return t.Statement
+	}
+	return t.Query
+}
+
+// describe turns a client deadline or a server statement timeout into an error naming
+// the timeout; other errors are returned unchanged.
+func (t TimeoutConfig) describe(err error) error {
+	if err == nil {
+		return nil
+	}
+	var pqErr *pq.Error
+	switch {
+	case interrupted():
+		// The statement was cancelled on SIGINT or SIGTERM
+		return fmt.Errorf("%w: %w", errInterrupted, err)
+	case errors.Is(stopped(), errTotalTimeout):
+		return fmt.Errorf("%w of %s: %w", errTotalTimeout, t.Total, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("query timed out after %s: %w", t.Query, err)
+	case errors.As(err, &pqErr) && pqErr.Code == "57014" && t.statement() > 0:
+		return fmt.Errorf("query exceeded statement_timeout of %s: %w", t.statement(), err)
+	}
+	return err
+}
+
+// beginWithStatementTimeout starts a transaction whose statements are cancelled by the
+// server after d (SET LOCAL statement_timeout).
+func beginWithStatementTimeout(ctx context.Context, db querier, d time.Duration) (*sql.Tx, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	ms := fmt.Sprintf("%dms", max(d.Milliseconds(), 1))
+	if _, err := tx.ExecContext(ctx, "select set_config('statement_timeout', $1, true)", ms); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to set statement_timeout: %w", err)
+	}
+	return tx, nil
+}
+
+// isServerError reports whether err is a failure of the query itself (an error raised
+// by the server, a timeout or a lost connection) rather than a result that could not be
+// scanned into the requested type.
+func isServerError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled) ||
+		retryPolicy.retryable(err)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// TLSConfig configures TLS for Postgres connections. Settings given in the DSN
+// (sslmode, sslrootcert, sslcert, sslkey) take precedence.
+type TLSConfig struct {
+	// Mode is disable, require, verify-ca or verify-full. Without a mode, connections to
+	// localhost or a Unix socket disable TLS (the local dev containers have no
+	// certificates) and all other connections require it.
+	Mode string `yaml:"mode"`
+	// RootCA is the CA bundle used to verify the server certificate.
+	RootCA string `yaml:"root_ca"`
+	// Cert and Key are the client certificate and its private key.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ServerName is the name verified against the server certificate (and sent as SNI)
+	// when it differs from the DSN host, e.g. when connecting through a tunnel.
+	ServerName string `yaml:"server_name"`
+}
+
+var tlsModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+func validateTLSConfig(t TLSConfig) error {
+	if t.Mode != "" && !contains(tlsModes, t.Mode) {
+		return fmt.Errorf("tls.mode: unsupported mode '%s' (supported: %s)", t.Mode, strings.Join(tlsModes, ", "))
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be given together")
+	}
+	for _, f := range []struct{ name, path string }{{"root_ca", t.RootCA}, {"cert", t.Cert}, {"key", t.Key}} {
+		if f.path != "" && !existsFile(f.path) {
+			return fmt.Errorf("tls.%s: file does not exist: %s", f.name, f.path)
+		}
+	}
+	if t.Mode == "disable" && (t.RootCA != "" || t.Cert != "" || t.ServerName != "") {
+		return fmt.Errorf("tls.mode is disable but TLS settings are given")
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// postgresDSN returns the lib/pq key/value connection string for cfg with the TLS
+// settings applied. When tls.server_name is set the DSN host is replaced by the server
+// name, so lib/pq verifies the certificate against it, and dialHost is the address the
+// connection must actually be dialed to.
+func postgresDSN(cfg Config) (dsn string, dialHost string, err error) {
+	kv := cfg.DSN
+	if strings.HasPrefix(kv, "postgres://") || strings.HasPrefix(kv, "postgresql://") {
+		if kv, err = pq.ParseURL(kv); err != nil {
+			return "", "", fmt.Errorf("invalid dsn: %w", err)
+		}
+	}
+	params, err := parseDSNParams(kv)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid dsn: %w", err)
+	}
+	if err := applyService(params); err != nil {
+		return "", "", err
+	}
+	if params["host"] == "" && os.Getenv("PGHOST") == "" && cfg.CloudSQL.Instance == "" {
+		// Like psql, connect to the socket of a local server rather than localhost
+		if dir := defaultSocketDir(coalesceNonEmpty(coalesceNonEmpty(params["port"], os.Getenv("PGPORT")), "5432")); dir != "" {
+			params["host"] = dir
+		}
+	}
+	if params["password"] == "" && os.Getenv("PGPASSWORD") == "" && cfg.Credentials.Provider == "" {
+		password, err := pgpassPassword(params)
+		if err != nil {
+			return "", "", err
+		}
+		if password != "" {
+			params["password"] = password
+		}
+	}
+	// lib/pq would send it to the server as a setting
+	delete(params, "passfile")
+
+	t := cfg.TLS
+	setDefault := func(key, value string) {
+		if _, ok := params[key]; !ok && value != "" {
+			params[key] = value
+		}
+	}
+	mode := t.Mode
+	if mode == "" && isLocalHost(params["host"]) {
+		mode = "disable"
+	}
+	setDefault("sslmode", mode)
+	if cfg.CloudSQL.Instance != "" {
+		// The connections are tunneled through the TLS of the Cloud SQL server proxy
+		params["sslmode"] = "disable"
+	}
+	setDefault("sslrootcert", t.RootCA)
+	setDefault("sslcert", t.Cert)
+	setDefault("sslkey", t.Key)
+	// lib/pq sends settings it does not know itself, such as search_path, to the server
+	setDefault("search_path", cfg.searchPath())
+	setDefault("jd_sql.collation", cfg.Collation)
+	setDefault("jd_sql.merge_null_policy", strings.ToLower(cfg.MergeNullPolicy))
+	// lib/pq bounds the dial, TLS and startup with connect_timeout, in whole seconds
+	setDefault("connect_timeout", strconv.FormatInt(int64(math.Ceil(cfg.Timeouts.connect().Seconds())), 10))
+	if t.ServerName != "" {
+		dialHost = coalesceNonEmpty(params["host"], "localhost")
+		if strings.HasPrefix(dialHost, "/") {
+			return "", "", fmt.Errorf("tls.server_name cannot be used with a Unix socket host")
+		}
+		params["host"] = t.ServerName
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(params[k])
+		parts = append(parts, fmt.Sprintf("%s='%s'", k, v))
+	}
+	return strings.Join(parts, " "), dialHost, nil
+}
+
+// isLocalHost reports whether host (from a DSN; empty means the lib/pq default
+// localhost) is the local machine or a Unix socket directory.
+func isLocalHost(host string) bool {
+	if host == "" || host == "localhost" || strings.HasPrefix(host, "/") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// parseDSNParams parses a libpq key/value connection string: whitespace separated
+// key=value pairs whose values may be single quoted with backslash escapes.
+func parseDSNParams(s string) (map[string]string, error) {
+	params := map[string]string{}
+	r := []rune(s)
+	i := 0
+	skipSpace := func() {
+		for i < len(r) && (r[i] == ' ' || r[i] == '\t' || r[i] == '\n' || r[i] == '\r') {
+			i++
+		}
+	}
+	for {
+		skipSpace()
+		if i >= len(r) {
+			return params, nil
+		}
+		start := i
+		for i < len(r) && r[i] != '=' && r[i] != ' ' {
+			i++
+		}
+		key := string(r[start:i])
+		skipSpace()
+		if i >= len(r) || r[i] != '=' {
+			return nil, fmt.Errorf("missing '=' after '%s'", key)
+		}
+		i++
+		skipSpace()
+		var v strings.Builder
+		if i < len(r) && r[i] == '\'' {
+			i++
+			for ; i < len(r) && r[i] != '\''; i++ {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				v.WriteRune(r[i])
+			}
+			if i >= len(r) {
+				return nil, fmt.Errorf("unterminated quoted value of '%s'", key)
+			}
+			i++
+		} else {
+			for ; i < len(r) && r[i] != ' ' && r[i] != '\t'; i++ {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				v.WriteRune(r[i])
+			}
+		}
+		params[key] = v.String()
+	}
+}
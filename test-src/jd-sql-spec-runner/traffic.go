@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// trafficTraceVersion is the version of the --record trace format.
+const trafficTraceVersion = 1
+
+// trafficTrace is the SQL traffic of a run, captured by --record and served back by
+// --replay: the statements the runner sent, their arguments and their results.
+type trafficTrace struct {
+	Version int            `json:"version"`
+	Entries []trafficEntry `json:"entries"`
+
+	path string
+	mu   sync.Mutex
+	// queues holds the entries not replayed yet, by trafficKey.
+	queues map[string][]*trafficEntry
+	// connectErrs holds the recorded failures to connect not replayed yet.
+	connectErrs []*trafficError
+}
+
+// trafficEntry is one exchange with the database: a failure to connect, or a query
+// or statement with its result or error.
+type trafficEntry struct {
+	// Kind is connect, query (rows are returned) or exec.
+	Kind string         `json:"kind"`
+	SQL  string         `json:"sql,omitempty"`
+	Args []trafficValue `json:"args,omitempty"`
+	// Columns and Types are the names and database types of the result columns.
+	Columns      []string         `json:"columns,omitempty"`
+	Types        []string         `json:"types,omitempty"`
+	Rows         [][]trafficValue `json:"rows,omitempty"`
+	RowsAffected *int64           `json:"rows_affected,omitempty"`
+	// Err is the error of the statement, and RowsErr that of reading its rows after
+	// Rows.
+	Err     *trafficError `json:"error,omitempty"`
+	RowsErr *trafficError `json:"rows_error,omitempty"`
+}
+
+// trafficError is a recorded error, replayed as the same kind of error so that the
+// runner maps it to the same exit code.
+type trafficError struct {
+	Message string `json:"message"`
+	// Code and the fields after it are those of a server error (*pq.Error).
+	Code     string `json:"code,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+	Where    string `json:"where,omitempty"`
+	// Network marks a failure to reach the database, BadConn a connection the driver
+	// gave up on, and Timeout a query cancelled by its deadline.
+	Network bool `json:"network,omitempty"`
+	BadConn bool `json:"bad_conn,omitempty"`
+	Timeout bool `json:"timeout,omitempty"`
+}
+
+// trafficValue is an argument or result value, which JSON would not keep the Go type
+// of: {"text": ...} for bytes (or {"base64": ...} when they are not UTF-8), {"string":
+// ...}, {"int": ...}, {"float": "..."}, {"bool": ...}, {"time": RFC 3339} or null.
+type trafficValue struct {
+	v driver.Value
+}
+
+// sqlTraffic is the trace of --record or --replay, or nil.
+var sqlTraffic *trafficTrace
+
+// replaying is set by --replay: openPostgres then serves the recorded results instead
+// of connecting.
+var replaying bool
+
+// validateTraffic checks --record and --replay.
+func validateTraffic(flags cliFlags, impls []string) error {
+	rec, rep := flags.value("record"), flags.value("replay")
+	if rec == "" && rep == "" {
+		return nil
+	}
+	if rec != "" && rep != "" {
+		return errors.New("--record and --replay cannot be combined")
+	}
+	if flags.value("engines") != "" || len(impls) > 1 {
+		// The statements of several engines would be indistinguishable in one trace
+		return errors.New("--record and --replay cannot be combined with --engines or several --impl")
+	}
+	return nil
+}
+
+// startTraffic loads the --replay trace or starts the --record one. The returned function
+// writes the recorded trace when the run ends, failed or not.
+func startTraffic(flags cliFlags) (func() error, error) {
+	if path := flags.value("replay"); path != "" {
+		t, err := loadTrafficTrace(path)
+		if err != nil {
+			return nil, err
+		}
+		sqlTraffic, replaying = t, true
+		return func() error { return nil }, nil
+	}
+	path := flags.value("record")
+	if path == "" {
+		return func() error { return nil }, nil
+	}
+	sqlTraffic = &trafficTrace{Version: trafficTraceVersion, Entries: []trafficEntry{}, path: path}
+	return sqlTraffic.save, nil
+}
+
+func loadTrafficTrace(path string) (*trafficTrace, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --replay trace: %w", err)
+	}
+	t := &trafficTrace{path: path, queues: map[string][]*trafficEntry{}}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, fmt.Errorf("invalid --replay trace: %s: %w", path, err)
+	}
+	if t.Version != trafficTraceVersion {
+		return nil, fmt.Errorf("invalid --replay trace: %s: unsupported version %d (expected %d)", path, t.Version, trafficTraceVersion)
+	}
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		if e.Kind == "connect" {
+			t.connectErrs = append(t.connectErrs, e.Err)
+			continue
+		}
+		k := trafficKey(e.Kind, e.SQL, e.Args)
+		t.queues[k] = append(t.queues[k], e)
+	}
+	return t, nil
+}
+
+// save writes the recorded trace to its file.
+func (t *trafficTrace) save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to write --record trace: %w", err)
+	}
+	if err := os.WriteFile(t.path, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write --record trace: %w", err)
+	}
+	return nil
+}
+
+func (t *trafficTrace) add(e trafficEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Entries = append(t.Entries, e)
+}
+
+// trafficKey identifies the statements a recorded entry answers on replay.
+func trafficKey(kind, query string, args []trafficValue) string {
+	enc := []byte("[]")
+	if len(args) > 0 {
+		enc, _ = json.Marshal(args)
+	}
+	return kind + "\x00" + query + "\x00" + string(enc)
+}
+
+// errReplayMiss is the error of a statement that the --replay trace has no result (left)
+// for: the run differs from the recorded one.
+var errReplayMiss = errors.New("replay: no recorded result")
+
+// next returns the recorded entry answering the statement, in the order the answers
+// were recorded, or errReplayMiss when the trace has none (left).
+func (t *trafficTrace) next(kind, query string, args []driver.NamedValue) (*trafficEntry, error) {
+	k := trafficKey(kind, query, trafficArgs(args))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q := t.queues[k]
+	if len(q) == 0 {
+		return nil, fmt.Errorf("%w (left) in %s for %s", errReplayMiss, t.path, truncateRunes(strings.Join(strings.Fields(query), " "), 120))
+	}
+	t.queues[k] = q[1:]
+	return q[0], nil
+}
+
+func trafficArgs(args []driver.NamedValue) []trafficValue {
+	out := make([]trafficValue, len(args))
+	for i, a := range args {
+		out[i] = trafficValue{a.Value}
+	}
+	return out
+}
+
+func (v trafficValue) MarshalJSON() ([]byte, error) {
+	var m map[string]any
+	switch t := v.v.(type) {
+	case nil:
+		return []byte("null"), nil
+	case []byte:
+		if utf8.Valid(t) {
+			m = map[string]any{"text": string(t)}
+		} else {
+			m = map[string]any{"base64": base64.StdEncoding.EncodeToString(t)}
+		}
+	case string:
+		m = map[string]any{"string": t}
+	case int64:
+		m = map[string]any{"int": t}
+	case float64:
+		m = map[string]any{"float": strconv.FormatFloat(t, 'g', -1, 64)}
+	case bool:
+		m = map[string]any{"bool": t}
+	case time.Time:
+		m = map[string]any{"time": t.Format(time.RFC3339Nano)}
+	default:
+		m = map[string]any{"string": fmt.Sprint(t)}
+	}
+	return json.Marshal(m)
+}
+
+func (v *trafficValue) UnmarshalJSON(b []byte) error {
+	var m struct {
+		Text   *string `json:"text"`
+		Base64 *string `json:"base64"`
+		String *string `json:"string"`
+		Int    *int64  `json:"int"`
+		Float  *string `json:"float"`
+		Bool   *bool   `json:"bool"`
+		Time   *string `json:"time"`
+	}
+	if string(b) == "null" {
+		v.v = nil
+		return nil
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case m.Text != nil:
+		v.v = []byte(*m.Text)
+	case m.Base64 != nil:
+		v.v, err = base64.StdEncoding.DecodeString(*m.Base64)
+	case m.String != nil:
+		v.v = *m.String
+	case m.Int != nil:
+		v.v = *m.Int
+	case m.Float != nil:
+		v.v, err = strconv.ParseFloat(*m.Float, 64)
+	case m.Bool != nil:
+		v.v = *m.Bool
+	case m.Time != nil:
+		v.v, err = time.Parse(time.RFC3339Nano, *m.Time)
+	default:
+		err = fmt.Errorf("unknown value %s", b)
+	}
+	return err
+}
+
+// newTrafficError records err.
+func newTrafficError(err error) *trafficError {
+	te := &trafficError{Message: err.Error()}
+	var pqErr *pq.Error
+	switch {
+	case errors.As(err, &pqErr):
+		te.Message, te.Code, te.Severity = pqErr.Message, string(pqErr.Code), pqErr.Severity
+		te.Detail, te.Hint, te.Where = pqErr.Detail, pqErr.Hint, pqErr.Where
+	case errors.Is(err, driver.ErrBadConn):
+		te.BadConn = true
+	case errors.Is(err, context.DeadlineExceeded):
+		te.Timeout = true
+	case exitCode(err) == exitConnection:
+		te.Network = true
+	}
+	return te
+}
+
+// err returns the error te was recorded from, or one of the same kind.
+func (te *trafficError) err() error {
+	switch {
+	case te.Code != "":
+		return &pq.Error{Code: pq.ErrorCode(te.Code), Message: te.Message, Severity: te.Severity,
+			Detail: te.Detail, Hint: te.Hint, Where: te.Where}
+	case te.BadConn:
+		return driver.ErrBadConn
+	case te.Timeout:
+		return fmt.Errorf("%s: %w", te.Message, context.DeadlineExceeded)
+	case te.Network:
+		return &replayedNetError{te.Message}
+	default:
+		return errors.New(te.Message)
+	}
+}
+
+// replayedNetError is a recorded network error.
+type replayedNetError struct{ msg string }
+
+func (e *replayedNetError) Error() string   { return e.msg }
+func (e *replayedNetError) Timeout() bool   { return false }
+func (e *replayedNetError) Temporary() bool { return false }
+
+// Recording: a connector wrapping that of the driver, whose connections, statements and
+// rows add what passes through them to the trace.
+
+type recordingConnector struct {
+	driver.Connector
+	t *trafficTrace
+}
+
+func (c recordingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		c.t.add(trafficEntry{Kind: "connect", Err: newTrafficError(err)})
+		return nil, err
+	}
+	return &recordingConn{conn: conn, t: c.t}, nil
+}
+
+type recordingConn struct {
+	conn driver.Conn
+	t    *trafficTrace
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *recordingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var st driver.Stmt
+	var err error
+	if p, ok := c.conn.(driver.ConnPrepareContext); ok {
+		st, err = p.PrepareContext(ctx, query)
+	} else {
+		st, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &recordingStmt{stmt: st, query: query, t: c.t}, nil
+}
+
+func (c *recordingConn) Close() error { return c.conn.Close() }
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *recordingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.conn.Begin()
+}
+
+func (c *recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := q.QueryContext(ctx, query, args)
+	return c.t.recordRows(query, args, rows, err)
+}
+
+func (c *recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	res, err := e.ExecContext(ctx, query, args)
+	return c.t.recordResult(query, args, res, err)
+}
+
+func (c *recordingConn) Ping(ctx context.Context) error {
+	if p, ok := c.conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *recordingConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *recordingConn) IsValid() bool {
+	if v, ok := c.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type recordingStmt struct {
+	stmt  driver.Stmt
+	query string
+	t     *trafficTrace
+}
+
+func (s *recordingStmt) Close() error  { return s.stmt.Close() }
+func (s *recordingStmt) NumInput() int { return s.stmt.NumInput() }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *recordingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	var err error
+	if e, ok := s.stmt.(driver.StmtExecContext); ok {
+		res, err = e.ExecContext(ctx, args)
+	} else {
+		res, err = s.stmt.Exec(plainValues(args))
+	}
+	return s.t.recordResult(s.query, args, res, err)
+}
+
+func (s *recordingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	var err error
+	if q, ok := s.stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		rows, err = s.stmt.Query(plainValues(args))
+	}
+	return s.t.recordRows(s.query, args, rows, err)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return out
+}
+
+func plainValues(args []driver.NamedValue) []driver.Value {
+	out := make([]driver.Value, len(args))
+	for i, a := range args {
+		out[i] = a.Value
+	}
+	return out
+}
+
+// recordResult records the result of an exec.
+func (t *trafficTrace) recordResult(query string, args []driver.NamedValue, res driver.Result, err error) (driver.Result, error) {
+	e := trafficEntry{Kind: "exec", SQL: query, Args: trafficArgs(args)}
+	if err != nil {
+		e.Err = newTrafficError(err)
+	} else if n, nerr := res.RowsAffected(); nerr == nil {
+		e.RowsAffected = &n
+	}
+	t.add(e)
+	return res, err
+}
+
+// recordRows records the rows of a query as they are read; the entry is added when
+// they are closed.
+func (t *trafficTrace) recordRows(query string, args []driver.NamedValue, rows driver.Rows, err error) (driver.Rows, error) {
+	e := trafficEntry{Kind: "query", SQL: query, Args: trafficArgs(args)}
+	if err != nil {
+		e.Err = newTrafficError(err)
+		t.add(e)
+		return nil, err
+	}
+	e.Columns, e.Rows = rows.Columns(), [][]trafficValue{}
+	if ct, ok := rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		for i := range e.Columns {
+			e.Types = append(e.Types, ct.ColumnTypeDatabaseTypeName(i))
+		}
+	}
+	return &recordingRows{Rows: rows, e: e, t: t}, nil
+}
+
+type recordingRows struct {
+	driver.Rows
+	e    trafficEntry
+	t    *trafficTrace
+	done bool
+}
+
+func (r *recordingRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	switch {
+	case err == nil:
+		row := make([]trafficValue, len(dest))
+		for i, v := range dest {
+			if b, ok := v.([]byte); ok {
+				// The driver may reuse its buffer for the next row
+				v = append([]byte(nil), b...)
+			}
+			row[i] = trafficValue{v}
+		}
+		r.e.Rows = append(r.e.Rows, row)
+	case err != io.EOF:
+		r.e.RowsErr = newTrafficError(err)
+	}
+	return err
+}
+
+func (r *recordingRows) Close() error {
+	if !r.done {
+		r.done = true
+		r.t.add(r.e)
+	}
+	return r.Rows.Close()
+}
+
+func (r *recordingRows) ColumnTypeDatabaseTypeName(i int) string {
+	if i < len(r.e.Types) {
+		return r.e.Types[i]
+	}
+	return ""
+}
+
+// Replaying: a connector whose connections answer every statement from the trace,
+// without a database.
+
+type replayConnector struct{ t *trafficTrace }
+
+func (c replayConnector) Connect(context.Context) (driver.Conn, error) {
+	c.t.mu.Lock()
+	defer c.t.mu.Unlock()
+	if len(c.t.connectErrs) > 0 {
+		te := c.t.connectErrs[0]
+		c.t.connectErrs = c.t.connectErrs[1:]
+		return nil, te.err()
+	}
+	return &replayConn{t: c.t}, nil
+}
+
+func (c replayConnector) Driver() driver.Driver { return replayDriver{} }
+
+type replayDriver struct{}
+
+func (replayDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("replay: connections are opened by the connector")
+}
+
+type replayConn struct{ t *trafficTrace }
+
+func (c *replayConn) Prepare(query string) (driver.Stmt, error) {
+	return &replayStmt{conn: c, query: query}, nil
+}
+
+func (c *replayConn) Close() error               { return nil }
+func (c *replayConn) Begin() (driver.Tx, error)  { return replayTx{}, nil }
+func (c *replayConn) Ping(context.Context) error { return nil }
+
+func (c *replayConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return replayTx{}, nil
+}
+
+func (c *replayConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	e, err := c.t.next("query", query, args)
+	if err != nil {
+		return nil, err
+	}
+	if e.Err != nil {
+		return nil, e.Err.err()
+	}
+	return &replayRows{e: e}, nil
+}
+
+func (c *replayConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, err := c.t.next("exec", query, args)
+	if err != nil {
+		return nil, err
+	}
+	if e.Err != nil {
+		return nil, e.Err.err()
+	}
+	var n int64
+	if e.RowsAffected != nil {
+		n = *e.RowsAffected
+	}
+	return driver.RowsAffected(n), nil
+}
+
+type replayTx struct{}
+
+func (replayTx) Commit() error   { return nil }
+func (replayTx) Rollback() error { return nil }
+
+type replayStmt struct {
+	conn  *replayConn
+	query string
+}
+
+func (s *replayStmt) Close() error  { return nil }
+func (s *replayStmt) NumInput() int { return -1 }
+
+func (s *replayStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *replayStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, namedValues(args))
+}
+
+func (s *replayStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *replayStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
+
+type replayRows struct {
+	e *trafficEntry
+	i int
+}
+
+func (r *replayRows) Columns() []string { return r.e.Columns }
+func (r *replayRows) Close() error      { return nil }
+
+func (r *replayRows) Next(dest []driver.Value) error {
+	if r.i == len(r.e.Rows) {
+		if r.e.RowsErr != nil {
+			return r.e.RowsErr.err()
+		}
+		return io.EOF
+	}
+	for j, v := range r.e.Rows[r.i] {
+		if j < len(dest) {
+			dest[j] = v.v
+		}
+	}
+	r.i++
+	return nil
+}
+
+func (r *replayRows) ColumnTypeDatabaseTypeName(i int) string {
+	if i < len(r.e.Types) {
+		return r.e.Types[i]
+	}
+	return ""
+}
+
+// trafficDB returns the database of a run under --replay, or wraps connector to record
+// its traffic under --record; otherwise it opens connector as is.
+func trafficDB(connector driver.Connector) *sql.DB {
+	switch {
+	case replaying:
+		return sql.OpenDB(replayConnector{sqlTraffic})
+	case sqlTraffic != nil:
+		return sql.OpenDB(recordingConnector{connector, sqlTraffic})
+	default:
+		return sql.OpenDB(connector)
+	}
+}
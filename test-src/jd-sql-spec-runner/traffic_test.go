@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// runMainEnv makes the test binary run the runner instead of the tests, so that every
+// run starts from a fresh process as it does from the shell (see runReplay).
+const runMainEnv = "JD_SQL_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+// replayDir holds the config, inputs and recorded trace of the --replay tests.
+const replayDir = "../testdata/jd-sql-spec-runner/replay"
+
+// runReplay runs the runner with args in replayDir, answering its statements from
+// replica.trace.json, and returns its stdout, stderr and exit code.
+func runReplay(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	args = append([]string{"-c", "jd-sql-spec.yaml", "--replay", "replica.trace.json"}, args...)
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = replayDir
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", daemonEnv+"=")
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		code = exitErr.ExitCode()
+	case err != nil:
+		t.Fatalf("failed to run %v: %v", args, err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{
+			name:   "diff",
+			args:   []string{"a.json", "b.json"},
+			stdout: "@ [\"a\"]\n- 1\n+ 2\n",
+			code:   1,
+		},
+		{
+			name:   "patch conflict",
+			args:   []string{"-p", "conflict.jd", "a.json"},
+			stderr: "patch conflict at hunk 1\n  path:     [\"a\"]\n  expected: 5\n  actual:   1\n",
+			code:   1,
+		},
+		{
+			name:   "error",
+			args:   []string{"invalid.json", "b.json"},
+			stderr: "pq: invalid input syntax for type json",
+			code:   2,
+		},
+		{
+			name:   "not recorded",
+			args:   []string{"b.json", "a.json"},
+			stderr: "replay: no recorded result (left) in replica.trace.json for SELECT d, jd_diff_is_empty(d, $4::jd_diff_format) FROM jd_diff(",
+			code:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runReplay(t, tt.args...)
+			if stdout != tt.stdout {
+				t.Errorf("stdout = %q, want %q", stdout, tt.stdout)
+			}
+			if !strings.Contains(stderr, tt.stderr) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr, tt.stderr)
+			}
+			if code != tt.code {
+				t.Errorf("exit code = %d, want %d (stderr %q)", code, tt.code, stderr)
+			}
+		})
+	}
+}
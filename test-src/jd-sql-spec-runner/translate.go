@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// translateFormats are the formats a diff can be translated between, the values of the
+// jd_diff_format type of the packaged SQL.
+var translateFormats = []string{jdsql.FormatJd, jdsql.FormatJd2, jdsql.FormatPatch, jdsql.FormatMerge}
+
+func registerTranslateFlags(fs *flag.FlagSet) {
+	registerDiffFlags(fs)
+	fs.String("to", "", "format to translate the diff to: jd|jd2|patch|merge")
+}
+
+// translateFlag returns the -t value of the translate command: its --from and --to
+// flags as <in>2<out>, with --from defaulting to auto. -t itself is still accepted.
+func translateFlag(flags cliFlags) (string, error) {
+	t := coalesceNonEmpty(flags.value("t"), flags.value("translate"))
+	to := strings.ToLower(strings.TrimSpace(flags.value("to")))
+	switch {
+	case t != "" && to != "":
+		return "", errors.New("-t cannot be combined with --to")
+	case t != "":
+		return t, nil
+	case to == "":
+		return "", fmt.Errorf("translate requires --to <format> (supported pairs: %s)", translatePairs(translateFormats))
+	}
+	from := strings.ToLower(strings.TrimSpace(coalesceNonEmpty(flags.value("from"), jdsql.FormatAuto)))
+	return from + "2" + to, nil
+}
+
+// validateTranslateFlag rejects a -t value that does not name a supported pair of
+// formats, which would otherwise fail in the database on the jd_diff_format cast, or
+// not be taken for a translation at all.
+func validateTranslateFlag(flags cliFlags) error {
+	t := coalesceNonEmpty(flags.value("t"), flags.value("translate"))
+	if t == "" {
+		return nil
+	}
+	in, out := jdsql.ParseTranslate(t)
+	if (in != jdsql.FormatAuto && !contains(translateFormats, in)) || !contains(translateFormats, out) {
+		return fmt.Errorf("unsupported translation '%s' (supported pairs: %s; the input format may also be auto)",
+			t, translatePairs(translateFormats))
+	}
+	return nil
+}
+
+// translatePairs lists the translations between formats as <in>2<out>.
+func translatePairs(formats []string) string {
+	var pairs []string
+	for _, in := range formats {
+		for _, out := range formats {
+			if in != out {
+				pairs = append(pairs, in+"2"+out)
+			}
+		}
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// describeTranslateError explains the failure of a translation whose formats the
+// installed jd_diff_format does not have, as when the functions predate jd2, by listing
+// the pairs the installed functions support. Other errors are returned as they are.
+func describeTranslateError(db rowQuerier, inv invocation, err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "22P02" || !strings.Contains(pqErr.Message, "jd_diff_format") {
+		return err
+	}
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	var formats []string
+	if qerr := db.QueryRowContext(ctx, renderSQL("SELECT enum_range(NULL::jd_diff_format)::text[]")).Scan(pq.Array(&formats)); qerr != nil {
+		return err
+	}
+	return fmt.Errorf("translation %s2%s is not supported by the installed jd_translate_diff_format (supported pairs: %s): %w",
+		inv.TranslateIn, inv.TranslateOut, translatePairs(formats), err)
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"jd-sql/test-runner/pkg/jdsql"
+	"jd-sql/test-runner/render"
+)
+
+// The TUI is drawn with ANSI escapes on the alternate screen rather than with a
+// terminal UI library, which keeps the runner free of a dependency.
+const (
+	ansiAltScreen   = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen  = "\x1b[?25h\x1b[?1049l"
+	ansiHome        = "\x1b[H"
+	ansiClearLine   = "\x1b[K"
+	ansiReverse     = "\x1b[7m"
+	ansiBold        = "\x1b[1m"
+	ansiResetStyles = "\x1b[0m"
+)
+
+// tuiHelp is the key help on the status line of the TUI.
+const tuiHelp = "↑↓ move  ←→ fold  tab view  / search  n/N next  PgUp/PgDn scroll  q quit"
+
+// validateTUI rejects --tui outside an interactive plain diff of two input files.
+func validateTUI(args cliArgs, inv invocation) error {
+	if !args.Flags.enabled("tui") {
+		return nil
+	}
+	flags := inv.modeFlags()
+	if inv.At != nil {
+		flags = append(flags, "--at")
+	}
+	if inv.Paths != "" {
+		flags = append(flags, "-f "+inv.Paths)
+	}
+	if inv.SideBySide {
+		flags = append(flags, "-f "+formatSideBySide)
+	}
+	if len(flags) > 0 {
+		return errors.New("--tui cannot be combined with " + strings.Join(flags, " and "))
+	}
+	if len(inv.Redact) > 0 || oracle != nil {
+		return errors.New("--tui cannot be combined with --redact or --oracle")
+	}
+	if args.Command != "" || args.Table != nil || args.queryMode() || args.Update != nil || args.Git != nil ||
+		args.Manifest != "" || args.Spec != "" || isDir(args.FileA) || args.FileB == "" ||
+		args.Flags.enabled("stream") || args.Flags.enabled("ndjson") || args.Flags.enabled("watch") ||
+		args.Flags.value("chunk") != "" || args.Flags.value("report") != "" {
+		return errors.New("--tui is only supported for a single diff of two input files")
+	}
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if fi, err := f.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return errors.New("--tui requires a terminal on stdin and stdout")
+		}
+	}
+	return nil
+}
+
+// tuiNode is a path of the diff in the tree of the TUI, holding the elements of the diff
+// at and below it.
+type tuiNode struct {
+	label    string
+	path     string
+	depth    int
+	elems    []int
+	parent   *tuiNode
+	children []*tuiNode
+	expanded bool
+}
+
+// buildTUITree returns the tree of the paths of elems: the root is the whole document,
+// and each segment of the path of an element is a node, in the order of the diff.
+func buildTUITree(elems []diffElement) *tuiNode {
+	root := &tuiNode{label: "[]", path: "[]", expanded: true}
+	for i, e := range elems {
+		n := root
+		n.elems = append(n.elems, i)
+		for depth := range e.Path {
+			label := compactJSON(e.Path[depth])
+			var child *tuiNode
+			for _, c := range n.children {
+				if c.label == label {
+					child = c
+					break
+				}
+			}
+			if child == nil {
+				child = &tuiNode{label: label, path: compactJSON(e.Path[:depth+1]), depth: depth + 1, parent: n, expanded: depth == 0}
+				n.children = append(n.children, child)
+			}
+			n = child
+			n.elems = append(n.elems, i)
+		}
+	}
+	return root
+}
+
+// visible appends n and its descendants under expanded nodes to out, in tree order.
+func (n *tuiNode) visible(out []*tuiNode) []*tuiNode {
+	out = append(out, n)
+	if n.expanded {
+		for _, c := range n.children {
+			out = c.visible(out)
+		}
+	}
+	return out
+}
+
+// all appends n and all its descendants to out, in tree order.
+func (n *tuiNode) all(out []*tuiNode) []*tuiNode {
+	out = append(out, n)
+	for _, c := range n.children {
+		out = c.all(out)
+	}
+	return out
+}
+
+// tuiState is the state of the TUI: the tree, the selection and the view of its diff.
+type tuiState struct {
+	db      rowQuerier
+	inv     invocation
+	title   string
+	raw     []json.RawMessage
+	root    *tuiNode
+	rows    []*tuiNode
+	cursor  int
+	top     int
+	formats []string
+	format  int
+	scroll  int
+	search  string
+	typing  bool
+	message string
+	views   map[string][]string
+}
+
+// runTUI diffs fileA and fileB and opens the diff in a terminal browser: a collapsible
+// tree of the changed paths next to the diff of the selected path, which can be shown
+// as a jd diff, a JSON Patch or a merge patch. Each view is rendered in the database
+// with jd_render_diff from the elements under the path. The exit code is that of the
+// diff; equal documents print nothing and exit 0 without opening it.
+func runTUI(flags cliFlags, cfg Config, fileA, fileB string) (int, error) {
+	aText, bText, err := readInputs(fileA, fileB)
+	if err != nil {
+		return 2, err
+	}
+	inv := flagInvocation(flags, aText, bText)
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	q, params := jdsql.DiffElementsQuery(inv.A, inv.B, inv.Options)
+	var out []byte
+	err = db.QueryRowContext(ctx, renderSQL(q), params...).Scan(&out)
+	cancel()
+	if err != nil {
+		return 2, queryTimeouts.describe(fmt.Errorf("query failed: %w", err))
+	}
+	var raw []json.RawMessage
+	var elems []diffElement
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return 2, fmt.Errorf("unexpected diff elements: %w", err)
+	}
+	if err := json.Unmarshal(out, &elems); err != nil {
+		return 2, fmt.Errorf("unexpected diff elements: %w", err)
+	}
+	if len(elems) == 0 {
+		return 0, nil
+	}
+
+	s := &tuiState{
+		db: db, inv: inv, raw: raw, root: buildTUITree(elems),
+		title:   fmt.Sprintf("%s → %s", fileA, fileB),
+		formats: []string{jdsql.FormatJd, jdsql.FormatPatch, jdsql.FormatMerge},
+		views:   map[string][]string{},
+	}
+	if inv.Format == jdsql.FormatJd2 {
+		s.formats[0] = jdsql.FormatJd2
+	}
+	for i, f := range s.formats {
+		if f == inv.Format {
+			s.format = i
+		}
+	}
+	s.rows = s.root.visible(nil)
+
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return 2, fmt.Errorf("--tui: %w", err)
+	}
+	fmt.Fprint(os.Stdout, ansiAltScreen)
+	defer func() {
+		fmt.Fprint(os.Stdout, ansiMainScreen)
+		restore()
+	}()
+	buf := make([]byte, 64)
+	for {
+		s.draw()
+		n, err := os.Stdin.Read(buf)
+		if err != nil || stopped() != nil {
+			return 1, nil
+		}
+		if !s.key(string(buf[:n])) {
+			return 1, nil
+		}
+	}
+}
+
+// key handles the key k, as read from the terminal, and reports whether the TUI goes on.
+func (s *tuiState) key(k string) bool {
+	s.message = ""
+	if s.typing {
+		switch k {
+		case "\r", "\n":
+			s.typing = false
+			s.find(1, true)
+		case "\x1b", "\x03":
+			s.typing, s.search = false, ""
+		case "\x7f", "\b":
+			if r := []rune(s.search); len(r) > 0 {
+				s.search = string(r[:len(r)-1])
+			}
+		default:
+			if k[0] >= ' ' && !strings.HasPrefix(k, "\x1b") {
+				s.search += k
+			}
+		}
+		return true
+	}
+	cur := s.rows[s.cursor]
+	_, height := s.size()
+	switch k {
+	case "q", "\x03", "\x1b":
+		return false
+	case "k", "\x1b[A", "\x1bOA":
+		s.move(s.cursor - 1)
+	case "j", "\x1b[B", "\x1bOB":
+		s.move(s.cursor + 1)
+	case "g", "\x1b[H", "\x1bOH":
+		s.move(0)
+	case "G", "\x1b[F", "\x1bOF":
+		s.move(len(s.rows) - 1)
+	case "l", "\x1b[C", "\x1bOC":
+		if len(cur.children) > 0 && !cur.expanded {
+			s.toggle(cur)
+		} else if len(cur.children) > 0 {
+			s.move(s.cursor + 1)
+		}
+	case "h", "\x1b[D", "\x1bOD":
+		if cur.expanded && len(cur.children) > 0 {
+			s.toggle(cur)
+		} else if cur.parent != nil {
+			s.reveal(cur.parent)
+		}
+	case "\r", "\n", " ":
+		s.toggle(cur)
+	case "\t", "f":
+		s.format, s.scroll = (s.format+1)%len(s.formats), 0
+	case "\x1b[Z":
+		s.format, s.scroll = (s.format+len(s.formats)-1)%len(s.formats), 0
+	case "1", "2", "3":
+		s.format, s.scroll = int(k[0]-'1'), 0
+	case "\x1b[6~", "\x04":
+		s.scroll += height - 3
+	case "\x1b[5~", "\x15":
+		s.scroll = max(s.scroll-(height-3), 0)
+	case "/":
+		s.typing, s.search = true, ""
+	case "n":
+		s.find(1, false)
+	case "N":
+		s.find(-1, false)
+	}
+	return true
+}
+
+// move selects row i of the tree, within bounds.
+func (s *tuiState) move(i int) {
+	i = max(0, min(i, len(s.rows)-1))
+	if i != s.cursor {
+		s.cursor, s.scroll = i, 0
+	}
+}
+
+// reveal selects node n, expanding its ancestors so that it is visible.
+func (s *tuiState) reveal(n *tuiNode) {
+	for p := n.parent; p != nil; p = p.parent {
+		p.expanded = true
+	}
+	s.rows = s.root.visible(nil)
+	for i, r := range s.rows {
+		if r == n {
+			s.move(i)
+		}
+	}
+}
+
+// toggle expands or collapses node n.
+func (s *tuiState) toggle(n *tuiNode) {
+	if len(n.children) == 0 {
+		return
+	}
+	n.expanded = !n.expanded
+	s.rows = s.root.visible(nil)
+}
+
+// find selects the next node (dir 1) or the previous one (dir -1), from the selection,
+// whose path contains the search text, ignoring case. With here, the selection itself
+// is the first candidate.
+func (s *tuiState) find(dir int, here bool) {
+	if s.search == "" {
+		return
+	}
+	nodes := s.root.all(nil)
+	at := 0
+	for i, n := range nodes {
+		if n == s.rows[s.cursor] {
+			at = i
+		}
+	}
+	if !here {
+		at += dir
+	}
+	needle := strings.ToLower(s.search)
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[((at+dir*i)%len(nodes)+len(nodes))%len(nodes)]
+		if strings.Contains(strings.ToLower(n.path), needle) {
+			s.reveal(n)
+			return
+		}
+	}
+	s.message = fmt.Sprintf("no path matches %q", s.search)
+}
+
+// view returns the lines of the diff of node n in the current format, rendered in the
+// database from its elements and cached. Errors, such as a change a merge patch cannot
+// express, are shown in place of the diff.
+func (s *tuiState) view(n *tuiNode) []string {
+	format := s.formats[s.format]
+	key := format + "\x00" + n.path
+	if lines, ok := s.views[key]; ok {
+		return lines
+	}
+	subset := make([]json.RawMessage, len(n.elems))
+	for i, e := range n.elems {
+		subset[i] = s.raw[e]
+	}
+	elements, _ := json.Marshal(subset)
+	q, params := jdsql.RenderDiffQuery(elements, s.inv.Options, format)
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	var d sql.NullString
+	var empty sql.NullBool
+	var text string
+	if err := s.db.QueryRowContext(ctx, renderSQL(q), params...).Scan(&d, &empty); err != nil {
+		text = "error: " + queryTimeouts.describe(err).Error()
+	} else {
+		text, _ = jdsql.DecodeResult(d.String)
+		var buf bytes.Buffer
+		if !jdsql.IsJdText(format) && json.Indent(&buf, []byte(text), "", "  ") == nil {
+			text = buf.String()
+		}
+	}
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	s.views[key] = lines
+	return lines
+}
+
+// size returns the size of the terminal, with a minimum usable size.
+func (s *tuiState) size() (width, height int) {
+	width, height = terminalSize(os.Stdout)
+	return max(width, 40), max(height, 5)
+}
+
+// draw redraws the whole screen: the title line, the tree and the view of the selected
+// path side by side, and the status line.
+func (s *tuiState) draw() {
+	width, height := s.size()
+	body := height - 2
+	treeWidth := max(min(width*2/5, width-20), 16)
+	viewWidth := width - treeWidth - 3
+
+	if s.cursor < s.top {
+		s.top = s.cursor
+	} else if s.cursor >= s.top+body {
+		s.top = s.cursor - body + 1
+	}
+	cur := s.rows[s.cursor]
+	lines := s.view(cur)
+	s.scroll = max(min(s.scroll, len(lines)-body), 0)
+
+	var b strings.Builder
+	b.WriteString(ansiHome)
+	var tabs []string
+	for i, f := range s.formats {
+		if i == s.format {
+			f = "[" + f + "]"
+		}
+		tabs = append(tabs, f)
+	}
+	title := fmt.Sprintf(" jd-sql  %s  ·  %d changes  ·  view: %s", s.title, len(s.raw), strings.Join(tabs, " "))
+	b.WriteString(ansiReverse + padRunes(title, width) + ansiResetStyles + "\r\n")
+	for row := 0; row < body; row++ {
+		left := ""
+		selected := false
+		if i := s.top + row; i < len(s.rows) {
+			n := s.rows[i]
+			marker := "  "
+			if len(n.children) > 0 && n.expanded {
+				marker = "▾ "
+			} else if len(n.children) > 0 {
+				marker = "▸ "
+			}
+			left = fmt.Sprintf("%s%s%s (%d)", strings.Repeat("  ", n.depth), marker, n.label, len(n.elems))
+			selected = i == s.cursor
+		}
+		left = padRunes(left, treeWidth)
+		if selected {
+			left = ansiReverse + left + ansiResetStyles
+		}
+		right := ""
+		if i := s.scroll + row; i < len(lines) {
+			right = truncateRunes(lines[i], viewWidth)
+			if jdsql.IsJdText(s.formats[s.format]) && colorOutput {
+				right = render.Colorize(right)
+			}
+		}
+		b.WriteString(left + " │ " + right + ansiClearLine + "\r\n")
+	}
+	status := " " + cur.path + "  ·  " + tuiHelp
+	switch {
+	case s.typing:
+		status = " /" + s.search
+	case s.message != "":
+		status = " " + s.message
+	}
+	b.WriteString(ansiBold + truncateRunes(status, width) + ansiResetStyles + ansiClearLine)
+	fmt.Fprint(os.Stdout, b.String())
+}
+
+// truncateRunes returns s cut to at most n runes.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// padRunes returns s cut or padded with spaces to n runes.
+func padRunes(s string, n int) string {
+	s = truncateRunes(s, n)
+	return s + strings.Repeat(" ", n-utf8.RuneCountInString(s))
+}
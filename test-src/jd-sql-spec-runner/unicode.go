@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// normalizationForms are the accepted --normalize values.
+var normalizationForms = []string{"nfc", "nfkc"}
+
+// flagNormalize returns the Unicode normalization form of --normalize in the spelling of
+// jd_normalize_unicode (NFC or NFKC), or "" without it.
+func flagNormalize(flags cliFlags) string {
+	return strings.ToUpper(flags.value("normalize"))
+}
+
+// validateNormalize rejects unknown --normalize forms, and --normalize outside the modes
+// that diff or compare two documents.
+func validateNormalize(args cliArgs, inv invocation) error {
+	v := args.Flags.value("normalize")
+	if v == "" {
+		return nil
+	}
+	if !contains(normalizationForms, strings.ToLower(v)) {
+		return fmt.Errorf("unsupported --normalize form '%s' (supported: %s)", v, strings.Join(normalizationForms, ", "))
+	}
+	if m := inv.mode(); m != "diff" && m != "stat" && m != "equal" {
+		return fmt.Errorf("--normalize is not supported in %s mode", m)
+	}
+	if oracle != nil {
+		return errors.New("--oracle cannot be combined with --normalize")
+	}
+	if args.Table != nil || args.queryMode() || args.Update != nil || args.Manifest != "" || args.Spec != "" ||
+		args.Flags.enabled("stream") || args.Flags.value("chunk") != "" {
+		return errors.New("--normalize is not supported in table, query, update, batch, spec, streaming and chunked modes")
+	}
+	return nil
+}
+
+// withNormalize returns the statement q, with its arguments, with the documents passed
+// through jd_normalize_unicode, which normalizes their strings and keys to form. With
+// --schema, the documents are normalized before the defaults are filled in.
+func withNormalize(q string, args []any, form string) (string, []any) {
+	call := fmt.Sprintf("jd_normalize_unicode($$${1}::jsonb, $$%d)", len(args)+1)
+	return schemaDocParams.ReplaceAllString(q, call), append(args, form)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// updateTarget selects the rows whose JSON column update mode patches.
+type updateTarget struct {
+	// Table may be schema qualified.
+	Table  string
+	Column string
+	// Where is an SQL condition selecting the rows, used as written.
+	Where string
+}
+
+// getUpdateTarget reads the update mode flags; ok is false when --apply-to is not given.
+func getUpdateTarget(flags cliFlags) (ut updateTarget, ok bool, err error) {
+	applyTo := flags.value("apply-to")
+	if applyTo == "" {
+		return ut, false, nil
+	}
+	i := strings.LastIndex(applyTo, ".")
+	if i <= 0 || i == len(applyTo)-1 {
+		return ut, true, fmt.Errorf("invalid --apply-to value '%s' (expected table.column or schema.table.column)", applyTo)
+	}
+	ut = updateTarget{Table: applyTo[:i], Column: applyTo[i+1:], Where: strings.TrimSpace(flags.value("where"))}
+	if ut.Where == "" {
+		// An UPDATE without WHERE would patch every row; require it to be spelled out
+		return ut, true, errors.New(`update mode requires --where (use --where "true" to patch every row)`)
+	}
+	return ut, true, nil
+}
+
+// statement returns the UPDATE applying the diff bound as $1 (in format) to the column of
+// the selected rows. It returns the row's ctid and the jd diff of the old and new value.
+// A ctid is only unique within one table, so the rows of a partitioned or inherited
+// table are matched by tableoid as well. Where is spliced in after renderSQL, so it
+// runs as written.
+func (ut updateTarget) statement(format string) string {
+	col := quoteIdent(ut.Column)
+	q := renderSQL(fmt.Sprintf(`WITH before AS (
+  SELECT tableoid, ctid, %[1]s::jsonb AS doc FROM %[2]s WHERE %[3]s FOR UPDATE
+)
+UPDATE %[2]s AS t SET %[1]s = %[4]s
+FROM before WHERE t.tableoid = before.tableoid AND t.ctid = before.ctid
+RETURNING before.ctid::text, jd_diff(before.doc, t.%[1]s::jsonb, NULL::jsonb, 'jd'::jd_diff_format)`,
+		col, quoteQualifiedIdent(ut.Table), updateWherePlaceholder, jdsql.PatchCall(format, "before.doc", "$1")))
+	return strings.Replace(q, updateWherePlaceholder, ut.Where, 1)
+}
+
+// updateWherePlaceholder stands for the --where condition while the statement is
+// rendered; see statement.
+const updateWherePlaceholder = "/* where */"
+
+// runUpdate applies the diff in diffFile to the rows selected by ut inside a transaction,
+// printing the before/after diff of every updated row. The transaction is committed
+// only with --commit; with --dry-run it is rolled back.
+func runUpdate(flags cliFlags, cfg Config, ut updateTarget, diffFile string, commit bool) (int, error) {
+	if commit == flags.enabled("dry-run") {
+		return 2, errors.New("update mode requires either --dry-run (preview, rolled back) or --commit (apply)")
+	}
+	inv := flagInvocation(flags, nil, nil)
+	if inv.TranslateIn != "" {
+		return 2, errors.New("translate mode is not supported with --apply-to")
+	}
+	diff, err := readInput(diffFile)
+	if err != nil {
+		return 2, fmt.Errorf("failed to read diff file: %s: %w", diffFile, err)
+	}
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+
+	ctx, cancel := queryTimeouts.context(baseContext)
+	defer cancel()
+	var tx *sql.Tx
+	if t := queryTimeouts.statement(); t > 0 {
+		tx, err = beginWithStatementTimeout(ctx, db, t)
+	} else if tx, err = db.BeginTx(ctx, nil); err != nil {
+		err = fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err != nil {
+		return 2, err
+	}
+	defer tx.Rollback()
+
+	sqlText := ut.statement(inv.Format)
+	params := []any{jdsql.DiffArg(diff, inv.Format)}
+	trace := &execTrace{SQL: sqlText, Params: params, Attempts: 1}
+	rows, err := tx.QueryContext(ctx, sqlText, params...)
+	if err != nil {
+		trace.Err = queryTimeouts.describe(err)
+		if verbose {
+			logTrace(trace)
+		}
+		return 2, fmt.Errorf("update failed: %w", trace.Err)
+	}
+	for rows.Next() {
+		var ctid string
+		var change sql.NullString
+		if err := rows.Scan(&ctid, &change); err != nil {
+			rows.Close()
+			return 2, fmt.Errorf("failed to read updated row: %w", err)
+		}
+		trace.Rows++
+		fmt.Fprintf(os.Stdout, "-- row %s\n%s", ctid, jsonStringValue(change.String))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 2, fmt.Errorf("update failed: %w", queryTimeouts.describe(err))
+	}
+	if verbose {
+		logTrace(trace)
+	}
+
+	if !commit {
+		fmt.Fprintf(os.Stdout, "%d rows would be updated (rolled back; use --commit to apply)\n", trace.Rows)
+		return 0, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return 2, fmt.Errorf("failed to commit: %w", err)
+	}
+	fmt.Fprintf(os.Stdout, "%d rows updated\n", trace.Rows)
+	return 0, nil
+}
+
+// jsonStringValue returns the payload of a JSON string, or s unchanged.
+func jsonStringValue(s string) string {
+	var v string
+	if json.Unmarshal([]byte(s), &v) == nil {
+		return v
+	}
+	return s
+}
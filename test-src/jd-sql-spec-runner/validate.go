@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"jd-sql/test-runner/pkg/jdsql"
+)
+
+// validateLocal parses the JSON inputs of inv, read from fileA and fileB, for
+// --validate-local. It returns an error locating the first syntax error by line and
+// column, which the database's "invalid input syntax for type json" does not. jd text
+// diffs and blank inputs (bound as NULL) are not checked.
+func validateLocal(inv invocation, fileA, fileB string) error {
+	type input struct {
+		name string
+		doc  []byte
+	}
+	var inputs []input
+	switch {
+	case inv.TranslateIn != "" || inv.mode() == "invert":
+		if !jdsql.IsJdText(inv.TranslateIn) {
+			inputs = append(inputs, input{fileA, inv.A})
+		}
+	case inv.Patch || inv.Check:
+		if !jdsql.IsJdText(inv.Format) {
+			inputs = append(inputs, input{fileA, inv.A})
+		}
+		inputs = append(inputs, input{fileB, inv.B})
+	default:
+		inputs = append(inputs, input{fileA, inv.A}, input{fileB, inv.B})
+	}
+	for _, in := range inputs {
+		if len(bytes.TrimSpace(in.doc)) == 0 {
+			continue
+		}
+		var v any
+		err := json.Unmarshal(in.doc, &v)
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			line, col := lineColumn(in.doc, syntax.Offset)
+			return fmt.Errorf("%s:%d:%d: invalid JSON: %s", in.name, line, col, syntax.Error())
+		}
+		if err != nil {
+			return fmt.Errorf("%s: invalid JSON: %w", in.name, err)
+		}
+	}
+	return nil
+}
+
+// lineColumn returns the 1-based line and column of the byte before offset, where
+// encoding/json reports a syntax error.
+func lineColumn(doc []byte, offset int64) (line, col int) {
+	end := int(min(max(offset-1, 0), int64(len(doc))))
+	line = 1 + bytes.Count(doc[:end], []byte("\n"))
+	return line, end - bytes.LastIndexByte(doc[:end], '\n')
+}
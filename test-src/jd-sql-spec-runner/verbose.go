@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// verbose is set when debug logs are enabled (-v or --log-level debug): every query is
+// then traced and logged.
+var verbose bool
+
+// queryFirst runs stmt and scans the leading columns of the first row into dest, recording
+// the result column type and the number of rows in trace. Columns beyond dest are
+// skipped, and dest beyond the columns of the statement is left untouched.
+func queryFirst(ctx context.Context, stmt *sql.Stmt, args []any, trace *execTrace, dest ...any) error {
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if trace != nil {
+		if cols, err := rows.ColumnTypes(); err == nil && len(cols) > 0 {
+			trace.ColumnType = cols[0].DatabaseTypeName()
+		}
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	targets := make([]any, len(cols))
+	for i := range targets {
+		if i < len(dest) {
+			targets[i] = dest[i]
+		} else {
+			targets[i] = new(any)
+		}
+	}
+	return rows.Scan(targets...)
+}
+
+// logTrace logs the trace of one query at debug level, with the fields of t.log.
+func logTrace(t *execTrace) {
+	params := make([]string, len(t.Params))
+	for i, p := range t.Params {
+		switch v := p.(type) {
+		case nil:
+			params[i] = fmt.Sprintf("$%d NULL", i+1)
+		case string:
+			if len(v) <= 16 && !strings.ContainsAny(v, "\n") {
+				params[i] = fmt.Sprintf("$%d %q (%d bytes)", i+1, v, len(v))
+			} else {
+				params[i] = fmt.Sprintf("$%d %d bytes", i+1, len(v))
+			}
+		default:
+			params[i] = fmt.Sprintf("$%d %T", i+1, v)
+		}
+	}
+	colType := t.ColumnType
+	if colType == "" {
+		colType = "unknown"
+	}
+	attrs := []any{
+		"sql", strings.Join(strings.Fields(t.SQL), " "),
+		"params", strings.Join(params, ", "),
+		"rows", t.Rows,
+		"column_type", colType,
+		"round_trip", t.RoundTrip.Round(10 * time.Microsecond),
+		"attempts", t.Attempts,
+	}
+	if t.Err != nil {
+		attrs = append(attrs, "error", t.Err.Error())
+		var pqErr *pq.Error
+		if errors.As(t.Err, &pqErr) {
+			attrs = append(attrs, "sqlstate", string(pqErr.Code))
+			if pqErr.Detail != "" {
+				attrs = append(attrs, "detail", pqErr.Detail)
+			}
+			if pqErr.Where != "" {
+				attrs = append(attrs, "where", strings.ReplaceAll(pqErr.Where, "\n", " | "))
+			}
+		}
+	}
+	log := t.log
+	if log == nil {
+		log = logger
+	}
+	log.Debug("query", attrs...)
+}
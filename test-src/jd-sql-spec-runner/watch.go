@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// watchInterval is how often watched files are checked for changes.
+const watchInterval = 250 * time.Millisecond
+
+// runWatch runs the diff of fileA and fileB, then again whenever either file changes,
+// until interrupted. Runs are separated by a timestamped line on stdout; errors are
+// reported on stderr and do not stop watching.
+//
+// Files are polled rather than watched with fsnotify: polling by path also follows
+// editors that save by replacing the file, and keeps the runner free of a dependency.
+func runWatch(flags cliFlags, cfg Config, fileA, fileB string) (int, error) {
+	// Interrupting the runner ends watching
+	ctx := baseContext
+
+	db, err := openPostgres(cfg)
+	if err != nil {
+		return 2, err
+	}
+	defer db.Close()
+	stmts := newStmtCache(db)
+	defer stmts.Close()
+
+	files := []string{fileA}
+	if fileB != "" {
+		files = append(files, fileB)
+	}
+	last := statFiles(files)
+	for {
+		runWatched(flags, stmts, fileA, fileB)
+
+		// Wait for a change, then until the files are stable for one interval, so that a
+		// save in several writes triggers a single run
+		for changed := false; ; {
+			select {
+			case <-ctx.Done():
+				return 0, nil
+			case <-time.After(watchInterval):
+			}
+			cur := statFiles(files)
+			if cur != last {
+				changed, last = true, cur
+				continue
+			}
+			if changed {
+				break
+			}
+		}
+	}
+}
+
+func runWatched(flags cliFlags, db querier, fileA, fileB string) {
+	fmt.Fprintf(os.Stdout, "=== %s ===\n", time.Now().Format(time.RFC3339))
+	aText, bText, err := readInputs(fileA, fileB)
+	if err == nil {
+		_, err = printInvocation(db, flagInvocation(flags, aText, bText))
+	}
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// statFiles returns a fingerprint of the size and modification time of files; a
+// missing file contributes its error text.
+func statFiles(files []string) string {
+	var fp string
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			fp += fmt.Sprintf("%s: %v\n", f, err)
+			continue
+		}
+		fp += fmt.Sprintf("%s: %d %d\n", f, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return fp
+}
@@ -0,0 +1,116 @@
+package jdsql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// DefaultBatchSize is the number of diffs a BatchDiffer sends in one statement unless
+// its Size is set.
+const DefaultBatchSize = 100
+
+// DiffResult is the result of one diff of a batch.
+type DiffResult struct {
+	// Diff is the diff, as returned by Client.Diff.
+	Diff string
+	// Equal is set when the documents have no diff.
+	Equal bool
+	// Err is the error of this diff, such as invalid JSON in one of its documents.
+	Err error
+}
+
+// BatchDiffer queues diffs and runs them in batches, each batch one statement and one
+// round trip, instead of one round trip per diff:
+//
+//	b := client.Batch()
+//	for _, p := range pairs {
+//		b.Add(p.Old, p.New)
+//	}
+//	results, err := b.Flush(ctx)
+//
+// The diffs use the format and options of the client. For the batches to share one
+// connection, create the client on a *sql.Conn. A BatchDiffer is not safe for
+// concurrent use.
+type BatchDiffer struct {
+	// Size is the number of diffs sent in one statement; 0 means DefaultBatchSize.
+	Size int
+
+	c     *Client
+	pairs [][2][]byte
+}
+
+// Batch returns an empty BatchDiffer running its diffs with c.
+func (c *Client) Batch() *BatchDiffer {
+	return &BatchDiffer{c: c}
+}
+
+// Add queues the diff from a to b. Its result is at the same index, counting from the
+// last Flush, as the call to Add.
+func (bd *BatchDiffer) Add(a, b []byte) {
+	bd.pairs = append(bd.pairs, [2][]byte{a, b})
+}
+
+// Len returns the number of queued diffs.
+func (bd *BatchDiffer) Len() int {
+	return len(bd.pairs)
+}
+
+// Flush runs the queued diffs and returns their results in the order they were added,
+// emptying the queue. A batch whose statement fails, for example on invalid JSON, is
+// run again one diff at a time, so the error is reported on the diffs that cause it and
+// the others still succeed. The error of Flush itself is that of ctx, after which the
+// results are incomplete.
+func (bd *BatchDiffer) Flush(ctx context.Context) ([]DiffResult, error) {
+	pairs := bd.pairs
+	bd.pairs = nil
+	size := bd.Size
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	results := make([]DiffResult, 0, len(pairs))
+	for start := 0; start < len(pairs); start += size {
+		chunk := pairs[start:min(start+size, len(pairs))]
+		res, err := bd.run(ctx, chunk)
+		if err != nil {
+			if ctx.Err() != nil {
+				return results, ctx.Err()
+			}
+			res = make([]DiffResult, len(chunk))
+			for i, p := range chunk {
+				q, args := DiffQuery(p[0], p[1], bd.c.opts.JSON(), bd.c.opts.Format)
+				d, different, err := bd.c.query(ctx, "diff", q, args)
+				if ctx.Err() != nil {
+					return results, ctx.Err()
+				}
+				res[i] = DiffResult{Diff: d, Equal: err == nil && !different, Err: err}
+			}
+		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+// run diffs chunk in one statement.
+func (bd *BatchDiffer) run(ctx context.Context, chunk [][2][]byte) ([]DiffResult, error) {
+	q, args := BatchDiffQuery(chunk, bd.c.opts.JSON(), bd.c.opts.Format)
+	var raw []byte
+	if err := bd.c.queryRow(ctx, bd.c.opts.Naming.Qualify(q), args...).Scan(&raw); err != nil {
+		return nil, fmt.Errorf("jd-sql batch diff failed: %w", err)
+	}
+	var rows [][2]json.RawMessage
+	if err := json.Unmarshal(raw, &rows); err != nil || len(rows) != len(chunk) {
+		return nil, fmt.Errorf("jd-sql batch diff failed: unexpected result")
+	}
+	res := make([]DiffResult, len(rows))
+	for i, r := range rows {
+		var empty bool
+		_ = json.Unmarshal(r[1], &empty)
+		if string(r[0]) != "null" {
+			// A NULL diff, as from NULL documents, is empty as in Client.Diff
+			res[i].Diff, _ = DecodeResult(string(r[0]))
+		}
+		res[i].Equal = empty
+	}
+	return res, nil
+}
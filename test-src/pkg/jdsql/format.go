@@ -0,0 +1,103 @@
+package jdsql
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Diff formats, the values of the jd_diff_format SQL type.
+const (
+	// FormatJd is the jd native text format.
+	FormatJd = "jd"
+	// FormatJd2 names the jd v2 native text format explicitly; see DetectJdFormat.
+	FormatJd2 = "jd2"
+	// FormatPatch is RFC 6902 JSON Patch.
+	FormatPatch = "patch"
+	// FormatMerge is RFC 7386 JSON Merge Patch.
+	FormatMerge = "merge"
+	// FormatAuto is not a jd_diff_format: it asks for the format of an input diff to be
+	// detected with DetectDiffFormat.
+	FormatAuto = "auto"
+)
+
+// NormalizeFormat maps a user supplied format to a jd_diff_format value, defaulting to jd.
+func NormalizeFormat(f string) string {
+	v := strings.TrimSpace(strings.ToLower(f))
+	switch v {
+	case FormatJd, FormatJd2, FormatPatch, FormatMerge:
+		return v
+	default:
+		return FormatJd
+	}
+}
+
+// KnownFormat reports whether f is a jd_diff_format value.
+func KnownFormat(f string) bool {
+	return NormalizeFormat(f) == f
+}
+
+// IsJdText reports whether format is one of the jd native text formats (v1 or v2).
+func IsJdText(format string) bool {
+	return format == FormatJd || format == FormatJd2
+}
+
+// DetectJdFormat tells v2 jd diff text from v1: only v2 has '^' options and metadata
+// lines and context lines. Content given as a JSON string is unwrapped first.
+func DetectJdFormat(content []byte) string {
+	text := string(content)
+	var s string
+	if json.Unmarshal(content, &s) == nil {
+		text = s
+	}
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case line == "", strings.HasPrefix(line, "@ "), strings.HasPrefix(line, "- "), strings.HasPrefix(line, "+ "):
+		default:
+			return FormatJd2
+		}
+	}
+	return FormatJd
+}
+
+// DetectDiffFormat sniffs the format of diff content: a JSON array is an RFC 6902
+// patch, a JSON object an RFC 7386 merge patch, and anything else jd text, v1 or v2 as
+// DetectJdFormat tells.
+func DetectDiffFormat(content []byte) string {
+	var v any
+	if json.Unmarshal(content, &v) == nil {
+		switch v.(type) {
+		case []any:
+			return FormatPatch
+		case map[string]any:
+			return FormatMerge
+		}
+	}
+	return DetectJdFormat(content)
+}
+
+// ParseTranslate splits a translate spec of the form <in>2<out> (e.g., jd2patch). As
+// jd2 is itself a format, the split that leaves a known format on both sides wins, so
+// jd22jd reads jd2 to jd and jd2jd2 reads jd to jd2.
+func ParseTranslate(t string) (inFmt string, outFmt string) {
+	if t == "" {
+		return "", ""
+	}
+	t = strings.ToLower(t)
+	for i := strings.Index(t, "2"); i >= 0; {
+		in, out := t[:i], t[i+1:]
+		if KnownFormat(in) && KnownFormat(out) {
+			return in, out
+		}
+		next := strings.Index(t[i+1:], "2")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	// expect pattern X2Y
+	parts := strings.SplitN(t, "2", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
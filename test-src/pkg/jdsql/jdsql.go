@@ -0,0 +1,234 @@
+// Package jdsql calls the jd-sql SQL functions (jd_diff, jd_patch_text, jd_apply_patch,
+// jd_apply_merge, jd_patch_check and jd_translate_diff_format) from Go:
+//
+//	client := jdsql.New(db, jdsql.Options{Format: jdsql.FormatPatch})
+//	d, err := client.Diff(ctx, a, b)
+//
+// Documents are passed as raw JSON text and parsed by the database, so invalid JSON
+// surfaces as an SQL error. The jd-sql functions must be installed (see the runner's
+// install subcommand).
+//
+// The caller owns the connections: a Client runs on the *sql.DB, *sql.Conn or *sql.Tx it
+// is given, or on any driver through NewFunc, and every call takes the context it runs
+// under. With derives a client with other options for a single call, and a BatchDiffer
+// sends many diffs in one round trip.
+package jdsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Querier is the part of *sql.DB, *sql.Conn and *sql.Tx used by a Client.
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Row is the single result row of a statement: a *sql.Row, or the row returned by the
+// QueryRow method of other drivers, such as pgx.
+type Row interface {
+	Scan(dest ...any) error
+}
+
+// QueryRowFunc runs a statement that returns a single row. It adapts pools of drivers
+// other than database/sql, for example a pgx pool:
+//
+//	client := jdsql.NewFunc(func(ctx context.Context, q string, args ...any) jdsql.Row {
+//		return pool.QueryRow(ctx, q, args...)
+//	}, opts)
+//
+// Arguments are strings, holding JSON or jd text, and nil for NULL. Results are scanned
+// into *sql.NullString, *sql.NullBool and *[]byte.
+type QueryRowFunc func(ctx context.Context, query string, args ...any) Row
+
+// Options configures a Client. Zero values select the jd format and no jd options.
+type Options struct {
+	// Format is the diff format of Diff and Patch: jd (default), jd2, patch or merge.
+	Format string
+	// Set compares arrays as sets (jd -set).
+	Set bool
+	// MultiSet compares arrays as multisets (jd -mset).
+	MultiSet bool
+	// Precision, when set, treats numbers within this tolerance as equal (jd -precision).
+	Precision *float64
+	// SetKeys matches objects in arrays by these keys (jd -setkeys).
+	SetKeys []string
+	// Strict6902 makes Translate reject RFC 6902 operations it cannot represent, such as
+	// a move whose source value is unknown, instead of dropping them.
+	Strict6902 bool
+	// Naming locates functions installed in a dedicated schema or with a name prefix.
+	Naming Naming
+}
+
+// JSON returns the jd options array of o, or nil (NULL options) when no option is set.
+func (o Options) JSON() []byte {
+	var opts []any
+	if o.Set {
+		opts = append(opts, "SET")
+	}
+	if o.MultiSet {
+		opts = append(opts, "MULTISET")
+	}
+	if o.Precision != nil {
+		opts = append(opts, map[string]json.RawMessage{"precision": json.RawMessage(strconv.FormatFloat(*o.Precision, 'g', -1, 64))})
+	}
+	if len(o.SetKeys) > 0 {
+		opts = append(opts, map[string][]string{"setkeys": o.SetKeys})
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	enc, _ := json.Marshal(opts)
+	return enc
+}
+
+// Client runs jd-sql calls on a database connection or pool. It is safe for concurrent
+// use when its connection or pool is.
+type Client struct {
+	queryRow QueryRowFunc
+	opts     Options
+}
+
+// New returns a Client running its calls on db.
+func New(db Querier, opts Options) *Client {
+	return NewFunc(func(ctx context.Context, q string, args ...any) Row {
+		return db.QueryRowContext(ctx, q, args...)
+	}, opts)
+}
+
+// NewFunc returns a Client running its calls with queryRow.
+func NewFunc(queryRow QueryRowFunc, opts Options) *Client {
+	opts.Format = NormalizeFormat(opts.Format)
+	return &Client{queryRow: queryRow, opts: opts}
+}
+
+// With returns a Client on the same connection or pool with opts in place of the
+// client's options, for calls that need another format or other jd options:
+//
+//	d, err := client.With(jdsql.Options{Format: jdsql.FormatMerge}).Diff(ctx, a, b)
+//
+// A zero Naming in opts keeps the client's. Deriving a client is cheap.
+func (c *Client) With(opts Options) *Client {
+	if opts.Naming == (Naming{}) {
+		opts.Naming = c.opts.Naming
+	}
+	opts.Format = NormalizeFormat(opts.Format)
+	return &Client{queryRow: c.queryRow, opts: opts}
+}
+
+// Options returns the options of the client.
+func (c *Client) Options() Options {
+	return c.opts
+}
+
+// Diff returns the diff from a to b in the client's format: jd text, or the JSON of a
+// patch or merge patch. Equal documents give an empty diff ("", "[]" or "{}").
+func (c *Client) Diff(ctx context.Context, a, b []byte) (string, error) {
+	q, args := DiffQuery(a, b, c.opts.JSON(), c.opts.Format)
+	out, _, err := c.query(ctx, "diff", q, args)
+	return out, err
+}
+
+// Equal reports whether a and b have no diff under the client's options.
+func (c *Client) Equal(ctx context.Context, a, b []byte) (bool, error) {
+	q, args := EqualQuery(a, b, c.opts.JSON())
+	_, different, err := c.query(ctx, "equal", q, args)
+	return !different, err
+}
+
+// Patch applies diff, in the client's format, to doc and returns the resulting document.
+func (c *Client) Patch(ctx context.Context, diff, doc []byte) (string, error) {
+	q, args := PatchQuery(diff, doc, c.opts.Format)
+	out, _, err := c.query(ctx, "patch", q, args)
+	return out, err
+}
+
+// Check reports whether diff, in the client's format, applies cleanly to doc, without
+// applying it. When it does not, failure describes the first failing hunk.
+func (c *Client) Check(ctx context.Context, diff, doc []byte) (ok bool, failure string, err error) {
+	q, args := CheckQuery(diff, doc, c.opts.Format)
+	failure, fails, err := c.query(ctx, "check", q, args)
+	return err == nil && !fails, failure, err
+}
+
+// Conflict is a value that ours and theirs changed differently in a three-way merge.
+// Values absent on a side are nil.
+type Conflict struct {
+	// Path is the jd path of the value, e.g. ["items",0].
+	Path   json.RawMessage `json:"path"`
+	Base   json.RawMessage `json:"base,omitempty"`
+	Ours   json.RawMessage `json:"ours,omitempty"`
+	Theirs json.RawMessage `json:"theirs,omitempty"`
+}
+
+// Merge3 merges ours and theirs, both derived from base, comparing values with the
+// client's options. Where they conflict, the merged document holds ours.
+func (c *Client) Merge3(ctx context.Context, base, ours, theirs []byte) (string, []Conflict, error) {
+	q, args := Merge3Query(base, ours, theirs, c.opts.JSON())
+	var merged sql.NullString
+	var raw []byte
+	if err := c.queryRow(ctx, c.opts.Naming.Qualify(q), args...).Scan(&merged, &raw); err != nil {
+		return "", nil, fmt.Errorf("jd-sql merge3 failed: %w", err)
+	}
+	var conflicts []Conflict
+	if err := json.Unmarshal(raw, &conflicts); err != nil {
+		return "", nil, fmt.Errorf("jd-sql merge3 failed: invalid conflicts: %w", err)
+	}
+	out, _ := DecodeResult(merged.String)
+	return out, conflicts, nil
+}
+
+// Canonicalize returns doc in its canonical form: sorted keys, no whitespace and
+// numbers without trailing fractional zeros.
+func (c *Client) Canonicalize(ctx context.Context, doc []byte) (string, error) {
+	q, args := CanonicalizeQuery(doc)
+	out, _, err := c.query(ctx, "canonicalize", q, args)
+	return out, err
+}
+
+// Hash returns the canonical hash of doc: documents that are equal as JSON values,
+// whatever their key order and formatting, have the same hash.
+func (c *Client) Hash(ctx context.Context, doc []byte) (string, error) {
+	q, args := HashQuery(doc)
+	var hash sql.NullString
+	if err := c.queryRow(ctx, c.opts.Naming.Qualify(q), args...).Scan(&hash); err != nil {
+		return "", fmt.Errorf("jd-sql hash failed: %w", err)
+	}
+	return hash.String, nil
+}
+
+// Translate converts diff from one format to another.
+func (c *Client) Translate(ctx context.Context, diff []byte, from, to string) (string, error) {
+	if !KnownFormat(from) || !KnownFormat(to) {
+		return "", fmt.Errorf("unknown translate formats '%s' and '%s' (expected jd, jd2, patch or merge)", from, to)
+	}
+	q, args := TranslateQuery(diff, from, to, c.opts.Strict6902)
+	out, _, err := c.query(ctx, "translate", q, args)
+	return out, err
+}
+
+// query runs q, whose second column is the jd_diff_is_empty of the first (or, for
+// check, whether it applies) except in patch and canonicalize mode, whose statements
+// have one column.
+func (c *Client) query(ctx context.Context, mode, q string, args []any) (string, bool, error) {
+	var out sql.NullString
+	var empty sql.NullBool
+	dest := []any{&out, &empty}
+	if mode == "patch" || mode == "canonicalize" {
+		dest = dest[:1]
+	}
+	if err := c.queryRow(ctx, c.opts.Naming.Qualify(q), args...).Scan(dest...); err != nil {
+		return "", false, fmt.Errorf("jd-sql %s failed: %w", mode, err)
+	}
+	if !out.Valid {
+		return "", false, nil
+	}
+	s, different := DecodeResult(out.String)
+	if empty.Valid {
+		different = !empty.Bool
+	}
+	return s, different, nil
+}
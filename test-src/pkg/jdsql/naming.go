@@ -0,0 +1,50 @@
+package jdsql
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Naming locates the jd-sql functions when they are installed in a dedicated schema or
+// with a name prefix. The zero Naming leaves statements unqualified, so the names are
+// resolved through the search_path.
+type Naming struct {
+	// Schema qualifies the jd-sql functions and types, e.g. "jd" calls "jd"."jd_diff".
+	Schema string
+	// FunctionPrefix is prepended to the function names, e.g. "x_" calls "x_jd_diff".
+	// Type names are not prefixed.
+	FunctionPrefix string
+}
+
+// The jd-sql names of the statements built by this package: function calls, such as
+// jd_diff(, and casts, such as ::jd_diff_format.
+var (
+	jdFunctionCall = regexp.MustCompile(`\bjd_[a-z0-9_]+\(`)
+	jdTypeCast     = regexp.MustCompile(`::jd_[a-z0-9_]+\b`)
+)
+
+// Qualify returns q, a statement built by this package, with its jd-sql function and
+// type names qualified by n. The names are quoted, so the schema and prefix are used
+// exactly as written.
+func (n Naming) Qualify(q string) string {
+	if n == (Naming{}) {
+		return q
+	}
+	q = jdFunctionCall.ReplaceAllStringFunc(q, func(call string) string {
+		return n.qualified(n.FunctionPrefix+strings.TrimSuffix(call, "(")) + "("
+	})
+	return jdTypeCast.ReplaceAllStringFunc(q, func(cast string) string {
+		return "::" + n.qualified(strings.TrimPrefix(cast, "::"))
+	})
+}
+
+func (n Naming) qualified(name string) string {
+	if n.Schema == "" {
+		return quoteIdent(name)
+	}
+	return quoteIdent(n.Schema) + "." + quoteIdent(name)
+}
+
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
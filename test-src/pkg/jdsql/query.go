@@ -0,0 +1,303 @@
+package jdsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DiffQuery returns the statement diffing a and b with the 4-arg jd_diff, and its
+// arguments. Blank inputs and nil options are bound as NULL. The second column, from
+// jd_diff_is_empty, tells whether the diff is empty.
+func DiffQuery(a, b, options []byte, format string) (string, []any) {
+	return "SELECT d, jd_diff_is_empty(d, $4::jd_diff_format) FROM jd_diff($1::jsonb, $2::jsonb, $3::jsonb, $4::jd_diff_format) AS d",
+		[]any{NullableText(a), NullableText(b), NullableText(options), format}
+}
+
+// DiffAtQuery returns the statement diffing the values at path, a jd path as JSON, in a
+// and b with jd_diff_at, and its arguments. It returns the same columns as DiffQuery;
+// the paths of the diff start with path.
+func DiffAtQuery(a, b, path, options []byte, format string) (string, []any) {
+	return "SELECT d, jd_diff_is_empty(d, $5::jd_diff_format) FROM jd_diff_at($1::jsonb, $2::jsonb, $3::jsonb, $4::jsonb, $5::jd_diff_format) AS d",
+		[]any{NullableText(a), NullableText(b), NullableText(path), NullableText(options), format}
+}
+
+// DiffElementsQuery returns the statement computing the structural diff of a and b with
+// jd_diff_struct, and its arguments. Its single column is the JSON array of the diff
+// elements, in order, which RenderDiffQuery turns back into a diff.
+func DiffElementsQuery(a, b, options []byte) (string, []any) {
+	return "SELECT coalesce(jsonb_agg(to_jsonb(d) ORDER BY d.ordinality), '[]'::jsonb) " +
+			"FROM jd_diff_struct($1::jsonb, $2::jsonb, coalesce($3::jsonb, '[]'::jsonb)) WITH ORDINALITY AS d",
+		[]any{NullableText(a), NullableText(b), NullableText(options)}
+}
+
+// RenderDiffQuery returns the statement rendering the JSON array of diff elements in
+// format with jd_render_diff, and its arguments. It returns the same columns as DiffQuery.
+func RenderDiffQuery(elements, options []byte, format string) (string, []any) {
+	return "SELECT d, jd_diff_is_empty(d, $3::jd_diff_format) FROM jd_render_diff($1::jsonb, $2::jsonb, $3::jd_diff_format) AS d",
+		[]any{string(elements), NullableText(options), format}
+}
+
+// BatchDiffQuery returns the statement diffing each pair of documents in pairs with the
+// 4-arg jd_diff, and its arguments. The documents are sent as one JSON array of [a, b]
+// pairs of strings, blank documents as null, so a batch is one round trip. Its single
+// column is the JSON array of the results, in order, each a [diff, empty] pair where
+// empty is the jd_diff_is_empty of the diff.
+func BatchDiffQuery(pairs [][2][]byte, options []byte, format string) (string, []any) {
+	docs := make([][2]any, len(pairs))
+	for i, p := range pairs {
+		docs[i] = [2]any{NullableText(p[0]), NullableText(p[1])}
+	}
+	enc, _ := json.Marshal(docs)
+	return "SELECT coalesce(jsonb_agg(jsonb_build_array(d, jd_diff_is_empty(d, $3::jd_diff_format)) ORDER BY t.n), '[]'::jsonb) " +
+			"FROM jsonb_array_elements($1::jsonb) WITH ORDINALITY AS t(p, n), " +
+			"LATERAL jd_diff((t.p->>0)::jsonb, (t.p->>1)::jsonb, $2::jsonb, $3::jd_diff_format) AS d",
+		[]any{string(enc), NullableText(options), format}
+}
+
+// ReadDiffQuery returns the statement reading diff, in format, into its diff elements
+// with the jd_read_diff function of the format, and its arguments. Like
+// DiffElementsQuery its single column is the JSON array of the elements, in order.
+func ReadDiffQuery(diff []byte, format string) (string, []any) {
+	read := "jd_read_diff_text($1::text)"
+	switch format {
+	case FormatPatch:
+		read = "unnest(jd_read_diff_patch($1::jsonb))"
+	case FormatMerge:
+		read = "unnest(jd_read_diff_merge($1::jsonb))"
+	}
+	return "SELECT coalesce(jsonb_agg(to_jsonb(d) ORDER BY d.ordinality), '[]'::jsonb) FROM " + read + " WITH ORDINALITY AS d",
+		[]any{DiffArg(diff, format)}
+}
+
+// PatchElementsQuery returns the statement applying the JSON array of diff elements to
+// doc with jd_patch_struct, and its arguments.
+func PatchElementsQuery(elements, doc []byte) (string, []any) {
+	return "SELECT jd_patch_struct($1::jsonb, array(SELECT jsonb_populate_record(null::jd_diff_element, e) " +
+			"FROM jsonb_array_elements($2::jsonb) WITH ORDINALITY AS t(e, n) ORDER BY n))",
+		[]any{NullableText(doc), string(elements)}
+}
+
+// StatQuery returns the statement summarizing the diff of a and b with jd_diff_stat, and
+// its arguments. Like DiffQuery it returns two columns: the summary as JSON and whether
+// the diff is empty.
+func StatQuery(a, b, options []byte) (string, []any) {
+	return "SELECT s, (s->>'additions')::int + (s->>'removals')::int + (s->>'modifications')::int = 0 " +
+			"FROM jd_diff_stat($1::jsonb, $2::jsonb, coalesce($3::jsonb, '[]'::jsonb)) AS s",
+		[]any{NullableText(a), NullableText(b), NullableText(options)}
+}
+
+// PathsQuery returns the statement listing the paths changed between a and b with
+// jd_diff_paths, and its arguments. Like DiffQuery it returns two columns: the JSON
+// array of paths and whether it is empty.
+func PathsQuery(a, b, options []byte) (string, []any) {
+	return "SELECT p, jsonb_array_length(p) = 0 FROM jd_diff_paths($1::jsonb, $2::jsonb, coalesce($3::jsonb, '[]'::jsonb)) AS p",
+		[]any{NullableText(a), NullableText(b), NullableText(options)}
+}
+
+// HunksQuery returns the statement returning the hunks of the diff of a and b with
+// jd_diff_hunks, one JSON row each, and its arguments.
+func HunksQuery(a, b, options []byte) (string, []any) {
+	return "SELECT h FROM jd_diff_hunks($1::jsonb, $2::jsonb, coalesce($3::jsonb, '[]'::jsonb)) AS h",
+		[]any{NullableText(a), NullableText(b), NullableText(options)}
+}
+
+// EqualQuery returns the statement testing a and b for equality with jd_equal, and its
+// arguments. Like DiffQuery it returns two columns, but no diff is built: the first is
+// always empty and the second tells whether a and b are equal.
+func EqualQuery(a, b, options []byte) (string, []any) {
+	return "SELECT '', jd_equal($1::jsonb, $2::jsonb, coalesce($3::jsonb, '[]'::jsonb))",
+		[]any{NullableText(a), NullableText(b), NullableText(options)}
+}
+
+// PatchQuery returns the statement applying diff, in format, to doc, and its arguments.
+func PatchQuery(diff, doc []byte, format string) (string, []any) {
+	return "SELECT " + PatchCall(format, "$1::jsonb", "$2"), []any{NullableText(doc), DiffArg(diff, format)}
+}
+
+// InvertQuery returns the statement inverting diff, in format, with jd_invert_diff, and
+// its arguments. Like TranslateQuery, the second column tells whether the inverse is
+// empty.
+func InvertQuery(diff []byte, format string) (string, []any) {
+	return "SELECT d, jd_diff_is_empty(d, $2::jd_diff_format) FROM jd_invert_diff($1::jsonb, $2::jd_diff_format) AS d",
+		[]any{DiffContentArg(diff, format), format}
+}
+
+// RevertQuery returns the statement applying the inverse of diff, in format, to doc,
+// which undoes diff on the document it produced, and its arguments.
+func RevertQuery(diff, doc []byte, format string) (string, []any) {
+	inverse := "jd_invert_diff($2::jsonb, $3::jd_diff_format)"
+	if IsJdText(format) {
+		inverse = "(" + inverse + " #>> '{}')"
+	}
+	return "SELECT " + PatchCall(format, "$1::jsonb", inverse), []any{NullableText(doc), DiffContentArg(diff, format), format}
+}
+
+// PatchChainQuery returns the statement applying diffs in order to doc, each diff with
+// the patch function of its format in formats, and its arguments. The calls are nested in
+// one statement, so the chain is applied in one transaction and the intermediate
+// documents never leave the server.
+func PatchChainQuery(doc []byte, diffs [][]byte, formats []string) (string, []any) {
+	call, args := "$1::jsonb", []any{NullableText(doc)}
+	for i, diff := range diffs {
+		args = append(args, DiffArg(diff, formats[i]))
+		call = PatchCall(formats[i], call, fmt.Sprintf("$%d", len(args)))
+	}
+	return "SELECT " + call, args
+}
+
+// CheckQuery returns the statement checking whether diff, in format, applies cleanly to
+// doc with jd_patch_check, and its arguments. Like DiffQuery it returns two columns: the
+// first failing hunk as "hunk <n> at <path>: <error>" ("" when the diff applies), and
+// whether the diff applies.
+func CheckQuery(diff, doc []byte, format string) (string, []any) {
+	return "SELECT coalesce(format('hunk %s at %s: %s', c.hunk, c.path, c.error), ''), c.hunk IS NULL " +
+			"FROM (SELECT 1) AS one LEFT JOIN jd_patch_check($1::jsonb, $2::jsonb, $3::jd_diff_format) AS c ON true",
+		[]any{NullableText(doc), DiffContentArg(diff, format), format}
+}
+
+// Merge3Query returns the statement merging ours and theirs, both derived from base,
+// with jd_merge3, and its arguments. It returns the merged document and the conflicts
+// (see Conflict).
+func Merge3Query(base, ours, theirs, options []byte) (string, []any) {
+	return "SELECT merged, conflicts FROM jd_merge3($1::jsonb, $2::jsonb, $3::jsonb, $4::jsonb)",
+		[]any{NullableText(base), NullableText(ours), NullableText(theirs), NullableText(options)}
+}
+
+// CanonicalizeQuery returns the statement rendering doc in its canonical form with
+// jd_canonicalize, and its arguments.
+func CanonicalizeQuery(doc []byte) (string, []any) {
+	return "SELECT jd_canonicalize($1::jsonb)", []any{NullableText(doc)}
+}
+
+// HashQuery returns the statement computing the canonical hash of doc with
+// jd_canonical_hash, and its arguments.
+func HashQuery(doc []byte) (string, []any) {
+	return "SELECT jd_canonical_hash($1::jsonb)", []any{NullableText(doc)}
+}
+
+// TranslateQuery returns the statement translating diff from one format to another, and
+// its arguments. A jd input is passed as jd2 when DetectJdFormat finds v2 text. Like
+// DiffQuery, the second column tells whether the translated diff is empty. With strict,
+// RFC 6902 operations that cannot be translated raise an error rather than being dropped.
+func TranslateQuery(diff []byte, from, to string, strict bool) (string, []any) {
+	return translateQuery("jd_translate_diff_format", diff, from, to, strict)
+}
+
+// TranslateRoundTripQuery is TranslateQuery with jd_translate_roundtrip, which fails
+// when translating the result back does not give the hunks of diff.
+func TranslateRoundTripQuery(diff []byte, from, to string, strict bool) (string, []any) {
+	return translateQuery("jd_translate_roundtrip", diff, from, to, strict)
+}
+
+func translateQuery(fn string, diff []byte, from, to string, strict bool) (string, []any) {
+	if from == FormatJd {
+		from = DetectJdFormat(diff)
+	}
+	return "SELECT d, jd_diff_is_empty(d, $3::jd_diff_format) FROM " + fn + "($1::jsonb, $2::jd_diff_format, $3::jd_diff_format, $4) AS d",
+		[]any{DiffContentArg(diff, from), from, to, strict}
+}
+
+// PatchCall returns the call applying the diff bound to diffParam to doc, using the
+// patch function of format.
+func PatchCall(format, doc, diffParam string) string {
+	switch format {
+	case FormatPatch:
+		return fmt.Sprintf("jd_apply_patch(%s, %s::jsonb)", doc, diffParam)
+	case FormatMerge:
+		return fmt.Sprintf("jd_apply_merge(%s, %s::jsonb)", doc, diffParam)
+	default:
+		return fmt.Sprintf("jd_patch_text(%s, %s::text)", doc, diffParam)
+	}
+}
+
+// DiffArg binds a diff for PatchCall: jd diffs as text, patch and merge diffs as JSON.
+func DiffArg(diff []byte, format string) any {
+	if format == FormatPatch || format == FormatMerge {
+		return NullableText(diff)
+	}
+	return string(diff)
+}
+
+// DiffContentArg binds diff content for jd_translate_diff_format. jd native diffs are
+// plain text, so unless the input already is a JSON string it is wrapped as one.
+func DiffContentArg(content []byte, format string) any {
+	v := NullableText(content)
+	if v == nil || !IsJdText(format) {
+		return v
+	}
+	var s string
+	if json.Unmarshal(content, &s) == nil {
+		return v
+	}
+	enc, _ := json.Marshal(string(content))
+	return string(enc)
+}
+
+// NullableText binds b as text, or as NULL when it is blank.
+func NullableText(b []byte) any {
+	if strings.TrimSpace(string(b)) == "" {
+		return nil
+	}
+	return string(b)
+}
+
+// DecodeResult turns the text of a jd-sql result into the output printed for it and
+// reports whether it is a non-empty diff. A JSON string (a jd diff) is unquoted, other
+// JSON is compacted, and anything else is taken as plain jd text. Whether the diff is
+// empty is guessed from its value; prefer the jd_diff_is_empty column where the
+// statement has one.
+func DecodeResult(out string) (string, bool) {
+	if decoded, err := DecodeJSON([]byte(out)); err == nil {
+		if s, ok := decoded.(string); ok {
+			return s, strings.TrimSpace(s) != ""
+		}
+		enc, _ := json.Marshal(decoded)
+		return string(enc), DiffPresent(decoded)
+	}
+	return out, strings.TrimSpace(out) != ""
+}
+
+// DecodeJSON decodes the JSON value b like json.Unmarshal into an any, except that
+// numbers are decoded as json.Number. Encoding the value again then reproduces every
+// number literal exactly, where float64 would round large integers and high-precision
+// decimals.
+func DecodeJSON(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: data after the top-level value")
+	}
+	return v, nil
+}
+
+// DiffPresent reports whether a decoded JSON result holds a difference: empty patches,
+// merge patches and strings, null, false and zero do not.
+func DiffPresent(v any) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case float64:
+		return t != 0
+	case json.Number:
+		f, err := t.Float64()
+		return err != nil || f != 0
+	case string:
+		return t != ""
+	case []any:
+		return len(t) > 0
+	case map[string]any:
+		return len(t) > 0
+	default:
+		return true
+	}
+}
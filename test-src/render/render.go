@@ -0,0 +1,87 @@
+// Package render formats jd diff text for display, colorizing it with ANSI escapes
+// when the output is a terminal.
+package render
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ColorMode selects when diffs are colorized.
+type ColorMode string
+
+const (
+	ColorAuto   ColorMode = "auto"
+	ColorAlways ColorMode = "always"
+	ColorNever  ColorMode = "never"
+)
+
+const (
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiDim   = "\x1b[2m"
+	ansiReset = "\x1b[0m"
+)
+
+// ParseColorMode parses a --color value. An empty value means auto.
+func ParseColorMode(s string) (ColorMode, error) {
+	switch m := ColorMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return ColorAuto, nil
+	case ColorAuto, ColorAlways, ColorNever:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid --color value '%s' (expected auto, always or never)", s)
+	}
+}
+
+// Enabled reports whether output written to f is colorized. In auto mode that is the
+// case when f is a terminal, NO_COLOR is unset and TERM is not dumb.
+func (m ColorMode) Enabled(f *os.File) bool {
+	switch m {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Colorize returns jd diff text with removals in red, additions in green and the
+// '@' paths and '^' options dimmed. Context lines are left as they are.
+func Colorize(diff string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		body := strings.TrimSuffix(line, "\n")
+		color := ""
+		switch {
+		case strings.HasPrefix(body, "- "):
+			color = ansiRed
+		case strings.HasPrefix(body, "+ "):
+			color = ansiGreen
+		case strings.HasPrefix(body, "@ "), strings.HasPrefix(body, "^ "):
+			color = ansiDim
+		}
+		if color == "" {
+			b.WriteString(line)
+			continue
+		}
+		b.WriteString(color + body + ansiReset + line[len(body):])
+	}
+	return b.String()
+}
+
+// Diff writes jd diff text to w, colorized when color is set.
+func Diff(w io.Writer, diff string, color bool) error {
+	if color {
+		diff = Colorize(diff)
+	}
+	_, err := io.WriteString(w, diff)
+	return err
+}